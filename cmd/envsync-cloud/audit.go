@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 500
+)
+
+// auditChange names a secret a write added, changed or removed.
+type auditChange struct {
+	Project string `json:"project"`
+	Env     string `json:"env"`
+	Key     string `json:"key"`
+}
+
+type auditEvent struct {
+	ID         string         `json:"id"`
+	Time       time.Time      `json:"ts"`
+	Actor      string         `json:"actor"`
+	ActorEmail string         `json:"actor_email,omitempty"`
+	Action     string         `json:"action"`
+	Project    string         `json:"project,omitempty"`
+	Metadata   map[string]any `json:"metadata"`
+}
+
+// auditQuery filters the events of one vault owner. Empty fields and zero
+// times match everything. Results are newest first; cursor continues after
+// the last event of the previous page.
+type auditQuery struct {
+	OwnerID string
+	Project string
+	Actor   string
+	Action  string
+	Key     string
+	Since   time.Time
+	Until   time.Time
+	Cursor  *auditCursor
+	Limit   int
+}
+
+type auditCursor struct {
+	Time time.Time
+	ID   string
+}
+
+func (c *auditCursor) String() string {
+	raw := c.Time.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseAuditCursor(s string) (*auditCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &auditCursor{Time: t, ID: id}, nil
+}
+
+// before reports whether e sorts after the cursor in newest-first order.
+func (c *auditCursor) before(e auditEvent) bool {
+	if c == nil {
+		return true
+	}
+	if !e.Time.Equal(c.Time) {
+		return e.Time.Before(c.Time)
+	}
+	return e.ID < c.ID
+}
+
+// parseAuditTime accepts RFC 3339 timestamps and plain dates.
+func parseAuditTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (want RFC 3339 or YYYY-MM-DD)", s)
+	}
+	return t, nil
+}
+
+func (s *cloudServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	p, err := s.verifier.authenticate(r)
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+	if !p.hasScope("store:read") {
+		writeError(w, r, http.StatusForbidden, "forbidden", "token missing scope store:read")
+		return
+	}
+	query := r.URL.Query()
+	ownerID, err := s.resolveOwner(p, query.Get("organization_id"), query.Get("team_id"), r.Method)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeError(w, r, http.StatusForbidden, "forbidden", err.Error())
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	q := auditQuery{
+		OwnerID: ownerID,
+		Actor:   strings.TrimSpace(query.Get("actor")),
+		Action:  strings.TrimSpace(query.Get("action")),
+		Key:     strings.TrimSpace(query.Get("key")),
+		Limit:   defaultAuditLimit,
+	}
+	if raw := strings.TrimSpace(query.Get("project")); raw != "" {
+		if q.Project, err = s.normalizeProject(raw); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_project", err.Error())
+			return
+		}
+	}
+	if q.Since, err = parseAuditTime(query.Get("since")); err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "since: "+err.Error())
+		return
+	}
+	if q.Until, err = parseAuditTime(query.Get("until")); err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "until: "+err.Error())
+		return
+	}
+	if raw := strings.TrimSpace(query.Get("limit")); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			writeError(w, r, http.StatusBadRequest, "bad_request", "invalid limit")
+			return
+		}
+		q.Limit = min(limit, maxAuditLimit)
+	}
+	if raw := strings.TrimSpace(query.Get("cursor")); raw != "" {
+		if q.Cursor, err = parseAuditCursor(raw); err != nil {
+			writeError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+	events, next, err := s.repo.Audit(r.Context(), q)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "read audit events failed")
+		return
+	}
+	body := map[string]any{"events": events}
+	if next != nil {
+		body["next_cursor"] = next.String()
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// storeChanges lists the secrets that differ between two sets of rows,
+// sorted.
+func storeChanges(live, want map[envKey]*envRows) []auditChange {
+	changes := []auditChange{}
+	seen := map[auditChange]bool{}
+	add := func(key envKey, name string) {
+		c := auditChange{Project: key.project, Env: key.env, Key: name}
+		if !seen[c] {
+			seen[c] = true
+			changes = append(changes, c)
+		}
+	}
+	compare := func(a, b map[envKey]*envRows) {
+		for key, env := range a {
+			var other map[string]*secretRows
+			if b[key] != nil {
+				other = b[key].secrets
+			}
+			for name, secret := range env.secrets {
+				peer := other[name]
+				if peer == nil || peer.currentVersion != secret.currentVersion ||
+					!reflect.DeepEqual(peer.metadata, secret.metadata) || !reflect.DeepEqual(peer.versions, secret.versions) {
+					add(key, name)
+				}
+			}
+		}
+	}
+	compare(want, live)
+	compare(live, want)
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		if a.Env != b.Env {
+			return a.Env < b.Env
+		}
+		return a.Key < b.Key
+	})
+	return changes
+}
+
+func auditMetadata(fromRevision, toRevision int, changes []auditChange) map[string]any {
+	return map[string]any{
+		"source":        "envsync-cloud",
+		"from_revision": fromRevision,
+		"to_revision":   toRevision,
+		"changes":       changes,
+	}
+}
+
+func insertAuditEvent(ctx context.Context, q queryer, actorID, action, ownerID, project string, metadata map[string]any) error {
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `
+INSERT INTO audit_events (actor_user_id, action, vault_owner_user_id, project_name, metadata_json)
+VALUES ($1, $2, $3, $4, $5::jsonb)
+`, actorID, action, ownerID, project, b)
+	return err
+}
+
+func (r *pgRepo) Audit(ctx context.Context, q auditQuery) ([]auditEvent, *auditCursor, error) {
+	var since, until, cursorTime, cursorID any
+	if !q.Since.IsZero() {
+		since = q.Since
+	}
+	if !q.Until.IsZero() {
+		until = q.Until
+	}
+	if q.Cursor != nil {
+		cursorTime, cursorID = q.Cursor.Time, q.Cursor.ID
+	}
+	rows, err := r.db.QueryContext(ctx, `
+SELECT a.id::text, a.created_at, COALESCE(a.actor_user_id, ''), COALESCE(u.email, ''), a.action, COALESCE(a.project_name, ''), a.metadata_json
+FROM audit_events a
+LEFT JOIN users u ON u.id::text = a.actor_user_id
+WHERE a.vault_owner_user_id = $1
+  AND ($2::text = '' OR a.project_name = $2::text)
+  AND ($3::text = '' OR a.actor_user_id = $3::text OR u.email = $3::text)
+  AND ($4::text = '' OR a.action = $4::text)
+  AND ($5::text = '' OR a.metadata_json->'changes' @> jsonb_build_array(jsonb_build_object('key', $5::text)))
+  AND ($6::timestamptz IS NULL OR a.created_at >= $6::timestamptz)
+  AND ($7::timestamptz IS NULL OR a.created_at < $7::timestamptz)
+  AND ($8::timestamptz IS NULL OR (a.created_at, a.id::text) < ($8::timestamptz, $9::text))
+ORDER BY a.created_at DESC, a.id::text DESC
+LIMIT $10
+`, q.OwnerID, q.Project, q.Actor, q.Action, q.Key, since, until, cursorTime, cursorID, q.Limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := []auditEvent{}
+	for rows.Next() {
+		var (
+			e        auditEvent
+			metadata []byte
+		)
+		if err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.ActorEmail, &e.Action, &e.Project, &metadata); err != nil {
+			_ = rows.Close()
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			_ = rows.Close()
+			return nil, nil, err
+		}
+		events = append(events, e)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, nil, err
+	}
+	return pageEvents(events, q.Limit)
+}
+
+// pageEvents trims a limit+1 result to limit and returns the cursor for the
+// next page, if there is one.
+func pageEvents(events []auditEvent, limit int) ([]auditEvent, *auditCursor, error) {
+	if len(events) <= limit {
+		return events, nil, nil
+	}
+	events = events[:limit]
+	last := events[len(events)-1]
+	return events, &auditCursor{Time: last.Time, ID: last.ID}, nil
+}
+
+func (m *memoryRepo) Audit(_ context.Context, q auditQuery) ([]auditEvent, *auditCursor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []auditEvent{}
+	for i := len(m.events) - 1; i >= 0; i-- {
+		e := m.events[i]
+		if e.owner != q.OwnerID || !q.matches(e.auditEvent) {
+			continue
+		}
+		events = append(events, e.auditEvent)
+		if len(events) > q.Limit {
+			break
+		}
+	}
+	return pageEvents(events, q.Limit)
+}
+
+// matches applies q's filters other than the owner to e.
+func (q auditQuery) matches(e auditEvent) bool {
+	switch {
+	case q.Project != "" && e.Project != q.Project,
+		q.Actor != "" && e.Actor != q.Actor && e.ActorEmail != q.Actor,
+		q.Action != "" && e.Action != q.Action,
+		!q.Since.IsZero() && e.Time.Before(q.Since),
+		!q.Until.IsZero() && !e.Time.Before(q.Until),
+		!q.Cursor.before(e):
+		return false
+	}
+	if q.Key == "" {
+		return true
+	}
+	changes, _ := e.Metadata["changes"].([]auditChange)
+	for _, c := range changes {
+		if c.Key == q.Key {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryAuditEvent struct {
+	auditEvent
+	owner string
+}
+
+// recordAudit appends an event; the caller holds m.mu. IDs are zero-padded
+// sequence numbers so they sort in insertion order like the cursor expects.
+func (m *memoryRepo) recordAudit(actorID, action, ownerID, project string, metadata map[string]any) {
+	m.events = append(m.events, memoryAuditEvent{
+		owner: ownerID,
+		auditEvent: auditEvent{
+			ID:       fmt.Sprintf("%020d", len(m.events)+1),
+			Time:     time.Now().UTC(),
+			Actor:    actorID,
+			Action:   action,
+			Project:  project,
+			Metadata: metadata,
+		},
+	})
+}
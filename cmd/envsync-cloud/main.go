@@ -79,6 +79,11 @@ type authVerifier struct {
 type storeRepo interface {
 	Get(ctx context.Context, ownerID, project string) (*remoteStore, error)
 	Put(ctx context.Context, ownerID, actorID, project string, next *remoteStore, expectedRevision int) (*remoteStore, error)
+	List(ctx context.Context, ownerID string) ([]vaultSummary, error)
+	GetSecret(ctx context.Context, ownerID, project string, ref secretRef) (map[string]any, int, error)
+	PutSecret(ctx context.Context, ownerID, actorID, project string, ref secretRef, record map[string]any, expectedVersion int) (int, error)
+	DeleteSecret(ctx context.Context, ownerID, actorID, project string, ref secretRef, expectedVersion int) (int, error)
+	Audit(ctx context.Context, q auditQuery) ([]auditEvent, *auditCursor, error)
 }
 
 type cloudServer struct {
@@ -93,13 +98,22 @@ type remoteStore struct {
 	Revision    int            `json:"revision"`
 	SaltB64     string         `json:"salt_b64,omitempty"`
 	KeyCheckB64 string         `json:"key_check_b64,omitempty"`
+	KDF         map[string]any `json:"kdf,omitempty"`
+	Rekey       map[string]any `json:"rekey,omitempty"`
 	Teams       map[string]any `json:"teams,omitempty"`
 	Projects    map[string]any `json:"projects"`
 }
 
+type vaultSummary struct {
+	Project   string `json:"project"`
+	Revision  int    `json:"revision"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
 type memoryRepo struct {
-	mu   sync.Mutex
-	data map[string]*remoteStore
+	mu     sync.Mutex
+	data   map[string]*remoteStore
+	events []memoryAuditEvent
 }
 
 type statusRecorder struct {
@@ -171,6 +185,9 @@ func main() {
 	mux.HandleFunc("/healthz", srv.handleHealth)
 	mux.HandleFunc("/v1/me", srv.handleMe)
 	mux.HandleFunc("/v1/store", srv.handleStore)
+	mux.HandleFunc("/v1/vaults", srv.handleVaults)
+	mux.HandleFunc(secretPath, srv.handleSecret)
+	mux.HandleFunc("/v1/audit", srv.handleAudit)
 	mux.HandleFunc("/v1/tokens", srv.handleTokens)
 	mux.HandleFunc("/v1/tokens/", srv.handleTokens)
 
@@ -298,6 +315,7 @@ func (s *cloudServer) handleStore(w http.ResponseWriter, r *http.Request) {
 			writeError(w, r, http.StatusInternalServerError, "internal_error", "read store failed")
 			return
 		}
+		w.Header().Set(featuresHeader, secretRecordsFeature)
 		writeJSON(w, http.StatusOK, store)
 	case http.MethodPut:
 		if !p.hasScope("store:write") {
@@ -326,6 +344,10 @@ func (s *cloudServer) handleStore(w http.ResponseWriter, r *http.Request) {
 			writeError(w, r, http.StatusBadRequest, "bad_request", "invalid JSON payload")
 			return
 		}
+		if err := checkStoreRecords(&next); err != nil {
+			writeError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
 		saved, err := s.repo.Put(r.Context(), ownerID, p.UserID, project, &next, expectedRevision)
 		if err != nil {
 			if errors.Is(err, errConflict) {
@@ -342,6 +364,38 @@ func (s *cloudServer) handleStore(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *cloudServer) handleVaults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	p, err := s.verifier.authenticate(r)
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+	if !p.hasScope("store:read") {
+		writeError(w, r, http.StatusForbidden, "forbidden", "token missing scope store:read")
+		return
+	}
+	ownerID, err := s.resolveOwner(p, r.URL.Query().Get("organization_id"), r.URL.Query().Get("team_id"), r.Method)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeError(w, r, http.StatusForbidden, "forbidden", err.Error())
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	vaults, err := s.repo.List(r.Context(), ownerID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "list vaults failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"vaults": vaults})
+}
+
 func (s *cloudServer) handleTokens(w http.ResponseWriter, r *http.Request) {
 	p, err := s.verifier.authenticate(r)
 	if err != nil {
@@ -920,53 +974,67 @@ func runMigrations(db *sql.DB) error {
 		if _, err := db.Exec(string(raw)); err != nil {
 			return fmt.Errorf("migration %s failed: %w", name, err)
 		}
+		if step := migrationSteps[name]; step != nil {
+			if err := step(context.Background(), db); err != nil {
+				return fmt.Errorf("migration %s failed: %w", name, err)
+			}
+		}
 	}
 	return nil
 }
 
+// migrationSteps run right after the SQL migration they are keyed by, for
+// data moves SQL alone does not express well.
+var migrationSteps = map[string]func(context.Context, *sql.DB) error{
+	"004_normalized_secrets.sql": migrateSnapshots,
+}
+
 type pgRepo struct {
 	db *sql.DB
 }
 
 func (r *pgRepo) Get(ctx context.Context, ownerID, project string) (*remoteStore, error) {
-	loadRow := func(candidateOwner string) *sql.Row {
-		return r.db.QueryRowContext(ctx, `
-SELECT revision, payload_json, salt_b64, key_check_b64
-FROM vault_snapshots
-WHERE owner_user_id = $1 AND project_name = $2
-`, candidateOwner, project)
-	}
-	row := loadRow(ownerID)
-
-	var (
-		revision   int
-		payloadRaw []byte
-		saltB64    sql.NullString
-		keyCheck   sql.NullString
-	)
-	if err := row.Scan(&revision, &payloadRaw, &saltB64, &keyCheck); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			if legacyOwner := legacyOwnerID(ownerID); legacyOwner != "" {
-				row = loadRow(legacyOwner)
-				err = row.Scan(&revision, &payloadRaw, &saltB64, &keyCheck)
-			}
-		}
-		if errors.Is(err, sql.ErrNoRows) {
-			return &remoteStore{
-				Version:  1,
-				Revision: 0,
-				Projects: map[string]any{},
-				Teams:    map[string]any{},
-			}, nil
+	// Read the vault row and its rows from one snapshot of the database.
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	v, err := findVault(ctx, tx, ownerID, project, false)
+	if err == nil && v == nil {
+		if legacyOwner := legacyOwnerID(ownerID); legacyOwner != "" {
+			v, err = findVault(ctx, tx, legacyOwner, project, false)
 		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return &remoteStore{
+			Version:  1,
+			Revision: 0,
+			Projects: map[string]any{},
+			Teams:    map[string]any{},
+		}, nil
+	}
+	envs, err := loadVaultRows(ctx, tx, v.id)
+	if err != nil {
 		return nil, err
 	}
+	return assembleStore(v, envs)
+}
+
+// decodeSnapshot parses a legacy vault_snapshots row.
+func decodeSnapshot(revision int, payloadRaw []byte, saltB64, keyCheck string) (*remoteStore, error) {
 	var payload map[string]any
 	if err := json.Unmarshal(payloadRaw, &payload); err != nil {
 		return nil, err
 	}
 	projects, _ := payload["projects"].(map[string]any)
 	teams, _ := payload["teams"].(map[string]any)
+	rekey, _ := payload["rekey"].(map[string]any)
+	kdf, _ := payload["kdf"].(map[string]any)
 	if projects == nil {
 		projects = map[string]any{}
 	}
@@ -978,11 +1046,59 @@ WHERE owner_user_id = $1 AND project_name = $2
 		Revision:    revision,
 		Projects:    projects,
 		Teams:       teams,
-		SaltB64:     saltB64.String,
-		KeyCheckB64: keyCheck.String,
+		Rekey:       rekey,
+		SaltB64:     saltB64,
+		KeyCheckB64: keyCheck,
+		KDF:         kdf,
 	}, nil
 }
 
+func (r *pgRepo) List(ctx context.Context, ownerID string) ([]vaultSummary, error) {
+	owners := []string{ownerID}
+	if legacyOwner := legacyOwnerID(ownerID); legacyOwner != "" {
+		owners = append(owners, legacyOwner)
+	}
+	seen := map[string]bool{}
+	out := []vaultSummary{}
+	// Get falls back to legacy owner rows, so list them too unless the
+	// current owner already has a snapshot for the same project.
+	for _, owner := range owners {
+		rows, err := r.db.QueryContext(ctx, `
+SELECT project_name, revision, updated_at
+FROM vaults
+WHERE owner_key = $1
+ORDER BY project_name
+`, owner)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				v         vaultSummary
+				updatedAt time.Time
+			)
+			if err := rows.Scan(&v.Project, &v.Revision, &updatedAt); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			if seen[v.Project] {
+				continue
+			}
+			seen[v.Project] = true
+			v.UpdatedAt = updatedAt.UTC().Format(time.RFC3339)
+			out = append(out, v)
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Project < out[j].Project })
+	return out, nil
+}
+
 func legacyOwnerID(ownerID string) string {
 	if strings.HasPrefix(ownerID, "org:") {
 		return strings.TrimSpace(strings.TrimPrefix(ownerID, "org:"))
@@ -1000,54 +1116,31 @@ func (r *pgRepo) Put(ctx context.Context, ownerID, actorID, project string, next
 	}
 	defer func() { _ = tx.Rollback() }()
 
-	var currentRevision int
-	row := tx.QueryRowContext(ctx, `
-SELECT revision
-FROM vault_snapshots
-WHERE owner_user_id = $1 AND project_name = $2
-FOR UPDATE
-`, ownerID, project)
-	if err := row.Scan(&currentRevision); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			currentRevision = 0
-		} else {
-			return nil, err
-		}
+	v, err := findVault(ctx, tx, ownerID, project, true)
+	if err != nil {
+		return nil, err
+	}
+	currentRevision := 0
+	if v != nil {
+		currentRevision = v.revision
 	}
 	if currentRevision != expectedRevision {
 		return nil, fmt.Errorf("%w: expected %d, got %d", errConflict, expectedRevision, currentRevision)
 	}
-	nextRevision := currentRevision + 1
-
-	payload := map[string]any{
-		"projects": next.Projects,
-		"teams":    next.Teams,
-	}
-	payloadJSON, err := json.Marshal(payload)
-	if err != nil {
+	live := map[envKey]*envRows{}
+	if v == nil {
+		if v, err = createVault(ctx, tx, ownerID, project); err != nil {
+			return nil, err
+		}
+	} else if live, err = loadVaultRows(ctx, tx, v.id); err != nil {
 		return nil, err
 	}
-	_, err = tx.ExecContext(ctx, `
-INSERT INTO vault_snapshots (
-  owner_user_id, project_name, revision, payload_json, salt_b64, key_check_b64, updated_by_user_id, updated_at
-)
-VALUES ($1,$2,$3,$4::jsonb,$5,$6,$7,NOW())
-ON CONFLICT (owner_user_id, project_name)
-DO UPDATE SET
-  revision = EXCLUDED.revision,
-  payload_json = EXCLUDED.payload_json,
-  salt_b64 = EXCLUDED.salt_b64,
-  key_check_b64 = EXCLUDED.key_check_b64,
-  updated_by_user_id = EXCLUDED.updated_by_user_id,
-  updated_at = NOW()
-`, ownerID, project, nextRevision, payloadJSON, nullIfEmpty(next.SaltB64), nullIfEmpty(next.KeyCheckB64), actorID)
+	nextRevision := currentRevision + 1
+	changes, err := writeVault(ctx, tx, v, live, actorID, next, nextRevision)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := tx.ExecContext(ctx, `
-INSERT INTO audit_events (actor_user_id, action, vault_owner_user_id, project_name, metadata_json)
-VALUES ($1, 'store_put', $2, $3, $4::jsonb)
-`, actorID, ownerID, project, []byte(`{"source":"envsync-cloud"}`)); err != nil {
+	if err := insertAuditEvent(ctx, tx, actorID, "store_put", ownerID, project, auditMetadata(currentRevision, nextRevision, changes)); err != nil {
 		return nil, err
 	}
 
@@ -1093,7 +1186,7 @@ func (s *cloudServer) resolveOwner(p *principal, orgIDRaw, teamIDRaw, method str
 		return "org:" + orgID, nil
 	}
 	required := "reader"
-	if method == http.MethodPut {
+	if method == http.MethodPut || method == http.MethodDelete {
 		required = "maintainer"
 	}
 	if teamID != "" {
@@ -1345,17 +1438,24 @@ func (m *memoryRepo) Get(_ context.Context, ownerID, project string) (*remoteSto
 func (m *memoryRepo) Put(_ context.Context, ownerID, actorID string, project string, next *remoteStore, expectedRevision int) (*remoteStore, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	_ = actorID // currently unused; required by interface
 	key := ownerID + ":" + project
-	current := 0
+	current := &remoteStore{}
 	if existing := m.data[key]; existing != nil {
-		current = existing.Revision
+		current = existing
+	}
+	if current.Revision != expectedRevision {
+		return nil, fmt.Errorf("%w: expected %d, got %d", errConflict, expectedRevision, current.Revision)
+	}
+	_, live, err := splitStore(current)
+	if err != nil {
+		return nil, err
 	}
-	if current != expectedRevision {
-		return nil, fmt.Errorf("%w: expected %d, got %d", errConflict, expectedRevision, current)
+	_, want, err := splitStore(next)
+	if err != nil {
+		return nil, err
 	}
 	out := *next
-	out.Revision = current + 1
+	out.Revision = current.Revision + 1
 	if out.Projects == nil {
 		out.Projects = map[string]any{}
 	}
@@ -1363,5 +1463,22 @@ func (m *memoryRepo) Put(_ context.Context, ownerID, actorID string, project str
 		out.Teams = map[string]any{}
 	}
 	m.data[key] = &out
+	m.recordAudit(actorID, "store_put", ownerID, project, auditMetadata(current.Revision, out.Revision, storeChanges(live, want)))
 	return &out, nil
 }
+
+func (m *memoryRepo) List(_ context.Context, ownerID string) ([]vaultSummary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := ownerID + ":"
+	out := []vaultSummary{}
+	for key, store := range m.data {
+		project, ok := strings.CutPrefix(key, prefix)
+		if !ok || strings.Contains(project, ":") {
+			continue
+		}
+		out = append(out, vaultSummary{Project: project, Revision: store.Revision})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Project < out[j].Project })
+	return out, nil
+}
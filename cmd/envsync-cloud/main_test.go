@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -151,6 +155,254 @@ func TestStoreRejectsInvalidProject(t *testing.T) {
 	}
 }
 
+func TestVaultsListsOwnerProjects(t *testing.T) {
+	s := newTestCloudServer()
+	payload := []byte(`{"version":1,"revision":0,"projects":{},"teams":{}}`)
+	for _, target := range []string{"/v1/store?project=web", "/v1/store?project=api", "/v1/store?project=api&team_id=platform"} {
+		req := httptest.NewRequest(http.MethodPut, target, bytes.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer test-token")
+		req.Header.Set("If-Match", "0")
+		rec := httptest.NewRecorder()
+		s.handleStore(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("put %s expected 200, got %d body=%s", target, rec.Code, rec.Body.String())
+		}
+	}
+
+	list := func(target string) []vaultSummary {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		rec := httptest.NewRecorder()
+		s.handleVaults(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list %s expected 200, got %d body=%s", target, rec.Code, rec.Body.String())
+		}
+		var body struct {
+			Vaults []vaultSummary `json:"vaults"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode vaults: %v", err)
+		}
+		return body.Vaults
+	}
+
+	personal := list("/v1/vaults")
+	if len(personal) != 2 || personal[0].Project != "api" || personal[1].Project != "web" {
+		t.Fatalf("expected personal vaults [api web], got %+v", personal)
+	}
+	if personal[0].Revision != 1 {
+		t.Fatalf("expected revision 1, got %d", personal[0].Revision)
+	}
+	team := list("/v1/vaults?team_id=platform")
+	if len(team) != 1 || team[0].Project != "api" {
+		t.Fatalf("expected team vaults [api], got %+v", team)
+	}
+}
+
+func TestSecretRecordPreconditions(t *testing.T) {
+	s := newTestCloudServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc(secretPath, s.handleSecret)
+	do := func(method, match, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, "/v1/vaults/Web/envs/dev/secrets/TOKEN", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer test-token")
+		if match != "" {
+			req.Header.Set("If-Match", match)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "0", `{"current_version":1}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("put before the vault exists: expected 404, got %d", rec.Code)
+	}
+	seed := httptest.NewRequest(http.MethodPut, "/v1/store?project=web", strings.NewReader(`{"version":1,"projects":{"Web":{"name":"Web","envs":{}}}}`))
+	seed.Header.Set("Authorization", "Bearer test-token")
+	seed.Header.Set("If-Match", "0")
+	seedRec := httptest.NewRecorder()
+	s.handleStore(seedRec, seed)
+	if seedRec.Code != http.StatusOK {
+		t.Fatalf("seed expected 200, got %d body=%s", seedRec.Code, seedRec.Body.String())
+	}
+
+	if rec := do(http.MethodPut, "", `{"current_version":1}`); rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("missing If-Match: expected 428, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "0", `{"current_version":1,"cipher_b64":"a"}`); rec.Code != http.StatusOK {
+		t.Fatalf("create expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPut, "1", `{"current_version":2,"versions":[{"cipher_b64":"b"}]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("version without a number: expected 400, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "0", `{"current_version":1,"cipher_b64":"b"}`); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale create: expected 412, got %d", rec.Code)
+	}
+	rec := do(http.MethodPut, "1", `{"current_version":2,"cipher_b64":"c"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get(revisionHeader); got != "3" {
+		t.Fatalf("expected vault revision 3, got %q", got)
+	}
+
+	rec = do(http.MethodGet, "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get expected 200, got %d", rec.Code)
+	}
+	var record map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil {
+		t.Fatalf("decode record: %v", err)
+	}
+	if record["cipher_b64"] != "c" {
+		t.Fatalf("expected updated record, got %v", record)
+	}
+
+	if rec := do(http.MethodDelete, "1", ""); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale delete: expected 412, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "2", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete expected 204, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("get after delete: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestSplitStoreRoundTrip(t *testing.T) {
+	raw := []byte(`{
+  "version": 1,
+  "revision": 4,
+  "salt_b64": "salt",
+  "key_check_b64": "check",
+  "kdf": {"version": 1, "algorithm": "argon2id", "time": 3, "memory_kib": 262144, "threads": 4},
+  "rekey": {"previous_key_checks": ["old"]},
+  "teams": {"core": {"name": "core", "members": {"alice": "admin"}}},
+  "projects": {
+    "Api": {
+      "name": "Api",
+      "team": "core",
+      "data_key_id": "k1",
+      "envs": {
+        "dev": {"name": "dev", "vars": {
+          "TOKEN": {"current_version": 2, "last_synced_remote_version": 2, "versions": [
+            {"version": 1, "cipher_b64": "a"},
+            {"version": 2, "cipher_b64": "b", "deleted": true}
+          ]}
+        }},
+        "prod": {"name": "prod", "vars": {}}
+      }
+    },
+    "empty": {"name": "empty", "envs": {}}
+  }
+}`)
+	var st remoteStore
+	if err := json.Unmarshal(raw, &st); err != nil {
+		t.Fatal(err)
+	}
+	metadata, envs, err := splitStore(&st)
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if len(envs) != 2 || len(envs[envKey{project: "Api", env: "dev"}].secrets["TOKEN"].versions) != 2 {
+		t.Fatalf("expected two env rows with two TOKEN versions, got %+v", envs)
+	}
+	got, err := assembleStore(&vaultRow{
+		revision: 4,
+		salt:     sql.NullString{String: "salt", Valid: true},
+		keyCheck: sql.NullString{String: "check", Valid: true},
+		metadata: metadata,
+	}, envs)
+	if err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	if !reflect.DeepEqual(got, &st) {
+		want, _ := json.Marshal(&st)
+		have, _ := json.Marshal(got)
+		t.Fatalf("round trip changed the store:\nwant %s\ngot  %s", want, have)
+	}
+}
+
+func TestSplitStoreRejectsUnnumberedVersions(t *testing.T) {
+	var st remoteStore
+	raw := `{"projects":{"api":{"name":"api","envs":{"dev":{"name":"dev","vars":{
+  "TOKEN":{"current_version":2,"versions":[{"version":1,"cipher_b64":"a"},{"cipher_b64":"b"}]}}}}}}}`
+	if err := json.Unmarshal([]byte(raw), &st); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := splitStore(&st); !errors.Is(err, errInvalidRecord) {
+		t.Fatalf("expected a version without a number to be rejected, got %v", err)
+	}
+
+	s := newTestCloudServer()
+	req := httptest.NewRequest(http.MethodPut, "/v1/store?project=api", strings.NewReader(raw))
+	req.Header.Set("Authorization", "Bearer test-token")
+	req.Header.Set("If-Match", "0")
+	rec := httptest.NewRecorder()
+	s.handleStore(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("store put: expected 400, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAuditListsChangedKeys(t *testing.T) {
+	s := newTestCloudServer()
+	put := func(revision int, token string) {
+		t.Helper()
+		body := `{"version":1,"projects":{"api":{"name":"api","envs":{"prod":{"name":"prod","vars":{
+  "PROD_DB_URL":{"current_version":1,"versions":[{"version":1,"cipher_b64":"a"}]},
+  "TOKEN":{"current_version":1,"versions":[{"version":1,"cipher_b64":"` + token + `"}]}}}}}}}`
+		req := httptest.NewRequest(http.MethodPut, "/v1/store?project=api", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer test-token")
+		req.Header.Set("If-Match", strconv.Itoa(revision))
+		rec := httptest.NewRecorder()
+		s.handleStore(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("put expected 200, got %d body=%s", rec.Code, rec.Body.String())
+		}
+	}
+	put(0, "a")
+	put(1, "b")
+	put(2, "c")
+
+	list := func(target string) ([]auditEvent, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		rec := httptest.NewRecorder()
+		s.handleAudit(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("audit %s expected 200, got %d body=%s", target, rec.Code, rec.Body.String())
+		}
+		var body struct {
+			Events     []auditEvent `json:"events"`
+			NextCursor string       `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode audit: %v", err)
+		}
+		return body.Events, body.NextCursor
+	}
+
+	events, _ := list("/v1/audit?project=api&key=PROD_DB_URL")
+	if len(events) != 1 || events[0].Metadata["to_revision"] != float64(1) {
+		t.Fatalf("expected only the first write to touch PROD_DB_URL, got %+v", events)
+	}
+	page, cursor := list("/v1/audit?key=TOKEN&limit=2")
+	if len(page) != 2 || cursor == "" || page[0].Metadata["from_revision"] != float64(2) {
+		t.Fatalf("expected a first page of two newest events, got %+v cursor=%q", page, cursor)
+	}
+	rest, cursor := list("/v1/audit?key=TOKEN&limit=2&cursor=" + cursor)
+	if len(rest) != 1 || cursor != "" || rest[0].Metadata["to_revision"] != float64(1) {
+		t.Fatalf("expected the oldest event on the last page, got %+v cursor=%q", rest, cursor)
+	}
+	if events, _ := list("/v1/audit?until=2000-01-01"); len(events) != 0 {
+		t.Fatalf("expected no events before 2000, got %+v", events)
+	}
+}
+
 func TestUnauthorizedIncludesRequestID(t *testing.T) {
 	s := newTestCloudServer()
 	h := withRequestID(http.HandlerFunc(s.handleMe))
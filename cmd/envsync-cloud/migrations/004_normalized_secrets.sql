@@ -0,0 +1,64 @@
+-- Vaults are stored as rows instead of one payload_json blob. vault_snapshots
+-- is copied into these tables right after this migration and retired by 006.
+ALTER TABLE vaults ALTER COLUMN owner_id DROP NOT NULL;
+
+ALTER TABLE vaults DROP CONSTRAINT IF EXISTS vaults_owner_type_check;
+ALTER TABLE vaults ADD CONSTRAINT vaults_owner_type_check
+CHECK (owner_type IN ('user', 'organization', 'team'));
+
+ALTER TABLE vaults
+  ADD COLUMN IF NOT EXISTS owner_key TEXT,
+  ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS salt_b64 TEXT,
+  ADD COLUMN IF NOT EXISTS key_check_b64 TEXT,
+  ADD COLUMN IF NOT EXISTS metadata_json JSONB NOT NULL DEFAULT '{}'::jsonb,
+  ADD COLUMN IF NOT EXISTS updated_by_user_id TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_vaults_owner_key_project
+ON vaults (owner_key, project_name);
+
+CREATE TABLE IF NOT EXISTS environments (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  vault_id UUID NOT NULL REFERENCES vaults(id) ON DELETE CASCADE,
+  project_name TEXT NOT NULL,
+  name TEXT NOT NULL,
+  metadata_json JSONB NOT NULL DEFAULT '{}'::jsonb,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  removed_at TIMESTAMPTZ,
+  UNIQUE (vault_id, project_name, name)
+);
+
+CREATE TABLE IF NOT EXISTS secrets (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  environment_id UUID NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+  key TEXT NOT NULL,
+  current_version INTEGER NOT NULL,
+  metadata_json JSONB NOT NULL DEFAULT '{}'::jsonb,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  removed_at TIMESTAMPTZ,
+  UNIQUE (environment_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_secrets_environment_live
+ON secrets (environment_id)
+WHERE removed_at IS NULL;
+
+-- Replaced or removed versions keep their row with superseded_at set, so
+-- the server retains every ciphertext it was sent.
+CREATE TABLE IF NOT EXISTS secret_versions (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  secret_id UUID NOT NULL REFERENCES secrets(id) ON DELETE CASCADE,
+  version INTEGER NOT NULL,
+  payload_json JSONB NOT NULL,
+  created_by_user_id TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  superseded_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_secret_versions_live
+ON secret_versions (secret_id, version)
+WHERE superseded_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_secret_versions_secret
+ON secret_versions (secret_id, version, created_at DESC);
@@ -0,0 +1,6 @@
+CREATE INDEX IF NOT EXISTS idx_audit_events_owner_project_created
+ON audit_events (vault_owner_user_id, project_name, created_at DESC);
+
+-- Serves "who touched KEY" lookups on metadata_json->'changes'.
+CREATE INDEX IF NOT EXISTS idx_audit_events_changes
+ON audit_events USING GIN ((metadata_json->'changes') jsonb_path_ops);
@@ -0,0 +1,13 @@
+-- Snapshots were copied into the normalized tables after 004, so the old
+-- table is kept only as vault_snapshots_retired for reference and nothing
+-- reads or writes it any more. 001 creates an empty vault_snapshots again on
+-- every start; once the retired copy exists, that one is dropped.
+DO $$
+BEGIN
+  IF to_regclass('vault_snapshots_retired') IS NULL THEN
+    ALTER TABLE IF EXISTS vault_snapshots RENAME TO vault_snapshots_retired;
+  ELSE
+    DROP TABLE IF EXISTS vault_snapshots;
+  END IF;
+END
+$$;
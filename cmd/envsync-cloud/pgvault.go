@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Vault storage in Postgres. A vaults row holds the revision, recovery
+// metadata and everything in the store besides environments and secrets
+// (teams, rekey and the project fields, in metadata_json). environments,
+// secrets and secret_versions hold the rest, one row each. Writes only touch
+// rows that changed; removed environments and secrets get removed_at and
+// replaced versions get superseded_at, so history survives every write.
+
+// queryer is satisfied by *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type vaultRow struct {
+	id       string
+	revision int
+	salt     sql.NullString
+	keyCheck sql.NullString
+	metadata []byte
+}
+
+// envKey identifies an environment inside a vault. Vaults normally hold one
+// project, but the legacy default vault can hold several.
+type envKey struct {
+	project string
+	env     string
+}
+
+// envRows is an environment's live rows, or the rows a store should have.
+type envRows struct {
+	id       string
+	metadata map[string]any
+	secrets  map[string]*secretRows
+}
+
+type secretRows struct {
+	id             string
+	currentVersion int
+	metadata       map[string]any
+	versions       map[int]any
+}
+
+// findVault returns the vault row for owner and project, or nil. lock takes
+// a row lock for the rest of the transaction.
+func findVault(ctx context.Context, q queryer, ownerKey, project string, lock bool) (*vaultRow, error) {
+	query := `
+SELECT id, revision, salt_b64, key_check_b64, metadata_json
+FROM vaults
+WHERE owner_key = $1 AND project_name = $2
+`
+	if lock {
+		query += "FOR UPDATE\n"
+	}
+	v := &vaultRow{}
+	err := q.QueryRowContext(ctx, query, ownerKey, project).Scan(&v.id, &v.revision, &v.salt, &v.keyCheck, &v.metadata)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// createVault inserts an empty vault row. It returns errConflict when a
+// concurrent writer created the same vault first.
+func createVault(ctx context.Context, q queryer, ownerKey, project string) (*vaultRow, error) {
+	ownerType, ownerID := vaultOwner(ownerKey)
+	v := &vaultRow{metadata: []byte(`{}`)}
+	err := q.QueryRowContext(ctx, `
+INSERT INTO vaults (owner_type, owner_id, owner_key, project_name)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (owner_key, project_name) DO NOTHING
+RETURNING id
+`, ownerType, ownerID, ownerKey, project).Scan(&v.id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: vault created concurrently", errConflict)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// vaultOwner maps an owner key ("org:<id>", "team:<id>" or a user id) to the
+// owner_type and owner_id columns. owner_id stays NULL for non-UUID owners
+// such as the development user.
+func vaultOwner(ownerKey string) (string, any) {
+	ownerType, id := "user", ownerKey
+	if rest, ok := strings.CutPrefix(ownerKey, "org:"); ok {
+		ownerType, id = "organization", rest
+	} else if rest, ok := strings.CutPrefix(ownerKey, "team:"); ok {
+		ownerType, id = "team", rest
+	}
+	if !isUUID(id) {
+		return ownerType, nil
+	}
+	return ownerType, id
+}
+
+// loadVaultRows returns the live environments, secrets and versions of a
+// vault.
+func loadVaultRows(ctx context.Context, q queryer, vaultID string) (map[envKey]*envRows, error) {
+	envs := map[envKey]*envRows{}
+	byID := map[string]*envRows{}
+	rows, err := q.QueryContext(ctx, `
+SELECT id, project_name, name, metadata_json
+FROM environments
+WHERE vault_id = $1 AND removed_at IS NULL
+`, vaultID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			key      envKey
+			env      = &envRows{secrets: map[string]*secretRows{}}
+			metadata []byte
+		)
+		if err := rows.Scan(&env.id, &key.project, &key.env, &metadata); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal(metadata, &env.metadata); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		envs[key] = env
+		byID[env.id] = env
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+
+	secrets := map[string]*secretRows{}
+	rows, err = q.QueryContext(ctx, `
+SELECT s.id, s.environment_id, s.key, s.current_version, s.metadata_json
+FROM secrets s
+JOIN environments e ON e.id = s.environment_id
+WHERE e.vault_id = $1 AND e.removed_at IS NULL AND s.removed_at IS NULL
+`, vaultID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			envID, key string
+			secret     = &secretRows{versions: map[int]any{}}
+			metadata   []byte
+		)
+		if err := rows.Scan(&secret.id, &envID, &key, &secret.currentVersion, &metadata); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal(metadata, &secret.metadata); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if env := byID[envID]; env != nil {
+			env.secrets[key] = secret
+			secrets[secret.id] = secret
+		}
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.QueryContext(ctx, `
+SELECT v.secret_id, v.version, v.payload_json
+FROM secret_versions v
+JOIN secrets s ON s.id = v.secret_id
+JOIN environments e ON e.id = s.environment_id
+WHERE e.vault_id = $1 AND e.removed_at IS NULL AND s.removed_at IS NULL AND v.superseded_at IS NULL
+`, vaultID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			secretID string
+			version  int
+			payload  []byte
+			decoded  any
+		)
+		if err := rows.Scan(&secretID, &version, &payload); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &decoded); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if secret := secrets[secretID]; secret != nil {
+			secret.versions[version] = decoded
+		}
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+	return envs, nil
+}
+
+// loadSecretRows returns the id of the live environment key names and the
+// live rows of its secret name. envID is empty when the environment does not
+// exist and secret is nil when the secret does not.
+func loadSecretRows(ctx context.Context, q queryer, vaultID string, key envKey, name string) (envID string, secret *secretRows, err error) {
+	err = q.QueryRowContext(ctx, `
+SELECT id
+FROM environments
+WHERE vault_id = $1 AND project_name = $2 AND name = $3 AND removed_at IS NULL
+`, vaultID, key.project, key.env).Scan(&envID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret = &secretRows{versions: map[int]any{}}
+	var metadata []byte
+	err = q.QueryRowContext(ctx, `
+SELECT id, current_version, metadata_json
+FROM secrets
+WHERE environment_id = $1 AND key = $2 AND removed_at IS NULL
+`, envID, name).Scan(&secret.id, &secret.currentVersion, &metadata)
+	if errors.Is(err, sql.ErrNoRows) {
+		return envID, nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if err := json.Unmarshal(metadata, &secret.metadata); err != nil {
+		return "", nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, `
+SELECT version, payload_json
+FROM secret_versions
+WHERE secret_id = $1 AND superseded_at IS NULL
+`, secret.id)
+	if err != nil {
+		return "", nil, err
+	}
+	for rows.Next() {
+		var (
+			version int
+			payload []byte
+			decoded any
+		)
+		if err := rows.Scan(&version, &payload); err != nil {
+			_ = rows.Close()
+			return "", nil, err
+		}
+		if err := json.Unmarshal(payload, &decoded); err != nil {
+			_ = rows.Close()
+			return "", nil, err
+		}
+		secret.versions[version] = decoded
+	}
+	if err := closeRows(rows); err != nil {
+		return "", nil, err
+	}
+	return envID, secret, nil
+}
+
+// vaultProject returns the name project is stored under in v, matched the
+// way remoteStore.project matches it, or "" when v does not hold it.
+func vaultProject(v *vaultRow, project string) (string, error) {
+	var metadata struct {
+		Projects map[string]any `json:"projects"`
+	}
+	if err := json.Unmarshal(v.metadata, &metadata); err != nil {
+		return "", err
+	}
+	if asMap(metadata.Projects[project]) != nil {
+		return project, nil
+	}
+	for _, candidate := range sortedKeys(metadata.Projects) {
+		if strings.EqualFold(candidate, project) && asMap(metadata.Projects[candidate]) != nil {
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
+
+func closeRows(rows *sql.Rows) error {
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+// splitStore breaks st into the vault metadata_json document and the rows
+// its environments should have.
+func splitStore(st *remoteStore) ([]byte, map[envKey]*envRows, error) {
+	projects := map[string]any{}
+	envs := map[envKey]*envRows{}
+	for name, raw := range st.Projects {
+		project, ok := raw.(map[string]any)
+		if !ok {
+			projects[name] = raw
+			continue
+		}
+		projects[name] = without(project, "envs")
+		for envName, rawEnv := range asMap(project["envs"]) {
+			env := asMap(rawEnv)
+			if env == nil {
+				continue
+			}
+			want := &envRows{metadata: without(env, "vars"), secrets: map[string]*secretRows{}}
+			for key, rawRecord := range asMap(env["vars"]) {
+				record := asMap(rawRecord)
+				if record == nil {
+					continue
+				}
+				secret, err := splitRecord(record)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s/%s/%s: %w", name, envName, key, err)
+				}
+				want.secrets[key] = secret
+			}
+			envs[envKey{project: name, env: envName}] = want
+		}
+	}
+	metadata := map[string]any{"projects": projects, "teams": st.Teams}
+	if st.Rekey != nil {
+		metadata["rekey"] = st.Rekey
+	}
+	if st.KDF != nil {
+		metadata["kdf"] = st.KDF
+	}
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, envs, nil
+}
+
+// splitRecord returns the rows a SecretRecord should have.
+func splitRecord(record map[string]any) (*secretRows, error) {
+	if err := checkRecord(record); err != nil {
+		return nil, err
+	}
+	secret := &secretRows{
+		currentVersion: recordVersion(record),
+		metadata:       without(record, "current_version", "versions"),
+		versions:       map[int]any{},
+	}
+	list, _ := record["versions"].([]any)
+	for _, v := range list {
+		secret.versions[versionNumber(v)] = v
+	}
+	return secret, nil
+}
+
+// record rebuilds the SecretRecord a secret's rows hold.
+func (s *secretRows) record() map[string]any {
+	record := without(s.metadata)
+	record["current_version"] = float64(s.currentVersion)
+	versions := make([]any, 0, len(s.versions))
+	for _, n := range sortedVersions(s.versions) {
+		versions = append(versions, s.versions[n])
+	}
+	record["versions"] = versions
+	return record
+}
+
+// assembleStore rebuilds the remoteStore shape clients expect from a vault
+// row and its live rows.
+func assembleStore(v *vaultRow, envs map[envKey]*envRows) (*remoteStore, error) {
+	var metadata struct {
+		Projects map[string]any `json:"projects"`
+		Teams    map[string]any `json:"teams"`
+		Rekey    map[string]any `json:"rekey"`
+		KDF      map[string]any `json:"kdf"`
+	}
+	if err := json.Unmarshal(v.metadata, &metadata); err != nil {
+		return nil, err
+	}
+	st := &remoteStore{
+		Version:     1,
+		Revision:    v.revision,
+		SaltB64:     v.salt.String,
+		KeyCheckB64: v.keyCheck.String,
+		KDF:         metadata.KDF,
+		Rekey:       metadata.Rekey,
+		Teams:       metadata.Teams,
+		Projects:    map[string]any{},
+	}
+	if st.Teams == nil {
+		st.Teams = map[string]any{}
+	}
+	for name, raw := range metadata.Projects {
+		if project, ok := raw.(map[string]any); ok {
+			project["envs"] = map[string]any{}
+		}
+		st.Projects[name] = raw
+	}
+	for key, env := range envs {
+		project := asMap(st.Projects[key.project])
+		if project == nil {
+			project = map[string]any{"name": key.project, "envs": map[string]any{}}
+			st.Projects[key.project] = project
+		}
+		vars := map[string]any{}
+		for name, secret := range env.secrets {
+			vars[name] = secret.record()
+		}
+		out := without(env.metadata)
+		out["vars"] = vars
+		asMap(project["envs"])[key.env] = out
+	}
+	return st, nil
+}
+
+// without returns a shallow copy of m minus keys.
+func without(m map[string]any, keys ...string) map[string]any {
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	for _, k := range keys {
+		delete(out, k)
+	}
+	return out
+}
+
+// syncVaultRows brings a vault's live rows from live to want.
+func syncVaultRows(ctx context.Context, q queryer, vaultID, actorID string, live, want map[envKey]*envRows) error {
+	for _, key := range sortedEnvKeys(want) {
+		wantEnv, liveEnv := want[key], live[key]
+		metadata, err := json.Marshal(wantEnv.metadata)
+		if err != nil {
+			return err
+		}
+		switch {
+		case liveEnv == nil:
+			liveEnv = &envRows{secrets: map[string]*secretRows{}}
+			if liveEnv.id, err = upsertEnvironment(ctx, q, vaultID, key, metadata); err != nil {
+				return err
+			}
+		case !reflect.DeepEqual(liveEnv.metadata, wantEnv.metadata):
+			if _, err := q.ExecContext(ctx, `UPDATE environments SET metadata_json = $2::jsonb WHERE id = $1`, liveEnv.id, metadata); err != nil {
+				return err
+			}
+		}
+		for _, name := range sortedKeys(wantEnv.secrets) {
+			if err := syncSecretRows(ctx, q, liveEnv.id, name, actorID, liveEnv.secrets[name], wantEnv.secrets[name]); err != nil {
+				return err
+			}
+		}
+		for _, name := range sortedKeys(liveEnv.secrets) {
+			if wantEnv.secrets[name] == nil {
+				if err := removeSecretRows(ctx, q, liveEnv.secrets[name].id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, key := range sortedEnvKeys(live) {
+		if want[key] != nil {
+			continue
+		}
+		envID := live[key].id
+		if _, err := q.ExecContext(ctx, `UPDATE environments SET removed_at = NOW() WHERE id = $1`, envID); err != nil {
+			return err
+		}
+		if _, err := q.ExecContext(ctx, `
+UPDATE secret_versions SET superseded_at = NOW()
+WHERE superseded_at IS NULL AND secret_id IN (SELECT id FROM secrets WHERE environment_id = $1)
+`, envID); err != nil {
+			return err
+		}
+		if _, err := q.ExecContext(ctx, `UPDATE secrets SET removed_at = NOW() WHERE environment_id = $1 AND removed_at IS NULL`, envID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsertEnvironment creates an environment row, or revives a removed one
+// with the same name, and returns its id.
+func upsertEnvironment(ctx context.Context, q queryer, vaultID string, key envKey, metadata []byte) (string, error) {
+	var id string
+	err := q.QueryRowContext(ctx, `
+INSERT INTO environments (vault_id, project_name, name, metadata_json)
+VALUES ($1, $2, $3, $4::jsonb)
+ON CONFLICT (vault_id, project_name, name)
+DO UPDATE SET metadata_json = EXCLUDED.metadata_json, removed_at = NULL
+RETURNING id
+`, vaultID, key.project, key.env, metadata).Scan(&id)
+	return id, err
+}
+
+func syncSecretRows(ctx context.Context, q queryer, envID, key, actorID string, live, want *secretRows) error {
+	metadata, err := json.Marshal(want.metadata)
+	if err != nil {
+		return err
+	}
+	var secretID string
+	switch {
+	case live == nil:
+		// A removed secret with the same key is revived; its old versions
+		// were superseded when it was removed.
+		if err := q.QueryRowContext(ctx, `
+INSERT INTO secrets (environment_id, key, current_version, metadata_json)
+VALUES ($1, $2, $3, $4::jsonb)
+ON CONFLICT (environment_id, key)
+DO UPDATE SET current_version = EXCLUDED.current_version, metadata_json = EXCLUDED.metadata_json, removed_at = NULL, updated_at = NOW()
+RETURNING id
+`, envID, key, want.currentVersion, metadata).Scan(&secretID); err != nil {
+			return err
+		}
+		live = &secretRows{versions: map[int]any{}}
+	default:
+		secretID = live.id
+		if live.currentVersion != want.currentVersion || !reflect.DeepEqual(live.metadata, want.metadata) {
+			if _, err := q.ExecContext(ctx, `
+UPDATE secrets SET current_version = $2, metadata_json = $3::jsonb, updated_at = NOW()
+WHERE id = $1
+`, secretID, want.currentVersion, metadata); err != nil {
+				return err
+			}
+		}
+	}
+	for _, n := range sortedVersions(want.versions) {
+		previous, ok := live.versions[n]
+		if ok && reflect.DeepEqual(previous, want.versions[n]) {
+			continue
+		}
+		if ok {
+			if err := supersedeVersion(ctx, q, secretID, n); err != nil {
+				return err
+			}
+		}
+		payload, err := json.Marshal(want.versions[n])
+		if err != nil {
+			return err
+		}
+		if _, err := q.ExecContext(ctx, `
+INSERT INTO secret_versions (secret_id, version, payload_json, created_by_user_id)
+VALUES ($1, $2, $3::jsonb, $4)
+`, secretID, n, payload, nullIfEmpty(actorID)); err != nil {
+			return err
+		}
+	}
+	for _, n := range sortedVersions(live.versions) {
+		if _, ok := want.versions[n]; !ok {
+			if err := supersedeVersion(ctx, q, secretID, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func supersedeVersion(ctx context.Context, q queryer, secretID string, version int) error {
+	_, err := q.ExecContext(ctx, `
+UPDATE secret_versions SET superseded_at = NOW()
+WHERE secret_id = $1 AND version = $2 AND superseded_at IS NULL
+`, secretID, version)
+	return err
+}
+
+func removeSecretRows(ctx context.Context, q queryer, secretID string) error {
+	if _, err := q.ExecContext(ctx, `UPDATE secrets SET removed_at = NOW() WHERE id = $1`, secretID); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx, `
+UPDATE secret_versions SET superseded_at = NOW()
+WHERE secret_id = $1 AND superseded_at IS NULL
+`, secretID)
+	return err
+}
+
+// writeVault stores next as the vault's new state: the vault row is updated
+// and its live rows are synced from live. It returns the secrets that
+// changed. The caller holds the vault row lock.
+func writeVault(ctx context.Context, q queryer, v *vaultRow, live map[envKey]*envRows, actorID string, next *remoteStore, revision int) ([]auditChange, error) {
+	metadata, want, err := splitStore(next)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := q.ExecContext(ctx, `
+UPDATE vaults
+SET revision = $2, salt_b64 = $3, key_check_b64 = $4, metadata_json = $5::jsonb, updated_by_user_id = $6, updated_at = NOW()
+WHERE id = $1
+`, v.id, revision, nullIfEmpty(next.SaltB64), nullIfEmpty(next.KeyCheckB64), metadata, nullIfEmpty(actorID)); err != nil {
+		return nil, err
+	}
+	if err := syncVaultRows(ctx, q, v.id, actorID, live, want); err != nil {
+		return nil, err
+	}
+	return storeChanges(live, want), nil
+}
+
+// migrateSnapshots copies every vault_snapshots row that has no vaults row
+// yet into the normalized tables. It runs right after migration 004;
+// migration 006 then retires vault_snapshots so nothing reads it again.
+func migrateSnapshots(ctx context.Context, db *sql.DB) error {
+	type snapshot struct {
+		owner, project string
+		store          *remoteStore
+		updatedBy      string
+	}
+	rows, err := db.QueryContext(ctx, `
+SELECT s.owner_user_id, s.project_name, s.revision, s.payload_json, s.salt_b64, s.key_check_b64, COALESCE(s.updated_by_user_id, '')
+FROM vault_snapshots s
+WHERE NOT EXISTS (
+  SELECT 1 FROM vaults v WHERE v.owner_key = s.owner_user_id AND v.project_name = s.project_name
+)
+`)
+	if err != nil {
+		return err
+	}
+	var pending []snapshot
+	for rows.Next() {
+		var (
+			s          snapshot
+			revision   int
+			payloadRaw []byte
+			saltB64    sql.NullString
+			keyCheck   sql.NullString
+		)
+		if err := rows.Scan(&s.owner, &s.project, &revision, &payloadRaw, &saltB64, &keyCheck, &s.updatedBy); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if s.store, err = decodeSnapshot(revision, payloadRaw, saltB64.String, keyCheck.String); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("decode snapshot %s/%s: %w", s.owner, s.project, err)
+		}
+		pending = append(pending, s)
+	}
+	if err := closeRows(rows); err != nil {
+		return err
+	}
+	for _, s := range pending {
+		if err := func() error {
+			tx, err := db.BeginTx(ctx, &sql.TxOptions{})
+			if err != nil {
+				return err
+			}
+			defer func() { _ = tx.Rollback() }()
+			v, err := createVault(ctx, tx, s.owner, s.project)
+			if err != nil {
+				if errors.Is(err, errConflict) {
+					return nil
+				}
+				return err
+			}
+			if _, err := writeVault(ctx, tx, v, map[envKey]*envRows{}, s.updatedBy, s.store, s.store.Revision); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}(); err != nil {
+			return fmt.Errorf("migrate snapshot %s/%s: %w", s.owner, s.project, err)
+		}
+	}
+	return nil
+}
+
+func sortedEnvKeys(m map[envKey]*envRows) []envKey {
+	keys := make([]envKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].project != keys[j].project {
+			return keys[i].project < keys[j].project
+		}
+		return keys[i].env < keys[j].env
+	})
+	return keys
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedVersions(m map[int]any) []int {
+	out := make([]int, 0, len(m))
+	for n := range m {
+		out = append(out, n)
+	}
+	sort.Ints(out)
+	return out
+}
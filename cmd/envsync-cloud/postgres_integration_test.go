@@ -5,9 +5,11 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"regexp"
 	"testing"
 )
@@ -34,7 +36,7 @@ func TestPostgresPATTeamStoreAuthorization(t *testing.T) {
 		t.Fatalf("run migrations: %v", err)
 	}
 	if _, err := db.Exec(`
-TRUNCATE team_members, teams, personal_access_tokens, organization_members, organizations, vault_snapshots, vaults, users, audit_events CASCADE
+TRUNCATE team_members, teams, personal_access_tokens, organization_members, organizations, vaults, users, audit_events CASCADE
 `); err != nil {
 		t.Fatalf("truncate test tables: %v", err)
 	}
@@ -143,3 +145,119 @@ func TestMeIncludesTeams(t *testing.T) {
 		t.Fatalf("expected teams field in /v1/me response")
 	}
 }
+
+func TestPostgresVaultRowsKeepHistory(t *testing.T) {
+	databaseURL := os.Getenv("ENVSYNC_CLOUD_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("set ENVSYNC_CLOUD_DATABASE_URL to run postgres integration tests")
+	}
+	db, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	if err := runMigrations(db); err != nil {
+		t.Fatalf("run migrations: %v", err)
+	}
+	if _, err := db.Exec(`TRUNCATE vaults, audit_events CASCADE`); err != nil {
+		t.Fatalf("truncate test tables: %v", err)
+	}
+	ctx := context.Background()
+	repo := &pgRepo{db: db}
+	store := func(raw string) *remoteStore {
+		t.Helper()
+		var st remoteStore
+		if err := json.Unmarshal([]byte(raw), &st); err != nil {
+			t.Fatal(err)
+		}
+		return &st
+	}
+
+	first := store(`{"version":1,"salt_b64":"s","projects":{"api":{"name":"api","envs":{"dev":{"name":"dev","vars":{
+  "TOKEN":{"current_version":1,"versions":[{"version":1,"cipher_b64":"a"}]}}}}}}}`)
+	if _, err := repo.Put(ctx, "user-1", "user-1", "api", first, 0); err != nil {
+		t.Fatalf("first put: %v", err)
+	}
+	// v1 is re-encrypted and v2 added, as after a phrase rotation and a set.
+	second := store(`{"version":1,"salt_b64":"s","projects":{"api":{"name":"api","envs":{"dev":{"name":"dev","vars":{
+  "TOKEN":{"current_version":2,"versions":[{"version":1,"cipher_b64":"a2"},{"version":2,"cipher_b64":"b"}]}}}}}}}`)
+	if _, err := repo.Put(ctx, "user-1", "user-1", "api", second, 1); err != nil {
+		t.Fatalf("second put: %v", err)
+	}
+	got, err := repo.Get(ctx, "user-1", "api")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	second.Revision = 2
+	if !reflect.DeepEqual(got, second) {
+		t.Fatalf("expected the second store back, got %+v", got)
+	}
+	var total, live int
+	if err := db.QueryRow(`SELECT COUNT(*), COUNT(*) FILTER (WHERE superseded_at IS NULL) FROM secret_versions`).Scan(&total, &live); err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || live != 2 {
+		t.Fatalf("expected 3 version rows with 2 live, got %d and %d", total, live)
+	}
+
+	// A record write touches only that secret's rows.
+	ref := secretRef{project: "API", env: "dev", key: "TOKEN"}
+	record := map[string]any{"current_version": float64(3), "versions": []any{
+		map[string]any{"version": float64(1), "cipher_b64": "a2"},
+		map[string]any{"version": float64(2), "cipher_b64": "b"},
+		map[string]any{"version": float64(3), "cipher_b64": "c"},
+	}}
+	revision, err := repo.PutSecret(ctx, "user-1", "user-1", "api", ref, record, 2)
+	if err != nil || revision != 3 {
+		t.Fatalf("put secret: revision %d, %v", revision, err)
+	}
+	if _, err := repo.PutSecret(ctx, "user-1", "user-1", "api", ref, record, 2); !errors.Is(err, errVersionConflict) {
+		t.Fatalf("expected a stale record write to conflict, got %v", err)
+	}
+	gotRecord, revision, err := repo.GetSecret(ctx, "user-1", "api", ref)
+	if err != nil || revision != 3 || !reflect.DeepEqual(gotRecord, record) {
+		t.Fatalf("get secret: %v at revision %d, %v", gotRecord, revision, err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*), COUNT(*) FILTER (WHERE superseded_at IS NULL) FROM secret_versions`).Scan(&total, &live); err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 || live != 3 {
+		t.Fatalf("expected 4 version rows with 3 live, got %d and %d", total, live)
+	}
+
+	// Snapshots written before the normalized tables are copied on startup
+	// and the old table is retired.
+	initSQL, err := migrationFS.ReadFile("migrations/001_init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DROP TABLE IF EXISTS vault_snapshots_retired`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(initSQL)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`
+INSERT INTO vault_snapshots (owner_user_id, project_name, revision, payload_json)
+VALUES ('user-1', 'web', 7, '{"projects":{"web":{"name":"web","envs":{}}},"teams":{}}'::jsonb)
+`); err != nil {
+		t.Fatal(err)
+	}
+	if err := runMigrations(db); err != nil {
+		t.Fatalf("rerun migrations: %v", err)
+	}
+	web, err := repo.Get(ctx, "user-1", "web")
+	if err != nil {
+		t.Fatalf("get migrated vault: %v", err)
+	}
+	if web.Revision != 7 || web.Projects["web"] == nil {
+		t.Fatalf("expected migrated web vault at revision 7, got %+v", web)
+	}
+	var current, retired sql.NullString
+	if err := db.QueryRow(`SELECT to_regclass('vault_snapshots')::text, to_regclass('vault_snapshots_retired')::text`).Scan(&current, &retired); err != nil {
+		t.Fatal(err)
+	}
+	if current.Valid || !retired.Valid {
+		t.Fatalf("expected vault_snapshots retired, got %v and %v", current, retired)
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// secretPath addresses a single encrypted SecretRecord inside a vault.
+const secretPath = "/v1/vaults/{project}/envs/{env}/secrets/{key}"
+
+// Store responses list optional API features in featuresHeader so clients
+// can tell whether record-level writes are available. Record responses carry
+// the vault revision in revisionHeader.
+const (
+	featuresHeader       = "X-Envsync-Features"
+	secretRecordsFeature = "secret-records"
+	revisionHeader       = "X-Envsync-Revision"
+)
+
+var (
+	errVersionConflict = errors.New("secret version conflict")
+	errNotFound        = errors.New("not found")
+	errInvalidRecord   = errors.New("invalid secret record")
+)
+
+func (s *cloudServer) handleSecret(w http.ResponseWriter, r *http.Request) {
+	p, err := s.verifier.authenticate(r)
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+	ownerID, err := s.resolveOwner(p, r.URL.Query().Get("organization_id"), r.URL.Query().Get("team_id"), r.Method)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			writeError(w, r, http.StatusForbidden, "forbidden", err.Error())
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	projectName := strings.TrimSpace(r.PathValue("project"))
+	project, err := s.normalizeProject(projectName)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_project", err.Error())
+		return
+	}
+	envName, key := strings.TrimSpace(r.PathValue("env")), strings.TrimSpace(r.PathValue("key"))
+	if envName == "" || key == "" {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "env and key are required")
+		return
+	}
+	ref := secretRef{project: projectName, env: envName, key: key}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !p.hasScope("store:read") {
+			writeError(w, r, http.StatusForbidden, "forbidden", "token missing scope store:read")
+			return
+		}
+		record, revision, err := s.repo.GetSecret(r.Context(), ownerID, project, ref)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				writeError(w, r, http.StatusNotFound, "not_found", err.Error())
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "read secret failed")
+			return
+		}
+		w.Header().Set(revisionHeader, strconv.Itoa(revision))
+		writeJSON(w, http.StatusOK, record)
+	case http.MethodPut, http.MethodDelete:
+		if !p.hasScope("store:write") {
+			writeError(w, r, http.StatusForbidden, "forbidden", "token missing scope store:write")
+			return
+		}
+		match := strings.TrimSpace(r.Header.Get("If-Match"))
+		if match == "" {
+			writeError(w, r, http.StatusPreconditionRequired, "precondition_required", "If-Match required")
+			return
+		}
+		expectedVersion, err := strconv.Atoi(match)
+		if err != nil || expectedVersion < 0 {
+			writeError(w, r, http.StatusBadRequest, "bad_request", "invalid If-Match")
+			return
+		}
+		var record map[string]any
+		if r.Method == http.MethodPut {
+			r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+			defer r.Body.Close()
+			if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+				var bodyErr *http.MaxBytesError
+				if errors.As(err, &bodyErr) {
+					writeError(w, r, http.StatusRequestEntityTooLarge, "payload_too_large", "request body exceeds maximum allowed size")
+					return
+				}
+				writeError(w, r, http.StatusBadRequest, "bad_request", "invalid JSON payload")
+				return
+			}
+			if record == nil || recordVersion(record) <= 0 {
+				writeError(w, r, http.StatusBadRequest, "bad_request", "record requires a positive current_version")
+				return
+			}
+			if err := checkRecord(record); err != nil {
+				writeError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+				return
+			}
+		}
+		var revision int
+		if r.Method == http.MethodPut {
+			revision, err = s.repo.PutSecret(r.Context(), ownerID, p.UserID, project, ref, record, expectedVersion)
+		} else {
+			revision, err = s.repo.DeleteSecret(r.Context(), ownerID, p.UserID, project, ref, expectedVersion)
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, errVersionConflict):
+				writeError(w, r, http.StatusPreconditionFailed, "precondition_failed", err.Error())
+			case errors.Is(err, errNotFound):
+				writeError(w, r, http.StatusNotFound, "not_found", err.Error())
+			default:
+				writeError(w, r, http.StatusInternalServerError, "internal_error", "write secret failed")
+			}
+			return
+		}
+		w.Header().Set(revisionHeader, strconv.Itoa(revision))
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, record)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+// secretRef names a record inside a vault. project is the name as stored in
+// the vault's projects map, which may differ in case from the vault name.
+type secretRef struct {
+	project string
+	env     string
+	key     string
+}
+
+func (ref secretRef) String() string {
+	return ref.project + "/" + ref.env + "/" + ref.key
+}
+
+// secretRecord returns the record ref points at, or nil.
+func (st *remoteStore) secretRecord(ref secretRef) map[string]any {
+	project := st.project(ref.project)
+	env := asMap(asMap(project["envs"])[ref.env])
+	record, _ := asMap(env["vars"])[ref.key].(map[string]any)
+	return record
+}
+
+// setSecretRecord replaces the record ref points at, or deletes it when record
+// is nil, after checking that the stored current_version is expectedVersion
+// (0 when the key must not exist yet). The project must already be in the
+// vault; its env is created on first write.
+func (st *remoteStore) setSecretRecord(ref secretRef, record map[string]any, expectedVersion int) error {
+	project := st.project(ref.project)
+	if project == nil {
+		return fmt.Errorf("%w: project %q is not in this vault", errNotFound, ref.project)
+	}
+	current := recordVersion(st.secretRecord(ref))
+	if current != expectedVersion {
+		return fmt.Errorf("%w: %s expected version %d, got %d", errVersionConflict, ref, expectedVersion, current)
+	}
+	envs := asMap(project["envs"])
+	if envs == nil {
+		envs = map[string]any{}
+		project["envs"] = envs
+	}
+	env := asMap(envs[ref.env])
+	if env == nil {
+		if record == nil {
+			return fmt.Errorf("%w: %s", errNotFound, ref)
+		}
+		env = map[string]any{"name": ref.env}
+		envs[ref.env] = env
+	}
+	vars := asMap(env["vars"])
+	if vars == nil {
+		vars = map[string]any{}
+		env["vars"] = vars
+	}
+	if record == nil {
+		if _, ok := vars[ref.key]; !ok {
+			return fmt.Errorf("%w: %s", errNotFound, ref)
+		}
+		delete(vars, ref.key)
+		return nil
+	}
+	vars[ref.key] = record
+	return nil
+}
+
+// project looks name up exactly first and then case-insensitively, matching
+// how vault names are normalized.
+func (st *remoteStore) project(name string) map[string]any {
+	if project := asMap(st.Projects[name]); project != nil {
+		return project
+	}
+	for candidate, project := range st.Projects {
+		if strings.EqualFold(candidate, name) {
+			return asMap(project)
+		}
+	}
+	return nil
+}
+
+func recordVersion(record map[string]any) int {
+	v, _ := record["current_version"].(float64)
+	return int(v)
+}
+
+// checkRecord rejects a record unless each of its versions carries its own
+// positive version number, which is what version rows are keyed by.
+func checkRecord(record map[string]any) error {
+	list, _ := record["versions"].([]any)
+	seen := map[int]bool{}
+	for _, v := range list {
+		n := versionNumber(v)
+		if n <= 0 {
+			return fmt.Errorf("%w: every version needs a positive version number", errInvalidRecord)
+		}
+		if seen[n] {
+			return fmt.Errorf("%w: version %d appears twice", errInvalidRecord, n)
+		}
+		seen[n] = true
+	}
+	return nil
+}
+
+// checkStoreRecords runs checkRecord on every record in st.
+func checkStoreRecords(st *remoteStore) error {
+	for name, project := range st.Projects {
+		for envName, env := range asMap(asMap(project)["envs"]) {
+			for key, record := range asMap(asMap(env)["vars"]) {
+				if err := checkRecord(asMap(record)); err != nil {
+					return fmt.Errorf("%s/%s/%s: %w", name, envName, key, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// versionNumber returns the version number of an entry in a record's
+// versions list, or 0 when it has none.
+func versionNumber(v any) int {
+	n, ok := asMap(v)["version"].(float64)
+	if !ok || n != math.Trunc(n) {
+		return 0
+	}
+	return int(n)
+}
+
+func asMap(v any) map[string]any {
+	m, _ := v.(map[string]any)
+	return m
+}
+
+// cloneStore deep-copies st so a record write never mutates a snapshot that
+// was already handed out.
+func cloneStore(st *remoteStore) (*remoteStore, error) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	var out remoteStore
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (m *memoryRepo) GetSecret(ctx context.Context, ownerID, project string, ref secretRef) (map[string]any, int, error) {
+	store, err := m.Get(ctx, ownerID, project)
+	if err != nil {
+		return nil, 0, err
+	}
+	record := store.secretRecord(ref)
+	if record == nil {
+		return nil, 0, fmt.Errorf("%w: %s", errNotFound, ref)
+	}
+	return record, store.Revision, nil
+}
+
+func (m *memoryRepo) PutSecret(ctx context.Context, ownerID, actorID, project string, ref secretRef, record map[string]any, expectedVersion int) (int, error) {
+	return m.writeSecret(ownerID, actorID, project, ref, record, expectedVersion)
+}
+
+func (m *memoryRepo) DeleteSecret(ctx context.Context, ownerID, actorID, project string, ref secretRef, expectedVersion int) (int, error) {
+	return m.writeSecret(ownerID, actorID, project, ref, nil, expectedVersion)
+}
+
+func (m *memoryRepo) writeSecret(ownerID, actorID, project string, ref secretRef, record map[string]any, expectedVersion int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := ownerID + ":" + project
+	existing := m.data[key]
+	if existing == nil {
+		return 0, fmt.Errorf("%w: vault %q", errNotFound, project)
+	}
+	next, err := cloneStore(existing)
+	if err != nil {
+		return 0, err
+	}
+	if err := next.setSecretRecord(ref, record, expectedVersion); err != nil {
+		return 0, err
+	}
+	next.Revision = existing.Revision + 1
+	m.data[key] = next
+	changes := []auditChange{{Project: ref.project, Env: ref.env, Key: ref.key}}
+	m.recordAudit(actorID, secretAction(record), ownerID, project, auditMetadata(existing.Revision, next.Revision, changes))
+	return next.Revision, nil
+}
+
+func secretAction(record map[string]any) string {
+	if record == nil {
+		return "secret_delete"
+	}
+	return "secret_put"
+}
+
+// GetSecret reads only the one secret's rows, from one snapshot of the
+// database.
+func (r *pgRepo) GetSecret(ctx context.Context, ownerID, project string, ref secretRef) (map[string]any, int, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	v, key, err := findSecretVault(ctx, tx, ownerID, project, ref, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, secret, err := loadSecretRows(ctx, tx, v.id, key, ref.key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if secret == nil {
+		return nil, 0, fmt.Errorf("%w: %s", errNotFound, ref)
+	}
+	return secret.record(), v.revision, nil
+}
+
+func (r *pgRepo) PutSecret(ctx context.Context, ownerID, actorID, project string, ref secretRef, record map[string]any, expectedVersion int) (int, error) {
+	return r.writeSecret(ctx, ownerID, actorID, project, ref, record, expectedVersion)
+}
+
+func (r *pgRepo) DeleteSecret(ctx context.Context, ownerID, actorID, project string, ref secretRef, expectedVersion int) (int, error) {
+	return r.writeSecret(ctx, ownerID, actorID, project, ref, nil, expectedVersion)
+}
+
+// writeSecret changes one record under the vault row lock and bumps the
+// vault revision, so whole-store writers still see the change. A nil record
+// deletes the key. Only the secret's own rows are read and written. Vaults
+// that only exist under a legacy owner are not migrated here; the client
+// falls back to a full store PUT.
+func (r *pgRepo) writeSecret(ctx context.Context, ownerID, actorID, project string, ref secretRef, record map[string]any, expectedVersion int) (int, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	v, key, err := findSecretVault(ctx, tx, ownerID, project, ref, true)
+	if err != nil {
+		return 0, err
+	}
+	envID, live, err := loadSecretRows(ctx, tx, v.id, key, ref.key)
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	if live != nil {
+		current = live.currentVersion
+	}
+	if current != expectedVersion {
+		return 0, fmt.Errorf("%w: %s expected version %d, got %d", errVersionConflict, ref, expectedVersion, current)
+	}
+	if record == nil {
+		if live == nil {
+			return 0, fmt.Errorf("%w: %s", errNotFound, ref)
+		}
+		if err := removeSecretRows(ctx, tx, live.id); err != nil {
+			return 0, err
+		}
+	} else {
+		want, err := splitRecord(record)
+		if err != nil {
+			return 0, err
+		}
+		if envID == "" {
+			metadata, err := json.Marshal(map[string]any{"name": ref.env})
+			if err != nil {
+				return 0, err
+			}
+			if envID, err = upsertEnvironment(ctx, tx, v.id, key, metadata); err != nil {
+				return 0, err
+			}
+		}
+		if err := syncSecretRows(ctx, tx, envID, ref.key, actorID, live, want); err != nil {
+			return 0, err
+		}
+	}
+	nextRevision := v.revision + 1
+	if _, err := tx.ExecContext(ctx, `
+UPDATE vaults SET revision = $2, updated_by_user_id = $3, updated_at = NOW()
+WHERE id = $1
+`, v.id, nextRevision, nullIfEmpty(actorID)); err != nil {
+		return 0, err
+	}
+	changes := []auditChange{{Project: key.project, Env: ref.env, Key: ref.key}}
+	if err := insertAuditEvent(ctx, tx, actorID, secretAction(record), ownerID, project, auditMetadata(v.revision, nextRevision, changes)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return nextRevision, nil
+}
+
+// findSecretVault returns the vault row ref lives in and the environment
+// key its project is stored under. lock takes the vault row lock for a
+// write; reads fall back to the legacy owner as Get does.
+func findSecretVault(ctx context.Context, q queryer, ownerID, project string, ref secretRef, lock bool) (*vaultRow, envKey, error) {
+	v, err := findVault(ctx, q, ownerID, project, lock)
+	if err == nil && v == nil && !lock {
+		if legacyOwner := legacyOwnerID(ownerID); legacyOwner != "" {
+			v, err = findVault(ctx, q, legacyOwner, project, false)
+		}
+	}
+	if err != nil {
+		return nil, envKey{}, err
+	}
+	if v == nil {
+		return nil, envKey{}, fmt.Errorf("%w: vault %q", errNotFound, project)
+	}
+	name, err := vaultProject(v, ref.project)
+	if err != nil {
+		return nil, envKey{}, err
+	}
+	if name == "" {
+		return nil, envKey{}, fmt.Errorf("%w: project %q is not in this vault", errNotFound, ref.project)
+	}
+	return v, envKey{project: name, env: ref.env}, nil
+}
@@ -30,6 +30,8 @@ const requestIDKey contextKey = "request_id"
 type server struct {
 	storePath       string
 	token           string
+	tokenActor      string
+	actorTokens     map[string]string
 	authMode        string
 	authHeader      string
 	authProxySecret string
@@ -92,7 +94,9 @@ func main() {
 	s := &server{
 		storePath:       storePath,
 		token:           os.Getenv("ENVSYNC_SERVER_TOKEN"),
-		authMode:        authModeFromEnv(os.Getenv("ENVSYNC_SERVER_AUTH_MODE"), os.Getenv("ENVSYNC_SERVER_TOKEN")),
+		tokenActor:      strings.TrimSpace(os.Getenv("ENVSYNC_SERVER_TOKEN_ACTOR")),
+		actorTokens:     parseActorTokens(os.Getenv("ENVSYNC_SERVER_TOKENS")),
+		authMode:        authModeFromEnv(os.Getenv("ENVSYNC_SERVER_AUTH_MODE"), os.Getenv("ENVSYNC_SERVER_TOKEN")+os.Getenv("ENVSYNC_SERVER_TOKENS")),
 		authHeader:      authHeaderFromEnv(os.Getenv("ENVSYNC_SERVER_AUTH_HEADER")),
 		authProxySecret: strings.TrimSpace(os.Getenv("ENVSYNC_SERVER_AUTH_PROXY_SECRET")),
 		limiter:         limiter,
@@ -114,8 +118,8 @@ func main() {
 
 	log.Printf("envsync-server listening on %s", addr)
 	log.Printf("store file: %s", storePath)
-	if s.token != "" {
-		log.Printf("token auth: enabled")
+	if s.token != "" || len(s.actorTokens) > 0 {
+		log.Printf("token auth: enabled (%d actor tokens)", len(s.actorTokens))
 	}
 	log.Printf("auth mode: %s", s.authMode)
 	if s.authMode == "header" || s.authMode == "token_or_header" {
@@ -316,7 +320,8 @@ func getenvInt(name string, fallback int) int {
 }
 
 func (s *server) handleStore(w http.ResponseWriter, r *http.Request) {
-	if err := s.authorize(r); err != nil {
+	actor, err := s.authorize(r)
+	if err != nil {
 		s.metrics.unauthorizedTotal.Add(1)
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -354,6 +359,13 @@ func (s *server) handleStore(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, fmt.Sprintf("revision conflict: expected %d, got %d", expected, currentRevision), http.StatusConflict)
 			return
 		}
+		if s.authMode != "off" && actor != "" {
+			if denied := forbiddenChanges(s.store, next, actor); len(denied) > 0 {
+				s.mu.Unlock()
+				http.Error(w, forbiddenMessage(actor, denied), http.StatusForbidden)
+				return
+			}
+		}
 		next["revision"] = float64(currentRevision + 1)
 		s.store = next
 		err := s.saveLocked()
@@ -369,45 +381,78 @@ func (s *server) handleStore(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *server) authorize(r *http.Request) error {
+// authorize authenticates r and returns the actor it acts as. The shared
+// ENVSYNC_SERVER_TOKEN maps to ENVSYNC_SERVER_TOKEN_ACTOR. Left empty, the
+// shared token is the only way to get an empty actor, and it keeps the full
+// access it had before team roles were enforced.
+func (s *server) authorize(r *http.Request) (string, error) {
 	switch s.authMode {
 	case "off":
-		return nil
+		return "", nil
 	case "token":
-		if s.validToken(r) {
-			return nil
+		if actor, ok := s.tokenAuth(r); ok {
+			return actor, nil
 		}
 	case "header":
-		if s.validHeaderAuth(r) {
-			return nil
+		if actor, ok := s.headerAuth(r); ok {
+			return actor, nil
 		}
 	case "token_or_header":
-		if s.validToken(r) || s.validHeaderAuth(r) {
-			return nil
+		if actor, ok := s.tokenAuth(r); ok {
+			return actor, nil
+		}
+		if actor, ok := s.headerAuth(r); ok {
+			return actor, nil
 		}
 	default:
-		return errors.New("server auth misconfigured")
+		return "", errors.New("server auth misconfigured")
 	}
-	return errors.New("unauthorized")
+	return "", errors.New("unauthorized")
 }
 
-func (s *server) validToken(r *http.Request) bool {
-	if s.token == "" {
-		return false
-	}
-	want := "Bearer " + s.token
+func (s *server) tokenAuth(r *http.Request) (string, bool) {
 	got := r.Header.Get("Authorization")
-	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+	if s.token != "" && subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+s.token)) == 1 {
+		return s.tokenActor, true
+	}
+	for actor, token := range s.actorTokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) == 1 {
+			return actor, true
+		}
+	}
+	return "", false
 }
 
-func (s *server) validHeaderAuth(r *http.Request) bool {
+func (s *server) headerAuth(r *http.Request) (string, bool) {
 	if s.authProxySecret != "" {
 		got := strings.TrimSpace(r.Header.Get("X-Envsync-Proxy-Secret"))
 		if subtle.ConstantTimeCompare([]byte(got), []byte(s.authProxySecret)) != 1 || got == "" {
-			return false
+			return "", false
+		}
+	}
+	actor := strings.TrimSpace(r.Header.Get(s.authHeader))
+	return actor, actor != ""
+}
+
+// parseActorTokens reads "actor=token" pairs separated by commas.
+func parseActorTokens(raw string) map[string]string {
+	tokens := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		actor, token, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		actor, token = strings.TrimSpace(actor), strings.TrimSpace(token)
+		if !ok || actor == "" || token == "" {
+			continue
 		}
+		tokens[actor] = token
+	}
+	return tokens
+}
+
+func forbiddenMessage(actor string, paths []string) string {
+	if actor == "" {
+		actor = "(anonymous)"
 	}
-	return strings.TrimSpace(r.Header.Get(s.authHeader)) != ""
+	return fmt.Sprintf("forbidden: actor %s may not change %s", actor, strings.Join(paths, ", "))
 }
 
 func authModeFromEnv(rawMode, token string) string {
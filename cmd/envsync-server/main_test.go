@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -177,3 +178,188 @@ func TestStoreLoadConcurrency(t *testing.T) {
 		}
 	}
 }
+
+func putStore(handler http.Handler, token string, revision int, store map[string]any) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(store)
+	r := httptest.NewRequest(http.MethodPut, "/v1/store", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("If-Match", strconv.Itoa(revision))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func teamStore(tokenValue string, role string) map[string]any {
+	return map[string]any{
+		"version": float64(1),
+		"teams": map[string]any{
+			"core": map[string]any{"name": "core", "members": map[string]any{"alice": "admin", "bob": role}},
+		},
+		"projects": map[string]any{
+			"api": map[string]any{
+				"name": "api",
+				"team": "core",
+				"envs": map[string]any{
+					"dev": map[string]any{"name": "dev", "vars": map[string]any{
+						"TOKEN": map[string]any{"current_version": float64(1), "cipher_b64": tokenValue},
+					}},
+				},
+			},
+			"scratch": map[string]any{"name": "scratch", "envs": map[string]any{}},
+		},
+	}
+}
+
+func TestStoreEnforcesTeamRoles(t *testing.T) {
+	s, handler := newTestServer(t)
+	s.authMode = "token"
+	s.actorTokens = map[string]string{"alice": "alice-token", "bob": "bob-token"}
+
+	if w := putStore(handler, "alice-token", 0, teamStore("v1", "reader")); w.Code != http.StatusOK {
+		t.Fatalf("admin seed: want 200, got %d %s", w.Code, w.Body.String())
+	}
+
+	w := putStore(handler, "bob-token", 1, teamStore("v2", "admin"))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("reader write: want 403, got %d", w.Code)
+	}
+	for _, path := range []string{"projects/api/envs/dev/vars/TOKEN", "teams/core/members/bob"} {
+		if !strings.Contains(w.Body.String(), path) {
+			t.Fatalf("expected %s in %q", path, w.Body.String())
+		}
+	}
+
+	untouched := teamStore("v1", "reader")
+	asMap(untouched["projects"])["scratch"] = map[string]any{"name": "scratch", "envs": map[string]any{"dev": map[string]any{}}}
+	if w := putStore(handler, "bob-token", 1, untouched); w.Code != http.StatusOK {
+		t.Fatalf("reader write to a project outside the team: want 200, got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := putStore(handler, "alice-token", 2, teamStore("v2", "maintainer")); w.Code != http.StatusOK {
+		t.Fatalf("admin write: want 200, got %d %s", w.Code, w.Body.String())
+	}
+	if w := putStore(handler, "bob-token", 3, teamStore("v3", "maintainer")); w.Code != http.StatusOK {
+		t.Fatalf("maintainer write: want 200, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStoreSharedTokenWithoutActorIsUnrestricted(t *testing.T) {
+	s, handler := newTestServer(t)
+	s.authMode = "token"
+	s.token = "shared"
+
+	if w := putStore(handler, "shared", 0, teamStore("v1", "reader")); w.Code != http.StatusOK {
+		t.Fatalf("seed: want 200, got %d %s", w.Code, w.Body.String())
+	}
+	if w := putStore(handler, "shared", 1, teamStore("v2", "admin")); w.Code != http.StatusOK {
+		t.Fatalf("shared token write: want 200, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Mapped to an actor, the shared token holds that actor's role.
+	s.tokenActor = "bob"
+	if w := putStore(handler, "shared", 2, teamStore("v3", "reader")); w.Code != http.StatusOK {
+		t.Fatalf("admin demoting themselves: want 200, got %d %s", w.Code, w.Body.String())
+	}
+	if w := putStore(handler, "shared", 3, teamStore("v4", "reader")); w.Code != http.StatusForbidden {
+		t.Fatalf("reader write through the shared token: want 403, got %d", w.Code)
+	}
+}
+
+func TestStoreEnforcesTeamRolesOnSealedProjects(t *testing.T) {
+	s, handler := newTestServer(t)
+	s.authMode = "token"
+	s.actorTokens = map[string]string{"alice": "alice-token", "bob": "bob-token"}
+
+	sealedStore := func(tokenValue string) map[string]any {
+		return map[string]any{
+			"version": float64(1),
+			"teams": map[string]any{
+				"core": map[string]any{"name": "core", "members": map[string]any{"alice": "admin", "bob": "reader"}},
+			},
+			"projects": map[string]any{
+				"sealed-0a1b2c": map[string]any{
+					"name":     "sealed-0a1b2c",
+					"team":     "core",
+					"sealed":   map[string]any{"id": "sealed-0a1b2c"},
+					"manifest": map[string]any{"nonce_b64": "bm9uY2U=", "cipher_b64": "bWFuaWZlc3Q="},
+					"envs": map[string]any{
+						"9f86d081": map[string]any{"name": "9f86d081", "vars": map[string]any{
+							"e3b0c442": map[string]any{"current_version": float64(1), "cipher_b64": tokenValue},
+						}},
+					},
+				},
+			},
+		}
+	}
+	if w := putStore(handler, "alice-token", 0, sealedStore("v1")); w.Code != http.StatusOK {
+		t.Fatalf("admin seed: want 200, got %d %s", w.Code, w.Body.String())
+	}
+	w := putStore(handler, "bob-token", 1, sealedStore("v2"))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("reader write to a sealed team project: want 403, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "projects/sealed-0a1b2c/envs/9f86d081/vars/e3b0c442") {
+		t.Fatalf("expected the sealed var path in %q", w.Body.String())
+	}
+}
+
+func TestStoreRequiresAdminForTeamAuthKeys(t *testing.T) {
+	s, handler := newTestServer(t)
+	s.authMode = "token"
+	s.actorTokens = map[string]string{"alice": "alice-token", "bob": "bob-token"}
+
+	authed := func(bobKey, mac string) map[string]any {
+		store := teamStore("v1", "maintainer")
+		core := asMap(asMap(store["teams"])["core"])
+		core["public_keys"] = map[string]any{"alice": "a", "bob": bobKey}
+		core["auth_key_id"] = "k1"
+		core["keys_mac"] = mac
+		return store
+	}
+	if w := putStore(handler, "alice-token", 0, authed("b", "m1")); w.Code != http.StatusOK {
+		t.Fatalf("admin seed: want 200, got %d %s", w.Code, w.Body.String())
+	}
+	w := putStore(handler, "bob-token", 1, authed("b2", "m2"))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("maintainer roster change: want 403, got %d", w.Code)
+	}
+	for _, path := range []string{"teams/core/public_keys/bob", "teams/core/keys_mac"} {
+		if !strings.Contains(w.Body.String(), path) {
+			t.Fatalf("expected %s in %q", path, w.Body.String())
+		}
+	}
+	if w := putStore(handler, "alice-token", 1, authed("b2", "m2")); w.Code != http.StatusOK {
+		t.Fatalf("admin roster change: want 200, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStoreRequiresAdminForVaultFields(t *testing.T) {
+	s, handler := newTestServer(t)
+	s.authMode = "token"
+	s.actorTokens = map[string]string{"alice": "alice-token", "bob": "bob-token"}
+
+	seed := teamStore("v1", "reader")
+	seed["salt_b64"] = "c2FsdA=="
+	seed["key_check_b64"] = "Y2hlY2s="
+	if w := putStore(handler, "alice-token", 0, seed); w.Code != http.StatusOK {
+		t.Fatalf("admin seed: want 200, got %d %s", w.Code, w.Body.String())
+	}
+
+	rekeyed := teamStore("v1", "reader")
+	rekeyed["salt_b64"] = "bmV3LXNhbHQ="
+	rekeyed["key_check_b64"] = "bmV3LWNoZWNr"
+	rekeyed["kdf"] = map[string]any{"algorithm": "argon2id", "time": float64(1)}
+	rekeyed["rekey"] = map[string]any{"previous_key_checks": []any{"Y2hlY2s="}}
+	w := putStore(handler, "bob-token", 1, rekeyed)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("reader re-key: want 403, got %d", w.Code)
+	}
+	for _, path := range []string{"salt_b64", "key_check_b64", "kdf", "rekey"} {
+		if !strings.Contains(w.Body.String(), path) {
+			t.Fatalf("expected %s in %q", path, w.Body.String())
+		}
+	}
+	if w := putStore(handler, "alice-token", 1, rekeyed); w.Code != http.StatusOK {
+		t.Fatalf("admin re-key: want 200, got %d %s", w.Code, w.Body.String())
+	}
+}
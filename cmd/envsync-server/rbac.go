@@ -0,0 +1,229 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Team roles as written by the CLI. writer is the legacy name for maintainer.
+const (
+	roleAdmin      = "admin"
+	roleMaintainer = "maintainer"
+	roleWriter     = "writer"
+	roleReader     = "reader"
+)
+
+func roleRank(role string) int {
+	switch role {
+	case roleAdmin:
+		return 3
+	case roleMaintainer, roleWriter:
+		return 2
+	case roleReader:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// storeDiff collects the paths an incoming store changes that the actor's
+// team role does not allow. Roles come from the stored teams, so a PUT cannot
+// grant itself the role it needs; only a team created by the same PUT is
+// judged by its own member list.
+type storeDiff struct {
+	actor  string
+	roles  map[string]map[string]any
+	denied []string
+}
+
+// vaultFields are the top-level fields that decide how every project in the
+// store is keyed. Changing one re-keys the vault, so it needs an admin of
+// every team that owns a project.
+var vaultFields = []string{"salt_b64", "key_check_b64", "kdf", "rekey"}
+
+// forbiddenChanges returns the offending paths of next relative to current,
+// sorted. Projects that do not belong to a team are not restricted.
+func forbiddenChanges(current, next map[string]any, actor string) []string {
+	d := &storeDiff{actor: actor, roles: map[string]map[string]any{}}
+	currentTeams, nextTeams := asMap(current["teams"]), asMap(next["teams"])
+	for name, team := range currentTeams {
+		d.roles[name] = asMap(asMap(team)["members"])
+	}
+	for name, team := range nextTeams {
+		if _, ok := d.roles[name]; !ok {
+			d.roles[name] = asMap(asMap(team)["members"])
+		}
+	}
+	d.teams(currentTeams, nextTeams)
+	d.projects(asMap(current["projects"]), asMap(next["projects"]))
+	d.vault(current, next)
+	sort.Strings(d.denied)
+	return d.denied
+}
+
+func (d *storeDiff) require(team, role, path string) {
+	if team == "" {
+		return
+	}
+	if roleRank(asString(d.roles[team][d.actor])) < roleRank(role) {
+		d.denied = append(d.denied, path)
+	}
+}
+
+func (d *storeDiff) teams(current, next map[string]any) {
+	for _, name := range unionKeys(current, next) {
+		path := "teams/" + name
+		cur, nxt := asMap(current[name]), asMap(next[name])
+		if current[name] == nil || next[name] == nil {
+			d.require(name, roleAdmin, path)
+			continue
+		}
+		curMembers, nextMembers := asMap(cur["members"]), asMap(nxt["members"])
+		for _, member := range unionKeys(curMembers, nextMembers) {
+			if !reflect.DeepEqual(curMembers[member], nextMembers[member]) {
+				d.require(name, roleAdmin, path+"/members/"+member)
+			}
+		}
+		// Members publish their own public key after a phrase rotation,
+		// except in teams whose roster an authentication key covers.
+		curKeys, nextKeys := asMap(cur["public_keys"]), asMap(nxt["public_keys"])
+		for _, member := range unionKeys(curKeys, nextKeys) {
+			if reflect.DeepEqual(curKeys[member], nextKeys[member]) {
+				continue
+			}
+			role := roleAdmin
+			if member == d.actor && nextKeys[member] != nil && cur["auth_key_id"] == nil {
+				role = roleReader
+			}
+			d.require(name, role, path+"/public_keys/"+member)
+		}
+		for _, field := range unionKeys(cur, nxt) {
+			switch field {
+			case "members", "public_keys":
+				continue
+			}
+			if !reflect.DeepEqual(cur[field], nxt[field]) {
+				d.require(name, roleAdmin, path+"/"+field)
+			}
+		}
+	}
+}
+
+func (d *storeDiff) vault(current, next map[string]any) {
+	owners := map[string]bool{}
+	for _, store := range []map[string]any{current, next} {
+		for _, project := range asMap(store["projects"]) {
+			if team := asString(asMap(project)["team"]); team != "" {
+				owners[team] = true
+			}
+		}
+	}
+	for _, field := range vaultFields {
+		if reflect.DeepEqual(current[field], next[field]) {
+			continue
+		}
+		for _, team := range sortedSet(owners) {
+			d.require(team, roleAdmin, field)
+		}
+	}
+}
+
+func (d *storeDiff) projects(current, next map[string]any) {
+	for _, name := range unionKeys(current, next) {
+		path := "projects/" + name
+		cur, nxt := asMap(current[name]), asMap(next[name])
+		team := asString(cur["team"])
+		if team == "" {
+			team = asString(nxt["team"])
+		}
+		switch {
+		case current[name] == nil:
+			d.require(team, roleMaintainer, path)
+			continue
+		case next[name] == nil:
+			d.require(team, roleAdmin, path)
+			continue
+		}
+		if curTeam := asString(cur["team"]); curTeam != "" && curTeam != asString(nxt["team"]) {
+			d.require(curTeam, roleAdmin, path+"/team")
+		}
+		for _, field := range unionKeys(cur, nxt) {
+			switch field {
+			case "envs", "team", "wrapped_keys":
+				continue
+			}
+			if !reflect.DeepEqual(cur[field], nxt[field]) {
+				d.require(team, roleAdmin, path+"/"+field)
+			}
+		}
+		sameKey := reflect.DeepEqual(cur["data_key_id"], nxt["data_key_id"])
+		curWrapped, nextWrapped := asMap(cur["wrapped_keys"]), asMap(nxt["wrapped_keys"])
+		for _, member := range unionKeys(curWrapped, nextWrapped) {
+			if reflect.DeepEqual(curWrapped[member], nextWrapped[member]) {
+				continue
+			}
+			role := roleAdmin
+			if member == d.actor && sameKey && nextWrapped[member] != nil {
+				role = roleReader
+			}
+			d.require(team, role, path+"/wrapped_keys/"+member)
+		}
+		d.envs(team, path, asMap(cur["envs"]), asMap(nxt["envs"]))
+	}
+}
+
+func (d *storeDiff) envs(team, projectPath string, current, next map[string]any) {
+	for _, name := range unionKeys(current, next) {
+		path := projectPath + "/envs/" + name
+		if current[name] == nil || next[name] == nil {
+			d.require(team, roleMaintainer, path)
+			continue
+		}
+		cur, nxt := asMap(current[name]), asMap(next[name])
+		for _, field := range unionKeys(cur, nxt) {
+			if field != "vars" && !reflect.DeepEqual(cur[field], nxt[field]) {
+				d.require(team, roleMaintainer, path+"/"+field)
+			}
+		}
+		curVars, nextVars := asMap(cur["vars"]), asMap(nxt["vars"])
+		for _, key := range unionKeys(curVars, nextVars) {
+			if !reflect.DeepEqual(curVars[key], nextVars[key]) {
+				d.require(team, roleMaintainer, path+"/vars/"+key)
+			}
+		}
+	}
+}
+
+func unionKeys(a, b map[string]any) []string {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, m := range []map[string]any{a, b} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func asMap(v any) map[string]any {
+	m, _ := v.(map[string]any)
+	return m
+}
+
+func asString(v any) string {
+	s, _ := v.(string)
+	return s
+}
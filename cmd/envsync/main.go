@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"envsync/internal/envsync"
 
@@ -17,7 +19,7 @@ import (
 var version = "dev"
 
 type runner interface {
-	Init() error
+	InitWith(opts envsync.InitOptions) error
 	Login() error
 	Logout() error
 	WhoAmI() error
@@ -25,32 +27,53 @@ type runner interface {
 	ProjectList() error
 	ProjectUse(name string) error
 	ProjectDelete(name string) error
+	ProjectBind(name, organizationID, teamID string) error
+	ProjectSeal(name string) error
 	TeamCreate(name string) error
 	TeamList() error
 	TeamUse(name string) error
-	TeamAddMember(teamName, actor, role string) error
+	TeamAddMemberWith(teamName, actor string, opts envsync.AddMemberOptions) error
 	TeamRemoveMember(teamName, actor string) error
 	TeamListMembers(teamName string) error
-	EnvCreate(name string) error
+	TeamKey() error
+	TeamJoin(teamName string) error
+	EnvCreateWith(name string, opts envsync.EnvCreateOptions) error
 	EnvUse(name string) error
 	EnvList() error
-	Set(keyName, value, expiresAt string) error
-	Rotate(keyName, value string) error
+	SetWith(keyName, value string, opts envsync.SetOptions) error
+	RotateWith(keyName, value string, opts envsync.RotateOptions) error
+	Generate(keyName string, opts envsync.GenerateOptions) error
 	Get(keyName string) error
 	Delete(keyName string) error
+	Edit(envName string) error
 	List(showValues bool) error
-	Load() error
-	ImportEnv(file string) error
-	ExportEnv(file string) error
+	LoadWith(opts envsync.LoadOptions) error
+	Hook(shell string) error
+	HookEval(shell string) error
+	RunWith(command []string, opts envsync.RunOptions) error
+	ImportEnvWith(file string, opts envsync.ImportOptions) error
+	ExportEnvWith(file string, opts envsync.ExportOptions) error
 	History(keyName string) error
 	Rollback(keyName string, version int) error
+	RollbackAll(to string) error
 	Diff() error
-	Push(force bool) error
-	Pull(forceRemote bool) error
+	PushWith(opts envsync.PushOptions) error
+	PullWith(opts envsync.PullOptions) error
+	Resolve(strategy string, reveal bool) error
 	PhraseSave() error
 	PhraseClear() error
+	PhraseRotate() error
+	PhraseUpgradeKDF(opts envsync.KDFOptions) error
+	Agent(opts envsync.AgentOptions) error
+	AgentLock() error
+	AgentUnlock() error
+	AgentStop() error
+	SchemaSet(file string) error
+	SchemaShow() error
+	Validate(envName string) error
 	Doctor() error
 	DoctorJSON() error
+	Audit(filter envsync.AuditFilter, remote, asJSON bool) error
 	Restore() error
 }
 
@@ -63,6 +86,18 @@ func fatal(err error) {
 	os.Exit(1)
 }
 
+// secretArg returns the value argument of set or rotate, which may be left
+// out only when --from-file supplies it.
+func secretArg(args []string, fromFile string) (string, error) {
+	if len(args) == 2 {
+		return args[1], nil
+	}
+	if fromFile == "" {
+		return "", errors.New("missing value: pass it as an argument, - to read stdin, or --from-file")
+	}
+	return "", nil
+}
+
 func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 	rootCmd := &cobra.Command{
 		Use:           "envsync",
@@ -75,13 +110,21 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 	}
 	rootCmd.SetOut(out)
 
-	rootCmd.AddCommand(&cobra.Command{
-		Use:   "init",
+	var initOpts envsync.InitOptions
+	initCmd := &cobra.Command{
+		Use:   "init [--kdf-memory <MiB>] [--kdf-time <n>]",
 		Short: "Initialize envsync",
+		Long: "Create local state and a new recovery phrase. The vault key is derived\n" +
+			"from the phrase with Argon2id (64 MiB, 1 pass by default); the parameters\n" +
+			"are stored with the vault so every device derives the same key.",
+		Example: "envsync init --kdf-memory 256 --kdf-time 3",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return app.Init()
+			return app.InitWith(initOpts)
 		},
-	})
+	}
+	initCmd.Flags().Uint32Var(&initOpts.KDF.MemoryMiB, "kdf-memory", 0, "Argon2id memory in MiB (default 64)")
+	initCmd.Flags().Uint32Var(&initOpts.KDF.Time, "kdf-time", 0, "Argon2id passes (default 1)")
+	rootCmd.AddCommand(initCmd)
 	var loginToken string
 	loginCmd := &cobra.Command{
 		Use:   "login [--token <token>]",
@@ -163,6 +206,32 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 			return app.ProjectDelete(args[0])
 		},
 	})
+	projectBindCmd := &cobra.Command{
+		Use:   "bind <name> [--org <id> | --team <id>]",
+		Short: "Store a project's cloud vault under an organization or team",
+		Long: "Route a project's cloud vault through an organization or team.\n" +
+			"Without --org or --team the project returns to your personal vault.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			orgID, _ := cmd.Flags().GetString("org")
+			teamID, _ := cmd.Flags().GetString("team")
+			return app.ProjectBind(args[0], orgID, teamID)
+		},
+	}
+	projectBindCmd.Flags().String("org", "", "Cloud organization ID that owns the vault")
+	projectBindCmd.Flags().String("team", "", "Cloud team ID that owns the vault")
+	projectBindCmd.MarkFlagsMutuallyExclusive("org", "team")
+	projectCmd.AddCommand(projectBindCmd)
+	projectCmd.AddCommand(&cobra.Command{
+		Use:   "seal <name>",
+		Short: "Hide a project's names from the remote",
+		Long: "Store the project's env and key names on the remote as opaque IDs.\n" +
+			"An encrypted manifest maps them back; the next push replaces the remote copy.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.ProjectSeal(args[0])
+		},
+	})
 
 	teamCmd := &cobra.Command{Use: "team", Short: "Manage teams"}
 	rootCmd.AddCommand(teamCmd)
@@ -190,17 +259,24 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 			return app.TeamUse(args[0])
 		},
 	})
-	teamCmd.AddCommand(&cobra.Command{
-		Use:   "add-member <team> <actor> <role>",
+	var addMemberOpts envsync.AddMemberOptions
+	teamAddMemberCmd := &cobra.Command{
+		Use:   "add-member <team> <actor> <role> [--public-key <key>]",
 		Short: "Add a member to a team",
-		Args:  cobra.ExactArgs(3),
+		Long: "Add a member and wrap every team project's data key for them.\n" +
+			"Pass the key printed by `envsync team key` on the member's device;\n" +
+			"it may only be omitted to change an existing member's role.",
+		Args: cobra.ExactArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return app.TeamAddMember(args[0], args[1], args[2])
+			addMemberOpts.Role = args[2]
+			return app.TeamAddMemberWith(args[0], args[1], addMemberOpts)
 		},
-	})
+	}
+	teamAddMemberCmd.Flags().StringVar(&addMemberOpts.PublicKey, "public-key", "", "Member public key from `envsync team key`")
+	teamCmd.AddCommand(teamAddMemberCmd)
 	teamCmd.AddCommand(&cobra.Command{
 		Use:   "remove-member <team> <actor>",
-		Short: "Remove a member from a team",
+		Short: "Remove a member from a team and rotate its data keys",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return app.TeamRemoveMember(args[0], args[1])
@@ -218,17 +294,39 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 			return app.TeamListMembers(teamName)
 		},
 	})
+	teamCmd.AddCommand(&cobra.Command{
+		Use:   "key",
+		Short: "Print this device's public key for team admins",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.TeamKey()
+		},
+	})
+	teamCmd.AddCommand(&cobra.Command{
+		Use:   "join <team>",
+		Short: "Fetch a team and its projects from the remote",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.TeamJoin(args[0])
+		},
+	})
 
 	envCmd := &cobra.Command{Use: "env", Short: "Manage environments"}
 	rootCmd.AddCommand(envCmd)
-	envCmd.AddCommand(&cobra.Command{
-		Use:   "create <name>",
+	var envCreateOpts envsync.EnvCreateOptions
+	envCreateCmd := &cobra.Command{
+		Use:   "create <name> [--inherit <env>]",
 		Short: "Create an environment",
-		Args:  cobra.ExactArgs(1),
+		Long: "Create an environment. With --inherit it resolves every key it does not\n" +
+			"set itself from the parent environment; its own values win.",
+		Example: "envsync env create staging --inherit base",
+		Args:    cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return app.EnvCreate(args[0])
+			return app.EnvCreateWith(args[0], envCreateOpts)
 		},
-	})
+	}
+	envCreateCmd.Flags().StringVar(&envCreateOpts.Parent, "inherit", "", "Parent environment to inherit keys from")
+	envCmd.AddCommand(envCreateCmd)
 	envCmd.AddCommand(&cobra.Command{
 		Use:   "use <name>",
 		Short: "Use an environment",
@@ -246,28 +344,71 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 		},
 	})
 
+	var setOpts envsync.SetOptions
 	setCmd := &cobra.Command{
-		Use:   "set <KEY> <value>",
+		Use:   "set <KEY> <value|-> [--from-file <path>] [--expires-at <time>] [--no-validate]",
 		Short: "Set a secret",
-		Args:  cobra.ExactArgs(2),
+		Long: "Set a secret. Pass - as the value to read it from stdin, or --from-file to\n" +
+			"read it byte for byte from a file, so it stays out of shell history and the\n" +
+			"process list.",
+		Args: cobra.RangeArgs(1, 2),
 		Example: "envsync set API_KEY secret --expires-at 24h\n" +
-			"ENVSYNC_RECOVERY_PHRASE='<phrase>' envsync set API_KEY secret",
+			"printf '%s' \"$TOKEN\" | envsync set API_KEY -\n" +
+			"envsync set TLS_CERT --from-file cert.pem",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			expiresAt, _ := cmd.Flags().GetString("expires-at")
-			return app.Set(args[0], args[1], expiresAt)
+			value, err := secretArg(args, setOpts.FromFile)
+			if err != nil {
+				return err
+			}
+			return app.SetWith(args[0], value, setOpts)
 		},
 	}
-	setCmd.Flags().String("expires-at", "", "Expiration time (RFC3339 format) or duration (e.g., 24h)")
+	setCmd.Flags().StringVar(&setOpts.FromFile, "from-file", "", "Read the value from a file")
+	setCmd.Flags().StringVar(&setOpts.ExpiresAt, "expires-at", "", "Expiration time (RFC3339 format) or duration (e.g., 24h)")
+	setCmd.Flags().BoolVar(&setOpts.NoValidate, "no-validate", false, "Store the value even if the schema rejects it")
 	rootCmd.AddCommand(setCmd)
 
-	rootCmd.AddCommand(&cobra.Command{
-		Use:   "rotate <KEY> <value>",
-		Short: "Rotate a secret",
-		Args:  cobra.ExactArgs(2),
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return app.Rotate(args[0], args[1])
+	var generateOpts envsync.GenerateOptions
+	generateCmd := &cobra.Command{
+		Use:   "generate <KEY> [--length <n>] [--charset alnum|hex|base64url|symbols] [--type <type>] [--rotate] [--print]",
+		Short: "Store a random secret without it touching shell history",
+		Long: "Generate a random value and store it as a new version of KEY. The value is\n" +
+			"not printed unless --print is given. Types: uuid, password, ed25519-keypair\n" +
+			"(also stores KEY_PUBLIC), rsa-pem (--length in bits) and jwt-secret\n" +
+			"(--length in bytes).",
+		Example: "envsync generate SESSION_SECRET\n" +
+			"envsync generate WEBHOOK_TOKEN --length 48 --charset base64url\n" +
+			"envsync generate SIGNING_KEY --type ed25519-keypair\n" +
+			"envsync generate DB_PASSWORD --type password --rotate",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.Generate(args[0], generateOpts)
 		},
-	})
+	}
+	generateCmd.Flags().IntVar(&generateOpts.Length, "length", 0, "Characters to generate (default 32); bits for rsa-pem, bytes for jwt-secret")
+	generateCmd.Flags().StringVar(&generateOpts.Charset, "charset", "", "Characters to draw from: alnum|hex|base64url|symbols (default: alnum)")
+	generateCmd.Flags().StringVar(&generateOpts.Type, "type", "", "Generate a uuid|password|ed25519-keypair|rsa-pem|jwt-secret instead")
+	generateCmd.Flags().BoolVar(&generateOpts.Rotate, "rotate", false, "Record the new version as a rotation of an existing key")
+	generateCmd.Flags().BoolVar(&generateOpts.Print, "print", false, "Print the generated value to stdout")
+	generateCmd.MarkFlagsMutuallyExclusive("charset", "type")
+	rootCmd.AddCommand(generateCmd)
+
+	var rotateOpts envsync.RotateOptions
+	rotateCmd := &cobra.Command{
+		Use:     "rotate <KEY> <value|-> [--from-file <path>]",
+		Short:   "Rotate a secret",
+		Args:    cobra.RangeArgs(1, 2),
+		Example: "envsync rotate DB_PASSWORD - < new-password.txt",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			value, err := secretArg(args, rotateOpts.FromFile)
+			if err != nil {
+				return err
+			}
+			return app.RotateWith(args[0], value, rotateOpts)
+		},
+	}
+	rotateCmd.Flags().StringVar(&rotateOpts.FromFile, "from-file", "", "Read the new value from a file")
+	rootCmd.AddCommand(rotateCmd)
 	rootCmd.AddCommand(&cobra.Command{
 		Use:   "get <KEY>",
 		Short: "Get a secret",
@@ -284,6 +425,21 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 			return app.Delete(args[0])
 		},
 	})
+	editCmd := &cobra.Command{
+		Use:   "edit [--env <name>]",
+		Short: "Edit an environment's secrets in $EDITOR",
+		Long: "Decrypt the environment into a private temporary dotenv file and open it in\n" +
+			"$VISUAL or $EDITOR. Added, changed and removed lines are applied as new\n" +
+			"versions when the editor exits; the file is overwritten and removed.",
+		Example: "EDITOR='code --wait' envsync edit --env staging",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			envName, _ := cmd.Flags().GetString("env")
+			return app.Edit(envName)
+		},
+	}
+	editCmd.Flags().String("env", "", "Environment to edit (defaults to the active environment)")
+	rootCmd.AddCommand(editCmd)
 
 	listCmd := &cobra.Command{
 		Use:   "list",
@@ -297,30 +453,102 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 	listCmd.Flags().Bool("show", false, "Show secret values")
 	rootCmd.AddCommand(listCmd)
 
-	rootCmd.AddCommand(&cobra.Command{
-		Use:   "load",
+	var loadOpts envsync.LoadOptions
+	loadCmd := &cobra.Command{
+		Use:   "load [--shell bash|zsh|fish|pwsh|nu] [--raw]",
 		Short: "Load secrets into shell exports",
-		Args:  cobra.NoArgs,
+		Example: "eval \"$(envsync load)\"\n" +
+			"envsync load --shell fish | source\n" +
+			"envsync load --shell pwsh | Out-String | Invoke-Expression\n" +
+			"envsync load --shell nu | from json | load-env",
+		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return app.Load()
+			return app.LoadWith(loadOpts)
 		},
-	})
-	rootCmd.AddCommand(&cobra.Command{
-		Use:   "import <file>",
+	}
+	loadCmd.Flags().StringVar(&loadOpts.Shell, "shell", "", "Shell to quote for: bash|zsh|fish|pwsh|nu (default: bash)")
+	loadCmd.Flags().BoolVar(&loadOpts.Raw, "raw", false, "Print values without expanding ${KEY} references")
+	rootCmd.AddCommand(loadCmd)
+	hookCmd := &cobra.Command{
+		Use:   "hook <bash|zsh|fish|pwsh|nu>",
+		Short: "Print a prompt hook that loads secrets in directories with .envsync.json",
+		Long: "Print a shell hook that loads the active environment of the project named\n" +
+			"in the nearest .envsync.json when you enter its directory, and unloads it\n" +
+			"when you leave. The recovery phrase must be saved with `envsync phrase save`\n" +
+			"or set in ENVSYNC_RECOVERY_PHRASE.",
+		Example: "echo 'eval \"$(envsync hook bash)\"' >> ~/.bashrc\n" +
+			"echo 'eval \"$(envsync hook zsh)\"' >> ~/.zshrc\n" +
+			"echo 'envsync hook fish | source' >> ~/.config/fish/config.fish\n" +
+			"Add-Content $PROFILE 'Invoke-Expression (& envsync hook pwsh | Out-String)'\n" +
+			"envsync hook nu | save --force ($nu.default-config-dir | path join envsync.nu)",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if eval, _ := cmd.Flags().GetBool("eval"); eval {
+				return app.HookEval(args[0])
+			}
+			return app.Hook(args[0])
+		},
+	}
+	hookCmd.Flags().Bool("eval", false, "Print the statements for the current directory (run by the hook)")
+	_ = hookCmd.Flags().MarkHidden("eval")
+	rootCmd.AddCommand(hookCmd)
+	var runOpts envsync.RunOptions
+	runCmd := &cobra.Command{
+		Use:   "run [--project <name>] [--env <name>] [--raw] -- <cmd> [args...]",
+		Short: "Run a command with secrets injected into its environment",
+		Args:  cobra.MinimumNArgs(1),
+		Example: "envsync run -- npm start\n" +
+			"envsync run --env prod -- ./migrate.sh --dry-run",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.RunWith(args, runOpts)
+		},
+	}
+	runCmd.Flags().StringVar(&runOpts.Project, "project", "", "Project to load secrets from (defaults to the active project)")
+	runCmd.Flags().StringVar(&runOpts.Env, "env", "", "Environment to load secrets from (defaults to the active environment)")
+	runCmd.Flags().BoolVar(&runOpts.Raw, "raw", false, "Pass values without expanding ${KEY} references")
+	runCmd.Flags().SetInterspersed(false)
+	rootCmd.AddCommand(runCmd)
+
+	var importOpts envsync.ImportOptions
+	importCmd := &cobra.Command{
+		Use:   "import <file> [--format dotenv|docker|json|yaml] [--dry-run] [--no-validate]",
 		Short: "Import environment variables from file",
-		Args:  cobra.ExactArgs(1),
+		Long: "Import keys from a dotenv, docker env-file, JSON or YAML file. The format\n" +
+			"is picked from the file extension unless --format is given. Keys whose\n" +
+			"value is unchanged are skipped; unusable lines are reported with their\n" +
+			"line numbers.",
+		Example: "envsync import .env\n" +
+			"envsync import secrets.json --dry-run\n" +
+			"envsync import prod.list --format docker",
+		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return app.ImportEnv(args[0])
+			return app.ImportEnvWith(args[0], importOpts)
 		},
-	})
-	rootCmd.AddCommand(&cobra.Command{
-		Use:   "export <file>",
+	}
+	importCmd.Flags().StringVar(&importOpts.Format, "format", "", "Input format: dotenv|docker|json|yaml (default: from extension)")
+	importCmd.Flags().BoolVar(&importOpts.DryRun, "dry-run", false, "Show added, changed and unchanged keys without writing")
+	importCmd.Flags().BoolVar(&importOpts.NoValidate, "no-validate", false, "Import values even if the schema rejects them")
+	rootCmd.AddCommand(importCmd)
+	var exportOpts envsync.ExportOptions
+	exportCmd := &cobra.Command{
+		Use:   "export <file|-> [--format <format>] [--name <name>] [--namespace <ns>] [--raw]",
 		Short: "Export environment variables to file",
-		Args:  cobra.ExactArgs(1),
+		Long: "Write the current environment as dotenv, json, yaml, k8s-secret, docker,\n" +
+			"systemd, tfvars or shell. The format is picked from the file extension\n" +
+			"unless --format is given; \"-\" writes to stdout.",
+		Example: "envsync export .env\n" +
+			"envsync export - --format k8s-secret --namespace prod | kubectl apply -f -\n" +
+			"envsync export prod.tfvars",
+		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return app.ExportEnv(args[0])
+			return app.ExportEnvWith(args[0], exportOpts)
 		},
-	})
+	}
+	exportCmd.Flags().StringVar(&exportOpts.Format, "format", "", "Output format: dotenv|json|yaml|k8s-secret|docker|systemd|tfvars|shell (default: from extension)")
+	exportCmd.Flags().StringVar(&exportOpts.Name, "name", "", "Secret name for k8s-secret (default: <project>-<env>)")
+	exportCmd.Flags().StringVar(&exportOpts.Namespace, "namespace", "", "Namespace for k8s-secret")
+	exportCmd.Flags().BoolVar(&exportOpts.Raw, "raw", false, "Write values without expanding ${KEY} references")
+	rootCmd.AddCommand(exportCmd)
 	rootCmd.AddCommand(&cobra.Command{
 		Use:   "version",
 		Short: "Show version",
@@ -341,10 +569,29 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 	})
 
 	rollbackCmd := &cobra.Command{
-		Use:   "rollback <KEY>",
+		Use:   "rollback <KEY> --version <n> | --all --to <time>",
 		Short: "Rollback a secret",
-		Args:  cobra.ExactArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
+		Long: "Rollback a secret to an earlier version, or with --all every key of the\n" +
+			"active environment to the version it had at --to. Keys created after that\n" +
+			"time are deleted.",
+		Example: "envsync rollback API_KEY --version 3\n" +
+			"envsync rollback --all --to 2h",
+		Args: cobra.RangeArgs(0, 1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			all, _ := cmd.Flags().GetBool("all")
+			to, _ := cmd.Flags().GetString("to")
+			if all {
+				if len(args) != 0 {
+					return fmt.Errorf("--all rolls back every key; drop the key argument")
+				}
+				if to == "" {
+					return fmt.Errorf("--to is required with --all")
+				}
+				return app.RollbackAll(to)
+			}
+			if len(args) != 1 {
+				return fmt.Errorf("pass a key, or --all --to <time>")
+			}
 			vStr, _ := cmd.Flags().GetString("version")
 			if vStr == "" {
 				return fmt.Errorf("--version is required")
@@ -357,6 +604,9 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 		},
 	}
 	rollbackCmd.Flags().String("version", "", "Version to rollback to")
+	rollbackCmd.Flags().Bool("all", false, "Roll back every key of the active environment")
+	rollbackCmd.Flags().String("to", "", "With --all: RFC3339 time or duration ago (e.g. 2h) to roll back to")
+	rollbackCmd.MarkFlagsMutuallyExclusive("all", "version")
 	rootCmd.AddCommand(rollbackCmd)
 
 	rootCmd.AddCommand(&cobra.Command{
@@ -368,34 +618,63 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 		},
 	})
 
+	var pushOpts envsync.PushOptions
 	pushCmd := &cobra.Command{
 		Use:   "push",
 		Short: "Push local changes to remote",
 		Args:  cobra.NoArgs,
 		Example: "envsync push\n" +
+			"envsync push --strategy newest\n" +
 			"ENVSYNC_RECOVERY_PHRASE='<phrase>' envsync push --force",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			force, _ := cmd.Flags().GetBool("force")
-			return app.Push(force)
+			return app.PushWith(pushOpts)
 		},
 	}
-	pushCmd.Flags().BoolP("force", "f", false, "Force push")
+	pushCmd.Flags().BoolVarP(&pushOpts.Force, "force", "f", false, "Force push")
+	pushCmd.Flags().StringVar(&pushOpts.Strategy, "strategy", "", "Resolve conflicting keys: ours|theirs|newest|prompt")
+	pushCmd.Flags().BoolVar(&pushOpts.Reveal, "reveal", false, "Show decrypted values when prompting")
+	pushCmd.Flags().BoolVar(&pushOpts.NoValidate, "no-validate", false, "Push even if the environment breaks the schema")
+	pushCmd.MarkFlagsMutuallyExclusive("force", "strategy")
 	rootCmd.AddCommand(pushCmd)
 
+	var pullOpts envsync.PullOptions
 	pullCmd := &cobra.Command{
 		Use:   "pull",
 		Short: "Pull remote changes to local",
 		Args:  cobra.NoArgs,
 		Example: "envsync pull\n" +
+			"envsync pull --strategy prompt --reveal\n" +
 			"ENVSYNC_RECOVERY_PHRASE='<phrase>' envsync pull --force-remote",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			forceRemote, _ := cmd.Flags().GetBool("force-remote")
-			return app.Pull(forceRemote)
+			return app.PullWith(pullOpts)
 		},
 	}
-	pullCmd.Flags().BoolP("force-remote", "f", false, "Force pull")
+	pullCmd.Flags().BoolVarP(&pullOpts.Force, "force-remote", "f", false, "Force pull")
+	pullCmd.Flags().StringVar(&pullOpts.Strategy, "strategy", "", "Resolve conflicting keys: ours|theirs|newest|prompt")
+	pullCmd.Flags().BoolVar(&pullOpts.Reveal, "reveal", false, "Show decrypted values when prompting")
+	pullCmd.MarkFlagsMutuallyExclusive("force-remote", "strategy")
 	rootCmd.AddCommand(pullCmd)
 
+	resolveCmd := &cobra.Command{
+		Use:   "resolve",
+		Short: "Settle keys changed both locally and remotely",
+		Long: "Pull the active environment, decide each conflicting key, and push\n" +
+			"the keys where the local value was kept. Each decision is recorded\n" +
+			"as a new version on top of the remote history.",
+		Args: cobra.NoArgs,
+		Example: "envsync resolve\n" +
+			"envsync resolve --reveal\n" +
+			"envsync resolve --strategy newest",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			strategy, _ := cmd.Flags().GetString("strategy")
+			reveal, _ := cmd.Flags().GetBool("reveal")
+			return app.Resolve(strategy, reveal)
+		},
+	}
+	resolveCmd.Flags().String("strategy", "prompt", "How to resolve conflicting keys: ours|theirs|newest|prompt")
+	resolveCmd.Flags().Bool("reveal", false, "Show decrypted values when prompting")
+	rootCmd.AddCommand(resolveCmd)
+
 	phraseCmd := &cobra.Command{Use: "phrase", Short: "Manage recovery phrase"}
 	rootCmd.AddCommand(phraseCmd)
 	phraseCmd.AddCommand(&cobra.Command{
@@ -412,6 +691,115 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 			return app.PhraseClear()
 		},
 	})
+	phraseCmd.AddCommand(&cobra.Command{
+		Use:   "rotate",
+		Short: "Replace the recovery phrase and re-encrypt every secret",
+		Long: "Verify the current recovery phrase, generate and show a new phrase and\n" +
+			"salt, ask for one of its words back, then re-encrypt every secret version\n" +
+			"locally and on the remote.\n" +
+			"Other devices must run `envsync restore` with the new phrase.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.PhraseRotate()
+		},
+	})
+	var kdfOpts envsync.KDFOptions
+	upgradeKDFCmd := &cobra.Command{
+		Use:   "upgrade-kdf [--kdf-memory <MiB>] [--kdf-time <n>]",
+		Short: "Re-derive the key with new KDF parameters and re-encrypt every secret",
+		Long: "Keep the recovery phrase but derive the vault key with a fresh salt and the\n" +
+			"given Argon2id cost, then re-encrypt every secret version locally and on the\n" +
+			"remote. Omitted flags keep the current cost, and lowering either is warned\n" +
+			"about. Other devices must run `envsync restore`.",
+		Example: "envsync phrase upgrade-kdf --kdf-memory 256 --kdf-time 3",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.PhraseUpgradeKDF(kdfOpts)
+		},
+	}
+	upgradeKDFCmd.Flags().Uint32Var(&kdfOpts.MemoryMiB, "kdf-memory", 0, "Argon2id memory in MiB (default: current)")
+	upgradeKDFCmd.Flags().Uint32Var(&kdfOpts.Time, "kdf-time", 0, "Argon2id passes (default: current)")
+	phraseCmd.AddCommand(upgradeKDFCmd)
+
+	var agentOpts envsync.AgentOptions
+	agentCmd := &cobra.Command{
+		Use:   "agent [--ttl <duration>]",
+		Short: "Keep the derived key in memory for other commands",
+		Long: "Run in the foreground and hold the key derived from the recovery phrase\n" +
+			"behind a 0600 Unix socket (ENVSYNC_AGENT_SOCK, default agent.sock in the\n" +
+			"config dir). Other commands ask it for the key instead of reading the phrase\n" +
+			"and re-running the KDF. The phrase itself is never stored or handed out.",
+		Example: "envsync agent --ttl 30m &\n" +
+			"envsync agent lock",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.Agent(agentOpts)
+		},
+	}
+	agentCmd.Flags().DurationVar(&agentOpts.TTL, "ttl", 15*time.Minute, "Forget the key after this long without a request (0 keeps it)")
+	agentCmd.AddCommand(&cobra.Command{
+		Use:   "lock",
+		Short: "Make the agent forget the key",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.AgentLock()
+		},
+	})
+	agentCmd.AddCommand(&cobra.Command{
+		Use:   "unlock",
+		Short: "Give the agent the recovery phrase to derive the key",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.AgentUnlock()
+		},
+	})
+	agentCmd.AddCommand(&cobra.Command{
+		Use:   "stop",
+		Short: "Make the agent forget the key and exit",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.AgentStop()
+		},
+	})
+	rootCmd.AddCommand(agentCmd)
+
+	schemaCmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Manage the project's secret schema",
+		Long: "A schema declares required keys per environment, value types (string, int,\n" +
+			"bool, url, email, json, regex, enum), a minimum length and a description.\n" +
+			"A committed .envsync.schema.yaml takes precedence over the stored schema.",
+	}
+	rootCmd.AddCommand(schemaCmd)
+	schemaCmd.AddCommand(&cobra.Command{
+		Use:     "set <file>",
+		Short:   "Store a schema with the active project (shared on push)",
+		Example: "envsync schema set .envsync.schema.yaml",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.SchemaSet(args[0])
+		},
+	})
+	schemaCmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "Print the schema that applies to the active project",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return app.SchemaShow()
+		},
+	})
+	validateCmd := &cobra.Command{
+		Use:     "validate [--env <name>]",
+		Short:   "Check decrypted values against the schema",
+		Example: "envsync validate --env prod",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			envName, _ := cmd.Flags().GetString("env")
+			return app.Validate(envName)
+		},
+	}
+	validateCmd.Flags().String("env", "", "Environment to check (defaults to the active environment)")
+	rootCmd.AddCommand(validateCmd)
 
 	doctorCmd := &cobra.Command{
 		Use:   "doctor",
@@ -427,6 +815,30 @@ func buildRootCmd(app runner, out io.Writer) *cobra.Command {
 	doctorCmd.Flags().Bool("json", false, "Output checks as JSON for automation")
 	rootCmd.AddCommand(doctorCmd)
 
+	var auditFilter envsync.AuditFilter
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Search the audit log",
+		Long: "List audit events newest first from the local audit log and its rotated\n" +
+			"files, or with --remote from the cloud vault of the current project.",
+		Example: "envsync audit --key PROD_DB_URL --since 2026-09-01\n" +
+			"envsync audit --remote --action secret_put --json",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			remote, _ := cmd.Flags().GetBool("remote")
+			asJSON, _ := cmd.Flags().GetBool("json")
+			return app.Audit(auditFilter, remote, asJSON)
+		},
+	}
+	auditCmd.Flags().Bool("remote", false, "Query cloud audit events instead of the local log")
+	auditCmd.Flags().StringVar(&auditFilter.Key, "key", "", "Only events that touched this key")
+	auditCmd.Flags().StringVar(&auditFilter.Action, "action", "", "Only events with this action (push, pull, set, ...)")
+	auditCmd.Flags().StringVar(&auditFilter.Actor, "actor", "", "Only events by this actor")
+	auditCmd.Flags().StringVar(&auditFilter.Since, "since", "", "Only events at or after this time (RFC 3339 or YYYY-MM-DD)")
+	auditCmd.Flags().StringVar(&auditFilter.Until, "until", "", "Only events before this time (RFC 3339 or YYYY-MM-DD)")
+	auditCmd.Flags().Bool("json", false, "Output events as JSON for automation")
+	rootCmd.AddCommand(auditCmd)
+
 	rootCmd.AddCommand(&cobra.Command{
 		Use:     "restore",
 		Short:   "Restore from remote",
@@ -445,6 +857,10 @@ func main() {
 		fatal(err)
 	}
 	if err := buildRootCmd(app, os.Stdout).Execute(); err != nil {
+		var exitErr *envsync.ExitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		fatal(err)
 	}
 }
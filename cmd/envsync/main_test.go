@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"strconv"
 	"strings"
 	"testing"
+
+	"envsync/internal/envsync"
 )
 
 type fakeRunner struct {
@@ -20,7 +24,11 @@ func newFakeRunner() *fakeRunner {
 
 func (f *fakeRunner) mark(name string) { f.calls[name]++ }
 
-func (f *fakeRunner) Init() error  { f.mark("Init"); return nil }
+func (f *fakeRunner) InitWith(opts envsync.InitOptions) error {
+	f.mark("InitWith")
+	f.lastKV["kdf"] = fmt.Sprintf("%d/%d", opts.KDF.MemoryMiB, opts.KDF.Time)
+	return nil
+}
 func (f *fakeRunner) Login() error { f.mark("Login"); return nil }
 func (f *fakeRunner) LoginWithToken(token string) error {
 	f.mark("LoginWithToken")
@@ -33,11 +41,21 @@ func (f *fakeRunner) ProjectCreate(name string) error { f.mark("ProjectCreate");
 func (f *fakeRunner) ProjectList() error              { f.mark("ProjectList"); return nil }
 func (f *fakeRunner) ProjectUse(name string) error    { f.mark("ProjectUse"); return nil }
 func (f *fakeRunner) ProjectDelete(name string) error { f.mark("ProjectDelete"); return nil }
-func (f *fakeRunner) TeamCreate(name string) error    { f.mark("TeamCreate"); return nil }
-func (f *fakeRunner) TeamList() error                 { f.mark("TeamList"); return nil }
-func (f *fakeRunner) TeamUse(name string) error       { f.mark("TeamUse"); return nil }
-func (f *fakeRunner) TeamAddMember(teamName, actor, role string) error {
-	f.mark("TeamAddMember")
+func (f *fakeRunner) ProjectSeal(name string) error   { f.mark("ProjectSeal"); return nil }
+func (f *fakeRunner) ProjectBind(name, organizationID, teamID string) error {
+	f.mark("ProjectBind")
+	f.lastKV["project"] = name
+	f.lastKV["org"] = organizationID
+	f.lastKV["team"] = teamID
+	return nil
+}
+func (f *fakeRunner) TeamCreate(name string) error { f.mark("TeamCreate"); return nil }
+func (f *fakeRunner) TeamList() error              { f.mark("TeamList"); return nil }
+func (f *fakeRunner) TeamUse(name string) error    { f.mark("TeamUse"); return nil }
+func (f *fakeRunner) TeamAddMemberWith(teamName, actor string, opts envsync.AddMemberOptions) error {
+	f.mark("TeamAddMemberWith")
+	f.lastKV["role"] = opts.Role
+	f.lastKV["public_key"] = opts.PublicKey
 	return nil
 }
 func (f *fakeRunner) TeamRemoveMember(teamName, actor string) error {
@@ -45,28 +63,134 @@ func (f *fakeRunner) TeamRemoveMember(teamName, actor string) error {
 	return nil
 }
 func (f *fakeRunner) TeamListMembers(teamName string) error { f.mark("TeamListMembers"); return nil }
-func (f *fakeRunner) EnvCreate(name string) error           { f.mark("EnvCreate"); return nil }
+func (f *fakeRunner) TeamKey() error                        { f.mark("TeamKey"); return nil }
+func (f *fakeRunner) TeamJoin(teamName string) error        { f.mark("TeamJoin"); return nil }
 func (f *fakeRunner) EnvUse(name string) error              { f.mark("EnvUse"); return nil }
 func (f *fakeRunner) EnvList() error                        { f.mark("EnvList"); return nil }
-func (f *fakeRunner) Rotate(keyName, value string) error    { f.mark("Rotate"); return nil }
 func (f *fakeRunner) Get(keyName string) error              { f.mark("Get"); return nil }
 func (f *fakeRunner) Delete(keyName string) error           { f.mark("Delete"); return nil }
 func (f *fakeRunner) List(showValues bool) error            { f.mark("List"); return nil }
-func (f *fakeRunner) Load() error                           { f.mark("Load"); return nil }
-func (f *fakeRunner) ImportEnv(file string) error           { f.mark("ImportEnv"); return nil }
-func (f *fakeRunner) ExportEnv(file string) error           { f.mark("ExportEnv"); return nil }
-func (f *fakeRunner) History(keyName string) error          { f.mark("History"); return nil }
-func (f *fakeRunner) Diff() error                           { f.mark("Diff"); return nil }
-func (f *fakeRunner) PhraseSave() error                     { f.mark("PhraseSave"); return nil }
-func (f *fakeRunner) PhraseClear() error                    { f.mark("PhraseClear"); return nil }
-func (f *fakeRunner) Doctor() error                         { f.mark("Doctor"); return nil }
-func (f *fakeRunner) DoctorJSON() error                     { f.mark("DoctorJSON"); return nil }
-func (f *fakeRunner) Restore() error                        { f.mark("Restore"); return nil }
-func (f *fakeRunner) Set(keyName, value, expiresAt string) error {
-	f.mark("Set")
+func (f *fakeRunner) EnvCreateWith(name string, opts envsync.EnvCreateOptions) error {
+	f.mark("EnvCreateWith")
+	f.lastKV["env"] = name
+	f.lastKV["parent"] = opts.Parent
+	return nil
+}
+func (f *fakeRunner) LoadWith(opts envsync.LoadOptions) error {
+	f.mark("LoadWith")
+	f.lastKV["shell"] = opts.Shell
+	f.lastKV["raw"] = strconv.FormatBool(opts.Raw)
+	return nil
+}
+func (f *fakeRunner) Hook(shell string) error {
+	f.mark("Hook")
+	f.lastKV["shell"] = shell
+	return nil
+}
+func (f *fakeRunner) HookEval(shell string) error {
+	f.mark("HookEval")
+	f.lastKV["shell"] = shell
+	return nil
+}
+func (f *fakeRunner) SchemaSet(file string) error {
+	f.mark("SchemaSet")
+	f.lastKV["file"] = file
+	return nil
+}
+func (f *fakeRunner) SchemaShow() error { f.mark("SchemaShow"); return nil }
+func (f *fakeRunner) RotateWith(keyName, value string, opts envsync.RotateOptions) error {
+	f.mark("RotateWith")
+	f.lastKV["key"] = keyName
+	f.lastKV["value"] = value
+	f.lastKV["from_file"] = opts.FromFile
+	return nil
+}
+func (f *fakeRunner) RollbackAll(to string) error {
+	f.mark("RollbackAll")
+	f.lastKV["to"] = to
+	return nil
+}
+func (f *fakeRunner) Agent(opts envsync.AgentOptions) error {
+	f.mark("Agent")
+	f.lastKV["ttl"] = opts.TTL.String()
+	return nil
+}
+func (f *fakeRunner) AgentLock() error   { f.mark("AgentLock"); return nil }
+func (f *fakeRunner) AgentUnlock() error { f.mark("AgentUnlock"); return nil }
+func (f *fakeRunner) AgentStop() error   { f.mark("AgentStop"); return nil }
+func (f *fakeRunner) Edit(envName string) error {
+	f.mark("Edit")
+	f.lastKV["env"] = envName
+	return nil
+}
+func (f *fakeRunner) Generate(keyName string, opts envsync.GenerateOptions) error {
+	f.mark("Generate")
+	f.lastKV["key"] = keyName
+	f.lastKV["length"] = strconv.Itoa(opts.Length)
+	f.lastKV["charset"] = opts.Charset
+	f.lastKV["type"] = opts.Type
+	f.lastKV["rotate"] = strconv.FormatBool(opts.Rotate)
+	f.lastKV["print"] = strconv.FormatBool(opts.Print)
+	return nil
+}
+func (f *fakeRunner) Validate(envName string) error {
+	f.mark("Validate")
+	f.lastKV["env"] = envName
+	return nil
+}
+func (f *fakeRunner) ExportEnvWith(file string, opts envsync.ExportOptions) error {
+	f.mark("ExportEnvWith")
+	f.lastKV["file"] = file
+	f.lastKV["format"] = opts.Format
+	f.lastKV["namespace"] = opts.Namespace
+	f.lastKV["raw"] = strconv.FormatBool(opts.Raw)
+	return nil
+}
+func (f *fakeRunner) RunWith(command []string, opts envsync.RunOptions) error {
+	f.mark("RunWith")
+	f.lastKV["project"] = opts.Project
+	f.lastKV["env"] = opts.Env
+	f.lastKV["raw"] = strconv.FormatBool(opts.Raw)
+	f.lastKV["command"] = strings.Join(command, " ")
+	return nil
+}
+func (f *fakeRunner) ImportEnvWith(file string, opts envsync.ImportOptions) error {
+	f.mark("ImportEnvWith")
+	f.lastKV["file"] = file
+	f.lastKV["format"] = opts.Format
+	f.lastKV["dry_run"] = strconv.FormatBool(opts.DryRun)
+	f.lastKV["no_validate"] = strconv.FormatBool(opts.NoValidate)
+	return nil
+}
+func (f *fakeRunner) History(keyName string) error { f.mark("History"); return nil }
+func (f *fakeRunner) Diff() error                  { f.mark("Diff"); return nil }
+func (f *fakeRunner) PhraseSave() error            { f.mark("PhraseSave"); return nil }
+func (f *fakeRunner) PhraseClear() error           { f.mark("PhraseClear"); return nil }
+func (f *fakeRunner) PhraseRotate() error          { f.mark("PhraseRotate"); return nil }
+func (f *fakeRunner) PhraseUpgradeKDF(opts envsync.KDFOptions) error {
+	f.mark("PhraseUpgradeKDF")
+	f.lastKV["kdf"] = fmt.Sprintf("%d/%d", opts.MemoryMiB, opts.Time)
+	return nil
+}
+func (f *fakeRunner) Doctor() error     { f.mark("Doctor"); return nil }
+func (f *fakeRunner) DoctorJSON() error { f.mark("DoctorJSON"); return nil }
+func (f *fakeRunner) Restore() error    { f.mark("Restore"); return nil }
+func (f *fakeRunner) Audit(filter envsync.AuditFilter, remote, asJSON bool) error {
+	f.mark("Audit")
+	f.lastKV["key"] = filter.Key
+	f.lastKV["action"] = filter.Action
+	f.lastKV["since"] = filter.Since
+	f.lastKV["remote"] = strconv.FormatBool(remote)
+	f.lastKV["json"] = strconv.FormatBool(asJSON)
+	return nil
+}
+func (f *fakeRunner) SetWith(keyName, value string, opts envsync.SetOptions) error {
+	f.mark("SetWith")
 	f.lastKV["key"] = keyName
 	f.lastKV["value"] = value
-	f.lastKV["expiresAt"] = expiresAt
+	f.lastKV["expiresAt"] = opts.ExpiresAt
+	f.lastKV["no_validate"] = strconv.FormatBool(opts.NoValidate)
+	f.lastKV["from_file"] = opts.FromFile
 	return nil
 }
 func (f *fakeRunner) Rollback(keyName string, version int) error {
@@ -75,18 +199,29 @@ func (f *fakeRunner) Rollback(keyName string, version int) error {
 	f.lastKV["version"] = "set"
 	return nil
 }
-func (f *fakeRunner) Push(force bool) error {
-	f.mark("Push")
-	if force {
+func (f *fakeRunner) PushWith(opts envsync.PushOptions) error {
+	f.mark("PushWith")
+	if opts.Force {
 		f.lastKV["force"] = "true"
 	}
+	f.lastKV["strategy"] = opts.Strategy
+	f.lastKV["no_validate"] = strconv.FormatBool(opts.NoValidate)
 	return nil
 }
-func (f *fakeRunner) Pull(forceRemote bool) error {
-	f.mark("Pull")
-	if forceRemote {
+func (f *fakeRunner) PullWith(opts envsync.PullOptions) error {
+	f.mark("PullWith")
+	if opts.Force {
 		f.lastKV["force_remote"] = "true"
 	}
+	f.lastKV["strategy"] = opts.Strategy
+	return nil
+}
+func (f *fakeRunner) Resolve(strategy string, reveal bool) error {
+	f.mark("Resolve")
+	f.lastKV["strategy"] = strategy
+	if reveal {
+		f.lastKV["reveal"] = "true"
+	}
 	return nil
 }
 
@@ -104,6 +239,29 @@ func TestRollbackRequiresVersionFlag(t *testing.T) {
 	}
 }
 
+func TestRollbackAllWiring(t *testing.T) {
+	r := newFakeRunner()
+	cmd := buildRootCmd(r, &bytes.Buffer{})
+	cmd.SetArgs([]string{"rollback", "--all", "--to", "2h"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	if r.calls["RollbackAll"] != 1 || r.lastKV["to"] != "2h" {
+		t.Fatalf("expected RollbackAll(2h), got %v %v", r.calls, r.lastKV)
+	}
+	for _, args := range [][]string{
+		{"rollback", "--all"},
+		{"rollback", "API_KEY", "--all", "--to", "2h"},
+		{"rollback", "--all", "--to", "2h", "--version", "3"},
+	} {
+		cmd := buildRootCmd(newFakeRunner(), &bytes.Buffer{})
+		cmd.SetArgs(args)
+		if err := cmd.Execute(); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
 func TestRollbackRejectsInvalidVersion(t *testing.T) {
 	r := newFakeRunner()
 	buf := &bytes.Buffer{}
@@ -126,9 +284,9 @@ func TestSetPushPullRestoreWiring(t *testing.T) {
 		args []string
 		call string
 	}{
-		{[]string{"set", "API_KEY", "secret", "--expires-at", "24h"}, "Set"},
-		{[]string{"push", "--force"}, "Push"},
-		{[]string{"pull", "--force-remote"}, "Pull"},
+		{[]string{"set", "API_KEY", "secret", "--expires-at", "24h"}, "SetWith"},
+		{[]string{"push", "--force"}, "PushWith"},
+		{[]string{"pull", "--force-remote"}, "PullWith"},
 		{[]string{"restore"}, "Restore"},
 	}
 
@@ -154,6 +312,249 @@ func TestSetPushPullRestoreWiring(t *testing.T) {
 	}
 }
 
+func TestEnvCreateInheritWiring(t *testing.T) {
+	r := newFakeRunner()
+	cmd := buildRootCmd(r, &bytes.Buffer{})
+	cmd.SetArgs([]string{"env", "create", "staging", "--inherit", "base"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	if r.calls["EnvCreateWith"] != 1 {
+		t.Fatalf("expected EnvCreateWith call, got %v", r.calls)
+	}
+	if r.lastKV["env"] != "staging" || r.lastKV["parent"] != "base" {
+		t.Fatalf("unexpected args: %v", r.lastKV)
+	}
+}
+
+func TestRawFlagsWiring(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"load", "--raw"}, "LoadWith"},
+		{[]string{"run", "--raw", "--", "env"}, "RunWith"},
+	}
+	for _, tc := range cases {
+		r := newFakeRunner()
+		cmd := buildRootCmd(r, &bytes.Buffer{})
+		cmd.SetArgs(tc.args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("%v: execute failed: %v", tc.args, err)
+		}
+		if r.calls[tc.want] != 1 || r.lastKV["raw"] != "true" {
+			t.Fatalf("%v: expected raw %s call, got %v %v", tc.args, tc.want, r.calls, r.lastKV)
+		}
+	}
+}
+
+func TestLoadShellAndHookWiring(t *testing.T) {
+	cases := []struct {
+		args  []string
+		want  string
+		shell string
+	}{
+		{[]string{"load", "--shell", "fish"}, "LoadWith", "fish"},
+		{[]string{"hook", "zsh"}, "Hook", "zsh"},
+		{[]string{"hook", "pwsh", "--eval"}, "HookEval", "pwsh"},
+	}
+	for _, tc := range cases {
+		r := newFakeRunner()
+		cmd := buildRootCmd(r, &bytes.Buffer{})
+		cmd.SetArgs(tc.args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("%v: execute failed: %v", tc.args, err)
+		}
+		if r.calls[tc.want] != 1 || r.lastKV["shell"] != tc.shell {
+			t.Fatalf("%v: expected %s(%s), got %v %v", tc.args, tc.want, tc.shell, r.calls, r.lastKV)
+		}
+	}
+}
+
+func TestSchemaAndNoValidateWiring(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+		kv   map[string]string
+	}{
+		{[]string{"schema", "set", "schema.yaml"}, "SchemaSet", map[string]string{"file": "schema.yaml"}},
+		{[]string{"schema", "show"}, "SchemaShow", nil},
+		{[]string{"validate", "--env", "prod"}, "Validate", map[string]string{"env": "prod"}},
+		{[]string{"set", "PORT", "abc", "--no-validate"}, "SetWith", map[string]string{"no_validate": "true"}},
+		{[]string{"push", "--no-validate"}, "PushWith", map[string]string{"no_validate": "true"}},
+		{[]string{"import", ".env", "--no-validate"}, "ImportEnvWith", map[string]string{"no_validate": "true"}},
+	}
+	for _, tc := range cases {
+		r := newFakeRunner()
+		cmd := buildRootCmd(r, &bytes.Buffer{})
+		cmd.SetArgs(tc.args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("%v: execute failed: %v", tc.args, err)
+		}
+		if r.calls[tc.want] != 1 {
+			t.Fatalf("%v: expected %s call, got %v", tc.args, tc.want, r.calls)
+		}
+		for k, v := range tc.kv {
+			if r.lastKV[k] != v {
+				t.Fatalf("%v: expected %s=%s, got %v", tc.args, k, v, r.lastKV)
+			}
+		}
+	}
+}
+
+func TestGenerateFlagsWiring(t *testing.T) {
+	r := newFakeRunner()
+	cmd := buildRootCmd(r, &bytes.Buffer{})
+	cmd.SetArgs([]string{"generate", "TOKEN", "--length", "48", "--charset", "hex", "--rotate", "--print"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	want := map[string]string{"key": "TOKEN", "length": "48", "charset": "hex", "type": "", "rotate": "true", "print": "true"}
+	for k, v := range want {
+		if r.lastKV[k] != v {
+			t.Fatalf("expected %s=%q, got %v", k, v, r.lastKV)
+		}
+	}
+
+	cmd = buildRootCmd(newFakeRunner(), &bytes.Buffer{})
+	cmd.SetArgs([]string{"generate", "TOKEN", "--charset", "hex", "--type", "uuid"})
+	if err := cmd.Execute(); err == nil {
+		t.Fatal("expected --charset and --type to be mutually exclusive")
+	}
+}
+
+func TestSecretInputWiring(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+		kv   map[string]string
+	}{
+		{[]string{"set", "API_KEY", "-"}, "SetWith", map[string]string{"key": "API_KEY", "value": "-", "from_file": ""}},
+		{[]string{"set", "TLS_CERT", "--from-file", "cert.pem"}, "SetWith", map[string]string{"value": "", "from_file": "cert.pem"}},
+		{[]string{"rotate", "DB_PASSWORD", "-"}, "RotateWith", map[string]string{"key": "DB_PASSWORD", "value": "-"}},
+		{[]string{"rotate", "TLS_CERT", "--from-file", "new.pem"}, "RotateWith", map[string]string{"from_file": "new.pem"}},
+		{[]string{"edit", "--env", "staging"}, "Edit", map[string]string{"env": "staging"}},
+	}
+	for _, tc := range cases {
+		r := newFakeRunner()
+		cmd := buildRootCmd(r, &bytes.Buffer{})
+		cmd.SetArgs(tc.args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("%v: execute failed: %v", tc.args, err)
+		}
+		if r.calls[tc.want] != 1 {
+			t.Fatalf("%v: expected %s call, got %v", tc.args, tc.want, r.calls)
+		}
+		for k, v := range tc.kv {
+			if r.lastKV[k] != v {
+				t.Fatalf("%v: expected %s=%q, got %v", tc.args, k, v, r.lastKV)
+			}
+		}
+	}
+
+	cmd := buildRootCmd(newFakeRunner(), &bytes.Buffer{})
+	cmd.SetArgs([]string{"rotate", "DB_PASSWORD"})
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "missing value") {
+		t.Fatalf("expected rotate without a value to fail, got %v", err)
+	}
+}
+
+func TestAgentWiring(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+		ttl  string
+	}{
+		{[]string{"agent"}, "Agent", "15m0s"},
+		{[]string{"agent", "--ttl", "1h"}, "Agent", "1h0m0s"},
+		{[]string{"agent", "lock"}, "AgentLock", ""},
+		{[]string{"agent", "unlock"}, "AgentUnlock", ""},
+		{[]string{"agent", "stop"}, "AgentStop", ""},
+	}
+	for _, tc := range cases {
+		r := newFakeRunner()
+		cmd := buildRootCmd(r, &bytes.Buffer{})
+		cmd.SetArgs(tc.args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("%v: execute failed: %v", tc.args, err)
+		}
+		if r.calls[tc.want] != 1 || r.lastKV["ttl"] != tc.ttl {
+			t.Fatalf("%v: expected %s (ttl %q), got %v %v", tc.args, tc.want, tc.ttl, r.calls, r.lastKV)
+		}
+	}
+}
+
+func TestKDFFlagsWiring(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+		kdf  string
+	}{
+		{[]string{"init"}, "InitWith", "0/0"},
+		{[]string{"init", "--kdf-memory", "256", "--kdf-time", "3"}, "InitWith", "256/3"},
+		{[]string{"phrase", "upgrade-kdf", "--kdf-memory", "128"}, "PhraseUpgradeKDF", "128/0"},
+	}
+	for _, tc := range cases {
+		r := newFakeRunner()
+		cmd := buildRootCmd(r, &bytes.Buffer{})
+		cmd.SetArgs(tc.args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("%v: execute failed: %v", tc.args, err)
+		}
+		if r.calls[tc.want] != 1 || r.lastKV["kdf"] != tc.kdf {
+			t.Fatalf("%v: expected %s (kdf %q), got %v %v", tc.args, tc.want, tc.kdf, r.calls, r.lastKV)
+		}
+	}
+}
+
+func TestImportFlagsWiring(t *testing.T) {
+	r := newFakeRunner()
+	cmd := buildRootCmd(r, &bytes.Buffer{})
+	cmd.SetArgs([]string{"import", "prod.list", "--format", "docker", "--dry-run"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	if r.calls["ImportEnvWith"] != 1 {
+		t.Fatalf("expected ImportEnvWith call, got %v", r.calls)
+	}
+	if r.lastKV["file"] != "prod.list" || r.lastKV["format"] != "docker" || r.lastKV["dry_run"] != "true" {
+		t.Fatalf("unexpected args: %v", r.lastKV)
+	}
+}
+
+func TestExportFlagsWiring(t *testing.T) {
+	r := newFakeRunner()
+	cmd := buildRootCmd(r, &bytes.Buffer{})
+	cmd.SetArgs([]string{"export", "-", "--format", "k8s-secret", "--namespace", "prod", "--raw"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	want := map[string]string{"file": "-", "format": "k8s-secret", "namespace": "prod", "raw": "true"}
+	for k, v := range want {
+		if r.lastKV[k] != v {
+			t.Fatalf("%s = %q, want %q", k, r.lastKV[k], v)
+		}
+	}
+}
+
+func TestAuditFlagsWiring(t *testing.T) {
+	r := newFakeRunner()
+	cmd := buildRootCmd(r, &bytes.Buffer{})
+	cmd.SetArgs([]string{"audit", "--remote", "--key", "PROD_DB_URL", "--action", "push", "--since", "2026-09-01", "--json"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	if r.calls["Audit"] != 1 {
+		t.Fatalf("expected Audit call, got %d", r.calls["Audit"])
+	}
+	want := map[string]string{"key": "PROD_DB_URL", "action": "push", "since": "2026-09-01", "remote": "true", "json": "true"}
+	for k, v := range want {
+		if r.lastKV[k] != v {
+			t.Fatalf("%s = %q, want %q", k, r.lastKV[k], v)
+		}
+	}
+}
+
 func TestDoctorJSONWiring(t *testing.T) {
 	r := newFakeRunner()
 	buf := &bytes.Buffer{}
@@ -196,7 +597,7 @@ func TestCommandArgValidation(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected args validation error")
 	}
-	if !strings.Contains(err.Error(), "accepts 2 arg") {
+	if !strings.Contains(err.Error(), "missing value") {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
@@ -244,3 +645,87 @@ func TestLoginTokenFlagUsesTokenAwareRunner(t *testing.T) {
 		t.Fatalf("expected token to be forwarded, got %q", got)
 	}
 }
+
+func TestRunPassesCommandAfterDash(t *testing.T) {
+	r := newFakeRunner()
+	buf := &bytes.Buffer{}
+	cmd := buildRootCmd(r, buf)
+	cmd.SetArgs([]string{"run", "--env", "prod", "--", "sh", "-c", "echo $TOKEN", "--env", "x"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if r.calls["RunWith"] != 1 {
+		t.Fatalf("expected RunWith call, got %d", r.calls["RunWith"])
+	}
+	if got := r.lastKV["env"]; got != "prod" {
+		t.Fatalf("expected env prod, got %q", got)
+	}
+	if got := r.lastKV["command"]; got != "sh -c echo $TOKEN --env x" {
+		t.Fatalf("unexpected command %q", got)
+	}
+}
+
+func TestProjectBindFlags(t *testing.T) {
+	r := newFakeRunner()
+	cmd := buildRootCmd(r, &bytes.Buffer{})
+	cmd.SetArgs([]string{"project", "bind", "api", "--team", "team_123"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("project bind failed: %v", err)
+	}
+	if r.lastKV["project"] != "api" || r.lastKV["team"] != "team_123" || r.lastKV["org"] != "" {
+		t.Fatalf("unexpected bind args %+v", r.lastKV)
+	}
+
+	cmd = buildRootCmd(newFakeRunner(), &bytes.Buffer{})
+	cmd.SetArgs([]string{"project", "bind", "api", "--team", "t", "--org", "o"})
+	if err := cmd.Execute(); err == nil {
+		t.Fatal("expected --org and --team to be mutually exclusive")
+	}
+}
+
+func TestConflictStrategyWiring(t *testing.T) {
+	tests := []struct {
+		args     []string
+		call     string
+		strategy string
+	}{
+		{[]string{"push", "--strategy", "newest"}, "PushWith", "newest"},
+		{[]string{"pull", "--strategy", "theirs"}, "PullWith", "theirs"},
+		{[]string{"resolve", "--reveal"}, "Resolve", "prompt"},
+	}
+	for _, tc := range tests {
+		r := newFakeRunner()
+		cmd := buildRootCmd(r, &bytes.Buffer{})
+		cmd.SetArgs(tc.args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("execute %v: %v", tc.args, err)
+		}
+		if r.calls[tc.call] != 1 {
+			t.Fatalf("expected %s to be called for %v", tc.call, tc.args)
+		}
+		if got := r.lastKV["strategy"]; got != tc.strategy {
+			t.Fatalf("expected strategy %q for %v, got %q", tc.strategy, tc.args, got)
+		}
+	}
+
+	cmd := buildRootCmd(newFakeRunner(), &bytes.Buffer{})
+	cmd.SetArgs([]string{"push", "--force", "--strategy", "ours"})
+	if err := cmd.Execute(); err == nil {
+		t.Fatal("expected --force and --strategy to be mutually exclusive")
+	}
+}
+
+func TestTeamAddMemberPublicKeyFlag(t *testing.T) {
+	r := newFakeRunner()
+	cmd := buildRootCmd(r, &bytes.Buffer{})
+	cmd.SetArgs([]string{"team", "add-member", "core", "alice", "writer", "--public-key", "cHVi"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("add-member failed: %v", err)
+	}
+	if r.calls["TeamAddMemberWith"] != 1 {
+		t.Fatalf("expected TeamAddMemberWith, got %+v", r.calls)
+	}
+	if r.lastKV["role"] != "writer" || r.lastKV["public_key"] != "cHVi" {
+		t.Fatalf("unexpected add-member args %+v", r.lastKV)
+	}
+}
@@ -2,17 +2,19 @@ module envsync
 
 go 1.25.0
 
-require golang.org/x/crypto v0.48.0
+require (
+	github.com/coreos/go-oidc/v3 v3.17.0
+	github.com/jackc/pgx/v5 v5.8.0
+	github.com/spf13/cobra v1.10.2
+	golang.org/x/crypto v0.48.0
+)
 
 require (
-	github.com/coreos/go-oidc/v3 v3.17.0 // indirect
 	github.com/go-jose/go-jose/v4 v4.1.3 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
-	github.com/jackc/pgx/v5 v5.8.0 // indirect
 	github.com/jackc/puddle/v2 v2.2.2 // indirect
-	github.com/spf13/cobra v1.10.2 // indirect
 	github.com/spf13/pflag v1.0.10 // indirect
 	golang.org/x/oauth2 v0.28.0 // indirect
 	golang.org/x/sync v0.19.0 // indirect
@@ -0,0 +1,314 @@
+package envsync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	agentOpKey    = "key"
+	agentOpLock   = "lock"
+	agentOpUnlock = "unlock"
+	agentOpStop   = "stop"
+
+	// agentTimeout bounds one request; unlock runs the KDF.
+	agentTimeout = 30 * time.Second
+)
+
+// AgentOptions controls envsync agent. The agent locks itself after TTL
+// without a key request; zero keeps the key until lock or stop.
+type AgentOptions struct {
+	TTL time.Duration
+}
+
+// agentRequest is one request on the agent socket. Salt and KeyCheck name
+// the state a key request is for; Phrase is only sent with unlock.
+type agentRequest struct {
+	Op       string `json:"op"`
+	Salt     string `json:"salt,omitempty"`
+	KeyCheck string `json:"key_check,omitempty"`
+	Phrase   string `json:"phrase,omitempty"`
+}
+
+type agentResponse struct {
+	Error  string `json:"error,omitempty"`
+	Locked bool   `json:"locked,omitempty"`
+	Key    []byte `json:"key,omitempty"`
+}
+
+// keyAgent holds one derived vault key in locked memory. The recovery
+// phrase is only used to derive the key at unlock and never stored.
+type keyAgent struct {
+	mu       sync.Mutex
+	key      []byte
+	salt     string
+	keyCheck string
+	ttl      time.Duration
+	idle     *time.Timer
+}
+
+// Agent serves the derived vault key on a.AgentSocket until `envsync agent
+// stop` or a signal. It unlocks at start when the recovery phrase is stored
+// or typed at the prompt, and otherwise waits for `envsync agent unlock`.
+func (a *App) Agent(opts AgentOptions) error {
+	if a.AgentSocket == "" {
+		return errors.New("no agent socket configured")
+	}
+	if _, err := a.agentCall(agentRequest{Op: agentOpKey}); err == nil {
+		return fmt.Errorf("an agent is already listening on %s", a.AgentSocket)
+	}
+	if err := os.MkdirAll(filepath.Dir(a.AgentSocket), 0o700); err != nil {
+		return err
+	}
+	// Nothing answered, so a socket file left here is stale.
+	_ = os.Remove(a.AgentSocket)
+	ln, err := net.Listen("unix", a.AgentSocket)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	if err := os.Chmod(a.AgentSocket, 0o600); err != nil {
+		return err
+	}
+
+	agent := &keyAgent{ttl: opts.TTL}
+	defer agent.lock()
+	if phrase, err := a.readPhrase(); err != nil {
+		fmt.Fprintln(a.Stderr, cWarn("starting locked (%v); run `envsync agent unlock`", err))
+	} else if err := agent.unlock(a, phrase); err != nil {
+		fmt.Fprintln(a.Stderr, cWarn("starting locked: %v", err))
+	}
+	ttl := "no idle timeout"
+	if opts.TTL > 0 {
+		ttl = "locks after " + opts.TTL.String() + " idle"
+	}
+	fmt.Fprintf(a.Stdout, "%s on %s %s\n", cSuccess("envsync agent listening"), cBold(a.AgentSocket), cDim("("+ttl+")"))
+
+	var stopping sync.Once
+	stop := func() { stopping.Do(func() { ln.Close() }) }
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			stop()
+		}
+	}()
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				fmt.Fprintln(a.Stdout, cDim("envsync agent stopped"))
+				return nil
+			}
+			return err
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			if agent.serve(a, conn) {
+				stop()
+			}
+		}()
+	}
+}
+
+// serve answers one request and reports whether it asked the agent to stop.
+func (ag *keyAgent) serve(a *App, conn net.Conn) bool {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(agentTimeout))
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return false
+	}
+	var resp agentResponse
+	switch req.Op {
+	case agentOpKey:
+		resp = ag.keyFor(req.Salt, req.KeyCheck)
+	case agentOpUnlock:
+		if err := ag.unlock(a, req.Phrase); err != nil {
+			resp.Error = err.Error()
+		}
+	case agentOpLock, agentOpStop:
+		ag.lock()
+	default:
+		resp.Error = fmt.Sprintf("unknown request %q", req.Op)
+	}
+	_ = json.NewEncoder(conn).Encode(resp)
+	return req.Op == agentOpStop
+}
+
+// unlock derives the vault key of the current state from phrase.
+func (ag *keyAgent) unlock(a *App, phrase string) error {
+	if phrase == "" {
+		return errors.New("recovery phrase cannot be empty")
+	}
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	salt, err := base64.StdEncoding.DecodeString(state.SaltB64)
+	if err != nil {
+		return err
+	}
+	derived, err := deriveKey(phrase, salt, state.KDF)
+	if err != nil {
+		return err
+	}
+	defer clear(derived)
+	expected, err := base64.StdEncoding.DecodeString(state.KeyCheckB64)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, keyCheck(derived)) {
+		return errors.New("invalid recovery phrase")
+	}
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.wipe()
+	ag.key = make([]byte, len(derived))
+	if err := lockMemory(ag.key); err != nil {
+		fmt.Fprintln(a.Stderr, cWarn("could not lock the key in memory: %v", err))
+	}
+	copy(ag.key, derived)
+	ag.salt, ag.keyCheck = state.SaltB64, state.KeyCheckB64
+	ag.touch()
+	return nil
+}
+
+// keyFor returns the key if the agent holds the one for salt and keyCheck.
+func (ag *keyAgent) keyFor(salt, keyCheck string) agentResponse {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	switch {
+	case ag.key == nil:
+		return agentResponse{Locked: true}
+	case salt != ag.salt || keyCheck != ag.keyCheck:
+		return agentResponse{Error: "agent holds the key of a different state; run `envsync agent unlock`"}
+	}
+	ag.touch()
+	// Copy, so the response is not wiped by a lock while it is encoded.
+	return agentResponse{Key: bytes.Clone(ag.key)}
+}
+
+func (ag *keyAgent) lock() {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.wipe()
+}
+
+// wipe zeroes and forgets the key. Callers hold mu.
+func (ag *keyAgent) wipe() {
+	if ag.idle != nil {
+		ag.idle.Stop()
+		ag.idle = nil
+	}
+	if ag.key != nil {
+		clear(ag.key)
+		_ = unlockMemory(ag.key)
+		ag.key = nil
+	}
+}
+
+// touch restarts the idle timer. Callers hold mu.
+func (ag *keyAgent) touch() {
+	if ag.ttl <= 0 {
+		return
+	}
+	if ag.idle != nil {
+		ag.idle.Stop()
+	}
+	ag.idle = time.AfterFunc(ag.ttl, ag.lock)
+}
+
+// agentCall sends one request to the agent on a.AgentSocket. The error is
+// about reaching the agent; what the agent refused is in the response.
+func (a *App) agentCall(req agentRequest) (*agentResponse, error) {
+	if a.AgentSocket == "" {
+		return nil, errors.New("no agent socket configured")
+	}
+	conn, err := net.DialTimeout("unix", a.AgentSocket, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("no agent on %s: %w", a.AgentSocket, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(agentTimeout))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp agentResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// agentKey returns the vault key for state from a running, unlocked agent,
+// or nil so the caller falls back to the recovery phrase.
+func (a *App) agentKey(state *State) []byte {
+	if a.AgentSocket == "" {
+		return nil
+	}
+	resp, err := a.agentCall(agentRequest{Op: agentOpKey, Salt: state.SaltB64, KeyCheck: state.KeyCheckB64})
+	if err != nil || resp.Error != "" || resp.Locked {
+		return nil
+	}
+	expected, err := base64.StdEncoding.DecodeString(state.KeyCheckB64)
+	if err != nil || !hmac.Equal(expected, keyCheck(resp.Key)) {
+		return nil
+	}
+	return resp.Key
+}
+
+// AgentUnlock reads the recovery phrase and hands it to the running agent,
+// which derives and keeps the key.
+func (a *App) AgentUnlock() error {
+	// Make sure an agent is listening before prompting.
+	if _, err := a.agentCall(agentRequest{Op: agentOpKey}); err != nil {
+		return err
+	}
+	phrase, err := a.readPhrase()
+	if err != nil {
+		return err
+	}
+	resp, err := a.agentCall(agentRequest{Op: agentOpUnlock, Phrase: phrase})
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	fmt.Fprintln(a.Stdout, cSuccess("agent unlocked"))
+	return nil
+}
+
+// AgentLock makes the running agent forget its key.
+func (a *App) AgentLock() error {
+	if _, err := a.agentCall(agentRequest{Op: agentOpLock}); err != nil {
+		return err
+	}
+	fmt.Fprintln(a.Stdout, cSuccess("agent locked"))
+	return nil
+}
+
+// AgentStop makes the running agent forget its key and exit.
+func (a *App) AgentStop() error {
+	if _, err := a.agentCall(agentRequest{Op: agentOpStop}); err != nil {
+		return err
+	}
+	fmt.Fprintln(a.Stdout, cSuccess("agent stopped"))
+	return nil
+}
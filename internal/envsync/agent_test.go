@@ -0,0 +1,111 @@
+//go:build !windows
+// +build !windows
+
+package envsync
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAgent runs an agent for app's state and returns once it listens.
+func startAgent(t *testing.T, app *App, ttl time.Duration) <-chan error {
+	t.Helper()
+	// Unix socket paths are short; t.TempDir can be too long on macOS.
+	dir, err := os.MkdirTemp("", "esa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	app.AgentSocket = filepath.Join(dir, "agent.sock")
+	agent := cloneApp(app)
+	done := make(chan error, 1)
+	go func() { done <- agent.Agent(AgentOptions{TTL: ttl}) }()
+	for range 100 {
+		if conn, err := net.Dial("unix", app.AgentSocket); err == nil {
+			conn.Close()
+			return done
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("agent did not start")
+	return nil
+}
+
+func TestAgentServesKeyUntilLockedOrStopped(t *testing.T) {
+	app, _ := newTestApp(t)
+	phrase := os.Getenv("ENVSYNC_RECOVERY_PHRASE")
+	setAll(t, app, "TOKEN", "abc")
+	done := startAgent(t, app, time.Minute)
+	if info, err := os.Stat(app.AgentSocket); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected a 0600 socket, got %v %v", info, err)
+	}
+	if err := cloneApp(app).Agent(AgentOptions{}); err == nil || !strings.Contains(err.Error(), "already listening") {
+		t.Fatalf("expected a second agent to refuse, got %v", err)
+	}
+
+	// Without a phrase the client can only decrypt through the agent.
+	t.Setenv("ENVSYNC_RECOVERY_PHRASE", "")
+	client := cloneApp(app)
+	client.phraseCache, client.vaultKeyFor, client.vaultKey = "", "", nil
+	if got := activeValuesFor(t, client)["TOKEN"]; got != "abc" {
+		t.Fatalf("TOKEN through the agent = %q", got)
+	}
+
+	if err := client.AgentLock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if err := client.Set("TOKEN", "def", ""); err == nil {
+		t.Fatal("expected a locked agent and no phrase to fail")
+	}
+
+	client.Stdin = strings.NewReader("wrong words\n")
+	if err := client.AgentUnlock(); err == nil || !strings.Contains(err.Error(), "invalid recovery phrase") {
+		t.Fatalf("expected a wrong phrase to be refused, got %v", err)
+	}
+	client.Stdin = strings.NewReader(phrase + "\n")
+	if err := client.AgentUnlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if err := client.Set("TOKEN", "def", ""); err != nil {
+		t.Fatalf("set after unlock: %v", err)
+	}
+
+	if err := client.AgentStop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("agent exited with %v", err)
+	}
+	if _, err := os.Stat(app.AgentSocket); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed, got %v", err)
+	}
+	if err := client.AgentLock(); err == nil {
+		t.Fatal("expected lock without an agent to fail")
+	}
+}
+
+func TestAgentLocksAfterIdleTTL(t *testing.T) {
+	app, _ := newTestApp(t)
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	startAgent(t, app, 100*time.Millisecond)
+	t.Cleanup(func() { _ = app.AgentStop() })
+	if app.agentKey(state) == nil {
+		t.Fatal("expected the agent to start unlocked from ENVSYNC_RECOVERY_PHRASE")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if app.agentKey(state) != nil {
+		t.Fatal("expected the agent to lock after the idle TTL")
+	}
+	resp, err := app.agentCall(agentRequest{Op: agentOpKey, Salt: state.SaltB64, KeyCheck: state.KeyCheckB64})
+	if err != nil || !resp.Locked {
+		t.Fatalf("expected a locked response, got %+v %v", resp, err)
+	}
+}
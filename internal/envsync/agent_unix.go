@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package envsync
+
+import "syscall"
+
+// lockMemory keeps b out of swap.
+func lockMemory(b []byte) error {
+	return syscall.Mlock(b)
+}
+
+func unlockMemory(b []byte) error {
+	return syscall.Munlock(b)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package envsync
+
+// lockMemory is a no-op on Windows; the agent's key may be paged out.
+func lockMemory(b []byte) error {
+	return nil
+}
+
+func unlockMemory(b []byte) error {
+	return nil
+}
@@ -2,7 +2,6 @@ package envsync
 
 import (
 	"bufio"
-	"bytes"
 	"crypto/hmac"
 	"crypto/rand"
 	"encoding/base64"
@@ -33,6 +32,7 @@ type App struct {
 	RemotePath      string
 	AuditPath       string
 	SessionPath     string
+	AgentSocket     string
 	CloudURL        string
 	RemoteMode      string
 	RemoteURL       string
@@ -40,6 +40,7 @@ type App struct {
 	RemoteRetryMax  int
 	RemoteRetryBase time.Duration
 	RemoteRetryMaxD time.Duration
+	PushMaxAttempts int
 	CWD             string
 	Now             func() time.Time
 	Sleep           func(time.Duration)
@@ -56,35 +57,63 @@ type App struct {
 	AuditMaxAge     time.Duration
 	FixPermissions  bool
 	phraseCache     string
+	vaultKeyFor     string
+	vaultKey        []byte
+	stateLocks      int
+	releaseState    func()
 }
 
 type State struct {
 	Version         int                 `json:"version"`
 	DeviceID        string              `json:"device_id"`
+	Identity        *DeviceIdentity     `json:"identity,omitempty"`
 	SaltB64         string              `json:"salt_b64"`
 	KeyCheckB64     string              `json:"key_check_b64"`
+	KDF             *KDFParams          `json:"kdf,omitempty"`
 	CurrentTeam     string              `json:"current_team"`
 	CurrentProject  string              `json:"current_project"`
 	CurrentEnv      string              `json:"current_env"`
 	ProjectBindings map[string]string   `json:"project_bindings"`
 	Teams           map[string]*Team    `json:"teams"`
 	Projects        map[string]*Project `json:"projects"`
+	PendingRekey    *PendingRekey       `json:"pending_rekey,omitempty"`
+
+	// loaded is the file content state was read from, so saveState can
+	// tell whether someone else wrote the file in between.
+	loaded []byte
 }
 
 type Project struct {
-	Name string          `json:"name"`
-	Team string          `json:"team,omitempty"`
-	Envs map[string]*Env `json:"envs"`
+	Name                string                 `json:"name"`
+	Team                string                 `json:"team,omitempty"`
+	CloudOrganizationID string                 `json:"cloud_organization_id,omitempty"`
+	CloudTeamID         string                 `json:"cloud_team_id,omitempty"`
+	DataKeyID           string                 `json:"data_key_id,omitempty"`
+	WrappedKeys         map[string]*WrappedKey `json:"wrapped_keys,omitempty"`
+	KeyMAC              string                 `json:"key_mac,omitempty"`
+	Schema              *Schema                `json:"schema,omitempty"`
+	Sealed              *SealedInfo            `json:"sealed,omitempty"`
+	Manifest            *SealedManifest        `json:"manifest,omitempty"`
+	Envs                map[string]*Env        `json:"envs"`
 }
 
 type Team struct {
-	Name    string            `json:"name"`
-	Members map[string]string `json:"members"`
+	Name       string            `json:"name"`
+	Members    map[string]string `json:"members"`
+	PublicKeys map[string]string `json:"public_keys,omitempty"`
+	// AuthKeyID names the team's authentication key, AuthKeys holds it
+	// wrapped for each member and KeysMAC authenticates the roster under it.
+	AuthKeyID string                 `json:"auth_key_id,omitempty"`
+	AuthKeys  map[string]*WrappedKey `json:"auth_keys,omitempty"`
+	KeysMAC   string                 `json:"keys_mac,omitempty"`
 }
 
 type Env struct {
-	Name string                   `json:"name"`
-	Vars map[string]*SecretRecord `json:"vars"`
+	Name string `json:"name"`
+	// Parent names the env this one inherits keys from; the child's own
+	// records win.
+	Parent string                   `json:"parent,omitempty"`
+	Vars   map[string]*SecretRecord `json:"vars"`
 }
 
 type SecretRecord struct {
@@ -103,6 +132,8 @@ type SecretVersion struct {
 	UpdatedAt string `json:"updated_at"`
 	DeviceID  string `json:"device_id"`
 	PlainHash string `json:"plain_hash"`
+	KeyID     string `json:"key_id,omitempty"`
+	AAD       int    `json:"aad,omitempty"`
 }
 
 type RemoteStore struct {
@@ -110,8 +141,15 @@ type RemoteStore struct {
 	Revision    int                 `json:"revision"`
 	SaltB64     string              `json:"salt_b64,omitempty"`
 	KeyCheckB64 string              `json:"key_check_b64,omitempty"`
+	KDF         *KDFParams          `json:"kdf,omitempty"`
+	Rekey       *RekeyInfo          `json:"rekey,omitempty"`
 	Teams       map[string]*Team    `json:"teams,omitempty"`
 	Projects    map[string]*Project `json:"projects"`
+
+	// secretRecords is set when the server advertised record-level writes.
+	secretRecords bool
+	// opaque holds the sealed projects this device cannot open, by ID.
+	opaque map[string]*Project
 }
 
 func NewApp() (*App, error) {
@@ -130,6 +168,10 @@ func NewApp() (*App, error) {
 	}
 	remoteURL := os.Getenv("ENVSYNC_REMOTE_URL")
 	remoteToken := os.Getenv("ENVSYNC_REMOTE_TOKEN")
+	agentSocket := os.Getenv("ENVSYNC_AGENT_SOCK")
+	if agentSocket == "" {
+		agentSocket = filepath.Join(base, "agent.sock")
+	}
 	cloudURL := strings.TrimSuffix(strings.TrimSpace(os.Getenv("ENVSYNC_CLOUD_URL")), "/")
 	if cloudURL == "" && strings.TrimSpace(remoteURL) != "" {
 		cloudURL = strings.TrimSuffix(strings.TrimSpace(remoteURL), "/")
@@ -140,6 +182,7 @@ func NewApp() (*App, error) {
 		RemotePath:      remote,
 		AuditPath:       filepath.Join(base, "audit.log"),
 		SessionPath:     filepath.Join(base, "session.json"),
+		AgentSocket:     agentSocket,
 		CloudURL:        cloudURL,
 		RemoteMode:      strings.ToLower(strings.TrimSpace(os.Getenv("ENVSYNC_REMOTE_MODE"))),
 		RemoteURL:       strings.TrimSuffix(remoteURL, "/"),
@@ -147,6 +190,7 @@ func NewApp() (*App, error) {
 		RemoteRetryMax:  max(1, getenvInt("ENVSYNC_REMOTE_RETRY_MAX_ATTEMPTS", 3)),
 		RemoteRetryBase: getenvDuration("ENVSYNC_REMOTE_RETRY_BASE_DELAY", 200*time.Millisecond),
 		RemoteRetryMaxD: getenvDuration("ENVSYNC_REMOTE_RETRY_MAX_DELAY", 2*time.Second),
+		PushMaxAttempts: max(1, getenvInt("ENVSYNC_PUSH_MAX_ATTEMPTS", 5)),
 		CWD:             cwd,
 		Now:             time.Now,
 		Sleep:           time.Sleep,
@@ -237,7 +281,30 @@ func getenvDuration(name string, fallback time.Duration) time.Duration {
 }
 
 func (a *App) Init() error {
+	return a.InitWith(InitOptions{})
+}
+
+// InitOptions controls envsync init.
+type InitOptions struct {
+	KDF KDFOptions
+}
+
+// InitWith creates the local state and a new recovery phrase, deriving the
+// vault key with the KDF cost in opts.
+func (a *App) InitWith(opts InitOptions) error {
+	kdf, err := opts.KDF.params(defaultKDFParams())
+	if err != nil {
+		return err
+	}
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if _, err := os.Stat(a.StatePath); err == nil {
+		if opts.KDF.set() {
+			return errors.New("already initialized; change the KDF cost with `envsync phrase upgrade-kdf`")
+		}
 		diskVersion, err := a.stateVersionOnDisk()
 		if err != nil {
 			return err
@@ -246,12 +313,31 @@ func (a *App) Init() error {
 		if err != nil {
 			return err
 		}
-		if diskVersion < state.Version {
+		bound, err := a.bindStateVersions(state)
+		if err != nil {
+			return err
+		}
+		rehashed, err := a.rehashStateVersions(state)
+		if err != nil {
+			return err
+		}
+		if diskVersion < state.Version || bound > 0 || rehashed > 0 {
 			if err := a.saveState(state); err != nil {
 				return err
 			}
-			fmt.Fprintf(a.Stdout, "%s local state schema v%d -> v%d\n", cSuccess("upgraded"), diskVersion, state.Version)
-			a.logAudit("init_upgrade", state, map[string]any{"from_version": diskVersion, "to_version": state.Version})
+			if diskVersion < state.Version {
+				fmt.Fprintf(a.Stdout, "%s local state schema v%d -> v%d\n", cSuccess("upgraded"), diskVersion, state.Version)
+			}
+			if bound > 0 {
+				fmt.Fprintf(a.Stdout, "re-encrypted %d secret versions bound to their project, env and key\n", bound)
+			}
+			if state.Version < currentStateSchemaVersion {
+				fmt.Fprintln(a.Stdout, cDim("some versions need a data key this device does not hold; the state stays on v2 until they are bound"))
+			}
+			if rehashed > 0 {
+				fmt.Fprintf(a.Stdout, "%s %d value hashes with keyed HMACs\n", cSuccess("replaced"), rehashed)
+			}
+			a.logAudit("init_upgrade", state, map[string]any{"from_version": diskVersion, "to_version": state.Version, "versions": bound, "hashes": rehashed})
 			return nil
 		}
 		fmt.Fprintf(a.Stdout, "%s (state schema v%d)\n", cSuccess("already initialized"), state.Version)
@@ -268,17 +354,26 @@ func (a *App) Init() error {
 	if _, err := rand.Read(salt); err != nil {
 		return err
 	}
-	key := deriveKey(phrase, salt)
+	key, err := deriveKey(phrase, salt, kdf)
+	if err != nil {
+		return err
+	}
 	check := keyCheck(key)
 	deviceID, err := randomHex(8)
 	if err != nil {
 		return err
 	}
+	identity, _, err := newDeviceIdentity(key)
+	if err != nil {
+		return err
+	}
 	state := &State{
 		Version:         currentStateSchemaVersion,
 		DeviceID:        deviceID,
+		Identity:        identity,
 		SaltB64:         base64.StdEncoding.EncodeToString(salt),
 		KeyCheckB64:     base64.StdEncoding.EncodeToString(check),
+		KDF:             kdf,
 		CurrentEnv:      defaultEnv,
 		ProjectBindings: map[string]string{},
 		Teams:           map[string]*Team{},
@@ -287,7 +382,7 @@ func (a *App) Init() error {
 	if err := a.saveState(state); err != nil {
 		return err
 	}
-	a.logAudit("init", state, map[string]any{"device_id": deviceID})
+	a.logAudit("init", state, map[string]any{"device_id": deviceID, "kdf": kdf.String()})
 	fmt.Fprintf(a.Stdout, "%s\n\n", cSuccess("envsync initialized"))
 	fmt.Fprintf(a.Stdout, "Recovery phrase (save this now; it is not stored):\n%s\n", cBold(phrase))
 	a.promptAndSaveRecoveryPhrase(phrase)
@@ -345,6 +440,11 @@ func (a *App) saveRecoveryPhraseFile(dir string, phrase string) (string, error)
 }
 
 func (a *App) TeamCreate(name string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -356,10 +456,25 @@ func (a *App) TeamCreate(name string) error {
 		return fmt.Errorf("team %q already exists", name)
 	}
 	actor := a.actorID(state)
-	state.Teams[name] = &Team{
+	vaultKey, err := a.getSecretKey(state)
+	if err != nil {
+		return err
+	}
+	team := &Team{
 		Name:    name,
 		Members: map[string]string{actor: roleAdmin},
 	}
+	if err := a.registerDevice(state, team, vaultKey); err != nil {
+		return err
+	}
+	id, err := a.memberIdentity(state)
+	if err != nil {
+		return err
+	}
+	if _, err := authenticateTeam(id, team); err != nil {
+		return err
+	}
+	state.Teams[name] = team
 	if state.CurrentTeam == "" {
 		state.CurrentTeam = name
 	}
@@ -396,6 +511,11 @@ func (a *App) TeamList() error {
 }
 
 func (a *App) TeamUse(name string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -420,6 +540,26 @@ func (a *App) TeamUse(name string) error {
 }
 
 func (a *App) TeamAddMember(teamName, actor, role string) error {
+	return a.TeamAddMemberWith(teamName, actor, AddMemberOptions{Role: role})
+}
+
+// AddMemberOptions controls envsync team add-member. PublicKey is the key
+// `envsync team key` prints on the member's device; it may only be left
+// out to change the role of a member who already has one.
+type AddMemberOptions struct {
+	Role      string
+	PublicKey string
+}
+
+// TeamAddMemberWith adds a member with opts.Role and wraps every team
+// project's data key for opts.PublicKey.
+func (a *App) TeamAddMemberWith(teamName, actor string, opts AddMemberOptions) error {
+	role, publicKey := opts.Role, opts.PublicKey
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -444,11 +584,23 @@ func (a *App) TeamAddMember(teamName, actor, role string) error {
 	if !hasRole(state, teamName, current, roleAdmin) {
 		return errors.New("team admin role required")
 	}
+	if publicKey == "" && team.PublicKeys[actor] == "" {
+		return fmt.Errorf("public key required for %s; run `envsync team key` on their device", actor)
+	}
+	if publicKey != "" {
+		if _, err := parsePublicKey(publicKey); err != nil {
+			return err
+		}
+		if team.PublicKeys == nil {
+			team.PublicKeys = map[string]string{}
+		}
+		team.PublicKeys[actor] = strings.TrimSpace(publicKey)
+	}
 	if team.Members == nil {
 		team.Members = map[string]string{}
 	}
 	team.Members[actor] = role
-	if err := a.saveState(state); err != nil {
+	if _, err := a.rekeyTeamProjects(state, teamName, false); err != nil {
 		return err
 	}
 	fmt.Fprintf(a.Stdout, "%s %s to team %s as %s\n", cSuccess("added"), cBold(actor), cBold(teamName), cInfo("%s", role))
@@ -457,6 +609,11 @@ func (a *App) TeamAddMember(teamName, actor, role string) error {
 }
 
 func (a *App) TeamRemoveMember(teamName, actor string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -485,11 +642,16 @@ func (a *App) TeamRemoveMember(teamName, actor string) error {
 		return errors.New("cannot remove yourself from the team")
 	}
 	delete(team.Members, actor)
-	if err := a.saveState(state); err != nil {
+	delete(team.PublicKeys, actor)
+	// Dropping the member's wrapped key is not enough: they may have kept a
+	// copy of the data key, so every team project moves to a fresh one.
+	versions, err := a.rekeyTeamProjects(state, teamName, true)
+	if err != nil {
 		return err
 	}
 	fmt.Fprintf(a.Stdout, "%s %s from team %s\n", cSuccess("removed"), cBold(actor), cBold(teamName))
-	a.logAudit("team_remove_member", state, map[string]any{"team": teamName, "member": actor})
+	fmt.Fprintf(a.Stdout, "%s %d secret versions under new data keys\n", cSuccess("re-keyed"), versions)
+	a.logAudit("team_remove_member", state, map[string]any{"team": teamName, "member": actor, "versions": versions})
 	return nil
 }
 
@@ -523,7 +685,120 @@ func (a *App) TeamListMembers(teamName string) error {
 	return nil
 }
 
+// TeamKey prints the caller's actor and this device's public key. A team
+// admin passes it to `envsync team add-member --public-key` so this device
+// can decrypt team projects. A state from before device identities gets one
+// here.
+func (a *App) TeamKey() error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	if state.Identity == nil {
+		vaultKey, err := a.getSecretKey(state)
+		if err != nil {
+			return err
+		}
+		if _, err := a.deviceIdentity(state, vaultKey); err != nil {
+			return err
+		}
+		if err := a.saveState(state); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(a.Stdout, "%s %s\n", cDim("actor"), a.actorID(state))
+	fmt.Fprintf(a.Stdout, "%s %s\n", cDim("public key"), state.Identity.PublicKeyB64)
+	return nil
+}
+
+// TeamJoin copies a team and its projects from the remote into local state.
+// Each project must already carry a data key wrapped for the caller.
+func (a *App) TeamJoin(teamName string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	if teamName == "" {
+		return errors.New("team name required")
+	}
+	remote, err := a.loadRestoreStore()
+	if err != nil {
+		return err
+	}
+	if hasManifests(remote.Projects) {
+		id, err := a.memberIdentity(state)
+		if err != nil {
+			return err
+		}
+		openRemoteProjects(remote, id)
+	}
+	team := cloneTeams(remote.Teams)[teamName]
+	if team == nil {
+		return fmt.Errorf("team %q not found on remote", teamName)
+	}
+	actor := a.actorID(state)
+	if team.Members[actor] == "" {
+		return fmt.Errorf("%s is not a member of team %q", actor, teamName)
+	}
+	id, err := a.memberIdentity(state)
+	if err != nil {
+		return err
+	}
+	if team, err = verifiedTeam(id, state.Teams[teamName], team); err != nil {
+		return err
+	}
+	state.Teams[teamName] = team
+	joined := []string{}
+	for _, name := range sortedKeys(remote.Projects) {
+		project := remote.Projects[name]
+		if project == nil || project.Team != teamName {
+			continue
+		}
+		if _, exists := state.Projects[name]; exists {
+			fmt.Fprintf(a.Stderr, "warning: skipping project %s: a local project has the same name\n", name)
+			continue
+		}
+		keys, err := a.keysFor(state, project)
+		if err != nil {
+			return err
+		}
+		if err := verifyProjectKey(id, team, project, keys); err != nil {
+			return err
+		}
+		markSyncedVersions(map[string]*Project{name: project})
+		state.Projects[name] = project
+		joined = append(joined, name)
+	}
+	if state.CurrentTeam == "" {
+		state.CurrentTeam = teamName
+	}
+	if state.CurrentProject == "" && len(joined) > 0 {
+		state.CurrentProject = joined[0]
+	}
+	if err := a.saveState(state); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.Stdout, "%s %s (%d projects)\n", cSuccess("joined team"), cBold(teamName), len(joined))
+	a.logAudit("team_join", state, map[string]any{"team": teamName, "projects": joined})
+	return nil
+}
+
 func (a *App) ProjectCreate(name string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -539,7 +814,37 @@ func (a *App) ProjectCreate(name string) error {
 		if !hasRole(state, state.CurrentTeam, a.actorID(state), roleAdmin, roleWriter) {
 			return errors.New("writer/admin role required on current team")
 		}
+		vaultKey, err := a.getSecretKey(state)
+		if err != nil {
+			return err
+		}
+		if err := a.registerDevice(state, state.Teams[state.CurrentTeam], vaultKey); err != nil {
+			return err
+		}
+		keys, err := newProjectKeys(name, vaultKey)
+		if err != nil {
+			return err
+		}
+		wrapped, err := wrapForTeam(state.Teams[state.CurrentTeam], keys)
+		if err != nil {
+			return err
+		}
 		project.Team = state.CurrentTeam
+		project.DataKeyID = keys.keyID
+		project.WrappedKeys = wrapped
+		if team := state.Teams[state.CurrentTeam]; team.AuthKeyID != "" {
+			id, err := a.memberIdentity(state)
+			if err != nil {
+				return err
+			}
+			authKey, err := teamAuthKey(id, team)
+			if err != nil {
+				return err
+			}
+			if err := sealProjectKey(project, team.Name, keys, authKey); err != nil {
+				return err
+			}
+		}
 	}
 	state.Projects[name] = project
 	if state.CurrentProject == "" {
@@ -578,6 +883,11 @@ func (a *App) ProjectList() error {
 }
 
 func (a *App) ProjectUse(name string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -603,6 +913,11 @@ func (a *App) ProjectUse(name string) error {
 }
 
 func (a *App) ProjectDelete(name string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -635,7 +950,57 @@ func (a *App) ProjectDelete(name string) error {
 	return nil
 }
 
+// ProjectBind selects the cloud owner of a project's vault. Empty IDs move the
+// project back to the caller's personal vault.
+func (a *App) ProjectBind(name, organizationID, teamID string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	project, ok := state.Projects[name]
+	if !ok {
+		return fmt.Errorf("unknown project %q", name)
+	}
+	if err := a.requireProjectRole(state, project, roleAdmin); err != nil {
+		return err
+	}
+	organizationID = strings.TrimSpace(organizationID)
+	teamID = strings.TrimSpace(teamID)
+	if organizationID != "" && teamID != "" {
+		return errors.New("a project can be bound to an organization or a team, not both")
+	}
+	project.CloudOrganizationID = organizationID
+	project.CloudTeamID = teamID
+	if err := a.saveState(state); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.Stdout, "%s %s to %s\n", cSuccess("bound project"), cBold(name), projectScope(name, project))
+	a.logAudit("project_bind", state, map[string]any{"project": name, "organization_id": organizationID, "team_id": teamID})
+	return nil
+}
+
 func (a *App) EnvCreate(name string) error {
+	return a.EnvCreateWith(name, EnvCreateOptions{})
+}
+
+// EnvCreateOptions controls envsync env create. Parent names an env the new
+// one inherits every key from that it does not set itself.
+type EnvCreateOptions struct {
+	Parent string
+}
+
+func (a *App) EnvCreateWith(name string, opts EnvCreateOptions) error {
+	parent := opts.Parent
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -650,16 +1015,32 @@ func (a *App) EnvCreate(name string) error {
 	if _, ok := project.Envs[name]; ok {
 		return fmt.Errorf("environment %q already exists", name)
 	}
-	project.Envs[name] = &Env{Name: name, Vars: map[string]*SecretRecord{}}
+	if parent != "" && project.Envs[parent] == nil {
+		return fmt.Errorf("unknown environment %q", parent)
+	}
+	project.Envs[name] = &Env{Name: name, Parent: parent, Vars: map[string]*SecretRecord{}}
 	if err := a.saveState(state); err != nil {
 		return err
 	}
-	fmt.Fprintf(a.Stdout, "%s %s\n", cSuccess("created environment"), cBold(name))
-	a.logAudit("env_create", state, map[string]any{"env": name})
+	msg := cSuccess("created environment") + " " + cBold(name)
+	if parent != "" {
+		msg += " " + cDim("(inherits "+parent+")")
+	}
+	fmt.Fprintln(a.Stdout, msg)
+	fields := map[string]any{"env": name}
+	if parent != "" {
+		fields["parent"] = parent
+	}
+	a.logAudit("env_create", state, fields)
 	return nil
 }
 
 func (a *App) EnvUse(name string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -709,12 +1090,41 @@ func (a *App) EnvList() error {
 		if state.CurrentEnv == n {
 			marker = cSuccess("* ")
 		}
+		if parent := project.Envs[n].Parent; parent != "" {
+			fmt.Fprintf(a.Stdout, "%s%s %s\n", marker, n, cDim("(inherits "+parent+")"))
+			continue
+		}
 		fmt.Fprintf(a.Stdout, "%s%s\n", marker, n)
 	}
 	return nil
 }
 
 func (a *App) Set(keyName, value, expiresAt string) error {
+	return a.SetWith(keyName, value, SetOptions{ExpiresAt: expiresAt})
+}
+
+// SetOptions controls envsync set. ExpiresAt is an RFC 3339 time or a
+// duration from now; NoValidate stores a value the schema rejects. FromFile
+// reads the value from a file instead of the command line.
+type SetOptions struct {
+	ExpiresAt  string
+	NoValidate bool
+	FromFile   string
+}
+
+// SetWith stores value for keyName in the active env. A value of "-" is
+// read from stdin.
+func (a *App) SetWith(keyName, value string, opts SetOptions) error {
+	expiresAt := opts.ExpiresAt
+	value, err := a.secretValue(value, opts.FromFile)
+	if err != nil {
+		return err
+	}
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -733,6 +1143,17 @@ func (a *App) Set(keyName, value, expiresAt string) error {
 	if env.Vars == nil {
 		env.Vars = map[string]*SecretRecord{}
 	}
+	if !opts.NoValidate {
+		schema, _, err := a.schemaFor(project)
+		if err != nil {
+			return err
+		}
+		if schema != nil {
+			if reason := schema.checkStored(keyName, value); reason != "" {
+				return fmt.Errorf("%s: %s (rerun with --no-validate to set it anyway)", keyName, reason)
+			}
+		}
+	}
 
 	// Resolve expiresAt — accept RFC3339 or Go duration string.
 	resolvedExpiry := ""
@@ -746,11 +1167,15 @@ func (a *App) Set(keyName, value, expiresAt string) error {
 		}
 	}
 
+	projKeys, err := a.keysFor(state, project)
+	if err != nil {
+		return err
+	}
 	rec := env.Vars[keyName]
 	if rec == nil {
 		rec = &SecretRecord{}
 	}
-	next, err := a.writeSecretVersion(state, rec, value, false, resolvedExpiry)
+	next, err := a.writeSecretVersion(state, projKeys, env.Name, keyName, rec, value, false, resolvedExpiry)
 	if err != nil {
 		return err
 	}
@@ -768,6 +1193,27 @@ func (a *App) Set(keyName, value, expiresAt string) error {
 }
 
 func (a *App) Rotate(keyName, value string) error {
+	return a.RotateWith(keyName, value, RotateOptions{})
+}
+
+// RotateOptions controls envsync rotate. FromFile reads the new value from
+// a file instead of the command line.
+type RotateOptions struct {
+	FromFile string
+}
+
+// RotateWith stores value as a rotation of keyName. A value of "-" is read
+// from stdin.
+func (a *App) RotateWith(keyName, value string, opts RotateOptions) error {
+	value, err := a.secretValue(value, opts.FromFile)
+	if err != nil {
+		return err
+	}
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -787,7 +1233,11 @@ func (a *App) Rotate(keyName, value string) error {
 	if rec == nil {
 		return fmt.Errorf("key %q not found", keyName)
 	}
-	next, err := a.writeSecretVersion(state, rec, value, true, "")
+	projKeys, err := a.keysFor(state, project)
+	if err != nil {
+		return err
+	}
+	next, err := a.writeSecretVersion(state, projKeys, env.Name, keyName, rec, value, true, "")
 	if err != nil {
 		return err
 	}
@@ -804,10 +1254,6 @@ func (a *App) Get(keyName string) error {
 	if err != nil {
 		return err
 	}
-	secretKey, err := a.getSecretKey(state)
-	if err != nil {
-		return err
-	}
 	project, _, err := currentProject(state, a.CWD)
 	if err != nil {
 		return err
@@ -815,10 +1261,18 @@ func (a *App) Get(keyName string) error {
 	if err := a.requireProjectRole(state, project, roleAdmin, roleWriter, roleReader); err != nil {
 		return err
 	}
+	projKeys, err := a.keysFor(state, project)
+	if err != nil {
+		return err
+	}
 	env, err := currentEnv(state, a.CWD)
 	if err != nil {
 		return err
 	}
+	env, from, err := effectiveEnv(project, env)
+	if err != nil {
+		return err
+	}
 	rec := env.Vars[keyName]
 	if rec == nil || len(rec.Versions) == 0 {
 		return fmt.Errorf("key %q not found", keyName)
@@ -834,7 +1288,7 @@ func (a *App) Get(keyName string) error {
 			return fmt.Errorf("key %q has expired (at %s)", keyName, v.ExpiresAt)
 		}
 	}
-	value, err := decrypt(secretKey, v)
+	value, err := projKeys.decrypt(from[keyName], keyName, v)
 	if err != nil {
 		return err
 	}
@@ -843,6 +1297,11 @@ func (a *App) Get(keyName string) error {
 }
 
 func (a *App) Delete(keyName string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
 		return err
@@ -862,6 +1321,18 @@ func (a *App) Delete(keyName string) error {
 	if rec == nil {
 		return fmt.Errorf("key %q not found", keyName)
 	}
+	next := a.deleteSecretVersion(state, rec)
+	if err := a.saveState(state); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.Stdout, "%s %s\n", cSuccess("deleted"), cBold(keyName))
+	a.logAudit("delete", state, map[string]any{"key": keyName, "version": next})
+	return nil
+}
+
+// deleteSecretVersion records a deleted version on top of rec and returns
+// its number.
+func (a *App) deleteSecretVersion(state *State, rec *SecretRecord) int {
 	next := rec.CurrentVersion + 1
 	rec.CurrentVersion = next
 	rec.Versions = append(rec.Versions, SecretVersion{
@@ -870,12 +1341,7 @@ func (a *App) Delete(keyName string) error {
 		UpdatedAt: a.Now().UTC().Format(time.RFC3339),
 		DeviceID:  state.DeviceID,
 	})
-	if err := a.saveState(state); err != nil {
-		return err
-	}
-	fmt.Fprintf(a.Stdout, "%s %s\n", cSuccess("deleted"), cBold(keyName))
-	a.logAudit("delete", state, map[string]any{"key": keyName, "version": next})
-	return nil
+	return next
 }
 
 func (a *App) List(showValues bool) error {
@@ -894,13 +1360,17 @@ func (a *App) List(showValues bool) error {
 	if err != nil {
 		return err
 	}
+	env, from, err := effectiveEnv(project, env)
+	if err != nil {
+		return err
+	}
 	if len(env.Vars) == 0 {
 		fmt.Fprintln(a.Stdout, cDim("no variables"))
 		return nil
 	}
-	var secretKey []byte
+	var projKeys *projectKeys
 	if showValues {
-		secretKey, err = a.getSecretKey(state)
+		projKeys, err = a.keysFor(state, project)
 		if err != nil {
 			return err
 		}
@@ -928,14 +1398,17 @@ func (a *App) List(showValues bool) error {
 			}
 		}
 		suffix := ""
+		if from[k] != env.Name {
+			suffix = " " + cDim("(from "+from[k]+")")
+		}
 		if expired {
-			suffix = " " + cWarn("[EXPIRED]")
+			suffix += " " + cWarn("[EXPIRED]")
 		}
 		if !showValues {
 			fmt.Fprintf(a.Stdout, "%s=%s%s\n", cBold(k), cDim("******"), suffix)
 			continue
 		}
-		value, err := decrypt(secretKey, v)
+		value, err := projKeys.decrypt(from[k], k, v)
 		if err != nil {
 			return err
 		}
@@ -945,33 +1418,19 @@ func (a *App) List(showValues bool) error {
 }
 
 func (a *App) Load() error {
-	state, err := a.loadState()
+	return a.LoadWith(LoadOptions{})
+}
+
+// activeValues decrypts the current version of every key env has or
+// inherits, skipping deleted and expired keys.
+func (a *App) activeValues(projKeys *projectKeys, project *Project, env *Env) (map[string]string, error) {
+	env, from, err := effectiveEnv(project, env)
 	if err != nil {
-		return err
-	}
-	secretKey, err := a.getSecretKey(state)
-	if err != nil {
-		return err
-	}
-	project, _, err := currentProject(state, a.CWD)
-	if err != nil {
-		return err
-	}
-	if err := a.requireProjectRole(state, project, roleAdmin, roleWriter, roleReader); err != nil {
-		return err
-	}
-	env, err := currentEnv(state, a.CWD)
-	if err != nil {
-		return err
-	}
-	keys := make([]string, 0, len(env.Vars))
-	for k := range env.Vars {
-		keys = append(keys, k)
+		return nil, err
 	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		rec := env.Vars[k]
-		if len(rec.Versions) == 0 {
+	values := map[string]string{}
+	for k, rec := range env.Vars {
+		if rec == nil || len(rec.Versions) == 0 {
 			continue
 		}
 		v := rec.Versions[len(rec.Versions)-1]
@@ -985,13 +1444,22 @@ func (a *App) Load() error {
 				continue
 			}
 		}
-		value, err := decrypt(secretKey, v)
+		value, err := projKeys.decrypt(from[k], k, v)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		fmt.Fprintf(a.Stdout, "export %s=%q\n", k, value)
+		values[k] = value
 	}
-	return nil
+	return values, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func (a *App) History(keyName string) error {
@@ -1027,22 +1495,12 @@ func (a *App) History(keyName string) error {
 }
 
 func (a *App) Rollback(keyName string, version int) error {
-	state, err := a.loadState()
-	if err != nil {
-		return err
-	}
-	project, _, err := currentProject(state, a.CWD)
-	if err != nil {
-		return err
-	}
-	if err := a.requireProjectRole(state, project, roleAdmin, roleWriter); err != nil {
-		return err
-	}
-	env, err := currentEnv(state, a.CWD)
+	tx, err := a.beginSecretTx("", "")
 	if err != nil {
 		return err
 	}
-	rec := env.Vars[keyName]
+	defer tx.close()
+	rec := tx.env.Vars[keyName]
 	if rec == nil {
 		return fmt.Errorf("key %q not found", keyName)
 	}
@@ -1056,22 +1514,86 @@ func (a *App) Rollback(keyName string, version int) error {
 	if target == nil {
 		return fmt.Errorf("version %d not found", version)
 	}
-	next := rec.CurrentVersion + 1
-	rec.CurrentVersion = next
-	rec.Versions = append(rec.Versions, SecretVersion{
-		Version:   next,
-		NonceB64:  target.NonceB64,
-		CipherB64: target.CipherB64,
-		Deleted:   target.Deleted,
-		UpdatedAt: a.Now().UTC().Format(time.RFC3339),
-		DeviceID:  state.DeviceID,
-		PlainHash: target.PlainHash,
-	})
-	if err := a.saveState(state); err != nil {
+	if _, err := tx.restore(keyName, *target); err != nil {
+		return err
+	}
+	if err := tx.commit("rollback", map[string]any{"key": keyName, "version": version}); err != nil {
 		return err
 	}
 	fmt.Fprintf(a.Stdout, "%s %s to v%d\n", cSuccess("rolled back"), cBold(keyName), version)
-	a.logAudit("rollback", state, map[string]any{"key": keyName, "version": version})
+	return nil
+}
+
+// RollbackAll returns every key of the active env to the version that was
+// current at to, an RFC 3339 time or a duration ago. Keys created after
+// that time are deleted and keys already at that version are left alone;
+// all changes land as one batch.
+func (a *App) RollbackAll(to string) error {
+	cutoff, err := time.Parse(time.RFC3339, to)
+	if err != nil {
+		dur, durErr := time.ParseDuration(to)
+		if durErr != nil || dur < 0 {
+			return fmt.Errorf("invalid --to value %q: must be RFC3339 or a Go duration ago (e.g. 2h)", to)
+		}
+		cutoff = a.Now().Add(-dur)
+	}
+	tx, err := a.beginSecretTx("", "")
+	if err != nil {
+		return err
+	}
+	defer tx.close()
+	var restored, deleted []string
+	for _, k := range sortedKeys(tx.env.Vars) {
+		rec := tx.env.Vars[k]
+		if rec == nil || len(rec.Versions) == 0 {
+			continue
+		}
+		current := rec.Versions[len(rec.Versions)-1]
+		var target *SecretVersion
+		for i, v := range rec.Versions {
+			at, err := time.Parse(time.RFC3339, v.UpdatedAt)
+			if err != nil || at.After(cutoff) {
+				continue
+			}
+			if target == nil || v.Version > target.Version {
+				target = &rec.Versions[i]
+			}
+		}
+		switch {
+		case target == nil || target.Deleted:
+			if current.Deleted {
+				continue
+			}
+			if _, err := tx.delete(k); err != nil {
+				return err
+			}
+			deleted = append(deleted, k)
+		case current.Deleted || target.PlainHash != current.PlainHash:
+			// A version restored earlier has the target's value. Hashes of
+			// different schemes never match, which at worst restores a
+			// value that was already current.
+			if _, err := tx.restore(k, *target); err != nil {
+				return err
+			}
+			restored = append(restored, k)
+		}
+	}
+	at := cutoff.UTC().Format(time.RFC3339)
+	if len(restored)+len(deleted) == 0 {
+		fmt.Fprintf(a.Stdout, "%s\n", cDim("nothing changed since "+at))
+		return nil
+	}
+	if err := tx.commit("rollback", map[string]any{"to": at}); err != nil {
+		return err
+	}
+	for _, k := range restored {
+		fmt.Fprintf(a.Stdout, "  %s %s %s\n", cWarn("~"), cBold(k), cDim(fmt.Sprintf("v%d", tx.versions[k])))
+	}
+	for _, k := range deleted {
+		fmt.Fprintf(a.Stdout, "  %s %s\n", cError("-"), cBold(k))
+	}
+	fmt.Fprintf(a.Stdout, "%s %s to %s %s\n", cSuccess("rolled back"), cBold(tx.projName+"/"+tx.envName), at,
+		cDim(fmt.Sprintf("(%d restored, %d deleted)", len(restored), len(deleted))))
 	return nil
 }
 
@@ -1084,10 +1606,15 @@ func (a *App) DoctorJSON() error {
 }
 
 func (a *App) Restore() error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if _, err := os.Stat(a.StatePath); err == nil {
 		return errors.New("state already exists; remove it before restore")
 	}
-	remote, err := a.loadRemoteStore()
+	remote, err := a.loadRestoreStore()
 	if err != nil {
 		return err
 	}
@@ -1102,7 +1629,10 @@ func (a *App) Restore() error {
 	if err != nil {
 		return fmt.Errorf("invalid remote salt: %w", err)
 	}
-	key := deriveKey(phrase, salt)
+	key, err := deriveKey(phrase, salt, remote.KDF)
+	if err != nil {
+		return err
+	}
 	expected, err := base64.StdEncoding.DecodeString(remote.KeyCheckB64)
 	if err != nil {
 		return fmt.Errorf("invalid remote key check: %w", err)
@@ -1114,6 +1644,10 @@ func (a *App) Restore() error {
 	if err != nil {
 		return err
 	}
+	identity, device, err := newDeviceIdentity(key)
+	if err != nil {
+		return err
+	}
 	projects := remote.Projects
 	if projects == nil {
 		projects = map[string]*Project{}
@@ -1125,13 +1659,19 @@ func (a *App) Restore() error {
 	state := &State{
 		Version:         currentStateSchemaVersion,
 		DeviceID:        deviceID,
+		Identity:        identity,
 		SaltB64:         remote.SaltB64,
 		KeyCheckB64:     remote.KeyCheckB64,
+		KDF:             remote.KDF,
 		CurrentEnv:      defaultEnv,
 		ProjectBindings: map[string]string{},
 		Teams:           teams,
 		Projects:        projects,
 	}
+	openRemoteProjects(remote, &memberIdentity{actor: a.actorID(state), vault: key, device: device})
+	for _, id := range sortedKeys(remote.opaque) {
+		fmt.Fprintf(a.Stderr, "warning: skipping sealed project %s: this device cannot open it\n", id)
+	}
 	if len(projects) > 0 {
 		names := make([]string, 0, len(projects))
 		for name := range projects {
@@ -1142,6 +1682,11 @@ func (a *App) Restore() error {
 		state.ProjectBindings[a.CWD] = names[0]
 	}
 	markSyncedVersions(state.Projects)
+	if hasUnboundVersions(state.Projects) {
+		// Nothing ties a version an older envsync sealed to where restore
+		// finds it, so it is kept as it is and refuses to open.
+		fmt.Fprintln(a.Stderr, "warning: some secrets on the remote were sealed without their location by an older envsync and cannot be read; run `envsync init` and `envsync push` on an upgraded device that holds them, then pull")
+	}
 	if err := a.saveState(state); err != nil {
 		return err
 	}
@@ -1151,10 +1696,48 @@ func (a *App) Restore() error {
 }
 
 func (a *App) Push(force bool) error {
+	return a.push(PushOptions{Force: force})
+}
+
+// PushOptions controls envsync push. Force overwrites conflicting keys,
+// Strategy settles them instead; NoValidate pushes an env the schema
+// rejects.
+type PushOptions struct {
+	Force      bool
+	Strategy   string
+	Reveal     bool
+	NoValidate bool
+}
+
+func (a *App) PushWith(opts PushOptions) error {
+	if opts.Strategy != "" {
+		if err := validateStrategy(opts.Strategy); err != nil {
+			return err
+		}
+	}
+	return a.push(opts)
+}
+
+func (a *App) push(opts PushOptions) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	force, strategy, reveal := opts.Force, opts.Strategy, opts.Reveal
 	state, err := a.loadState()
 	if err != nil {
 		return err
 	}
+	if state.PendingRekey != nil {
+		err := a.finishPendingRekey(state)
+		if saveErr := a.saveState(state); saveErr != nil {
+			return saveErr
+		}
+		if err != nil {
+			return err
+		}
+	}
 	proj, projName, err := currentProject(state, a.CWD)
 	if err != nil {
 		return err
@@ -1170,76 +1753,249 @@ func (a *App) Push(force bool) error {
 	if localEnv == nil {
 		return fmt.Errorf("environment %q not found", envName)
 	}
-	remote, err := a.loadRemoteStore()
-	if err != nil {
-		return err
+	if !opts.NoValidate {
+		if err := a.requireSchema(state, projName, envName, "push"); err != nil {
+			return err
+		}
+	}
+	var resolver *conflictResolver
+	if strategy != "" {
+		if resolver, err = a.newConflictResolver(state, proj, envName, strategy, reveal); err != nil {
+			return err
+		}
 	}
-	expectedRevision := remote.Revision
-	if err := validateRemoteCrypto(state, remote); err != nil {
+	scope := projectScope(projName, proj)
+	attempts := a.pushMaxAttempts()
+	var (
+		changed                  []string
+		resolved                 map[string]*SecretRecord
+		fromRevision, toRevision int
+	)
+	for attempt := 1; ; attempt++ {
+		remote, err := a.loadRemoteStoreWith(state, scope)
+		if err != nil {
+			return err
+		}
+		expectedRevision := remote.Revision
+		if err := checkRemoteKeys(state, remote, projName, proj); err != nil {
+			return err
+		}
+		if err := checkRemoteSealed(remote, projName, proj); err != nil {
+			return err
+		}
+		if err := checkRemoteAncestors(remote, projName, proj, localEnv); err != nil {
+			return err
+		}
+		base := a.newRecordBase(remote, projName, envName)
+		before := remoteVersions(remote, projName, envName)
+		pushed, conflicts := rebaseEnvOntoRemote(remote, projName, envName, localEnv, force)
+		resolved = nil
+		if len(conflicts) > 0 && resolver != nil {
+			remoteEnv := remote.Projects[projName].Envs[envName]
+			resolved, conflicts, err = resolver.resolveAll(conflicts, localEnv, remoteEnv)
+			if err != nil {
+				return err
+			}
+			for k, rec := range resolved {
+				remoteEnv.Vars[k] = cloneRecord(rec)
+			}
+		}
+		if len(conflicts) > 0 && !force {
+			return fmt.Errorf("push conflicts for keys: %s (rerun with --force or --strategy)", strings.Join(conflicts, ", "))
+		}
+		remoteProject := remote.Projects[projName]
+		if proj.DataKeyID != "" && remoteProject.DataKeyID == "" {
+			copyProjectKeys(remoteProject, proj)
+		}
+		if remoteProject.Team == "" {
+			remoteProject.Team = proj.Team
+		}
+		if newerSchema(proj.Schema, remoteProject.Schema) {
+			remoteProject.Schema = proj.Schema
+		}
+		remoteProject.Sealed = proj.Sealed
+		if proj.DataKeyID == "" || remote.SaltB64 == "" {
+			attachCryptoMetadata(state, remote)
+		}
+		remote.Teams = teamsForPush(remote.Teams, state.Teams, a.actorID(state))
+		err = errRecordsUnsupported
+		if records, ok := base.changed(remote, projName, envName); ok {
+			err = a.saveRemoteRecords(scope, remote, projName, envName, base, records)
+		}
+		if errors.Is(err, errRecordsUnsupported) {
+			err = a.saveRemoteStoreWith(state, scope, remote, expectedRevision)
+		}
+		if err == nil {
+			for _, k := range pushed {
+				rec := localEnv.Vars[k]
+				rec.LastSyncedRemoteVersion = rec.CurrentVersion
+				if before[k] != rec.CurrentVersion {
+					changed = append(changed, k)
+				}
+			}
+			changed = append(changed, sortedKeys(resolved)...)
+			fromRevision, toRevision = expectedRevision, remote.Revision
+			break
+		}
+		if !errors.Is(err, errRemoteConflict) || attempt >= attempts {
+			return err
+		}
+		fmt.Fprintln(a.Stderr, cDim(fmt.Sprintf("remote changed during push; retrying (%d/%d)", attempt+1, attempts)))
+	}
+	for k, rec := range resolved {
+		rec.LastSyncedRemoteVersion = rec.CurrentVersion
+		localEnv.Vars[k] = rec
+	}
+	if err := a.saveState(state); err != nil {
 		return err
 	}
-	attachCryptoMetadata(state, remote)
-	remote.Teams = cloneTeams(state.Teams)
+	if scope.Unsealed != "" && fromRevision == 0 && a.effectiveRemoteMode() == "cloud" {
+		if err := a.retireUnsealedVault(scope); err != nil {
+			fmt.Fprintf(a.Stderr, "warning: %v; it still holds the project's names\n", err)
+		}
+	}
+	fmt.Fprintln(a.Stdout, cSuccess("push complete"))
+	sort.Strings(changed)
+	fields := map[string]any{
+		"project": projName, "env": envName, "force": force,
+		"keys": changed, "from_revision": fromRevision, "to_revision": toRevision,
+	}
+	if strategy != "" {
+		fields["strategy"] = strategy
+		fields["resolved"] = sortedKeys(resolved)
+	}
+	a.logAudit("push", state, fields)
+	return nil
+}
+
+// remoteVersions maps the keys of a remote env to their current versions.
+func remoteVersions(remote *RemoteStore, projName, envName string) map[string]int {
+	versions := map[string]int{}
+	if project := remote.Projects[projName]; project != nil && project.Envs[envName] != nil {
+		for k, rec := range project.Envs[envName].Vars {
+			versions[k] = rec.CurrentVersion
+		}
+	}
+	return versions
+}
+
+// sameCurrentVersion reports whether local and remote hold the very same
+// current version, as when a push wrote that record but failed before it
+// could record the sync locally.
+func sameCurrentVersion(local, remote *SecretRecord) bool {
+	if remote == nil || local.CurrentVersion != remote.CurrentVersion {
+		return false
+	}
+	lv, rv := currentVersion(local), currentVersion(remote)
+	return lv != nil && rv != nil && *lv == *rv
+}
+
+// rebaseEnvOntoRemote applies the local env's per-key changes to remote,
+// leaving keys that only moved remotely untouched. A key conflicts when both
+// sides advanced past LastSyncedRemoteVersion to different versions; force
+// overwrites those too.
+// It returns the keys copied to remote and the conflicting keys, sorted.
+// Local records are not modified so a failed save can be retried.
+func rebaseEnvOntoRemote(remote *RemoteStore, projName, envName string, localEnv *Env, force bool) (pushed, conflicts []string) {
 	remoteProject := remote.Projects[projName]
 	if remoteProject == nil {
 		remoteProject = &Project{Name: projName, Envs: map[string]*Env{}}
 		remote.Projects[projName] = remoteProject
 	}
+	if remoteProject.Envs == nil {
+		remoteProject.Envs = map[string]*Env{}
+	}
 	remoteEnv := remoteProject.Envs[envName]
 	if remoteEnv == nil {
 		remoteEnv = &Env{Name: envName, Vars: map[string]*SecretRecord{}}
 		remoteProject.Envs[envName] = remoteEnv
 	}
-	conflicts := []string{}
-	for k, localRec := range localEnv.Vars {
-		remoteRec := remoteEnv.Vars[k]
+	if remoteEnv.Vars == nil {
+		remoteEnv.Vars = map[string]*SecretRecord{}
+	}
+	if localEnv.Parent != "" {
+		remoteEnv.Parent = localEnv.Parent
+	}
+	for _, k := range sortedKeys(localEnv.Vars) {
+		localRec := localEnv.Vars[k]
 		remoteCurrent := 0
-		if remoteRec != nil {
+		if remoteRec := remoteEnv.Vars[k]; remoteRec != nil {
 			remoteCurrent = remoteRec.CurrentVersion
 		}
-		if remoteCurrent > localRec.LastSyncedRemoteVersion && localRec.CurrentVersion > localRec.LastSyncedRemoteVersion {
+		if remoteCurrent > localRec.LastSyncedRemoteVersion && localRec.CurrentVersion > localRec.LastSyncedRemoteVersion && !sameCurrentVersion(localRec, remoteEnv.Vars[k]) {
 			conflicts = append(conflicts, k)
+			if !force {
+				continue
+			}
+		} else if localRec.CurrentVersion < remoteCurrent {
 			continue
 		}
-		if localRec.CurrentVersion >= remoteCurrent {
-			copyRec := *localRec
-			remoteEnv.Vars[k] = &copyRec
-			localRec.LastSyncedRemoteVersion = localRec.CurrentVersion
-		}
+		copyRec := *localRec
+		copyRec.LastSyncedRemoteVersion = localRec.CurrentVersion
+		remoteEnv.Vars[k] = &copyRec
+		pushed = append(pushed, k)
 	}
-	if len(conflicts) > 0 && !force {
-		return fmt.Errorf("push conflicts for keys: %s (rerun with --force)", strings.Join(conflicts, ", "))
-	}
-	if len(conflicts) > 0 && force {
-		for _, k := range conflicts {
-			localRec := localEnv.Vars[k]
-			copyRec := *localRec
-			remoteEnv.Vars[k] = &copyRec
-			localRec.LastSyncedRemoteVersion = localRec.CurrentVersion
+	return pushed, conflicts
+}
+
+func (a *App) Pull(forceRemote bool) error {
+	_, err := a.pull(forceRemote, "", false)
+	return err
+}
+
+// PullOptions controls envsync pull. Force takes the remote value of
+// conflicting keys, Strategy (ours, theirs, newest or prompt) settles them
+// instead; Reveal shows values in prompts.
+type PullOptions struct {
+	Force    bool
+	Strategy string
+	Reveal   bool
+}
+
+func (a *App) PullWith(opts PullOptions) error {
+	if opts.Strategy != "" {
+		if err := validateStrategy(opts.Strategy); err != nil {
+			return err
 		}
 	}
-	if err := a.saveRemoteStore(remote, expectedRevision); err != nil {
+	_, err := a.pull(opts.Force, opts.Strategy, opts.Reveal)
+	return err
+}
+
+// Resolve pulls the active environment, settles conflicting keys with
+// strategy, and pushes any keys resolved in favour of the local value.
+func (a *App) Resolve(strategy string, reveal bool) error {
+	if strategy == "" {
+		strategy = strategyPrompt
+	}
+	if err := validateStrategy(strategy); err != nil {
 		return err
 	}
-	if err := a.saveState(state); err != nil {
+	pending, err := a.pull(false, strategy, reveal)
+	if err != nil || pending == 0 {
 		return err
 	}
-	fmt.Fprintln(a.Stdout, cSuccess("push complete"))
-	a.logAudit("push", state, map[string]any{"project": projName, "env": envName, "force": force})
-	return nil
+	return a.push(PushOptions{})
 }
 
-func (a *App) Pull(forceRemote bool) error {
+// pull returns how many keys now hold a local resolution that still needs
+// to be pushed.
+func (a *App) pull(forceRemote bool, strategy string, reveal bool) (int, error) {
+	unlock, err := a.lockState()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
 	state, err := a.loadState()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	proj, projName, err := currentProject(state, a.CWD)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if err := a.requireProjectRole(state, proj, roleAdmin, roleWriter, roleReader); err != nil {
-		return err
+		return 0, err
 	}
 	envName := state.CurrentEnv
 	if envName == "" {
@@ -1249,36 +2005,81 @@ func (a *App) Pull(forceRemote bool) error {
 		proj.Envs[envName] = &Env{Name: envName, Vars: map[string]*SecretRecord{}}
 	}
 	localEnv := proj.Envs[envName]
-	remote, err := a.loadRemoteStore()
+	remote, err := a.loadProjectRemote(state, projName, proj)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if len(remote.Teams) > 0 {
-		state.Teams = cloneTeams(remote.Teams)
+		id, err := a.memberIdentity(state)
+		if err != nil {
+			return 0, err
+		}
+		if state.Teams, err = verifiedTeams(id, state.Teams, remote.Teams); err != nil {
+			return 0, err
+		}
 	}
-	if err := validateRemoteCrypto(state, remote); err != nil {
-		return err
+	if err := checkRemoteKeys(state, remote, projName, nil); err != nil {
+		return 0, err
 	}
 	remoteProject := remote.Projects[projName]
+	if remoteProject != nil && remoteProject.DataKeyID != "" {
+		if err := a.adoptProjectKeys(state, proj, remoteProject); err != nil {
+			return 0, err
+		}
+	}
+	var resolver *conflictResolver
+	if strategy != "" {
+		if resolver, err = a.newConflictResolver(state, proj, envName, strategy, reveal); err != nil {
+			return 0, err
+		}
+	}
 	if remoteProject == nil {
 		fmt.Fprintln(a.Stdout, cDim("nothing to pull"))
-		return nil
+		return 0, nil
+	}
+	if newerSchema(remoteProject.Schema, proj.Schema) {
+		proj.Schema = remoteProject.Schema
+		fmt.Fprintf(a.Stdout, "%s %s\n", cDim("pulled schema"), cBold(fmt.Sprintf("v%d", proj.Schema.Version)))
+	}
+	if adoptSealedInfo(proj, remoteProject) {
+		fmt.Fprintf(a.Stdout, "%s %s\n", cDim("project metadata is sealed as"), cBold(proj.Sealed.ID))
 	}
 	remoteEnv := remoteProject.Envs[envName]
 	if remoteEnv == nil {
 		fmt.Fprintln(a.Stdout, cDim("nothing to pull"))
-		return nil
+		return 0, nil
+	}
+	if remoteEnv.Parent != "" {
+		localEnv.Parent = remoteEnv.Parent
+		adopted, err := adoptRemoteAncestors(proj, remoteProject, remoteEnv)
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range adopted {
+			fmt.Fprintf(a.Stdout, "%s %s\n", cDim("pulled inherited environment"), cBold(name))
+		}
 	}
 	conflicts := []string{}
-	for k, remoteRec := range remoteEnv.Vars {
+	pulled := []string{}
+	unbound := []string{}
+	for _, k := range sortedKeys(remoteEnv.Vars) {
+		remoteRec := remoteEnv.Vars[k]
 		localRec := localEnv.Vars[k]
+		if hasUnboundRecord(remoteRec) {
+			// Nothing ties a version an older envsync sealed to this key, so
+			// it may have been copied here from another one. The local copy
+			// stays until a device that holds it bound pushes it again.
+			unbound = append(unbound, k)
+			continue
+		}
 		if localRec == nil {
 			copyRec := *remoteRec
 			copyRec.LastSyncedRemoteVersion = remoteRec.CurrentVersion
 			localEnv.Vars[k] = &copyRec
+			pulled = append(pulled, k)
 			continue
 		}
-		if remoteRec.CurrentVersion > localRec.LastSyncedRemoteVersion && localRec.CurrentVersion > localRec.LastSyncedRemoteVersion {
+		if remoteRec.CurrentVersion > localRec.LastSyncedRemoteVersion && localRec.CurrentVersion > localRec.LastSyncedRemoteVersion && !sameCurrentVersion(localRec, remoteRec) {
 			conflicts = append(conflicts, k)
 			continue
 		}
@@ -1286,10 +2087,27 @@ func (a *App) Pull(forceRemote bool) error {
 			copyRec := *remoteRec
 			copyRec.LastSyncedRemoteVersion = remoteRec.CurrentVersion
 			localEnv.Vars[k] = &copyRec
+			if remoteRec.CurrentVersion != localRec.CurrentVersion {
+				pulled = append(pulled, k)
+			}
+		}
+	}
+	var resolved map[string]*SecretRecord
+	pending := 0
+	if len(conflicts) > 0 && resolver != nil {
+		resolved, conflicts, err = resolver.resolveAll(conflicts, localEnv, remoteEnv)
+		if err != nil {
+			return 0, err
+		}
+		for k, rec := range resolved {
+			if rec.CurrentVersion > rec.LastSyncedRemoteVersion {
+				pending++
+			}
+			localEnv.Vars[k] = rec
 		}
 	}
 	if len(conflicts) > 0 && !forceRemote {
-		return fmt.Errorf("pull conflicts for keys: %s (rerun with --force-remote)", strings.Join(conflicts, ", "))
+		return 0, fmt.Errorf("pull conflicts for keys: %s (rerun with --force-remote or --strategy)", strings.Join(conflicts, ", "))
 	}
 	if len(conflicts) > 0 && forceRemote {
 		for _, k := range conflicts {
@@ -1297,14 +2115,36 @@ func (a *App) Pull(forceRemote bool) error {
 			copyRec := *remoteRec
 			copyRec.LastSyncedRemoteVersion = remoteRec.CurrentVersion
 			localEnv.Vars[k] = &copyRec
+			pulled = append(pulled, k)
+		}
+	}
+	if len(unbound) > 0 {
+		fmt.Fprintf(a.Stderr, "warning: skipped %s: the remote copies were sealed without their location by an older envsync; run `envsync init` and `envsync push` on an upgraded device that holds them\n", strings.Join(unbound, ", "))
+	}
+	// Records from a remote an older envsync pushed may hold unkeyed value
+	// hashes.
+	if hasLegacyHashes(map[string]*Project{projName: proj}) {
+		if keys, err := a.unwrapProjectKeys(state, proj); err == nil {
+			if _, err := rehashVersions(proj, keys); err != nil {
+				return 0, err
+			}
 		}
 	}
 	if err := a.saveState(state); err != nil {
-		return err
+		return 0, err
 	}
 	fmt.Fprintln(a.Stdout, cSuccess("pull complete"))
-	a.logAudit("pull", state, map[string]any{"project": projName, "env": envName, "force_remote": forceRemote})
-	return nil
+	sort.Strings(pulled)
+	fields := map[string]any{
+		"project": projName, "env": envName, "force_remote": forceRemote,
+		"keys": pulled, "revision": remote.Revision,
+	}
+	if strategy != "" {
+		fields["strategy"] = strategy
+		fields["resolved"] = sortedKeys(resolved)
+	}
+	a.logAudit("pull", state, fields)
+	return pending, nil
 }
 
 func (a *App) Diff() error {
@@ -1326,9 +2166,11 @@ func (a *App) Diff() error {
 	localEnv := proj.Envs[envName]
 	if localEnv == nil {
 		localEnv = &Env{Name: envName, Vars: map[string]*SecretRecord{}}
+	} else if localEnv, _, err = effectiveEnv(proj, localEnv); err != nil {
+		return err
 	}
 
-	remote, err := a.loadRemoteStore()
+	remote, err := a.loadProjectRemote(state, projName, proj)
 	if err != nil {
 		return err
 	}
@@ -1339,6 +2181,8 @@ func (a *App) Diff() error {
 	}
 	if remoteEnv == nil {
 		remoteEnv = &Env{Name: envName, Vars: map[string]*SecretRecord{}}
+	} else if remoteEnv, _, err = effectiveEnv(remoteProject, remoteEnv); err != nil {
+		return err
 	}
 
 	// Gather all keys from both sides.
@@ -1384,11 +2228,16 @@ func (a *App) Diff() error {
 		}
 
 		if localVer == remoteVer && localDeleted == remoteDeleted {
-			// Check hash too for content differences.
+			// Check hash too for content differences. While only one side
+			// has rewritten its unkeyed hash the two cannot be compared, and
+			// the same version is taken to hold the same value.
 			if localRec != nil && remoteRec != nil &&
-				len(localRec.Versions) > 0 && len(remoteRec.Versions) > 0 &&
-				localRec.Versions[len(localRec.Versions)-1].PlainHash == remoteRec.Versions[len(remoteRec.Versions)-1].PlainHash {
-				continue
+				len(localRec.Versions) > 0 && len(remoteRec.Versions) > 0 {
+				localHash := localRec.Versions[len(localRec.Versions)-1].PlainHash
+				remoteHash := remoteRec.Versions[len(remoteRec.Versions)-1].PlainHash
+				if localHash == remoteHash || !sameHashScheme(localHash, remoteHash) {
+					continue
+				}
 			}
 			if localRec == nil && remoteRec == nil {
 				continue
@@ -1436,7 +2285,10 @@ func (a *App) PhraseSave() error {
 	if err != nil {
 		return err
 	}
-	key := deriveKey(phrase, salt)
+	key, err := deriveKey(phrase, salt, state.KDF)
+	if err != nil {
+		return err
+	}
 	if !hmac.Equal(expected, keyCheck(key)) {
 		return errors.New("invalid recovery phrase")
 	}
@@ -1461,10 +2313,7 @@ func (a *App) PhraseClear() error {
 }
 
 func (a *App) readPhrase() (string, error) {
-	if phrase := strings.TrimSpace(os.Getenv("ENVSYNC_RECOVERY_PHRASE")); phrase != "" {
-		return phrase, nil
-	}
-	if phrase, err := a.phraseFromKeychain(); err == nil && phrase != "" {
+	if phrase := a.storedPhrase(); phrase != "" {
 		return phrase, nil
 	}
 	fmt.Fprint(a.Stderr, "Recovery phrase: ")
@@ -1480,8 +2329,25 @@ func (a *App) readPhrase() (string, error) {
 	return phrase, nil
 }
 
+// storedPhrase returns the recovery phrase from the environment or the
+// keychain without prompting, or "" if neither has one.
+func (a *App) storedPhrase() string {
+	if phrase := strings.TrimSpace(os.Getenv("ENVSYNC_RECOVERY_PHRASE")); phrase != "" {
+		return phrase
+	}
+	if phrase, err := a.phraseFromKeychain(); err == nil && phrase != "" {
+		return phrase
+	}
+	return ""
+}
+
+// getSecretKey returns the vault key, asking a running agent first and
+// otherwise deriving it from the recovery phrase.
 func (a *App) getSecretKey(state *State) ([]byte, error) {
 	if a.phraseCache == "" {
+		if key := a.agentKey(state); key != nil {
+			return key, nil
+		}
 		phrase, err := a.readPhrase()
 		if err != nil {
 			return nil, err
@@ -1492,7 +2358,16 @@ func (a *App) getSecretKey(state *State) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	key := deriveKey(a.phraseCache, salt)
+	// Deriving is deliberately slow; reuse the key while phrase, salt and
+	// KDF parameters stay the same.
+	if cacheFor := a.phraseCache + "\x00" + state.SaltB64 + "\x00" + kdfOf(state.KDF).String(); a.vaultKeyFor != cacheFor {
+		key, err := deriveKey(a.phraseCache, salt, state.KDF)
+		if err != nil {
+			return nil, err
+		}
+		a.vaultKey, a.vaultKeyFor = key, cacheFor
+	}
+	key := a.vaultKey
 	expected, err := base64.StdEncoding.DecodeString(state.KeyCheckB64)
 	if err != nil {
 		return nil, err
@@ -1503,111 +2378,210 @@ func (a *App) getSecretKey(state *State) ([]byte, error) {
 	return key, nil
 }
 
-func (a *App) writeSecretVersion(state *State, rec *SecretRecord, value string, rotated bool, expiresAt string) (int, error) {
-	secretKey, err := a.getSecretKey(state)
-	if err != nil {
-		return 0, err
-	}
-	ct, nonce, hash, err := encrypt(secretKey, value)
-	if err != nil {
-		return 0, err
-	}
+// writeSecretVersion seals value as the next version of rec, the record of
+// keyName in envName.
+func (a *App) writeSecretVersion(state *State, keys *projectKeys, envName, keyName string, rec *SecretRecord, value string, rotated bool, expiresAt string) (int, error) {
 	next := rec.CurrentVersion + 1
-	rec.CurrentVersion = next
-	rec.Versions = append(rec.Versions, SecretVersion{
+	v := SecretVersion{
 		Version:   next,
-		NonceB64:  base64.StdEncoding.EncodeToString(nonce),
-		CipherB64: base64.StdEncoding.EncodeToString(ct),
 		Deleted:   false,
 		Rotated:   rotated,
 		ExpiresAt: expiresAt,
 		UpdatedAt: a.Now().UTC().Format(time.RFC3339),
 		DeviceID:  state.DeviceID,
-		PlainHash: hash,
-	})
+	}
+	if err := keys.seal(&v, envName, keyName, value); err != nil {
+		return 0, err
+	}
+	rec.CurrentVersion = next
+	rec.Versions = append(rec.Versions, v)
 	return next, nil
 }
 
+// ImportOptions controls envsync import. Format is dotenv, docker, json or
+// yaml; empty picks one from the file extension. DryRun reports which keys
+// would be added or changed without writing anything.
+type ImportOptions struct {
+	Format     string
+	DryRun     bool
+	NoValidate bool
+}
+
 func (a *App) ImportEnv(file string) error {
+	return a.ImportEnvWith(file, ImportOptions{})
+}
+
+// ImportEnvWith writes every key in file that is new or differs from its
+// current value as one new version each, in a single state update.
+func (a *App) ImportEnvWith(file string, opts ImportOptions) error {
+	format, err := importFormat(file, opts.Format)
+	if err != nil {
+		return err
+	}
 	b, err := os.ReadFile(file)
 	if err != nil {
 		return err
 	}
-	scanner := bufio.NewScanner(bytes.NewReader(b))
-	count := 0
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
+	entries, issues, err := parseEnvFile(b, format)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for _, issue := range issues {
+		fmt.Fprintln(a.Stderr, cWarn("%s:%d: skipped: %s", file, issue.Line, issue.Reason))
+	}
+	// A key assigned twice keeps its last value, as when a shell sources the file.
+	values := map[string]string{}
+	for _, e := range entries {
+		values[e.Key] = e.Value
+	}
+
+	tx, err := a.beginSecretTx("", "")
+	if err != nil {
+		return err
+	}
+	defer tx.close()
+	var added, changed, unchanged []string
+	for _, k := range sortedKeys(values) {
+		rec := tx.env.Vars[k]
+		if rec == nil || len(rec.Versions) == 0 || rec.Versions[len(rec.Versions)-1].Deleted {
+			added = append(added, k)
 			continue
 		}
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
+		// Value hashes are keyed, so telling a changed value needs the key.
+		keys, err := tx.keys()
+		if err != nil {
+			return err
+		}
+		if keys.matches(rec.Versions[len(rec.Versions)-1], values[k]) {
+			unchanged = append(unchanged, k)
+		} else {
+			changed = append(changed, k)
+		}
+	}
+	var invalid []string
+	if !opts.NoValidate {
+		schema, _, err := a.schemaFor(tx.project)
+		if err != nil {
+			return err
+		}
+		for _, k := range sortedKeys(values) {
+			if schema == nil {
+				break
+			}
+			if reason := schema.checkStored(k, values[k]); reason != "" {
+				invalid = append(invalid, k+": "+reason)
+			}
+		}
+	}
+	summary := fmt.Sprintf("(%d added, %d changed, %d unchanged)", len(added), len(changed), len(unchanged))
+	if opts.DryRun {
+		for _, line := range invalid {
+			fmt.Fprintf(a.Stdout, "  %s %s\n", cError("!"), line)
 		}
-		k := strings.TrimSpace(parts[0])
-		v := strings.TrimSpace(parts[1])
-		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[0] == v[len(v)-1] {
-			v = v[1 : len(v)-1]
+		for _, k := range added {
+			fmt.Fprintf(a.Stdout, "  %s %s\n", cSuccess("+"), cBold(k))
 		}
-		if err := a.Set(k, v, ""); err != nil {
-			return fmt.Errorf("failed to import %s: %w", k, err)
+		for _, k := range changed {
+			fmt.Fprintf(a.Stdout, "  %s %s\n", cWarn("~"), cBold(k))
 		}
-		count++
+		for _, k := range unchanged {
+			fmt.Fprintf(a.Stdout, "  %s %s\n", cDim("="), cDim(k))
+		}
+		fmt.Fprintf(a.Stdout, "%s %s\n", cDim("dry run, nothing written"), summary)
+		return nil
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%s breaks the schema (rerun with --no-validate to import anyway):\n  %s", file, strings.Join(invalid, "\n  "))
 	}
-	fmt.Fprintf(a.Stdout, "%s %d variables from %s\n", cSuccess("imported"), count, cBold(file))
+
+	for _, k := range append(added, changed...) {
+		if _, err := tx.set(k, values[k], false, ""); err != nil {
+			return err
+		}
+	}
+	if err := tx.commit("import", map[string]any{
+		"file":    filepath.Base(file),
+		"format":  format,
+		"skipped": len(issues),
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.Stdout, "%s %d variables from %s %s\n", cSuccess("imported"), len(added)+len(changed), cBold(file), cDim(summary))
 	return nil
 }
 
+// ExportOptions controls envsync export. Format is one of dotenv, json,
+// yaml, k8s-secret, docker, systemd, tfvars or shell; empty picks one from
+// the file extension. Name and Namespace fill in a k8s-secret manifest. Raw
+// skips ${...} expansion.
+type ExportOptions struct {
+	Format    string
+	Name      string
+	Namespace string
+	Raw       bool
+}
+
 func (a *App) ExportEnv(file string) error {
-	state, err := a.loadState()
+	return a.ExportEnvWith(file, ExportOptions{})
+}
+
+// ExportEnvWith writes the current env to file, or to stdout when file is
+// "-".
+func (a *App) ExportEnvWith(file string, opts ExportOptions) error {
+	format, err := exportFormat(file, opts.Format)
 	if err != nil {
 		return err
 	}
-	secretKey, err := a.getSecretKey(state)
+	for _, name := range []string{opts.Name, opts.Namespace} {
+		if name != "" {
+			if err := validK8sName(name); err != nil {
+				return err
+			}
+		}
+	}
+	state, err := a.loadState()
 	if err != nil {
 		return err
 	}
-	project, _, err := currentProject(state, a.CWD)
+	project, projName, err := currentProject(state, a.CWD)
 	if err != nil {
 		return err
 	}
 	if err := a.requireProjectRole(state, project, roleAdmin, roleWriter, roleReader); err != nil {
 		return err
 	}
+	projKeys, err := a.keysFor(state, project)
+	if err != nil {
+		return err
+	}
 	env, err := currentEnv(state, a.CWD)
 	if err != nil {
 		return err
 	}
-	var buf bytes.Buffer
-	keys := make([]string, 0, len(env.Vars))
-	for k := range env.Vars {
-		keys = append(keys, k)
+	values, err := a.activeValues(projKeys, project, env)
+	if err != nil {
+		return err
 	}
-	sort.Strings(keys)
-	exported := 0
-	for _, k := range keys {
-		rec := env.Vars[k]
-		if len(rec.Versions) == 0 {
-			continue
-		}
-		v := rec.Versions[len(rec.Versions)-1]
-		if v.Deleted {
-			continue
-		}
-		value, err := decrypt(secretKey, v)
-		if err != nil {
+	if !opts.Raw {
+		if values, err = a.interpolate(state, projName, env.Name, values); err != nil {
 			return err
 		}
-		if strings.ContainsAny(value, " \n\r\t\"'") {
-			buf.WriteString(fmt.Sprintf("%s=%q\n", k, value))
-		} else {
-			buf.WriteString(fmt.Sprintf("%s=%s\n", k, value))
-		}
-		exported++
 	}
-	if err := os.WriteFile(file, buf.Bytes(), 0o600); err != nil {
+	name := opts.Name
+	if name == "" {
+		name = k8sSecretName(projName, env.Name)
+	}
+	out, err := encodeEnv(format, values, !opts.Raw, name, opts.Namespace)
+	if err != nil {
+		return err
+	}
+	if file == "-" {
+		_, err := a.Stdout.Write(out)
+		return err
+	}
+	if err := os.WriteFile(file, out, 0o600); err != nil {
 		return err
 	}
-	fmt.Fprintf(a.Stdout, "%s %d variables to %s\n", cSuccess("exported"), exported, cBold(file))
+	fmt.Fprintf(a.Stdout, "%s %d variables to %s\n", cSuccess("exported"), len(values), cBold(file))
 	return nil
 }
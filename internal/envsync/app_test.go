@@ -26,12 +26,13 @@ func TestMain(m *testing.M) {
 
 func TestEncryptDecryptRoundTrip(t *testing.T) {
 	key := []byte("01234567890123456789012345678901")
-	ct, nonce, _, err := encrypt(key, "hello")
+	aad := versionAAD("api", "dev", "GREETING", 1)
+	ct, nonce, _, err := encrypt(key, "hello", aad)
 	if err != nil {
 		t.Fatalf("encrypt: %v", err)
 	}
-	v := SecretVersion{NonceB64: encode(nonce), CipherB64: encode(ct)}
-	out, err := decrypt(key, v)
+	v := SecretVersion{Version: 1, NonceB64: encode(nonce), CipherB64: encode(ct), AAD: aadV1}
+	out, err := decrypt(key, v, aad)
 	if err != nil {
 		t.Fatalf("decrypt: %v", err)
 	}
@@ -146,7 +147,7 @@ func TestInitReRunUpgradesLegacyStateSchema(t *testing.T) {
 	if err := app.Init(); err != nil {
 		t.Fatalf("re-run init: %v", err)
 	}
-	if out := stdout.String(); !strings.Contains(out, "v1 -> v2") {
+	if out := stdout.String(); !strings.Contains(out, fmt.Sprintf("v1 -> v%d", currentStateSchemaVersion)) {
 		t.Fatalf("expected upgrade message, got %q", out)
 	}
 
@@ -499,7 +500,7 @@ func TestTeamRBACReaderCannotSet(t *testing.T) {
 	if err := app.Set("TOKEN", "abc", ""); err != nil {
 		t.Fatalf("admin set: %v", err)
 	}
-	if err := app.TeamAddMember("core", "viewer", roleReader); err != nil {
+	if err := app.TeamAddMemberWith("core", "viewer", AddMemberOptions{Role: roleReader, PublicKey: devicePublicKey(t, app)}); err != nil {
 		t.Fatalf("add member: %v", err)
 	}
 
@@ -601,7 +602,7 @@ func TestTeamRBACPrivilegedOperations(t *testing.T) {
 	if err := app.Push(false); err != nil {
 		t.Fatalf("admin push: %v", err)
 	}
-	if err := app.TeamAddMember("core", "viewer", roleReader); err != nil {
+	if err := app.TeamAddMemberWith("core", "viewer", AddMemberOptions{Role: roleReader, PublicKey: devicePublicKey(t, app)}); err != nil {
 		t.Fatalf("add member: %v", err)
 	}
 
@@ -1102,6 +1103,124 @@ func TestAuditRotationBySize(t *testing.T) {
 	}
 }
 
+func TestAuditSearchesRotatedFiles(t *testing.T) {
+	tmp := t.TempDir()
+	now := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	stdout := &bytes.Buffer{}
+	app := &App{
+		AuditPath:     filepath.Join(tmp, "audit.log"),
+		CWD:           tmp,
+		Stdout:        stdout,
+		Stderr:        &bytes.Buffer{},
+		Now:           func() time.Time { return now },
+		AuditMaxBytes: 256,
+		AuditMaxFiles: 10,
+	}
+	state := &State{DeviceID: "dev1"}
+	for i := 0; i < 12; i++ {
+		now = now.Add(24 * time.Hour)
+		key := "OTHER"
+		if i%3 == 0 {
+			key = "PROD_DB_URL"
+		}
+		app.logAudit("set", state, map[string]any{"key": key, "version": i + 1})
+	}
+	app.logAudit("push", state, map[string]any{"keys": []string{"A", "PROD_DB_URL"}, "from_revision": 4, "to_revision": 5})
+	if _, err := os.Stat(app.AuditPath + ".1"); err != nil {
+		t.Fatalf("expected rotated audit file: %v", err)
+	}
+
+	filter := AuditFilter{Key: "PROD_DB_URL", Since: "2026-09-05"}
+	if err := app.Audit(filter, false, true); err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	var out struct {
+		Events []map[string]any `json:"events"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	var got []string
+	for _, e := range out.Events {
+		got = append(got, fmt.Sprint(e["action"], " ", e["ts"]))
+	}
+	want := []string{
+		"push 2026-09-13T00:00:00Z",
+		"set 2026-09-11T00:00:00Z",
+		"set 2026-09-08T00:00:00Z",
+		"set 2026-09-05T00:00:00Z",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+
+	stdout.Reset()
+	if err := app.Audit(AuditFilter{Action: "push"}, false, false); err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "keys=A,PROD_DB_URL") || !strings.Contains(stdout.String(), "rev 4->5") {
+		t.Fatalf("unexpected output: %q", stdout.String())
+	}
+	if err := app.Audit(AuditFilter{Since: "last month"}, false, false); err == nil {
+		t.Fatal("expected invalid --since to fail")
+	}
+}
+
 func encode(b []byte) string {
 	return base64.StdEncoding.EncodeToString(b)
 }
+
+// newTestApp initializes envsync in a temp config dir, exports the generated
+// recovery phrase, and creates and selects the "api" project.
+func newTestApp(t *testing.T) (*App, *bytes.Buffer) {
+	t.Helper()
+	tmp := t.TempDir()
+	cwd := filepath.Join(tmp, "repo")
+	if err := os.MkdirAll(cwd, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stdout := &bytes.Buffer{}
+	app := &App{
+		ConfigDir:  filepath.Join(tmp, "cfg"),
+		StatePath:  filepath.Join(tmp, "cfg", "state.json"),
+		RemotePath: filepath.Join(tmp, "cfg", "remote.json"),
+		CWD:        cwd,
+		Stdin:      strings.NewReader(""),
+		Stdout:     stdout,
+		Stderr:     &bytes.Buffer{},
+		Now:        func() time.Time { return time.Unix(0, 0).UTC() },
+	}
+	if err := app.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	t.Setenv("ENVSYNC_RECOVERY_PHRASE", lines[len(lines)-1])
+	if err := app.ProjectCreate("api"); err != nil {
+		t.Fatalf("project create: %v", err)
+	}
+	if err := app.ProjectUse("api"); err != nil {
+		t.Fatalf("project use: %v", err)
+	}
+	stdout.Reset()
+	return app, stdout
+}
+
+func TestTeamsForPushKeepsRemoteMembershipForNonAdmins(t *testing.T) {
+	remote := map[string]*Team{
+		"core": {Name: "core", Members: map[string]string{"alice": roleAdmin, "bob": roleReader, "carol": roleMaintainer}},
+	}
+	local := map[string]*Team{
+		"core": {Name: "core", Members: map[string]string{"alice": roleAdmin, "bob": roleAdmin}, PublicKeys: map[string]string{"bob": "bob-key"}},
+		"solo": {Name: "solo", Members: map[string]string{"bob": roleAdmin}},
+	}
+	got := teamsForPush(remote, local, "bob")
+	if got["core"].Members["bob"] != roleReader || got["core"].Members["carol"] != roleMaintainer {
+		t.Fatalf("non-admin push rewrote membership: %+v", got["core"].Members)
+	}
+	if got["core"].PublicKeys["bob"] != "bob-key" {
+		t.Fatalf("expected bob's public key to be published, got %+v", got["core"].PublicKeys)
+	}
+	if got["solo"] == nil {
+		t.Fatal("expected a team the actor administers to be pushed")
+	}
+}
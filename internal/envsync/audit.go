@@ -1,10 +1,18 @@
 package envsync
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -97,3 +105,287 @@ func (a *App) pruneAuditByAge() {
 		}
 	}
 }
+
+// AuditFilter selects audit events. Empty fields match everything. Since and
+// Until take RFC 3339 timestamps or YYYY-MM-DD dates; Since is inclusive and
+// Until exclusive.
+type AuditFilter struct {
+	Key    string
+	Action string
+	Actor  string
+	Since  string
+	Until  string
+}
+
+// Audit prints matching audit events newest first: the local audit log and
+// its rotated files, or with remote the cloud events of the current
+// project's vault.
+func (a *App) Audit(filter AuditFilter, remote, asJSON bool) error {
+	since, err := parseAuditTime(filter.Since)
+	if err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+	until, err := parseAuditTime(filter.Until)
+	if err != nil {
+		return fmt.Errorf("--until: %w", err)
+	}
+	var events []map[string]any
+	if remote {
+		events, err = a.remoteAuditEvents(filter)
+	} else {
+		events, err = a.localAuditEvents()
+	}
+	if err != nil {
+		return err
+	}
+	matched := []map[string]any{}
+	for _, e := range events {
+		if auditMatches(e, filter, since, until) {
+			matched = append(matched, e)
+		}
+	}
+	if asJSON {
+		return json.NewEncoder(a.Stdout).Encode(map[string]any{"events": matched})
+	}
+	if len(matched) == 0 {
+		fmt.Fprintln(a.Stdout, cDim("no audit events"))
+		return nil
+	}
+	for _, e := range matched {
+		fmt.Fprintln(a.Stdout, formatAuditEvent(e))
+	}
+	return nil
+}
+
+// localAuditEvents reads the audit log and its rotated files, newest first.
+// Lines that do not parse are skipped.
+func (a *App) localAuditEvents() ([]map[string]any, error) {
+	if a.AuditPath == "" {
+		return nil, nil
+	}
+	matches, err := filepath.Glob(a.AuditPath + ".*")
+	if err != nil {
+		return nil, err
+	}
+	rotated := map[int]string{}
+	for _, p := range matches {
+		if n, err := strconv.Atoi(strings.TrimPrefix(p, a.AuditPath+".")); err == nil && n > 0 {
+			rotated[n] = p
+		}
+	}
+	numbers := make([]int, 0, len(rotated))
+	for n := range rotated {
+		numbers = append(numbers, n)
+	}
+	// Higher suffixes are older; read oldest first, then reverse.
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+	paths := make([]string, 0, len(numbers)+1)
+	for _, n := range numbers {
+		paths = append(paths, rotated[n])
+	}
+	paths = append(paths, a.AuditPath)
+
+	var events []map[string]any
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var e map[string]any
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				events = append(events, e)
+			}
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.Reverse(events)
+	return events, nil
+}
+
+// remoteAuditEvents pages through GET /v1/audit for the current project's
+// vault. The server applies the filter; events come back newest first with
+// their metadata flattened into the event like local entries.
+func (a *App) remoteAuditEvents(filter AuditFilter) ([]map[string]any, error) {
+	if a.effectiveRemoteMode() != "cloud" {
+		return nil, errors.New("audit --remote needs a cloud remote; run envsync login")
+	}
+	state, err := a.loadState()
+	if err != nil {
+		return nil, err
+	}
+	proj, projName, err := currentProject(state, a.CWD)
+	if err != nil {
+		return nil, err
+	}
+	token, err := a.cloudAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	query := projectScope(projName, proj).query()
+	for name, value := range map[string]string{
+		"key": filter.Key, "action": filter.Action, "actor": filter.Actor,
+		"since": filter.Since, "until": filter.Until,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	var events []map[string]any
+	for {
+		var page struct {
+			Events []struct {
+				ID         string         `json:"id"`
+				TS         string         `json:"ts"`
+				Actor      string         `json:"actor"`
+				ActorEmail string         `json:"actor_email"`
+				Action     string         `json:"action"`
+				Project    string         `json:"project"`
+				Metadata   map[string]any `json:"metadata"`
+			} `json:"events"`
+			NextCursor string `json:"next_cursor"`
+		}
+		err := a.withHTTPRetry(func() (bool, error) {
+			req, err := http.NewRequest(http.MethodGet, a.cloudBaseURL()+"/v1/audit?"+query.Encode(), nil)
+			if err != nil {
+				return false, err
+			}
+			addAuthHeader(req, token)
+			resp, err := a.httpClient().Do(req)
+			if err != nil {
+				return isRetryableNetworkError(err), err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusNotFound {
+				return false, errors.New("cloud server does not support audit queries")
+			}
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+				err := fmt.Errorf("remote audit query failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+				return isRetryableStatus(resp.StatusCode), err
+			}
+			return false, json.NewDecoder(resp.Body).Decode(&page)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page.Events {
+			event := map[string]any{}
+			for k, v := range e.Metadata {
+				event[k] = v
+			}
+			actor := e.ActorEmail
+			if actor == "" {
+				actor = e.Actor
+			}
+			event["id"] = e.ID
+			event["ts"] = e.TS
+			event["actor"] = actor
+			event["action"] = e.Action
+			event["project"] = e.Project
+			events = append(events, event)
+		}
+		if page.NextCursor == "" {
+			return events, nil
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+}
+
+// parseAuditTime accepts RFC 3339 timestamps and plain dates.
+func parseAuditTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (want RFC 3339 or YYYY-MM-DD)", s)
+	}
+	return t, nil
+}
+
+func auditMatches(e map[string]any, filter AuditFilter, since, until time.Time) bool {
+	if filter.Action != "" && e["action"] != filter.Action {
+		return false
+	}
+	if filter.Actor != "" && e["actor"] != filter.Actor {
+		return false
+	}
+	if !since.IsZero() || !until.IsZero() {
+		ts, err := time.Parse(time.RFC3339, fmt.Sprint(e["ts"]))
+		if err != nil || (!since.IsZero() && ts.Before(since)) || (!until.IsZero() && !ts.Before(until)) {
+			return false
+		}
+	}
+	return filter.Key == "" || slices.Contains(auditKeys(e), filter.Key)
+}
+
+// auditKeys collects the secret keys an event names: "key" on set, rotate
+// and friends, "keys" on push and pull, and "changes" on cloud events.
+func auditKeys(e map[string]any) []string {
+	var keys []string
+	if k, ok := e["key"].(string); ok && k != "" {
+		keys = append(keys, k)
+	}
+	for _, field := range []string{"keys", "resolved"} {
+		if list, ok := e[field].([]any); ok {
+			for _, k := range list {
+				if s, ok := k.(string); ok {
+					keys = append(keys, s)
+				}
+			}
+		}
+	}
+	if changes, ok := e["changes"].([]any); ok {
+		for _, c := range changes {
+			if change, ok := c.(map[string]any); ok {
+				if s, ok := change["key"].(string); ok {
+					keys = append(keys, s)
+				}
+			}
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+func formatAuditEvent(e map[string]any) string {
+	str := func(k string) string {
+		s, _ := e[k].(string)
+		return s
+	}
+	where := str("project")
+	if env := str("environment"); env != "" && where != "" {
+		where += "/" + env
+	}
+	actor := str("actor")
+	if actor == "" {
+		actor = "-"
+	}
+	parts := []string{cDim(str("ts")), actor, cBold(str("action"))}
+	if where != "" {
+		parts = append(parts, where)
+	}
+	if keys := auditKeys(e); len(keys) > 0 {
+		parts = append(parts, "keys="+strings.Join(keys, ","))
+	}
+	if from, ok := e["from_revision"].(float64); ok {
+		if to, ok := e["to_revision"].(float64); ok {
+			parts = append(parts, cDim(fmt.Sprintf("rev %d->%d", int(from), int(to))))
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -260,6 +260,45 @@ func (a *App) hasCloudSession() bool {
 }
 
 func (a *App) cloudMe(token string) (map[string]any, error) {
+	payload, err := a.cloudMePayload(token)
+	if err != nil {
+		return nil, err
+	}
+	if user, ok := payload["user"].(map[string]any); ok {
+		return user, nil
+	}
+	return payload, nil
+}
+
+// cloudMemberships returns one scope per organization and team the token's
+// user belongs to, in the order the server reports them.
+func (a *App) cloudMemberships(token string) ([]remoteScope, error) {
+	payload, err := a.cloudMePayload(token)
+	if err != nil {
+		return nil, err
+	}
+	scopes := []remoteScope{}
+	orgs, _ := payload["organizations"].([]any)
+	for _, raw := range orgs {
+		if id := getString(asMap(raw), "organization_id"); id != "" {
+			scopes = append(scopes, remoteScope{OrganizationID: id})
+		}
+	}
+	teams, _ := payload["teams"].([]any)
+	for _, raw := range teams {
+		if id := getString(asMap(raw), "team_id"); id != "" {
+			scopes = append(scopes, remoteScope{TeamID: id})
+		}
+	}
+	return scopes, nil
+}
+
+func asMap(v any) map[string]any {
+	m, _ := v.(map[string]any)
+	return m
+}
+
+func (a *App) cloudMePayload(token string) (map[string]any, error) {
 	req, err := http.NewRequest(http.MethodGet, a.cloudBaseURL()+"/v1/me", nil)
 	if err != nil {
 		return nil, err
@@ -279,9 +318,6 @@ func (a *App) cloudMe(token string) (map[string]any, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
 		return nil, err
 	}
-	if user, ok := payload["user"].(map[string]any); ok {
-		return user, nil
-	}
 	return payload, nil
 }
 
@@ -2,12 +2,19 @@ package envsync
 
 import (
 	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -222,3 +229,585 @@ func TestPullRejectsMismatchedRecoveryMetadata(t *testing.T) {
 		t.Fatalf("expected recovery mismatch error, got %v", err)
 	}
 }
+
+// fakeCloud mimics the envsync-cloud store endpoints, keeping one snapshot
+// per owner and project like the real server.
+type fakeCloud struct {
+	mu     sync.Mutex
+	stores map[string]*RemoteStore
+	teams  []string
+
+	// failPuts rejects store writes to the listed owner|project vaults.
+	failPuts map[string]bool
+
+	// records advertises and serves single-record writes.
+	records      bool
+	storePuts    int
+	recordWrites []string
+	// failRecords rejects record writes to the listed env/key paths.
+	failRecords map[string]bool
+}
+
+func newFakeCloud(t *testing.T, teams ...string) (*fakeCloud, *httptest.Server) {
+	t.Helper()
+	fc := &fakeCloud{stores: map[string]*RemoteStore{}, teams: teams}
+	srv := httptest.NewServer(http.HandlerFunc(fc.serveHTTP))
+	t.Cleanup(srv.Close)
+	return fc, srv
+}
+
+func fakeCloudOwner(q url.Values) string {
+	if id := q.Get("team_id"); id != "" {
+		return "team:" + id
+	}
+	if id := q.Get("organization_id"); id != "" {
+		return "org:" + id
+	}
+	return "user"
+}
+
+func (fc *fakeCloud) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	q := r.URL.Query()
+	owner := fakeCloudOwner(q)
+	w.Header().Set("Content-Type", "application/json")
+	if fc.records && strings.HasPrefix(r.URL.Path, "/v1/vaults/") {
+		fc.serveRecord(w, r, owner)
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/me":
+		teams := []map[string]string{}
+		for _, id := range fc.teams {
+			teams = append(teams, map[string]string{"team_id": id, "role": "maintainer"})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"user": map[string]any{"id": "user"}, "teams": teams})
+	case "/v1/vaults":
+		vaults := []map[string]any{}
+		for key, store := range fc.stores {
+			if project, ok := strings.CutPrefix(key, owner+"|"); ok {
+				vaults = append(vaults, map[string]any{"project": project, "revision": store.Revision})
+			}
+		}
+		sort.Slice(vaults, func(i, j int) bool { return vaults[i]["project"].(string) < vaults[j]["project"].(string) })
+		_ = json.NewEncoder(w).Encode(map[string]any{"vaults": vaults})
+	case "/v1/store":
+		project := q.Get("project")
+		if project == "" {
+			project = defaultCloudVault
+		}
+		key := owner + "|" + project
+		current := fc.stores[key]
+		if r.Method == http.MethodGet {
+			if current == nil {
+				current = &RemoteStore{Version: 1, Projects: map[string]*Project{}}
+			}
+			if fc.records {
+				w.Header().Set(featuresHeader, secretRecordsFeature)
+			}
+			_ = json.NewEncoder(w).Encode(current)
+			return
+		}
+		if fc.failPuts[key] {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":"forbidden"}`))
+			return
+		}
+		revision := 0
+		if current != nil {
+			revision = current.Revision
+		}
+		if r.Header.Get("If-Match") != strconv.Itoa(revision) {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error":"conflict"}`))
+			return
+		}
+		var next RemoteStore
+		if err := json.NewDecoder(r.Body).Decode(&next); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		next.Revision = revision + 1
+		fc.stores[key] = &next
+		fc.storePuts++
+		_ = json.NewEncoder(w).Encode(&next)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveRecord handles PUT /v1/vaults/{project}/envs/{env}/secrets/{key}.
+func (fc *fakeCloud) serveRecord(w http.ResponseWriter, r *http.Request, owner string) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/vaults/"), "/")
+	if r.Method != http.MethodPut || len(parts) != 5 {
+		http.NotFound(w, r)
+		return
+	}
+	project, envName, key := parts[0], parts[2], parts[4]
+	store := fc.stores[owner+"|"+strings.ToLower(project)]
+	if store == nil || store.Projects[project] == nil {
+		http.NotFound(w, r)
+		return
+	}
+	env := store.Projects[project].Envs[envName]
+	if env == nil {
+		env = &Env{Name: envName, Vars: map[string]*SecretRecord{}}
+		store.Projects[project].Envs[envName] = env
+	}
+	current := 0
+	if rec := env.Vars[key]; rec != nil {
+		current = rec.CurrentVersion
+	}
+	if r.Header.Get("If-Match") != strconv.Itoa(current) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if fc.failRecords[envName+"/"+key] {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var rec SecretRecord
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	env.Vars[key] = &rec
+	store.Revision++
+	fc.recordWrites = append(fc.recordWrites, envName+"/"+key)
+	w.Header().Set(revisionHeader, strconv.Itoa(store.Revision))
+	_ = json.NewEncoder(w).Encode(&rec)
+}
+
+func useFakeCloud(t *testing.T, app *App, srv *httptest.Server) {
+	t.Helper()
+	app.RemoteMode = "cloud"
+	app.CloudURL = srv.URL
+	app.HTTPClient = srv.Client()
+	app.SessionPath = filepath.Join(app.ConfigDir, "session.json")
+	if err := os.WriteFile(app.SessionPath, []byte(`{"access_token":"pat-token"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloudPushWritesOneVaultPerProject(t *testing.T) {
+	app, _ := newTestApp(t)
+	fc, srv := newFakeCloud(t)
+	useFakeCloud(t, app, srv)
+
+	if err := app.Set("TOKEN", "api-secret", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push api: %v", err)
+	}
+	if err := app.ProjectCreate("web"); err != nil {
+		t.Fatalf("project create: %v", err)
+	}
+	if err := app.ProjectUse("web"); err != nil {
+		t.Fatalf("project use: %v", err)
+	}
+	if err := app.ProjectBind("web", "", "team_1"); err != nil {
+		t.Fatalf("project bind: %v", err)
+	}
+	if err := app.Set("TOKEN", "web-secret", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	// The web vault starts at revision 0 even though api was pushed first.
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push web: %v", err)
+	}
+
+	api := fc.stores["user|api"]
+	if api == nil || api.Revision != 1 || api.Projects["api"] == nil || api.Projects["web"] != nil {
+		t.Fatalf("expected personal api vault holding only api, got %+v", api)
+	}
+	web := fc.stores["team:team_1|web"]
+	if web == nil || web.Revision != 1 || web.Projects["web"] == nil || web.Projects["api"] != nil {
+		t.Fatalf("expected team web vault holding only web, got %+v", web)
+	}
+	if fc.stores["user|default"] != nil {
+		t.Fatal("expected nothing written to the default vault")
+	}
+}
+
+func TestCloudPushWritesSingleRecordsWhenAdvertised(t *testing.T) {
+	app, _ := newTestApp(t)
+	fc, srv := newFakeCloud(t)
+	fc.records = true
+	useFakeCloud(t, app, srv)
+	app.AuditPath = filepath.Join(t.TempDir(), "audit.log")
+
+	if err := app.Set("A", "1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Set("B", "1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	// The first push creates the vault, which only a store write can do.
+	if err := app.Push(false); err != nil {
+		t.Fatalf("first push: %v", err)
+	}
+	if fc.storePuts != 1 || len(fc.recordWrites) != 0 {
+		t.Fatalf("expected one store write, got %d store and %v record writes", fc.storePuts, fc.recordWrites)
+	}
+
+	if err := app.Set("B", "2", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Set("C", "1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("second push: %v", err)
+	}
+	if fc.storePuts != 1 || strings.Join(fc.recordWrites, ",") != "dev/B,dev/C" {
+		t.Fatalf("expected record writes for B and C only, got %d store and %v record writes", fc.storePuts, fc.recordWrites)
+	}
+
+	vault := fc.stores["user|api"]
+	if vault.Revision != 3 || vault.Projects["api"].Envs["dev"].Vars["B"].CurrentVersion != 2 {
+		t.Fatalf("expected B at v2 in vault revision 3, got %+v", vault)
+	}
+	events, err := app.localAuditEvents()
+	if err != nil || len(events) == 0 || events[0]["action"] != "push" {
+		t.Fatalf("expected push audit event, got %v (%v)", events, err)
+	}
+	if keys := strings.Join(auditKeys(events[0]), ","); keys != "B,C" || events[0]["from_revision"] != 1.0 || events[0]["to_revision"] != 3.0 {
+		t.Fatalf("push audit recorded %v, want keys B,C from revision 1 to 3", events[0])
+	}
+	if err := app.Pull(false); err != nil {
+		t.Fatalf("pull after record push: %v", err)
+	}
+	if got := activeValuesFor(t, app); got["A"] != "1" || got["B"] != "2" || got["C"] != "1" {
+		t.Fatalf("read %v after record push", got)
+	}
+}
+
+func TestCloudPushAfterPartialRecordWriteDoesNotConflict(t *testing.T) {
+	app, _ := newTestApp(t)
+	fc, srv := newFakeCloud(t)
+	fc.records = true
+	useFakeCloud(t, app, srv)
+
+	setAll(t, app, "A", "1", "B", "1")
+	if err := app.Push(false); err != nil {
+		t.Fatalf("first push: %v", err)
+	}
+	setAll(t, app, "A", "2", "B", "2")
+	// A is written, then B is refused, so the push fails with A already on
+	// the remote at the local version.
+	fc.failRecords = map[string]bool{"dev/B": true}
+	if err := app.Push(false); err == nil {
+		t.Fatal("expected the push to fail")
+	}
+	if strings.Join(fc.recordWrites, ",") != "dev/A" {
+		t.Fatalf("expected only A written, got %v", fc.recordWrites)
+	}
+	if err := app.Pull(false); err != nil {
+		t.Fatalf("pull after partial push: %v", err)
+	}
+	fc.failRecords = nil
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push after partial push: %v", err)
+	}
+	if strings.Join(fc.recordWrites, ",") != "dev/A,dev/B" {
+		t.Fatalf("expected B written on retry, got %v", fc.recordWrites)
+	}
+	if got := activeValuesFor(t, app); got["A"] != "2" || got["B"] != "2" {
+		t.Fatalf("read %v after retried push", got)
+	}
+}
+
+func TestCloudProjectVaultSeedsFromDefaultVault(t *testing.T) {
+	app, _ := newTestApp(t)
+	fc, srv := newFakeCloud(t)
+	useFakeCloud(t, app, srv)
+
+	if err := app.Set("TOKEN", "legacy", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &RemoteStore{Version: 1, Revision: 3, Projects: map[string]*Project{}}
+	attachCryptoMetadata(state, legacy)
+	raw, _ := json.Marshal(state.Projects["api"])
+	var legacyProject Project
+	if err := json.Unmarshal(raw, &legacyProject); err != nil {
+		t.Fatal(err)
+	}
+	legacy.Projects["api"] = &legacyProject
+	fc.stores["user|default"] = legacy
+	delete(state.Projects["api"].Envs["dev"].Vars, "TOKEN")
+	if err := app.saveState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Pull(false); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if err := app.Get("TOKEN"); err != nil {
+		t.Fatalf("expected TOKEN pulled from the default vault: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if got := fc.stores["user|api"]; got == nil || got.Projects["api"].Envs["dev"].Vars["TOKEN"] == nil {
+		t.Fatalf("expected api vault to carry legacy history, got %+v", got)
+	}
+	if fc.stores["user|default"].Revision != 3 {
+		t.Fatal("expected legacy default vault to be left untouched")
+	}
+}
+
+func TestRestoreEnumeratesCloudVaults(t *testing.T) {
+	app, _ := newTestApp(t)
+	_, srv := newFakeCloud(t, "team_1")
+	useFakeCloud(t, app, srv)
+
+	if err := app.Set("TOKEN", "api-secret", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push api: %v", err)
+	}
+	if err := app.ProjectCreate("web"); err != nil {
+		t.Fatalf("project create: %v", err)
+	}
+	if err := app.ProjectUse("web"); err != nil {
+		t.Fatalf("project use: %v", err)
+	}
+	if err := app.ProjectBind("web", "", "team_1"); err != nil {
+		t.Fatalf("project bind: %v", err)
+	}
+	if err := app.Set("TOKEN", "web-secret", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push web: %v", err)
+	}
+
+	if err := os.Remove(app.StatePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Restore(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Projects["api"] == nil || state.Projects["web"] == nil {
+		t.Fatalf("expected api and web restored, got %v", sortedKeys(state.Projects))
+	}
+	if got := state.Projects["web"].CloudTeamID; got != "team_1" {
+		t.Fatalf("expected web to stay bound to team_1, got %q", got)
+	}
+	if got := state.Projects["api"].CloudTeamID; got != "" {
+		t.Fatalf("expected api to stay personal, got %q", got)
+	}
+}
+
+func TestCloudSealedProjectMovesVault(t *testing.T) {
+	app, _ := newTestApp(t)
+	fc, srv := newFakeCloud(t)
+	useFakeCloud(t, app, srv)
+	if err := app.Set("TOKEN", "v1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	tmp := t.TempDir()
+	peer := &App{
+		ConfigDir:  filepath.Join(tmp, "cfg"),
+		StatePath:  filepath.Join(tmp, "cfg", "state.json"),
+		RemotePath: filepath.Join(tmp, "cfg", "remote.json"),
+		CWD:        app.CWD,
+		Stdin:      strings.NewReader(""),
+		Stdout:     &bytes.Buffer{},
+		Stderr:     &bytes.Buffer{},
+		Now:        app.Now,
+	}
+	if err := os.MkdirAll(peer.ConfigDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	useFakeCloud(t, peer, srv)
+	if err := peer.Restore(); err != nil {
+		t.Fatalf("restore peer: %v", err)
+	}
+
+	if err := app.ProjectSeal("api"); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if err := app.Set("TOKEN", "v2", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("sealed push: %v", err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := state.Projects["api"].Sealed.ID
+	sealed := fc.stores["user|"+id]
+	if sealed == nil || sealed.Projects[id] == nil || sealed.Projects["api"] != nil {
+		t.Fatalf("expected the project under %s in its own vault, got %+v", id, sealed)
+	}
+	for envID, env := range sealed.Projects[id].Envs {
+		if envID == "dev" || env.Vars["TOKEN"] != nil {
+			t.Fatalf("sealed vault still names env %s: %v", envID, sortedKeys(env.Vars))
+		}
+		for _, rec := range env.Vars {
+			if rec.CurrentVersion != 2 {
+				t.Fatalf("expected history carried over to v2, got v%d", rec.CurrentVersion)
+			}
+		}
+	}
+	stub := fc.stores["user|api"].Projects["api"]
+	if stub == nil || stub.Sealed == nil || stub.Sealed.ID != id || len(stub.Envs) != 0 {
+		t.Fatalf("expected the unsealed vault emptied to a stub, got %+v", stub)
+	}
+
+	if err := peer.Pull(false); err != nil {
+		t.Fatalf("peer pull: %v", err)
+	}
+	if got := activeValuesFor(t, peer)["TOKEN"]; got != "v2" {
+		t.Fatalf("peer pulled %q through the stub", got)
+	}
+
+	if err := os.Remove(app.StatePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Restore(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := activeValuesFor(t, app)["TOKEN"]; got != "v2" {
+		t.Fatalf("restored %q next to the stub", got)
+	}
+}
+
+// pushTwoCloudProjects pushes TOKEN to api and web, each in its own vault.
+func pushTwoCloudProjects(t *testing.T, app *App) {
+	t.Helper()
+	if err := app.Set("TOKEN", "api-secret", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push api: %v", err)
+	}
+	if err := app.ProjectCreate("web"); err != nil {
+		t.Fatalf("project create: %v", err)
+	}
+	if err := app.ProjectUse("web"); err != nil {
+		t.Fatalf("project use: %v", err)
+	}
+	if err := app.Set("TOKEN", "web-secret", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push web: %v", err)
+	}
+}
+
+func TestPhraseRotateFinishesFailedRemoteOnPush(t *testing.T) {
+	app, _ := newTestApp(t)
+	fc, srv := newFakeCloud(t)
+	useFakeCloud(t, app, srv)
+	pushTwoCloudProjects(t, app)
+
+	fc.failPuts = map[string]bool{"user|web": true}
+	confirmRotation(app)
+	err := app.PhraseRotate()
+	if err == nil || !strings.Contains(err.Error(), "next push finishes them") {
+		t.Fatalf("expected the web vault to be left pending, got %v", err)
+	}
+	t.Setenv("ENVSYNC_RECOVERY_PHRASE", app.phraseCache)
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.PendingRekey == nil || len(state.PendingRekey.Scopes) != 1 {
+		t.Fatalf("expected one pending remote, got %+v", state.PendingRekey)
+	}
+	if fc.stores["user|web"].KeyCheckB64 == state.KeyCheckB64 {
+		t.Fatal("expected the web vault to keep the previous key")
+	}
+
+	fc.failPuts = nil
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	state, err = app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.PendingRekey != nil {
+		t.Fatalf("expected push to finish the rotation, still pending %v", state.PendingRekey.Scopes)
+	}
+	if fc.stores["user|web"].KeyCheckB64 != state.KeyCheckB64 {
+		t.Fatal("expected the web vault under the new key")
+	}
+
+	if err := os.Remove(app.StatePath); err != nil {
+		t.Fatal(err)
+	}
+	app.phraseCache = ""
+	if err := app.Restore(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if err := app.ProjectUse("web"); err != nil {
+		t.Fatalf("project use: %v", err)
+	}
+	if got := activeValuesFor(t, app)["TOKEN"]; got != "web-secret" {
+		t.Fatalf("restored %q from the finished vault", got)
+	}
+}
+
+func TestTeamRekeyFinishesFailedRemoteOnPush(t *testing.T) {
+	app, _ := newTestApp(t)
+	fc, srv := newFakeCloud(t)
+	useFakeCloud(t, app, srv)
+	if err := app.TeamCreate("core"); err != nil {
+		t.Fatalf("team create: %v", err)
+	}
+	for _, name := range []string{"app", "web"} {
+		if err := app.ProjectCreate(name); err != nil {
+			t.Fatalf("project create: %v", err)
+		}
+		if err := app.ProjectUse(name); err != nil {
+			t.Fatalf("project use: %v", err)
+		}
+		if err := app.Set("TOKEN", name+"-secret", ""); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		if err := app.Push(false); err != nil {
+			t.Fatalf("push %s: %v", name, err)
+		}
+	}
+
+	member, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := base64.StdEncoding.EncodeToString(member.PublicKey().Bytes())
+	fc.failPuts = map[string]bool{"user|web": true}
+	err = app.TeamAddMemberWith("core", "bob", AddMemberOptions{Role: roleReader, PublicKey: publicKey})
+	if err == nil || !strings.Contains(err.Error(), "next push finishes them") {
+		t.Fatalf("expected the web vault to be left pending, got %v", err)
+	}
+	if fc.stores["user|web"].Projects["web"].WrappedKeys["bob"] != nil {
+		t.Fatal("expected the failed vault to hold no key for bob yet")
+	}
+
+	fc.failPuts = nil
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if fc.stores["user|web"].Projects["web"].WrappedKeys["bob"] == nil {
+		t.Fatal("expected push to wrap the web data key for bob")
+	}
+}
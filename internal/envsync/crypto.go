@@ -3,20 +3,114 @@ package envsync
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"math/big"
 	"strings"
 
 	"golang.org/x/crypto/argon2"
 )
 
-func deriveKey(phrase string, salt []byte) []byte {
-	return argon2.IDKey([]byte(phrase), salt, 1, 64*1024, 4, 32)
+const (
+	kdfArgon2id      = "argon2id"
+	kdfParamsVersion = 1
+
+	minKDFMemoryMiB = 8
+	maxKDFMemoryMiB = 4096
+	maxKDFTime      = 16
+)
+
+// KDFParams records how the vault key is derived from the recovery phrase.
+// It is stored next to the salt so a vault can be hardened, or made cheaper
+// for small CI runners, without every reader assuming the same cost. Vaults
+// created before the block existed have none and use defaultKDFParams.
+type KDFParams struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+	Time      uint32 `json:"time"`
+	MemoryKiB uint32 `json:"memory_kib"`
+	Threads   uint8  `json:"threads"`
+}
+
+func defaultKDFParams() KDFParams {
+	return KDFParams{Version: kdfParamsVersion, Algorithm: kdfArgon2id, Time: 1, MemoryKiB: 64 * 1024, Threads: 4}
+}
+
+// kdfOf returns the parameters kdf records, or the defaults when it is nil.
+func kdfOf(kdf *KDFParams) KDFParams {
+	if kdf == nil {
+		return defaultKDFParams()
+	}
+	return *kdf
+}
+
+func sameKDF(a, b *KDFParams) bool {
+	return kdfOf(a) == kdfOf(b)
+}
+
+func (p KDFParams) validate() error {
+	switch {
+	case p.Version != kdfParamsVersion:
+		return fmt.Errorf("unsupported kdf metadata version %d; upgrade envsync", p.Version)
+	case p.Algorithm != kdfArgon2id:
+		return fmt.Errorf("unsupported kdf %q; upgrade envsync", p.Algorithm)
+	case p.Time < 1 || p.Time > maxKDFTime:
+		return fmt.Errorf("kdf time must be between 1 and %d", maxKDFTime)
+	case p.MemoryKiB < minKDFMemoryMiB*1024 || p.MemoryKiB > maxKDFMemoryMiB*1024:
+		return fmt.Errorf("kdf memory must be between %d and %d MiB", minKDFMemoryMiB, maxKDFMemoryMiB)
+	case p.Threads < 1:
+		return errors.New("kdf threads must be at least 1")
+	}
+	return nil
+}
+
+func (p KDFParams) String() string {
+	return fmt.Sprintf("%s t=%d m=%dMiB p=%d", p.Algorithm, p.Time, p.MemoryKiB/1024, p.Threads)
+}
+
+// KDFOptions picks the cost of a new vault key. Zero fields keep the
+// base parameters: the defaults for a new vault, the current ones when
+// upgrading.
+type KDFOptions struct {
+	MemoryMiB uint32
+	Time      uint32
+}
+
+func (o KDFOptions) set() bool {
+	return o.MemoryMiB != 0 || o.Time != 0
+}
+
+func (o KDFOptions) params(p KDFParams) (*KDFParams, error) {
+	if o.MemoryMiB != 0 {
+		if o.MemoryMiB < minKDFMemoryMiB || o.MemoryMiB > maxKDFMemoryMiB {
+			return nil, fmt.Errorf("--kdf-memory must be between %d and %d MiB", minKDFMemoryMiB, maxKDFMemoryMiB)
+		}
+		p.MemoryKiB = o.MemoryMiB * 1024
+	}
+	if o.Time != 0 {
+		p.Time = o.Time
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// deriveKey derives the vault key from phrase with the parameters kdf
+// records.
+func deriveKey(phrase string, salt []byte, kdf *KDFParams) ([]byte, error) {
+	p := kdfOf(kdf)
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return argon2.IDKey([]byte(phrase), salt, p.Time, p.MemoryKiB, p.Threads, 32), nil
 }
 
 func keyCheck(key []byte) []byte {
@@ -25,7 +119,31 @@ func keyCheck(key []byte) []byte {
 	return h.Sum(nil)
 }
 
-func encrypt(key []byte, plaintext string) ([]byte, []byte, string, error) {
+// aadV1 marks a SecretVersion sealed with its location as associated data.
+// Versions written before state schema v3 have no marker and none.
+const aadV1 = 1
+
+// errUnboundVersion reports a version sealed without associated data, which
+// would still open after being moved to another key, env or project.
+var errUnboundVersion = errors.New("sealed without its location by an older envsync; upgrade the device that wrote it and set the value again")
+
+// errDecrypt reports a version that did not open. On its own it cannot
+// tell a wrong key from a ciphertext that was moved or changed.
+var errDecrypt = errors.New("cannot decrypt: wrong key, or the ciphertext was changed")
+
+// errMisplaced replaces errDecrypt when the key is known to be the one the
+// version was sealed with, which leaves its location or contents.
+var errMisplaced = errors.New("ciphertext does not belong here; it was moved or tampered with")
+
+// versionAAD is the associated data a version is sealed with. It binds the
+// ciphertext to project, env, key name and version number, so a ciphertext
+// copied anywhere else fails to open.
+func versionAAD(project, env, key string, version int) []byte {
+	b, _ := json.Marshal([]any{"envsync", aadV1, project, env, key, version})
+	return b
+}
+
+func encrypt(key []byte, plaintext string, aad []byte) ([]byte, []byte, string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, nil, "", err
@@ -38,12 +156,68 @@ func encrypt(key []byte, plaintext string) ([]byte, []byte, string, error) {
 	if _, err := rand.Read(nonce); err != nil {
 		return nil, nil, "", err
 	}
-	ct := gcm.Seal(nil, nonce, []byte(plaintext), nil)
+	ct := gcm.Seal(nil, nonce, []byte(plaintext), aad)
+	return ct, nonce, plainHash(key, plaintext), nil
+}
+
+// keyedHashPrefix marks a PlainHash that is an HMAC. Older builds stored a
+// bare SHA-256 of the value, which the remote could match against a
+// dictionary of likely secrets.
+const keyedHashPrefix = "hmac-sha256:"
+
+// plainHash is the SecretVersion.PlainHash of plaintext sealed with key: an
+// HMAC under a subkey of key, so equal values can be spotted without
+// decrypting but not guessed without the key.
+func plainHash(key []byte, plaintext string) string {
+	// HKDF only fails for outputs longer than 255 hash blocks.
+	sub, _ := hkdf.Key(sha256.New, key, nil, "envsync-plain-hash", 32)
+	h := hmac.New(sha256.New, sub)
+	h.Write([]byte(plaintext))
+	return keyedHashPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// legacyPlainHash is the unkeyed PlainHash older builds stored.
+func legacyPlainHash(plaintext string) string {
 	h := sha256.Sum256([]byte(plaintext))
-	return ct, nonce, hex.EncodeToString(h[:]), nil
+	return hex.EncodeToString(h[:])
 }
 
-func decrypt(key []byte, v SecretVersion) (string, error) {
+func isKeyedHash(h string) bool {
+	return strings.HasPrefix(h, keyedHashPrefix)
+}
+
+// sameHashScheme reports whether PlainHash values a and b can be compared:
+// a keyed and a legacy hash of the same value differ.
+func sameHashScheme(a, b string) bool {
+	return isKeyedHash(a) == isKeyedHash(b)
+}
+
+// decrypt opens v, which must be sealed with aad.
+func decrypt(key []byte, v SecretVersion, aad []byte) (string, error) {
+	switch v.AAD {
+	case aadV1:
+	case 0:
+		return "", errUnboundVersion
+	default:
+		return "", fmt.Errorf("unsupported aad scheme %d; upgrade envsync", v.AAD)
+	}
+	pt, err := open(key, v, aad)
+	if err != nil {
+		return "", errDecrypt
+	}
+	return pt, nil
+}
+
+// decryptUnbound opens a version written before state schema v3. Only the
+// migration that re-seals such versions calls it.
+func decryptUnbound(key []byte, v SecretVersion) (string, error) {
+	if v.AAD != 0 {
+		return "", fmt.Errorf("v%d is already bound to its location", v.Version)
+	}
+	return open(key, v, nil)
+}
+
+func open(key []byte, v SecretVersion, aad []byte) (string, error) {
 	nonce, err := base64.StdEncoding.DecodeString(v.NonceB64)
 	if err != nil {
 		return "", err
@@ -60,7 +234,7 @@ func decrypt(key []byte, v SecretVersion) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	pt, err := gcm.Open(nil, nonce, ct, nil)
+	pt, err := gcm.Open(nil, nonce, ct, aad)
 	if err != nil {
 		return "", err
 	}
@@ -75,6 +249,31 @@ func randomHex(n int) (string, error) {
 	return hex.EncodeToString(b), nil
 }
 
+// randomString draws n characters uniformly from alphabet.
+func randomString(n int, alphabet string) (string, error) {
+	out := make([]byte, n)
+	for i := range out {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		out[i] = alphabet[idx.Int64()]
+	}
+	return string(out), nil
+}
+
+// randomUUID returns a version 4 UUID.
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
 func generatePhrase(words int) (string, error) {
 	parts := make([]string, words)
 	for i := 0; i < words; i++ {
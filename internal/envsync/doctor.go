@@ -27,6 +27,7 @@ func (a *App) collectDoctorChecks() ([]doctorCheck, *State) {
 		add("config_dir", false, err.Error(), "run `envsync init` to create local config and state")
 	}
 
+	scope := remoteScope{}
 	state, err := a.loadState()
 	if err != nil {
 		add("state", false, err.Error(), "initialize or restore first: `envsync init` or `envsync restore`")
@@ -36,6 +37,7 @@ func (a *App) collectDoctorChecks() ([]doctorCheck, *State) {
 			add("active_project", false, pErr.Error(), "select a project with `envsync project use <name>` or create one with `envsync project create <name>`")
 		} else {
 			add("active_project", true, projectName, "")
+			scope = projectScope(projectName, project)
 			envName := state.CurrentEnv
 			if envName == "" {
 				envName = defaultEnv
@@ -44,6 +46,7 @@ func (a *App) collectDoctorChecks() ([]doctorCheck, *State) {
 				add("active_env", false, fmt.Sprintf("environment %q missing", envName), "create/select an environment: `envsync env create <name>` then `envsync env use <name>`")
 			} else {
 				add("active_env", true, envName, "")
+				a.schemaDoctorChecks(state, project, projectName, envName, add)
 			}
 		}
 	}
@@ -54,12 +57,12 @@ func (a *App) collectDoctorChecks() ([]doctorCheck, *State) {
 		target = a.RemoteURL
 	}
 	if mode == "cloud" {
-		target = a.cloudBaseURL()
+		target = a.cloudBaseURL() + " (vault " + scope.String() + ")"
 	}
 	add("remote_mode", true, mode, "")
 	add("remote_target", true, target, "")
 
-	if _, err := a.loadRemoteStore(); err != nil {
+	if _, err := a.loadRemoteStoreFor(scope); err != nil {
 		add("remote_read", false, err.Error(), "verify remote settings/token reachability and retry `envsync pull`")
 	} else {
 		add("remote_read", true, "ok", "")
@@ -69,8 +72,10 @@ func (a *App) collectDoctorChecks() ([]doctorCheck, *State) {
 		add("recovery_phrase", true, "available via ENVSYNC_RECOVERY_PHRASE", "")
 	} else if phrase, err := a.phraseFromKeychain(); err == nil && strings.TrimSpace(phrase) != "" {
 		add("recovery_phrase", true, "available via keychain", "")
+	} else if state != nil && a.agentKey(state) != nil {
+		add("recovery_phrase", true, "key held by envsync agent on "+a.AgentSocket, "")
 	} else {
-		add("recovery_phrase", false, "ENVSYNC_RECOVERY_PHRASE is not set and keychain phrase is unavailable", "set ENVSYNC_RECOVERY_PHRASE or run `envsync phrase save` to use keychain-backed recovery")
+		add("recovery_phrase", false, "ENVSYNC_RECOVERY_PHRASE is not set and keychain phrase is unavailable", "set ENVSYNC_RECOVERY_PHRASE, run `envsync phrase save` to use keychain-backed recovery, or start `envsync agent`")
 	}
 
 	for _, issue := range a.permissionIssues() {
@@ -80,6 +85,34 @@ func (a *App) collectDoctorChecks() ([]doctorCheck, *State) {
 	return checks, state
 }
 
+// schemaDoctorChecks reports the schema violations of the active env. It
+// only decrypts when the recovery phrase is available without prompting.
+func (a *App) schemaDoctorChecks(state *State, project *Project, projectName, envName string, add func(name string, ok bool, details, hint string)) {
+	schema, source, err := a.schemaFor(project)
+	switch {
+	case err != nil:
+		add("schema", false, err.Error(), "fix the schema file or remove it")
+		return
+	case schema == nil:
+		return
+	case a.phraseCache == "" && a.storedPhrase() == "" && a.agentKey(state) == nil:
+		add("schema", false, "cannot decrypt to check "+source, "set ENVSYNC_RECOVERY_PHRASE, run `envsync phrase save` or start `envsync agent`")
+		return
+	}
+	_, violations, _, err := a.schemaViolations(state, projectName, envName)
+	if err != nil {
+		add("schema", false, err.Error(), "run `envsync validate` once the values can be decrypted")
+		return
+	}
+	if len(violations) == 0 {
+		add("schema", true, fmt.Sprintf("%s valid against %s", envName, source), "")
+		return
+	}
+	for _, v := range violations {
+		add("schema", false, envName+": "+v.String(), "set a valid value with `envsync set` or run `envsync validate`")
+	}
+}
+
 func (a *App) runDoctor(asJSON bool) error {
 	checks, state := a.collectDoctorChecks()
 	hasFail := false
@@ -0,0 +1,259 @@
+package envsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// maxSecretBytes caps values read from stdin or a file. Linux refuses
+// larger single environment strings (MAX_ARG_STRLEN), so a bigger secret
+// could not be loaded or passed to `envsync run` anyway.
+const maxSecretBytes = 128 << 10
+
+// secretValue returns the value to store: value itself, stdin when value is
+// "-", or the contents of fromFile. Stdin loses one trailing newline, so
+// `echo secret | envsync set KEY -` stores "secret"; files are kept byte
+// for byte.
+func (a *App) secretValue(value, fromFile string) (string, error) {
+	switch {
+	case fromFile != "" && value != "":
+		return "", errors.New("pass either a value or --from-file, not both")
+	case fromFile != "":
+		f, err := os.Open(fromFile)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		b, err := io.ReadAll(io.LimitReader(f, maxSecretBytes+1))
+		if err != nil {
+			return "", err
+		}
+		if len(b) > maxSecretBytes {
+			return "", fmt.Errorf("%s is larger than the %d KiB limit for one secret", fromFile, maxSecretBytes>>10)
+		}
+		return string(b), nil
+	case value == "-":
+		b, err := io.ReadAll(io.LimitReader(a.Stdin, maxSecretBytes+3))
+		if err != nil {
+			return "", err
+		}
+		s := string(b)
+		if strings.HasSuffix(s, "\n") {
+			s = strings.TrimSuffix(s[:len(s)-1], "\r")
+		}
+		if len(s) > maxSecretBytes {
+			return "", fmt.Errorf("stdin is larger than the %d KiB limit for one secret", maxSecretBytes>>10)
+		}
+		return s, nil
+	}
+	return value, nil
+}
+
+// Edit decrypts the own keys of envName (the active env when empty) into a
+// private dotenv file, opens $VISUAL or $EDITOR on it and applies the result
+// as one batch of new versions: added and changed keys are written, removed
+// keys deleted. The file is overwritten and removed afterwards. The state
+// lock is not held while the editor is open.
+func (a *App) Edit(envName string) error {
+	tx, err := a.beginSecretTx("", envName)
+	if err != nil {
+		return err
+	}
+	defer tx.close()
+	projKeys, err := tx.keys()
+	if err != nil {
+		return err
+	}
+	values, err := a.activeValues(projKeys, tx.project, tx.env)
+	if err != nil {
+		return err
+	}
+	_, from, err := effectiveEnv(tx.project, tx.env)
+	if err != nil {
+		return err
+	}
+	own := map[string]string{}
+	var header strings.Builder
+	fmt.Fprintf(&header, "# envsync edit: %s/%s\n", tx.projName, tx.envName)
+	header.WriteString("# Save and quit to apply. Removing a line deletes the key.\n")
+	for _, k := range sortedKeys(values) {
+		if from[k] == tx.envName {
+			own[k] = values[k]
+		} else {
+			fmt.Fprintf(&header, "# %s is inherited from %s; add a line to override it.\n", k, from[k])
+		}
+	}
+	body, err := encodeEnv(formatDotenv, own, false, "", "")
+	if err != nil {
+		return err
+	}
+	tx.close()
+
+	dir, err := os.MkdirTemp("", "envsync-edit-")
+	if err != nil {
+		return err
+	}
+	defer shredDir(dir)
+	path := filepath.Join(dir, tx.projName+"-"+tx.envName+".env")
+	if err := os.WriteFile(path, append([]byte(header.String()), body...), 0o600); err != nil {
+		return err
+	}
+	if err := a.runEditor(path); err != nil {
+		return err
+	}
+	edited, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	entries, issues, err := parseEnvFile(edited, formatDotenv)
+	if err != nil {
+		return err
+	}
+	if len(issues) > 0 {
+		// A line that did not parse would otherwise read as a deleted key.
+		for _, issue := range issues {
+			fmt.Fprintln(a.Stderr, cWarn("line %d: %s", issue.Line, issue.Reason))
+		}
+		return errors.New("edit not applied: the file has lines that do not parse")
+	}
+	next := map[string]string{}
+	for _, e := range entries {
+		next[e.Key] = e.Value
+	}
+	var added, changed, deleted []string
+	for _, k := range sortedKeys(next) {
+		old, ok := own[k]
+		switch {
+		case !ok:
+			added = append(added, k)
+		case old != next[k]:
+			changed = append(changed, k)
+		}
+	}
+	for _, k := range sortedKeys(own) {
+		if _, ok := next[k]; !ok {
+			deleted = append(deleted, k)
+		}
+	}
+	if len(added)+len(changed)+len(deleted) == 0 {
+		fmt.Fprintln(a.Stdout, cDim("no changes"))
+		return nil
+	}
+
+	// Another command may have written while the editor was open; apply the
+	// edit to the state as it is now, leaving keys it did not touch alone.
+	tx, err = a.beginSecretTx(tx.projName, tx.envName)
+	if err != nil {
+		return err
+	}
+	defer tx.close()
+	schema, _, err := a.schemaFor(tx.project)
+	if err != nil {
+		return err
+	}
+	if schema != nil {
+		var bad []string
+		for _, k := range append(added, changed...) {
+			if reason := schema.checkStored(k, next[k]); reason != "" {
+				bad = append(bad, k+": "+reason)
+			}
+		}
+		if len(bad) > 0 {
+			return fmt.Errorf("edit not applied, the schema rejects %s", strings.Join(bad, "; "))
+		}
+	}
+
+	for _, k := range append(added, changed...) {
+		if _, err := tx.set(k, next[k], false, ""); err != nil {
+			return err
+		}
+	}
+	for _, k := range deleted {
+		rec := tx.env.Vars[k]
+		if rec == nil || len(rec.Versions) == 0 || rec.Versions[len(rec.Versions)-1].Deleted {
+			continue
+		}
+		if _, err := tx.delete(k); err != nil {
+			return err
+		}
+	}
+	if err := tx.commit("edit", map[string]any{"added": added, "changed": changed, "deleted": deleted}); err != nil {
+		return err
+	}
+	for _, k := range added {
+		fmt.Fprintf(a.Stdout, "  %s %s\n", cSuccess("+"), cBold(k))
+	}
+	for _, k := range changed {
+		fmt.Fprintf(a.Stdout, "  %s %s\n", cWarn("~"), cBold(k))
+	}
+	for _, k := range deleted {
+		fmt.Fprintf(a.Stdout, "  %s %s\n", cError("-"), cBold(k))
+	}
+	fmt.Fprintf(a.Stdout, "%s %s %s\n", cSuccess("edited"), cBold(tx.projName+"/"+tx.envName),
+		cDim(fmt.Sprintf("(%d added, %d changed, %d deleted)", len(added), len(changed), len(deleted))))
+	return nil
+}
+
+// runEditor opens path in $VISUAL, $EDITOR or the platform default and
+// waits for it to exit. The variable may carry arguments, e.g. "code --wait".
+func (a *App) runEditor(path string) error {
+	editor := strings.TrimSpace(os.Getenv("VISUAL"))
+	if editor == "" {
+		editor = strings.TrimSpace(os.Getenv("EDITOR"))
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], path)...)
+	cmd.Stdin = a.Stdin
+	cmd.Stdout = a.Stdout
+	cmd.Stderr = a.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %s: %w; no changes applied", args[0], err)
+	}
+	return nil
+}
+
+// shredDir overwrites every file under dir with zeros and removes dir.
+// Editors may leave swap or backup files next to the one they edit, so all
+// of them are cleared, not only the dotenv file.
+func shredDir(dir string) {
+	_ = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			shredFile(path)
+		}
+		return nil
+	})
+	_ = os.RemoveAll(dir)
+}
+
+func shredFile(path string) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	zeros := make([]byte, 32<<10)
+	for left := info.Size(); left > 0; {
+		n := min(left, int64(len(zeros)))
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return
+		}
+		left -= n
+	}
+	_ = f.Sync()
+}
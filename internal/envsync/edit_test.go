@@ -0,0 +1,150 @@
+//go:build !windows
+// +build !windows
+
+package envsync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetAndRotateReadStdinAndFiles(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.Stdin = strings.NewReader("from stdin\r\n")
+	if err := app.Set("TOKEN", "-", ""); err != nil {
+		t.Fatalf("set from stdin: %v", err)
+	}
+	pem := filepath.Join(t.TempDir(), "cert.pem")
+	cert := "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n\x00\xff"
+	if err := os.WriteFile(pem, []byte(cert), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.SetWith("CERT", "", SetOptions{FromFile: pem}); err != nil {
+		t.Fatalf("set from file: %v", err)
+	}
+	values := activeValuesFor(t, app)
+	if values["TOKEN"] != "from stdin" || values["CERT"] != cert {
+		t.Fatalf("unexpected values: %q", values)
+	}
+
+	app.Stdin = strings.NewReader("rotated\n\n")
+	if err := app.RotateWith("TOKEN", "-", RotateOptions{}); err != nil {
+		t.Fatalf("rotate from stdin: %v", err)
+	}
+	if got := activeValuesFor(t, app)["TOKEN"]; got != "rotated\n" {
+		t.Fatalf("expected only one trailing newline stripped, got %q", got)
+	}
+
+	big := filepath.Join(t.TempDir(), "big")
+	if err := os.WriteFile(big, make([]byte, maxSecretBytes+1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.SetWith("BIG", "", SetOptions{FromFile: big}); err == nil || !strings.Contains(err.Error(), "128 KiB limit") {
+		t.Fatalf("expected the size limit to apply, got %v", err)
+	}
+	if err := app.SetWith("BOTH", "x", SetOptions{FromFile: pem}); err == nil {
+		t.Fatal("expected a value and --from-file together to fail")
+	}
+}
+
+// fakeEditor points EDITOR at a script that runs body with the file as $1
+// and records the file's path in the returned file.
+func fakeEditor(t *testing.T, body string) string {
+	t.Helper()
+	dir := t.TempDir()
+	record := filepath.Join(dir, "path")
+	script := filepath.Join(dir, "editor.sh")
+	src := "#!/bin/sh\nset -e\necho \"$1\" > " + record + "\n" + body + "\n"
+	if err := os.WriteFile(script, []byte(src), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", script)
+	return record
+}
+
+func TestEditAppliesChangesAsOneBatch(t *testing.T) {
+	app, stdout := newTestApp(t)
+	setAll(t, app, "KEEP", "same value", "CHANGE", "old", "GONE", "bye", "REF", "${KEEP}")
+	if err := app.EnvCreateWith("staging", EnvCreateOptions{Parent: "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.EnvUse("staging"); err != nil {
+		t.Fatal(err)
+	}
+	setAll(t, app, "OWN", "staging only")
+	if err := app.EnvUse("dev"); err != nil {
+		t.Fatal(err)
+	}
+	record := fakeEditor(t, `grep -v '^GONE=' "$1" | sed 's/^CHANGE=.*/CHANGE=new/' > "$1.tmp"
+mv "$1.tmp" "$1"
+echo 'NEW="line1\nline2"' >> "$1"`)
+	stdout.Reset()
+	if err := app.Edit(""); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	want := map[string]string{"KEEP": "same value", "CHANGE": "new", "NEW": "line1\nline2", "REF": "${KEEP}"}
+	got := activeValuesFor(t, app)
+	if len(got) != len(want) {
+		t.Fatalf("unexpected keys: %q", got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "(1 added, 1 changed, 1 deleted)") || strings.Contains(out, "line1") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := state.Projects["api"].Envs["dev"].Vars["KEEP"]; rec.CurrentVersion != 1 {
+		t.Fatalf("unchanged key got a new version: %+v", rec.Versions)
+	}
+	path, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(strings.TrimSpace(string(path)))); !os.IsNotExist(err) {
+		t.Fatalf("expected the temp dir to be removed, got %v", err)
+	}
+
+	// Inherited keys are listed as comments and are not deleted from the
+	// parent when staging is edited.
+	fakeEditor(t, `grep -q '^# KEEP is inherited from dev' "$1"
+grep -v '^OWN=' "$1" > "$1.tmp"
+mv "$1.tmp" "$1"`)
+	if err := app.Edit("staging"); err != nil {
+		t.Fatalf("edit staging: %v", err)
+	}
+	if err := app.EnvUse("staging"); err != nil {
+		t.Fatal(err)
+	}
+	got = activeValuesFor(t, app)
+	if _, ok := got["OWN"]; ok || got["KEEP"] != "same value" {
+		t.Fatalf("unexpected staging values: %q", got)
+	}
+}
+
+func TestEditAbortsOnBadLinesAndEditorFailure(t *testing.T) {
+	app, _ := newTestApp(t)
+	setAll(t, app, "A", "1", "B", "2")
+
+	fakeEditor(t, `echo 'not a valid line' >> "$1"`)
+	if err := app.Edit(""); err == nil || !strings.Contains(err.Error(), "edit not applied") {
+		t.Fatalf("expected a parse failure to abort, got %v", err)
+	}
+	fakeEditor(t, `: > "$1"
+exit 1`)
+	if err := app.Edit(""); err == nil || !strings.Contains(err.Error(), "no changes applied") {
+		t.Fatalf("expected an editor failure to abort, got %v", err)
+	}
+	if got := activeValuesFor(t, app); got["A"] != "1" || got["B"] != "2" {
+		t.Fatalf("values changed after aborted edits: %q", got)
+	}
+}
@@ -0,0 +1,216 @@
+package envsync
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Formats written by envsync export, besides the import formats.
+const (
+	formatK8sSecret = "k8s-secret"
+	formatSystemd   = "systemd"
+	formatTFVars    = "tfvars"
+	formatShell     = "shell"
+)
+
+var (
+	dotenvBarePattern = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+	tfvarsKeyPattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+	k8sNameInvalid    = regexp.MustCompile(`[^a-z0-9.-]+`)
+)
+
+// exportFormat returns format, or the format implied by file's extension
+// when format is empty. Stdout ("-") defaults to dotenv.
+func exportFormat(file, format string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(format)); f {
+	case formatDotenv, formatDocker, formatJSON, formatYAML, formatK8sSecret, formatSystemd, formatTFVars, formatShell:
+		return f, nil
+	case "yml":
+		return formatYAML, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format %q (want dotenv, json, yaml, k8s-secret, docker, systemd, tfvars or shell)", format)
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return formatJSON, nil
+	case ".yaml", ".yml":
+		return formatYAML, nil
+	case ".tfvars":
+		return formatTFVars, nil
+	}
+	return formatDotenv, nil
+}
+
+// encodeEnv renders values in format. literal is set when values are
+// final rather than raw, so a "${" in them must not read back as a
+// reference on import.
+func encodeEnv(format string, values map[string]string, literal bool, name, namespace string) ([]byte, error) {
+	var buf bytes.Buffer
+	keys := sortedKeys(values)
+	if literal && (format == formatJSON || format == formatYAML) {
+		values = escapeRefs(values)
+	}
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(values); err != nil {
+			return nil, err
+		}
+	case formatYAML:
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "%s: %s\n", k, yamlDoubleQuote(values[k]))
+		}
+	case formatK8sSecret:
+		buf.WriteString("apiVersion: v1\nkind: Secret\nmetadata:\n")
+		fmt.Fprintf(&buf, "  name: %s\n", name)
+		if namespace != "" {
+			fmt.Fprintf(&buf, "  namespace: %s\n", namespace)
+		}
+		buf.WriteString("type: Opaque\ndata:\n")
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "  %s: %s\n", k, base64.StdEncoding.EncodeToString([]byte(values[k])))
+		}
+	case formatDocker:
+		for _, k := range keys {
+			if strings.ContainsAny(values[k], "\n\r") {
+				return nil, fmt.Errorf("%s: docker env-files cannot hold multi-line values", k)
+			}
+			fmt.Fprintf(&buf, "%s=%s\n", k, values[k])
+		}
+	case formatSystemd:
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "%s=\"%s\"\n", k, escapeWith(values[k], `\"$`+"`", nil))
+		}
+	case formatTFVars:
+		for _, k := range keys {
+			if !tfvarsKeyPattern.MatchString(k) {
+				return nil, fmt.Errorf("%s is not a valid Terraform variable name", k)
+			}
+			fmt.Fprintf(&buf, "%s = %s\n", k, hclQuote(values[k]))
+		}
+	case formatShell:
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "export %s=%s\n", k, shellQuote(values[k]))
+		}
+	default:
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "%s=%s\n", k, dotenvQuote(values[k], literal))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// escapeRefs returns values with every "${" written as "$${", which import
+// keeps and interpolation reads back as a literal "${".
+func escapeRefs(values map[string]string) map[string]string {
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		out[k] = strings.ReplaceAll(v, "${", "$${")
+	}
+	return out
+}
+
+// dotenvQuote leaves simple values bare and double-quotes the rest with the
+// escapes parseDotenv reads back.
+func dotenvQuote(v string, literal bool) string {
+	if dotenvBarePattern.MatchString(v) {
+		return v
+	}
+	s := escapeWith(v, `\"`, map[rune]string{'\n': `\n`, '\r': `\r`, '\t': `\t`})
+	if literal {
+		s = strings.ReplaceAll(s, "${", `\${`)
+	}
+	return `"` + s + `"`
+}
+
+// yamlDoubleQuote writes a YAML double-quoted scalar that is also a valid Go
+// string literal, which is how parseYAMLEnv decodes it.
+func yamlDoubleQuote(v string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range v {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// hclQuote writes an HCL string, escaping template sequences so Terraform
+// does not interpolate them.
+func hclQuote(v string) string {
+	s := escapeWith(v, `\"`, map[rune]string{'\n': `\n`, '\r': `\r`, '\t': `\t`})
+	s = strings.ReplaceAll(s, "${", "$${")
+	s = strings.ReplaceAll(s, "%{", "%%{")
+	return `"` + s + `"`
+}
+
+// shellQuote single-quotes v for POSIX shells.
+func shellQuote(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'"
+}
+
+// escapeWith backslash-escapes the runes in special and replaces those in
+// repl. Invalid UTF-8 is kept byte for byte.
+func escapeWith(v, special string, repl map[rune]string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); {
+		r, size := utf8.DecodeRuneInString(v[i:])
+		switch s, ok := repl[r]; {
+		case ok:
+			b.WriteString(s)
+		case r != utf8.RuneError && strings.ContainsRune(special, r):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteString(v[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// k8sSecretName turns project and env into a valid Secret name.
+func k8sSecretName(project, env string) string {
+	name := k8sNameInvalid.ReplaceAllString(strings.ToLower(project+"-"+env), "-")
+	name = strings.Trim(name, "-.")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	if name == "" {
+		return "envsync"
+	}
+	return name
+}
+
+// validK8sName reports whether name is a DNS subdomain, as Secret names and
+// namespaces must be.
+func validK8sName(name string) error {
+	if len(name) == 0 || len(name) > 253 || k8sNameInvalid.MatchString(name) || strings.Trim(name, "-.") != name {
+		return fmt.Errorf("invalid Kubernetes name %s", strconv.Quote(name))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package envsync
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportRoundTripsThroughImport(t *testing.T) {
+	values := map[string]string{
+		"PLAIN":   "abc",
+		"UNICODE": "café ☕",
+		"PEM":     "-----BEGIN KEY-----\nAAA\n-----END KEY-----\n",
+		"QUOTES":  `say "hi" it's \ok`,
+		"SPACES":  "  padded # not a comment ",
+		"DOLLAR":  "price ${5}",
+		"EMPTY":   "",
+		"CTRL":    "tab\there\r",
+	}
+	// A literal export escapes references, so import stores "$${", which
+	// interpolation reads back as the original "${".
+	literal := escapeRefs(values)
+	for _, format := range []string{formatDotenv, formatJSON, formatYAML} {
+		for _, tc := range []struct {
+			literal bool
+			want    map[string]string
+		}{{false, values}, {true, literal}} {
+			t.Run(fmt.Sprintf("%s/literal=%t", format, tc.literal), func(t *testing.T) {
+				out, err := encodeEnv(format, values, tc.literal, "", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries, issues, err := parseEnvFile(out, format)
+				if err != nil || len(issues) > 0 {
+					t.Fatalf("parse: %v %v\n%s", err, issues, out)
+				}
+				if got := entryMap(entries); !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("round trip mismatch:\n got %#v\nwant %#v\n%s", got, tc.want, out)
+				}
+			})
+		}
+	}
+}
+
+func TestExportDotenvEscapesLiteralReferences(t *testing.T) {
+	out, err := encodeEnv(formatDotenv, map[string]string{"A": "${HOME}"}, true, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "A=\"\\${HOME}\"\n" {
+		t.Fatalf("got %q", out)
+	}
+	entries, _, _ := parseEnvFile(out, formatDotenv)
+	if entries[0].Value != "$${HOME}" {
+		t.Fatalf("expected the reference escape back, got %q", entries[0].Value)
+	}
+}
+
+func TestExportTargets(t *testing.T) {
+	values := map[string]string{"A": "it's ${x}", "B": "line1\nline2"}
+	cases := []struct {
+		format string
+		want   string
+	}{
+		{formatShell, "export A='it'\\''s ${x}'\nexport B='line1\nline2'\n"},
+		{formatTFVars, "A = \"it's $${x}\"\nB = \"line1\\nline2\"\n"},
+		{formatSystemd, "A=\"it's \\${x}\"\nB=\"line1\nline2\"\n"},
+	}
+	for _, tc := range cases {
+		out, err := encodeEnv(tc.format, values, true, "", "")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		if string(out) != tc.want {
+			t.Fatalf("%s:\n got %q\nwant %q", tc.format, out, tc.want)
+		}
+	}
+	if _, err := encodeEnv(formatDocker, values, true, "", ""); err == nil || !strings.Contains(err.Error(), "B: docker env-files cannot hold multi-line values") {
+		t.Fatalf("expected docker to reject multi-line values, got %v", err)
+	}
+}
+
+func TestExportK8sSecretToStdout(t *testing.T) {
+	app, stdout := newTestApp(t)
+	setAll(t, app, "DB_URL", "postgres://x", "PEM", "a\nb")
+	stdout.Reset()
+	if err := app.ExportEnvWith("-", ExportOptions{Format: formatK8sSecret, Namespace: "prod"}); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	want := "apiVersion: v1\nkind: Secret\nmetadata:\n  name: api-dev\n  namespace: prod\ntype: Opaque\ndata:\n" +
+		"  DB_URL: " + base64.StdEncoding.EncodeToString([]byte("postgres://x")) + "\n" +
+		"  PEM: " + base64.StdEncoding.EncodeToString([]byte("a\nb")) + "\n"
+	if stdout.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", stdout.String(), want)
+	}
+	if err := app.ExportEnvWith("-", ExportOptions{Format: formatK8sSecret, Name: "Bad_Name"}); err == nil {
+		t.Fatal("expected invalid secret name to fail")
+	}
+
+	file := filepath.Join(t.TempDir(), "out.json")
+	if err := app.ExportEnv(file); err != nil {
+		t.Fatalf("export json: %v", err)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"PEM": "a\nb"`) {
+		t.Fatalf("expected JSON from the .json extension, got:\n%s", b)
+	}
+}
+
+func TestExportSkipsExpiredKeys(t *testing.T) {
+	app, stdout := newTestApp(t)
+	if err := app.Set("KEEP", "k", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Set("OLD", "o", "1h"); err != nil {
+		t.Fatal(err)
+	}
+	app.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	stdout.Reset()
+	if err := app.ExportEnvWith("-", ExportOptions{Format: formatDotenv}); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if got := stdout.String(); got != "KEEP=k\n" {
+		t.Fatalf("expected the expired key to be left out, got %q", got)
+	}
+}
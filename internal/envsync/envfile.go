@@ -0,0 +1,649 @@
+package envsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Formats accepted by envsync import.
+const (
+	formatDotenv = "dotenv"
+	formatDocker = "docker"
+	formatJSON   = "json"
+	formatYAML   = "yaml"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// envEntry is one assignment read from an import file.
+type envEntry struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// envIssue is a line an import skipped and why.
+type envIssue struct {
+	Line   int
+	Reason string
+}
+
+// importFormat returns format, or the format implied by file's extension
+// when format is empty.
+func importFormat(file, format string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(format)); f {
+	case formatDotenv, formatDocker, formatJSON, formatYAML:
+		return f, nil
+	case "yml":
+		return formatYAML, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format %q (want dotenv, docker, json or yaml)", format)
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return formatJSON, nil
+	case ".yaml", ".yml":
+		return formatYAML, nil
+	}
+	return formatDotenv, nil
+}
+
+// parseEnvFile reads the assignments in data. Lines it cannot use are
+// returned as issues; only a file that is unreadable as a whole is an error.
+func parseEnvFile(data []byte, format string) ([]envEntry, []envIssue, error) {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	switch format {
+	case formatDocker:
+		entries, issues := parseDockerEnv(data)
+		return entries, issues, nil
+	case formatJSON:
+		return parseJSONEnv(data)
+	case formatYAML:
+		entries, issues := parseYAMLEnv(data)
+		return entries, issues, nil
+	}
+	entries, issues := parseDotenv(data)
+	return entries, issues, nil
+}
+
+// parseDotenv understands `export` prefixes, # comments, single-quoted
+// literals and double-quoted values with escapes that may span lines.
+// ${VAR} stays as written so it becomes an envsync reference, except inside
+// single quotes where it is kept literal.
+func parseDotenv(data []byte) ([]envEntry, []envIssue) {
+	var (
+		entries []envEntry
+		issues  []envIssue
+	)
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimLeft(lines[i], " \t")
+		if strings.TrimSpace(line) == "" || line[0] == '#' {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			line = strings.TrimLeft(rest, " \t")
+		}
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok {
+			issues = append(issues, envIssue{lineNo, "expected KEY=value"})
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if !envKeyPattern.MatchString(key) {
+			issues = append(issues, envIssue{lineNo, fmt.Sprintf("invalid key %q", key)})
+			continue
+		}
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" || (rest[0] != '"' && rest[0] != '\'') {
+			entries = append(entries, envEntry{key, stripInlineComment(rest), lineNo})
+			continue
+		}
+		quote, body := rest[0], rest[1:]
+		end := closingQuote(body, quote)
+		for end < 0 && i+1 < len(lines) {
+			i++
+			body += "\n" + lines[i]
+			end = closingQuote(body, quote)
+		}
+		if end < 0 {
+			issues = append(issues, envIssue{lineNo, fmt.Sprintf("unterminated quoted value for %s", key)})
+			continue
+		}
+		if trailing := strings.TrimSpace(body[end+1:]); trailing != "" && trailing[0] != '#' {
+			issues = append(issues, envIssue{lineNo, fmt.Sprintf("unexpected text after quoted value for %s", key)})
+			continue
+		}
+		value := body[:end]
+		if quote == '"' {
+			value = unescapeDoubleQuoted(value)
+		} else {
+			value = strings.ReplaceAll(value, "${", "$${")
+		}
+		entries = append(entries, envEntry{key, value, lineNo})
+	}
+	return entries, issues
+}
+
+// closingQuote returns the index of the quote that ends s, skipping
+// backslash escapes inside double quotes, or -1.
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+func unescapeDoubleQuoted(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '"', '\\':
+			b.WriteByte(s[i])
+		case '$':
+			// \${ is a literal "${", written as the $${ reference escape.
+			if i+1 < len(s) && s[i+1] == '{' {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte('$')
+			}
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// stripInlineComment drops a # comment that follows whitespace.
+func stripInlineComment(s string) string {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '#' && (s[i-1] == ' ' || s[i-1] == '\t') {
+			s = s[:i]
+			break
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+// parseDockerEnv follows `docker run --env-file`: whole-line comments only
+// and values taken literally, quotes included.
+func parseDockerEnv(data []byte) ([]envEntry, []envIssue) {
+	var (
+		entries []envEntry
+		issues  []envIssue
+	)
+	for i, line := range strings.Split(string(data), "\n") {
+		lineNo := i + 1
+		trimmed := strings.TrimLeft(line, " \t")
+		if strings.TrimSpace(trimmed) == "" || trimmed[0] == '#' {
+			continue
+		}
+		key, value, ok := strings.Cut(trimmed, "=")
+		if !ok {
+			issues = append(issues, envIssue{lineNo, fmt.Sprintf("%s has no value (docker reads it from the host environment)", strings.TrimSpace(key))})
+			continue
+		}
+		if !envKeyPattern.MatchString(key) {
+			issues = append(issues, envIssue{lineNo, fmt.Sprintf("invalid key %q", key)})
+			continue
+		}
+		entries = append(entries, envEntry{key, strings.ReplaceAll(value, "${", "$${"), lineNo})
+	}
+	return entries, issues
+}
+
+// parseJSONEnv reads an object of strings, numbers and booleans.
+func parseJSONEnv(data []byte) ([]envEntry, []envIssue, error) {
+	var (
+		entries []envEntry
+		issues  []envIssue
+	)
+	invalid := func(err error) ([]envEntry, []envIssue, error) {
+		return nil, nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return invalid(err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return nil, nil, errors.New("JSON import needs an object of KEY: value pairs")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return invalid(err)
+		}
+		key, _ := tok.(string)
+		lineNo := 1 + bytes.Count(data[:dec.InputOffset()], []byte("\n"))
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return invalid(err)
+		}
+		raw = bytes.TrimSpace(raw)
+		switch {
+		case !envKeyPattern.MatchString(key):
+			issues = append(issues, envIssue{lineNo, fmt.Sprintf("invalid key %q", key)})
+		case raw[0] == '{' || raw[0] == '[':
+			issues = append(issues, envIssue{lineNo, fmt.Sprintf("nested value for %s is not supported", key)})
+		case string(raw) == "null":
+			issues = append(issues, envIssue{lineNo, fmt.Sprintf("%s is null", key)})
+		case raw[0] == '"':
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return invalid(err)
+			}
+			entries = append(entries, envEntry{key, s, lineNo})
+		default:
+			entries = append(entries, envEntry{key, string(raw), lineNo})
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return invalid(err)
+	}
+	return entries, issues, nil
+}
+
+// parseYAMLEnv reads a flat mapping: plain, quoted and block scalar values
+// at the top level. Nested mappings, lists and flow collections are
+// reported as issues.
+func parseYAMLEnv(data []byte) ([]envEntry, []envIssue) {
+	var (
+		entries []envEntry
+		issues  []envIssue
+	)
+	p := newYAMLTreeParser(data, false)
+	for {
+		l, ok := p.peek()
+		if !ok {
+			return entries, issues
+		}
+		if l.indent > 0 {
+			issues = append(issues, envIssue{l.num, "nested values are not supported"})
+			p.skip(0)
+			continue
+		}
+		key, rest, ok := cutYAMLKey(l.text)
+		rest = strings.TrimSpace(rest)
+		switch {
+		case l.text[0] == '-':
+			issues = append(issues, envIssue{l.num, "lists are not supported"})
+		case !ok:
+			issues = append(issues, envIssue{l.num, "expected KEY: value"})
+		case !envKeyPattern.MatchString(key):
+			issues = append(issues, envIssue{l.num, fmt.Sprintf("invalid key %q", key)})
+		case rest == "" || rest[0] == '#':
+			p.pos++
+			if next, ok := p.peek(); ok && next.indent > 0 {
+				issues = append(issues, envIssue{l.num, fmt.Sprintf("nested value for %s is not supported", key)})
+				p.skip(0)
+			} else {
+				issues = append(issues, envIssue{l.num, fmt.Sprintf("%s has no value", key)})
+			}
+			continue
+		case rest[0] == '{' || rest[0] == '[':
+			issues = append(issues, envIssue{l.num, fmt.Sprintf("flow collection for %s is not supported", key)})
+		default:
+			_, value, err := p.entry(l)
+			switch {
+			case err != nil:
+				issues = append(issues, envIssue{l.num, fmt.Sprintf("%s: %v", key, err)})
+			case value == nil:
+				issues = append(issues, envIssue{l.num, fmt.Sprintf("%s is null", key)})
+			default:
+				entries = append(entries, envEntry{key, value.(string), l.num})
+			}
+			continue
+		}
+		p.pos++
+	}
+}
+
+// cutYAMLKey splits `key: value`, where key may be quoted.
+func cutYAMLKey(line string) (key, rest string, ok bool) {
+	if line[0] == '"' || line[0] == '\'' {
+		end := closingQuote(line[1:], line[0])
+		if end < 0 || !strings.HasPrefix(line[end+2:], ":") {
+			return "", "", false
+		}
+		key, err := yamlQuoted(line[:end+2])
+		return key, line[end+3:], err == nil
+	}
+	for i := 0; i < len(line); i++ {
+		if line[i] == ':' && (i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t') {
+			return strings.TrimSpace(line[:i]), line[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// yamlQuoted decodes a single- or double-quoted scalar, ignoring a trailing
+// comment.
+func yamlQuoted(s string) (string, error) {
+	quote := s[0]
+	end := closingQuote(s[1:], quote)
+	// '' is an escaped quote inside single quotes.
+	for quote == '\'' && end >= 0 && end+2 < len(s) && s[end+2] == '\'' {
+		next := closingQuote(s[end+3:], quote)
+		if next < 0 {
+			end = -1
+			break
+		}
+		end += next + 2
+	}
+	if end < 0 {
+		return "", errors.New("unterminated quoted value")
+	}
+	if trailing := strings.TrimSpace(s[end+2:]); trailing != "" && trailing[0] != '#' {
+		return "", errors.New("unexpected text after quoted value")
+	}
+	body := s[1 : end+1]
+	if quote == '\'' {
+		return strings.ReplaceAll(body, "''", "'"), nil
+	}
+	return strconv.Unquote(`"` + body + `"`)
+}
+
+// yamlBlockScalar joins the lines of a | (literal) or > (folded) block,
+// applying the chomping indicator in header.
+func yamlBlockScalar(header string, block []string) string {
+	for len(block) > 0 && strings.TrimSpace(block[len(block)-1]) == "" && !strings.Contains(header, "+") {
+		block = block[:len(block)-1]
+	}
+	indent := -1
+	for _, l := range block {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		n := len(l) - len(strings.TrimLeft(l, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	lines := make([]string, len(block))
+	for i, l := range block {
+		if len(l) >= indent && indent > 0 {
+			l = l[indent:]
+		}
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	var value string
+	if header[0] == '>' {
+		var b strings.Builder
+		for i, l := range lines {
+			switch {
+			case l == "":
+				b.WriteByte('\n')
+			case i > 0 && lines[i-1] != "":
+				b.WriteByte(' ')
+			}
+			b.WriteString(l)
+		}
+		value = b.String()
+	} else {
+		value = strings.Join(lines, "\n")
+	}
+	switch {
+	case strings.Contains(header, "-"):
+		return value
+	case strings.Contains(header, "+"):
+		return value + "\n"
+	}
+	if value == "" {
+		return ""
+	}
+	return value + "\n"
+}
+
+// readYAMLTree decodes block mappings, block and flow lists of scalars and
+// plain, quoted or block scalars: the YAML a schema file needs. Plain
+// true/false become bools and plain integers ints.
+func readYAMLTree(data []byte) (any, error) {
+	p := newYAMLTreeParser(data, true)
+	first, ok := p.peek()
+	if !ok {
+		return map[string]any{}, nil
+	}
+	if first.indent != 0 {
+		return nil, fmt.Errorf("line %d: unexpected indentation", first.num)
+	}
+	tree, err := p.block(0)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := p.peek(); ok {
+		return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+	}
+	return tree, nil
+}
+
+type yamlTreeLine struct {
+	indent int
+	text   string
+	num    int
+}
+
+func (l yamlTreeLine) listItem() bool {
+	return l.text == "-" || strings.HasPrefix(l.text, "- ")
+}
+
+// yamlTreeParser reads the YAML subset envsync accepts, for schema files
+// and for env files. typed decodes plain true/false as bools and integers
+// as ints; env values keep every plain scalar a string.
+type yamlTreeParser struct {
+	lines []string
+	pos   int
+	typed bool
+}
+
+func newYAMLTreeParser(data []byte, typed bool) *yamlTreeParser {
+	return &yamlTreeParser{lines: strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n"), typed: typed}
+}
+
+// peek returns the next line that is not blank, a comment or a document
+// marker.
+func (p *yamlTreeParser) peek() (yamlTreeLine, bool) {
+	for ; p.pos < len(p.lines); p.pos++ {
+		raw := strings.TrimRight(p.lines[p.pos], " \t")
+		text := strings.TrimSpace(raw)
+		if text == "" || text[0] == '#' || text == "---" || text == "..." {
+			continue
+		}
+		return yamlTreeLine{indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text, num: p.pos + 1}, true
+	}
+	return yamlTreeLine{}, false
+}
+
+// skip moves past the lines indented deeper than indent.
+func (p *yamlTreeParser) skip(indent int) {
+	for l, ok := p.peek(); ok && l.indent > indent; l, ok = p.peek() {
+		p.pos++
+	}
+}
+
+func (p *yamlTreeParser) block(indent int) (any, error) {
+	l, _ := p.peek()
+	if l.listItem() {
+		return p.list(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlTreeParser) mapping(indent int) (map[string]any, error) {
+	out := map[string]any{}
+	for {
+		l, ok := p.peek()
+		if !ok || l.indent < indent {
+			return out, nil
+		}
+		if l.indent > indent || l.listItem() {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		key, value, err := p.entry(l)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.num, err)
+		}
+		if _, dup := out[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.num, key)
+		}
+		out[key] = value
+	}
+}
+
+// entry decodes the `key: value` on l, the next line, together with the
+// block scalar or nested block that belongs to it.
+func (p *yamlTreeParser) entry(l yamlTreeLine) (string, any, error) {
+	p.pos++
+	key, rest, ok := cutYAMLKey(l.text)
+	if !ok || key == "" {
+		return "", nil, errors.New("expected key: value")
+	}
+	rest = strings.TrimSpace(rest)
+	var (
+		value any
+		err   error
+	)
+	switch {
+	case rest == "" || rest[0] == '#':
+		next, ok := p.peek()
+		if ok && (next.indent > l.indent || next.indent == l.indent && next.listItem()) {
+			value, err = p.block(next.indent)
+		}
+	case rest[0] == '|' || rest[0] == '>':
+		var block []string
+		for ; p.pos < len(p.lines); p.pos++ {
+			raw := p.lines[p.pos]
+			if strings.TrimSpace(raw) != "" && len(raw)-len(strings.TrimLeft(raw, " ")) <= l.indent {
+				break
+			}
+			block = append(block, raw)
+		}
+		value = yamlBlockScalar(stripInlineComment(rest), block)
+	default:
+		value, err = yamlTreeScalar(rest, p.typed)
+	}
+	return key, value, err
+}
+
+func (p *yamlTreeParser) list(indent int) ([]any, error) {
+	out := []any{}
+	for {
+		l, ok := p.peek()
+		if !ok || l.indent < indent || l.indent == indent && !l.listItem() {
+			return out, nil
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		p.pos++
+		item := strings.TrimSpace(strings.TrimPrefix(l.text, "-"))
+		if _, _, isMap := cutYAMLKey(item); isMap && item[0] != '"' && item[0] != '\'' {
+			return nil, fmt.Errorf("line %d: lists may only hold scalars", l.num)
+		}
+		v, err := yamlTreeScalar(item, p.typed)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.num, err)
+		}
+		out = append(out, v)
+	}
+}
+
+// yamlTreeScalar decodes an inline value: a quoted or plain scalar or a
+// flow list of scalars.
+func yamlTreeScalar(s string, typed bool) (any, error) {
+	if s == "" {
+		return nil, nil
+	}
+	switch s[0] {
+	case '"', '\'':
+		return yamlQuoted(s)
+	case '{':
+		return nil, errors.New("flow mappings are not supported")
+	case '[':
+		body := stripInlineComment(s)
+		if !strings.HasSuffix(body, "]") {
+			return nil, errors.New("unterminated flow list")
+		}
+		out := []any{}
+		for _, item := range splitFlowList(body[1 : len(body)-1]) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			v, err := yamlTreeScalar(item, typed)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	plain := stripInlineComment(s)
+	switch plain {
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	if !typed {
+		return plain, nil
+	}
+	switch plain {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if n, err := strconv.Atoi(plain); err == nil {
+		return n, nil
+	}
+	return plain, nil
+}
+
+// splitFlowList splits on the commas outside quotes.
+func splitFlowList(s string) []string {
+	var (
+		parts []string
+		quote byte
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,177 @@
+package envsync
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func entryMap(entries []envEntry) map[string]string {
+	m := map[string]string{}
+	for _, e := range entries {
+		m[e.Key] = e.Value
+	}
+	return m
+}
+
+func TestParseDotenv(t *testing.T) {
+	src := `# comment
+export API_URL=https://api.example.com # trailing comment
+PLAIN = hello world
+HASH=abc#def
+SINGLE='raw ${HOME} \n'
+DOUBLE="say \"hi\"\tthere"
+REF="postgres://${DB_USER}@db"
+ESCAPED="\${NOT_A_REF}"
+PEM="-----BEGIN KEY-----
+line1
+-----END KEY-----"
+not a line
+1BAD=x
+OPEN="never closed
+`
+	entries, issues, err := parseEnvFile([]byte(src), formatDotenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"API_URL": "https://api.example.com",
+		"PLAIN":   "hello world",
+		"HASH":    "abc#def",
+		"SINGLE":  `raw $${HOME} \n`,
+		"DOUBLE":  "say \"hi\"\tthere",
+		"REF":     "postgres://${DB_USER}@db",
+		"ESCAPED": "$${NOT_A_REF}",
+		"PEM":     "-----BEGIN KEY-----\nline1\n-----END KEY-----",
+	}
+	if got := entryMap(entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("entries = %#v\nwant %#v", got, want)
+	}
+	wantIssues := []envIssue{
+		{12, "expected KEY=value"},
+		{13, `invalid key "1BAD"`},
+		{14, "unterminated quoted value for OPEN"},
+	}
+	if !reflect.DeepEqual(issues, wantIssues) {
+		t.Fatalf("issues = %#v", issues)
+	}
+}
+
+func TestParseDockerJSONAndYAML(t *testing.T) {
+	docker := "# comment\nA=\"quoted\"\nB=x # not a comment\nHOST_ONLY\n"
+	entries, issues, err := parseEnvFile([]byte(docker), formatDocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryMap(entries); got["A"] != `"quoted"` || got["B"] != "x # not a comment" || len(issues) != 1 || issues[0].Line != 4 {
+		t.Fatalf("docker: %#v %#v", got, issues)
+	}
+
+	js := "{\n  \"A\": \"1\",\n  \"PORT\": 8080,\n  \"DEBUG\": true,\n  \"NESTED\": {\"x\": 1},\n  \"NONE\": null\n}"
+	entries, issues, err = parseEnvFile([]byte(js), formatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryMap(entries); !reflect.DeepEqual(got, map[string]string{"A": "1", "PORT": "8080", "DEBUG": "true"}) {
+		t.Fatalf("json entries: %#v", got)
+	}
+	if len(issues) != 2 || issues[0].Line != 5 || issues[1].Line != 6 {
+		t.Fatalf("json issues: %#v", issues)
+	}
+	if _, _, err := parseEnvFile([]byte(`["A"]`), formatJSON); err == nil {
+		t.Fatal("expected a JSON array to be rejected")
+	}
+
+	yaml := `---
+A: plain value # comment
+B: "double\tquoted"
+C: 'it''s'
+"D": 42
+CERT: |
+  line1
+  line2
+FOLDED: >-
+  one
+  two
+NESTED:
+  x: 1
+EMPTY:
+- item
+`
+	entries, issues, err = parseEnvFile([]byte(yaml), formatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"A":      "plain value",
+		"B":      "double\tquoted",
+		"C":      "it's",
+		"D":      "42",
+		"CERT":   "line1\nline2\n",
+		"FOLDED": "one two",
+	}
+	if got := entryMap(entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("yaml entries = %#v", got)
+	}
+	var lines []int
+	for _, issue := range issues {
+		lines = append(lines, issue.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{12, 14, 15}) {
+		t.Fatalf("yaml issues: %#v", issues)
+	}
+}
+
+func TestImportFormatFromExtension(t *testing.T) {
+	cases := map[string]string{"a.json": formatJSON, "a.yml": formatYAML, "a.YAML": formatYAML, ".env": formatDotenv, "prod.list": formatDotenv}
+	for file, want := range cases {
+		if got, err := importFormat(file, ""); err != nil || got != want {
+			t.Fatalf("%s: got %q, %v", file, got, err)
+		}
+	}
+	if got, _ := importFormat("a.json", "docker"); got != formatDocker {
+		t.Fatalf("explicit format should win, got %q", got)
+	}
+	if _, err := importFormat("a.env", "toml"); err == nil {
+		t.Fatal("expected unknown format to fail")
+	}
+}
+
+func TestImportDryRunComparesHashes(t *testing.T) {
+	app, stdout := newTestApp(t)
+	setAll(t, app, "SAME", "1", "CHANGED", "old")
+	file := filepath.Join(t.TempDir(), "in.env")
+	if err := os.WriteFile(file, []byte("SAME=1\nCHANGED=new\nADDED=x\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout.Reset()
+	if err := app.ImportEnvWith(file, ImportOptions{DryRun: true}); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	out := stdout.String()
+	for _, want := range []string{"+ ADDED", "~ CHANGED", "= SAME", "(1 added, 1 changed, 1 unchanged)"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in:\n%s", want, out)
+		}
+	}
+	if got := activeValuesFor(t, app); got["CHANGED"] != "old" || got["ADDED"] != "" {
+		t.Fatalf("dry run wrote values: %v", got)
+	}
+
+	if err := app.ImportEnv(file); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if got := activeValuesFor(t, app); got["CHANGED"] != "new" || got["ADDED"] != "x" || got["SAME"] != "1" {
+		t.Fatalf("import wrote %v", got)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := state.Projects["api"].Envs["dev"].Vars["SAME"].CurrentVersion; v != 1 {
+		t.Fatalf("unchanged key got a new version: v%d", v)
+	}
+}
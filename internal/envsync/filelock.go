@@ -0,0 +1,18 @@
+package envsync
+
+import (
+	"os"
+	"path/filepath"
+)
+
+func withExclusiveFileLock(lockPath string, fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0o700); err != nil {
+		return err
+	}
+	release, err := acquireFileLock(lockPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn()
+}
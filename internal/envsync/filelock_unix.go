@@ -4,25 +4,24 @@
 package envsync
 
 import (
-"os"
-"path/filepath"
-"syscall"
+	"os"
+	"syscall"
 )
 
-func withExclusiveFileLock(lockPath string, fn func() error) error {
-	if err := os.MkdirAll(filepath.Dir(lockPath), 0o700); err != nil {
-		return err
-	}
+// acquireFileLock blocks until it holds an exclusive flock on lockPath.
+// The kernel drops the lock if the process dies, so a crash never leaves
+// it stuck.
+func acquireFileLock(lockPath string) (func(), error) {
 	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o600)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer lockFile.Close()
-
 	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
-		return err
+		lockFile.Close()
+		return nil, err
 	}
-	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
-
-	return fn()
+	return func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+	}, nil
 }
@@ -4,22 +4,35 @@
 package envsync
 
 import (
-"os"
-"path/filepath"
+	"errors"
+	"fmt"
+	"os"
+	"time"
 )
 
-func withExclusiveFileLock(lockPath string, fn func() error) error {
-	if err := os.MkdirAll(filepath.Dir(lockPath), 0o700); err != nil {
-		return err
-	}
-	// A simple approach is to use a lock by just creating the file exclusively, or for actual robust locking we'd use windows APIs.
-    // For now, this is a simplified stub.
-lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0o600)
-if err != nil {
-return err
-}
-defer lockFile.Close()
-defer os.Remove(lockPath)
+// fileLockTimeout bounds how long acquireFileLock waits for another
+// process to release the lock.
+const fileLockTimeout = 30 * time.Second
 
-return fn()
+// acquireFileLock holds the lock by creating lockPath exclusively and waits
+// while another process holds it. A lock left behind by a crashed process
+// has to be removed by hand; the timeout error names the file.
+func acquireFileLock(lockPath string) (func(), error) {
+	deadline := time.Now().Add(fileLockTimeout)
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0o600)
+		if err == nil {
+			return func() {
+				lockFile.Close()
+				os.Remove(lockPath)
+			}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s; remove it if no other envsync is running", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
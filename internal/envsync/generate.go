@@ -0,0 +1,253 @@
+package envsync
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	charsetAlnum     = "alnum"
+	charsetHex       = "hex"
+	charsetBase64URL = "base64url"
+	charsetSymbols   = "symbols"
+
+	genPassword  = "password"
+	genUUID      = "uuid"
+	genEd25519   = "ed25519-keypair"
+	genRSA       = "rsa-pem"
+	genJWTSecret = "jwt-secret"
+
+	// publicKeySuffix names the key that holds the public half of a
+	// generated keypair.
+	publicKeySuffix = "_PUBLIC"
+
+	defaultGenerateLength = 32
+	maxGenerateLength     = 4096
+)
+
+const (
+	alnumChars   = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	symbolChars  = "!#%&()*+,-./:;<=>?@[]^_{|}~"
+	lowerChars   = "abcdefghijklmnopqrstuvwxyz"
+	upperChars   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars   = "0123456789"
+	hexChars     = "0123456789abcdef"
+	base64URLSet = alnumChars + "-_"
+)
+
+// GenerateOptions controls envsync generate. Without Type the value is
+// Length characters from Charset (alnum by default). Length is the key size
+// in bits for rsa-pem and the number of random bytes for jwt-secret; uuid
+// and ed25519-keypair have fixed sizes.
+type GenerateOptions struct {
+	Length  int
+	Charset string
+	Type    string
+	Rotate  bool
+	Print   bool
+}
+
+// generatedSecret is a value to store under key+suffix.
+type generatedSecret struct {
+	suffix string
+	value  string
+}
+
+// Generate stores a random value for keyName in the active env as a new
+// version, or as a rotation with opts.Rotate. The value is only shown with
+// opts.Print; ed25519-keypair also stores the public key in
+// keyName_PUBLIC.
+func (a *App) Generate(keyName string, opts GenerateOptions) error {
+	secrets, describe, err := generateSecrets(opts)
+	if err != nil {
+		return err
+	}
+	tx, err := a.beginSecretTx("", "")
+	if err != nil {
+		return err
+	}
+	defer tx.close()
+	if opts.Rotate && tx.env.Vars[keyName] == nil {
+		return fmt.Errorf("key %q not found; generate it without --rotate first", keyName)
+	}
+	schema, _, err := a.schemaFor(tx.project)
+	if err != nil {
+		return err
+	}
+	for _, s := range secrets {
+		if schema == nil {
+			break
+		}
+		if reason := schema.checkStored(keyName+s.suffix, s.value); reason != "" {
+			return fmt.Errorf("generated %s breaks the schema: %s: %s", describe, keyName+s.suffix, reason)
+		}
+	}
+	for _, s := range secrets {
+		if _, err := tx.set(keyName+s.suffix, s.value, opts.Rotate, ""); err != nil {
+			return err
+		}
+	}
+	if err := tx.commit("generate", map[string]any{"kind": describe, "rotated": opts.Rotate}); err != nil {
+		return err
+	}
+	verb := cSuccess("generated")
+	if opts.Rotate {
+		verb = cSuccess("rotated")
+	}
+	status := a.Stdout
+	if opts.Print {
+		status = a.Stderr
+	}
+	for _, s := range secrets {
+		key := keyName + s.suffix
+		fmt.Fprintf(status, "%s %s %s\n", verb, cBold(key), cDim(fmt.Sprintf("(%s, version %d)", describe, tx.versions[key])))
+		if opts.Print {
+			fmt.Fprintln(a.Stdout, strings.TrimSuffix(s.value, "\n"))
+		}
+	}
+	return nil
+}
+
+// generateSecrets creates the values opts asks for and describes them
+// without revealing them.
+func generateSecrets(opts GenerateOptions) ([]generatedSecret, string, error) {
+	kind := strings.ToLower(strings.TrimSpace(opts.Type))
+	charset := strings.ToLower(strings.TrimSpace(opts.Charset))
+	if kind != "" && charset != "" {
+		return nil, "", fmt.Errorf("--charset does not apply to --type %s", kind)
+	}
+	if opts.Length < 0 {
+		return nil, "", errors.New("--length must be positive")
+	}
+	one := func(v string, err error) ([]generatedSecret, error) {
+		if err != nil {
+			return nil, err
+		}
+		return []generatedSecret{{value: v}}, nil
+	}
+	switch kind {
+	case "":
+		if charset == "" {
+			charset = charsetAlnum
+		}
+		alphabet, err := charsetAlphabet(charset)
+		if err != nil {
+			return nil, "", err
+		}
+		n, err := generateLength(opts.Length, defaultGenerateLength, 1, maxGenerateLength, "characters")
+		if err != nil {
+			return nil, "", err
+		}
+		secrets, err := one(randomString(n, alphabet))
+		return secrets, fmt.Sprintf("%d %s characters", n, charset), err
+	case genPassword:
+		n, err := generateLength(opts.Length, 24, 8, maxGenerateLength, "characters")
+		if err != nil {
+			return nil, "", err
+		}
+		secrets, err := one(randomPassword(n))
+		return secrets, fmt.Sprintf("%d-character password", n), err
+	case genUUID:
+		if opts.Length != 0 {
+			return nil, "", errors.New("--length does not apply to --type uuid")
+		}
+		secrets, err := one(randomUUID())
+		return secrets, "uuid", err
+	case genJWTSecret:
+		n, err := generateLength(opts.Length, 64, 32, maxGenerateLength, "bytes")
+		if err != nil {
+			return nil, "", err
+		}
+		b := make([]byte, n)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+		return []generatedSecret{{value: base64.RawURLEncoding.EncodeToString(b)}}, fmt.Sprintf("%d-byte jwt secret", n), nil
+	case genRSA:
+		bits, err := generateLength(opts.Length, 3072, 2048, 8192, "bits")
+		if err != nil {
+			return nil, "", err
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, "", err
+		}
+		return []generatedSecret{{value: pemString("PRIVATE KEY", der)}}, fmt.Sprintf("%d-bit rsa key", bits), nil
+	case genEd25519:
+		if opts.Length != 0 {
+			return nil, "", errors.New("--length does not apply to --type ed25519-keypair")
+		}
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", err
+		}
+		privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, "", err
+		}
+		pubDER, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return nil, "", err
+		}
+		return []generatedSecret{
+			{value: pemString("PRIVATE KEY", privDER)},
+			{suffix: publicKeySuffix, value: pemString("PUBLIC KEY", pubDER)},
+		}, "ed25519 keypair", nil
+	}
+	return nil, "", fmt.Errorf("unknown type %q (want uuid, password, ed25519-keypair, rsa-pem or jwt-secret)", opts.Type)
+}
+
+func charsetAlphabet(charset string) (string, error) {
+	switch charset {
+	case charsetAlnum:
+		return alnumChars, nil
+	case charsetHex:
+		return hexChars, nil
+	case charsetBase64URL:
+		return base64URLSet, nil
+	case charsetSymbols:
+		return alnumChars + symbolChars, nil
+	}
+	return "", fmt.Errorf("unknown charset %q (want alnum, hex, base64url or symbols)", charset)
+}
+
+// generateLength applies the default and bounds of one --length unit.
+func generateLength(n, def, lo, hi int, unit string) (int, error) {
+	if n == 0 {
+		return def, nil
+	}
+	if n < lo || n > hi {
+		return 0, fmt.Errorf("--length must be between %d and %d %s", lo, hi, unit)
+	}
+	return n, nil
+}
+
+// randomPassword draws from letters, digits and symbols and keeps drawing
+// until the password holds at least one of each class.
+func randomPassword(n int) (string, error) {
+	for {
+		p, err := randomString(n, alnumChars+symbolChars)
+		if err != nil {
+			return "", err
+		}
+		if strings.ContainsAny(p, lowerChars) && strings.ContainsAny(p, upperChars) &&
+			strings.ContainsAny(p, digitChars) && strings.ContainsAny(p, symbolChars) {
+			return p, nil
+		}
+	}
+}
+
+func pemString(blockType string, der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+}
@@ -0,0 +1,120 @@
+package envsync
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGenerateSecretsFormats(t *testing.T) {
+	cases := []struct {
+		opts GenerateOptions
+		want *regexp.Regexp
+	}{
+		{GenerateOptions{}, regexp.MustCompile(`^[A-Za-z0-9]{32}$`)},
+		{GenerateOptions{Length: 40, Charset: "hex"}, regexp.MustCompile(`^[0-9a-f]{40}$`)},
+		{GenerateOptions{Length: 16, Charset: "base64url"}, regexp.MustCompile(`^[A-Za-z0-9_-]{16}$`)},
+		{GenerateOptions{Type: "uuid"}, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		{GenerateOptions{Type: "jwt-secret"}, regexp.MustCompile(`^[A-Za-z0-9_-]{86}$`)},
+	}
+	for _, tc := range cases {
+		secrets, _, err := generateSecrets(tc.opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.opts, err)
+		}
+		if len(secrets) != 1 || !tc.want.MatchString(secrets[0].value) {
+			t.Fatalf("%+v: unexpected value %q", tc.opts, secrets[0].value)
+		}
+	}
+
+	secrets, _, err := generateSecrets(GenerateOptions{Type: "password", Length: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := secrets[0].value
+	if len(p) != 8 || !strings.ContainsAny(p, symbolChars) || !strings.ContainsAny(p, digitChars) ||
+		!strings.ContainsAny(p, lowerChars) || !strings.ContainsAny(p, upperChars) {
+		t.Fatalf("password %q misses a character class", p)
+	}
+
+	secrets, _, err = generateSecrets(GenerateOptions{Type: "ed25519-keypair"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 || secrets[1].suffix != publicKeySuffix {
+		t.Fatalf("expected private and public key, got %d secrets", len(secrets))
+	}
+	privBlock, _ := pem.Decode([]byte(secrets[0].value))
+	pubBlock, _ := pem.Decode([]byte(secrets[1].value))
+	if privBlock == nil || pubBlock == nil {
+		t.Fatal("expected PEM blocks")
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(privBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(pubBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !priv.(ed25519.PrivateKey).Public().(ed25519.PublicKey).Equal(pub) {
+		t.Fatal("public key does not match private key")
+	}
+
+	for opts, wantErr := range map[GenerateOptions]string{
+		{Charset: "emoji"}:                   "unknown charset",
+		{Type: "otp"}:                        "unknown type",
+		{Type: "uuid", Length: 10}:           "--length does not apply",
+		{Type: "rsa-pem", Length: 1024}:      "between 2048 and 8192 bits",
+		{Type: "password", Charset: "hex"}:   "--charset does not apply",
+		{Length: maxGenerateLength + 1}:      "between 1 and 4096 characters",
+		{Type: "jwt-secret", Length: 16}:     "between 32 and 4096 bytes",
+		{Type: "ed25519-keypair", Length: 1}: "--length does not apply",
+	} {
+		if _, _, err := generateSecrets(opts); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("%+v: expected %q, got %v", opts, wantErr, err)
+		}
+	}
+}
+
+func TestGenerateStoresWithoutPrinting(t *testing.T) {
+	app, stdout := newTestApp(t)
+	if err := app.Generate("TOKEN", GenerateOptions{Charset: "hex"}); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	value := activeValuesFor(t, app)["TOKEN"]
+	if len(value) != 32 {
+		t.Fatalf("expected a 32-character value, got %q", value)
+	}
+	if strings.Contains(stdout.String(), value) || !strings.Contains(stdout.String(), "generated TOKEN") {
+		t.Fatalf("unexpected output:\n%s", stdout.String())
+	}
+
+	if err := app.Generate("MISSING", GenerateOptions{Rotate: true}); err == nil {
+		t.Fatal("expected --rotate of a missing key to fail")
+	}
+
+	stdout.Reset()
+	if err := app.Generate("TOKEN", GenerateOptions{Type: "jwt-secret", Rotate: true, Print: true}); err != nil {
+		t.Fatalf("generate rotate: %v", err)
+	}
+	rotated := activeValuesFor(t, app)["TOKEN"]
+	if stdout.String() != rotated+"\n" {
+		t.Fatalf("expected only the value on stdout, got %q", stdout.String())
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(rotated); err != nil || len(b) != 64 {
+		t.Fatalf("expected 64 random bytes, got %q", rotated)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := state.Projects["api"].Envs["dev"].Vars["TOKEN"]
+	if rec.CurrentVersion != 2 || !rec.Versions[1].Rotated {
+		t.Fatalf("expected version 2 recorded as a rotation, got %+v", rec.Versions)
+	}
+}
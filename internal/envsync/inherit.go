@@ -0,0 +1,99 @@
+package envsync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// envChain returns env followed by its ancestors, nearest first.
+func envChain(project *Project, env *Env) ([]*Env, error) {
+	chain := []*Env{env}
+	seen := map[string]bool{env.Name: true}
+	for cur := env; cur.Parent != ""; {
+		if seen[cur.Parent] {
+			names := make([]string, 0, len(chain)+1)
+			for _, e := range chain {
+				names = append(names, e.Name)
+			}
+			return nil, fmt.Errorf("environment inheritance cycle: %s -> %s", strings.Join(names, " -> "), cur.Parent)
+		}
+		parent := project.Envs[cur.Parent]
+		if parent == nil {
+			return nil, fmt.Errorf("environment %q inherits from missing environment %q", cur.Name, cur.Parent)
+		}
+		seen[parent.Name] = true
+		chain = append(chain, parent)
+		cur = parent
+	}
+	return chain, nil
+}
+
+// effectiveEnv flattens env and its ancestors into one read-only Env. A key
+// the child defines, even as a deleted version, hides the same key further
+// up the chain. from maps every key to the env that defines it.
+func effectiveEnv(project *Project, env *Env) (*Env, map[string]string, error) {
+	chain, err := envChain(project, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged := &Env{Name: env.Name, Parent: env.Parent, Vars: map[string]*SecretRecord{}}
+	from := map[string]string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for k, rec := range chain[i].Vars {
+			merged.Vars[k] = rec
+			from[k] = chain[i].Name
+		}
+	}
+	return merged, from, nil
+}
+
+// envParents maps each env of project that inherits to its parent.
+func envParents(project *Project) map[string]string {
+	parents := map[string]string{}
+	for name, env := range project.Envs {
+		if env != nil && env.Parent != "" {
+			parents[name] = env.Parent
+		}
+	}
+	return parents
+}
+
+// checkRemoteAncestors makes sure every env that env inherits from is on the
+// remote, so other devices can resolve the keys it inherits.
+func checkRemoteAncestors(remote *RemoteStore, projName string, project *Project, env *Env) error {
+	chain, err := envChain(project, env)
+	if err != nil {
+		return err
+	}
+	remoteProject := remote.Projects[projName]
+	for _, ancestor := range chain[1:] {
+		if remoteProject == nil || remoteProject.Envs[ancestor.Name] == nil {
+			return fmt.Errorf("environment %q inherits from %q, which is not on the remote; push %q first", env.Name, ancestor.Name, ancestor.Name)
+		}
+	}
+	return nil
+}
+
+// adoptRemoteAncestors copies the envs remoteEnv inherits from that do not
+// exist locally yet, and returns their names.
+func adoptRemoteAncestors(local, remote *Project, remoteEnv *Env) ([]string, error) {
+	chain, err := envChain(remote, remoteEnv)
+	if err != nil {
+		return nil, err
+	}
+	var adopted []string
+	for _, ancestor := range chain[1:] {
+		if local.Envs[ancestor.Name] != nil {
+			continue
+		}
+		env := &Env{Name: ancestor.Name, Parent: ancestor.Parent, Vars: map[string]*SecretRecord{}}
+		for k, rec := range ancestor.Vars {
+			copyRec := cloneRecord(rec)
+			copyRec.LastSyncedRemoteVersion = rec.CurrentVersion
+			env.Vars[k] = copyRec
+		}
+		local.Envs[ancestor.Name] = env
+		adopted = append(adopted, ancestor.Name)
+	}
+	return adopted, nil
+}
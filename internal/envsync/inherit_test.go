@@ -0,0 +1,99 @@
+package envsync
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnvInheritanceResolvesThroughParent(t *testing.T) {
+	app, stdout := newTestApp(t)
+	if err := app.Set("LOG_LEVEL", "info", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	peer, peerOut := newPeerApp(t, app)
+
+	if err := app.EnvCreate("base"); err != nil {
+		t.Fatalf("env create base: %v", err)
+	}
+	if err := app.EnvUse("base"); err != nil {
+		t.Fatalf("env use base: %v", err)
+	}
+	if err := app.Set("SHARED", "s1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Set("DB_URL", "base-db", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.EnvCreateWith("staging", EnvCreateOptions{Parent: "base"}); err != nil {
+		t.Fatalf("env create staging: %v", err)
+	}
+	if err := app.EnvCreateWith("qa", EnvCreateOptions{Parent: "missing"}); err == nil {
+		t.Fatal("expected unknown parent to fail")
+	}
+	if err := app.EnvUse("staging"); err != nil {
+		t.Fatalf("env use staging: %v", err)
+	}
+	if err := app.Set("DB_URL", "staging-db", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	stdout.Reset()
+	if err := app.Get("SHARED"); err != nil || strings.TrimSpace(stdout.String()) != "s1" {
+		t.Fatalf("get SHARED = %q, %v", stdout.String(), err)
+	}
+	stdout.Reset()
+	if err := app.List(false); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if out := stdout.String(); !strings.Contains(out, "SHARED=****** (from base)") || strings.Contains(out, "DB_URL=****** (from") {
+		t.Fatalf("unexpected listing:\n%s", out)
+	}
+	if got := activeValuesFor(t, app); got["DB_URL"] != "staging-db" || got["SHARED"] != "s1" || got["LOG_LEVEL"] != "" {
+		t.Fatalf("resolved %v", got)
+	}
+
+	if err := app.Push(false); err == nil || !strings.Contains(err.Error(), `push "base" first`) {
+		t.Fatalf("expected push to require the parent on the remote, got %v", err)
+	}
+	if err := app.EnvUse("base"); err != nil {
+		t.Fatalf("env use base: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push base: %v", err)
+	}
+	if err := app.EnvUse("staging"); err != nil {
+		t.Fatalf("env use staging: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push staging: %v", err)
+	}
+
+	if err := peer.EnvCreate("staging"); err != nil {
+		t.Fatalf("peer env create: %v", err)
+	}
+	if err := peer.EnvUse("staging"); err != nil {
+		t.Fatalf("peer env use: %v", err)
+	}
+	if err := peer.Pull(false); err != nil {
+		t.Fatalf("peer pull: %v", err)
+	}
+	if !strings.Contains(peerOut.String(), "pulled inherited environment base") {
+		t.Fatalf("expected base to be pulled, got:\n%s", peerOut.String())
+	}
+	if got := activeValuesFor(t, peer); got["DB_URL"] != "staging-db" || got["SHARED"] != "s1" {
+		t.Fatalf("peer resolved %v", got)
+	}
+}
+
+func TestEnvChainRejectsCycles(t *testing.T) {
+	project := &Project{Envs: map[string]*Env{
+		"a": {Name: "a", Parent: "b"},
+		"b": {Name: "b", Parent: "a"},
+	}}
+	if _, err := envChain(project, project.Envs["a"]); err == nil || !strings.Contains(err.Error(), "a -> b -> a") {
+		t.Fatalf("expected cycle error, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package envsync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Values may reference other secrets: ${KEY} in the same env, ${env:KEY} in
+// another env of the same project and ${project/env:KEY} anywhere. $${ is a
+// literal "${". References resolve when values are consumed (load, export,
+// run) so rotating one secret updates every value built from it.
+
+type refKey struct {
+	project, env, key string
+}
+
+func (r refKey) String() string {
+	return r.project + "/" + r.env + ":" + r.key
+}
+
+// refResolver expands references for one command, decrypting each
+// referenced env at most once.
+type refResolver struct {
+	a        *App
+	state    *State
+	values   map[[2]string]map[string]string
+	resolved map[refKey]string
+	stack    []refKey
+}
+
+func (a *App) newRefResolver(state *State) *refResolver {
+	return &refResolver{
+		a:        a,
+		state:    state,
+		values:   map[[2]string]map[string]string{},
+		resolved: map[refKey]string{},
+	}
+}
+
+// interpolate expands the references in values, the active values of
+// projName/envName.
+func (a *App) interpolate(state *State, projName, envName string, values map[string]string) (map[string]string, error) {
+	r := a.newRefResolver(state)
+	r.values[[2]string{projName, envName}] = values
+	out := make(map[string]string, len(values))
+	for _, k := range sortedKeys(values) {
+		v, err := r.resolve(refKey{projName, envName, k})
+		if err != nil {
+			return nil, err
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (r *refResolver) resolve(ref refKey) (string, error) {
+	if v, ok := r.resolved[ref]; ok {
+		return v, nil
+	}
+	for i, seen := range r.stack {
+		if seen == ref {
+			names := make([]string, 0, len(r.stack)-i+1)
+			for _, s := range r.stack[i:] {
+				names = append(names, s.String())
+			}
+			return "", fmt.Errorf("reference cycle: %s -> %s", strings.Join(names, " -> "), ref)
+		}
+	}
+	values, err := r.envValues(ref.project, ref.env)
+	if err != nil {
+		return "", err
+	}
+	raw, ok := values[ref.key]
+	if !ok {
+		return "", fmt.Errorf("reference %s: key not found, deleted or expired", ref)
+	}
+	r.stack = append(r.stack, ref)
+	v, err := r.expand(raw, ref)
+	r.stack = r.stack[:len(r.stack)-1]
+	if err != nil {
+		return "", err
+	}
+	r.resolved[ref] = v
+	return v, nil
+}
+
+// expand replaces the references in raw, the value of from. Targets without
+// a project or env are relative to from.
+func (r *refResolver) expand(raw string, from refKey) (string, error) {
+	if !strings.Contains(raw, "${") {
+		return raw, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(raw, "${")
+		if i < 0 {
+			b.WriteString(raw)
+			return b.String(), nil
+		}
+		if i > 0 && raw[i-1] == '$' {
+			b.WriteString(raw[:i-1] + "${")
+			raw = raw[i+2:]
+			continue
+		}
+		end := strings.IndexByte(raw[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("%s: unterminated reference %q", from, raw[i:])
+		}
+		target, err := parseRef(raw[i+2:i+end], from)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", from, err)
+		}
+		v, err := r.resolve(target)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(raw[:i])
+		b.WriteString(v)
+		raw = raw[i+end+1:]
+	}
+}
+
+func parseRef(spec string, from refKey) (refKey, error) {
+	ref := refKey{project: from.project, env: from.env, key: spec}
+	if scope, key, ok := strings.Cut(spec, ":"); ok {
+		ref.key = key
+		ref.env = scope
+		if project, env, ok := strings.Cut(scope, "/"); ok {
+			ref.project, ref.env = project, env
+		}
+	}
+	if ref.project == "" || ref.env == "" || ref.key == "" || strings.ContainsAny(ref.key, "${}/: ") {
+		return refKey{}, fmt.Errorf("invalid reference ${%s}", spec)
+	}
+	return ref, nil
+}
+
+func (r *refResolver) envValues(projName, envName string) (map[string]string, error) {
+	id := [2]string{projName, envName}
+	if values, ok := r.values[id]; ok {
+		return values, nil
+	}
+	project := r.state.Projects[projName]
+	if project == nil {
+		return nil, fmt.Errorf("reference to unknown project %q", projName)
+	}
+	env := project.Envs[envName]
+	if env == nil {
+		return nil, fmt.Errorf("reference to unknown environment %s/%s", projName, envName)
+	}
+	if err := r.a.requireProjectRole(r.state, project, roleAdmin, roleWriter, roleReader); err != nil {
+		return nil, err
+	}
+	projKeys, err := r.a.keysFor(r.state, project)
+	if err != nil {
+		return nil, err
+	}
+	values, err := r.a.activeValues(projKeys, project, env)
+	if err != nil {
+		return nil, err
+	}
+	r.values[id] = values
+	return values, nil
+}
@@ -0,0 +1,707 @@
+package envsync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Team projects are sealed with a random per-project data key instead of the
+// vault key. The data key is wrapped for every member with X25519: a one-off
+// key pair agrees a secret with the member's public key, HKDF turns it into
+// an AES-GCM key, and the data key is sealed under that. Each device holds a
+// random identity key of its own, so sharing a recovery phrase does not share
+// team membership, and removing a member revokes their devices.
+
+// WrappedKey is a project data key sealed for one member.
+type WrappedKey struct {
+	KeyID        string `json:"key_id"`
+	EphemeralB64 string `json:"ephemeral_b64"`
+	NonceB64     string `json:"nonce_b64"`
+	CipherB64    string `json:"cipher_b64"`
+}
+
+// DeviceIdentity is this device's identity key pair. It is kept only in local
+// state, with the private key sealed under the vault key; team admins learn
+// the public key from `envsync team key`.
+type DeviceIdentity struct {
+	PublicKeyB64 string `json:"public_key_b64"`
+	NonceB64     string `json:"nonce_b64"`
+	CipherB64    string `json:"cipher_b64"`
+}
+
+const deviceIdentityInfo = "envsync-device-identity"
+
+func newDeviceIdentity(vaultKey []byte) (*DeviceIdentity, *ecdh.PrivateKey, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	identity, err := sealDeviceIdentity(vaultKey, private)
+	if err != nil {
+		return nil, nil, err
+	}
+	return identity, private, nil
+}
+
+func sealDeviceIdentity(vaultKey []byte, private *ecdh.PrivateKey) (*DeviceIdentity, error) {
+	key, err := hkdf.Key(sha256.New, vaultKey, nil, deviceIdentityInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, ct, err := sealBytes(key, private.Bytes(), []byte(deviceIdentityInfo))
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceIdentity{
+		PublicKeyB64: base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()),
+		NonceB64:     base64.StdEncoding.EncodeToString(nonce),
+		CipherB64:    base64.StdEncoding.EncodeToString(ct),
+	}, nil
+}
+
+func (d *DeviceIdentity) open(vaultKey []byte) (*ecdh.PrivateKey, error) {
+	key, err := hkdf.Key(sha256.New, vaultKey, nil, deviceIdentityInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(d.NonceB64)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(d.CipherB64)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := openBytes(key, nonce, ct, []byte(deviceIdentityInfo))
+	if err != nil {
+		return nil, fmt.Errorf("open device identity: %w", err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// deviceIdentity opens this device's identity key, creating one for a state
+// that predates them. The caller saves state.
+func (a *App) deviceIdentity(state *State, vaultKey []byte) (*ecdh.PrivateKey, error) {
+	if state.Identity != nil {
+		return state.Identity.open(vaultKey)
+	}
+	identity, private, err := newDeviceIdentity(vaultKey)
+	if err != nil {
+		return nil, err
+	}
+	state.Identity = identity
+	return private, nil
+}
+
+// registerDevice records this device's public key for the caller on team, so
+// data keys wrapped for the team afterwards reach it. A team with an
+// authentication key keeps the key an admin added.
+func (a *App) registerDevice(state *State, team *Team, vaultKey []byte) error {
+	actor := a.actorID(state)
+	if team == nil || team.Members[actor] == "" {
+		return nil
+	}
+	if team.AuthKeyID != "" && team.PublicKeys[actor] != "" {
+		return nil
+	}
+	if _, err := a.deviceIdentity(state, vaultKey); err != nil {
+		return err
+	}
+	if team.PublicKeys == nil {
+		team.PublicKeys = map[string]string{}
+	}
+	team.PublicKeys[actor] = state.Identity.PublicKeyB64
+	return nil
+}
+
+// memberIdentity opens one member's data keys on this device.
+type memberIdentity struct {
+	actor  string
+	vault  []byte
+	device *ecdh.PrivateKey
+}
+
+func (a *App) memberIdentity(state *State) (*memberIdentity, error) {
+	vaultKey, err := a.getSecretKey(state)
+	if err != nil {
+		return nil, err
+	}
+	id := &memberIdentity{actor: a.actorID(state), vault: vaultKey}
+	if state.Identity != nil {
+		if id.device, err = state.Identity.open(vaultKey); err != nil {
+			return nil, err
+		}
+	}
+	return id, nil
+}
+
+// unwrap opens w with the device identity, falling back to the legacy
+// identity for data keys wrapped before devices had their own.
+func (id *memberIdentity) unwrap(w *WrappedKey) ([]byte, error) {
+	if id.device != nil {
+		if data, err := unwrapDataKey(id.device, w); err == nil {
+			return data, nil
+		}
+	}
+	legacy, err := legacyIdentityKey(id.vault, id.actor)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapDataKey(legacy, w)
+}
+
+// legacyIdentityKey is the identity older releases derived from the vault key
+// and the actor. Anyone holding the recovery phrase can compute it, so it only
+// opens data keys already wrapped for it and is never wrapped for again.
+func legacyIdentityKey(vaultKey []byte, actor string) (*ecdh.PrivateKey, error) {
+	seed, err := hkdf.Key(sha256.New, vaultKey, nil, "envsync-identity:"+actor, 32)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(seed)
+}
+
+func parsePublicKey(publicKeyB64 string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKeyB64))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return pub, nil
+}
+
+func wrapDataKey(recipient *ecdh.PublicKey, keyID string, dataKey []byte) (*WrappedKey, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := wrapKEK(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes(), keyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce, ct, err := sealBytes(kek, dataKey, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	return &WrappedKey{
+		KeyID:        keyID,
+		EphemeralB64: base64.StdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+		NonceB64:     base64.StdEncoding.EncodeToString(nonce),
+		CipherB64:    base64.StdEncoding.EncodeToString(ct),
+	}, nil
+}
+
+func unwrapDataKey(identity *ecdh.PrivateKey, w *WrappedKey) ([]byte, error) {
+	ephemeralRaw, err := base64.StdEncoding.DecodeString(w.EphemeralB64)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralRaw)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := wrapKEK(shared, ephemeralRaw, identity.PublicKey().Bytes(), w.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(w.NonceB64)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(w.CipherB64)
+	if err != nil {
+		return nil, err
+	}
+	return openBytes(kek, nonce, ct, []byte(w.KeyID))
+}
+
+func wrapKEK(shared, ephemeral, recipient []byte, keyID string) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	return hkdf.Key(sha256.New, shared, salt, "envsync-wrap:"+keyID, 32)
+}
+
+func sealBytes(key, plaintext, aad []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, aad), nil
+}
+
+func openBytes(key, nonce, ct, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ct, aad)
+}
+
+// projectKeys holds what is needed to read and write one project's secrets:
+// the vault key for versions sealed before the project had a data key, and
+// the project's current data key, if any.
+type projectKeys struct {
+	project string
+	// shared marks a team project, whose versions without a key ID may be
+	// sealed with another member's vault key.
+	shared bool
+	vault  []byte
+	keyID  string
+	data   []byte
+}
+
+func newProjectKeys(project string, vaultKey []byte) (*projectKeys, error) {
+	keyID, err := randomHex(4)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	return &projectKeys{project: project, vault: vaultKey, keyID: keyID, data: data}, nil
+}
+
+// keysFor unwraps the caller's copy of project's data key. Personal projects
+// and team projects created before data keys existed use the vault key. A
+// state still on schema v2 is moved to v3, and unkeyed value hashes are
+// rewritten, first, since the key is now at hand.
+func (a *App) keysFor(state *State, project *Project) (*projectKeys, error) {
+	if _, err := a.bindStateVersions(state); err != nil {
+		return nil, err
+	}
+	if _, err := a.rehashStateVersions(state); err != nil {
+		return nil, err
+	}
+	return a.unwrapProjectKeys(state, project)
+}
+
+func (a *App) unwrapProjectKeys(state *State, project *Project) (*projectKeys, error) {
+	id, err := a.memberIdentity(state)
+	if err != nil {
+		return nil, err
+	}
+	return projectKeysFrom(id, project)
+}
+
+// projectKeysFrom unwraps id's copy of project's data key.
+func projectKeysFrom(id *memberIdentity, project *Project) (*projectKeys, error) {
+	keys := &projectKeys{vault: id.vault}
+	if project != nil {
+		keys.project, keys.shared = project.Name, project.Team != ""
+	}
+	if project == nil || project.DataKeyID == "" {
+		return keys, nil
+	}
+	wrapped := project.WrappedKeys[id.actor]
+	if wrapped == nil || wrapped.KeyID != project.DataKeyID {
+		return nil, fmt.Errorf("no data key for %s on project %q; ask a team admin to add your public key", id.actor, project.Name)
+	}
+	data, err := id.unwrap(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key for project %q: %w", project.Name, err)
+	}
+	keys.keyID, keys.data = project.DataKeyID, data
+	return keys, nil
+}
+
+// sealedWith returns the key v was sealed with.
+func (k *projectKeys) sealedWith(v SecretVersion) ([]byte, error) {
+	switch v.KeyID {
+	case "":
+		return k.vault, nil
+	case k.keyID:
+		return k.data, nil
+	}
+	return nil, fmt.Errorf("v%d is sealed with data key %s, which this device does not hold", v.Version, v.KeyID)
+}
+
+// decrypt opens v, a version of key in env.
+func (k *projectKeys) decrypt(env, key string, v SecretVersion) (string, error) {
+	sealKey, err := k.sealedWith(v)
+	if err != nil {
+		return "", err
+	}
+	plain, err := decrypt(sealKey, v, versionAAD(k.project, env, key, v.Version))
+	// The data key is the one named by the version's key ID, and the vault
+	// key passed the key check, so either failing to open leaves the
+	// location as the cause.
+	if errors.Is(err, errDecrypt) && (v.KeyID != "" || !k.shared) {
+		err = errMisplaced
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s v%d in %s/%s: %w", key, v.Version, k.project, env, err)
+	}
+	return plain, nil
+}
+
+// matches reports whether v, going by its PlainHash, holds value.
+func (k *projectKeys) matches(v SecretVersion, value string) bool {
+	if !isKeyedHash(v.PlainHash) {
+		return v.PlainHash == legacyPlainHash(value)
+	}
+	sealKey, err := k.sealedWith(v)
+	if err != nil {
+		return false
+	}
+	return v.PlainHash == plainHash(sealKey, value)
+}
+
+// current returns the key new versions are sealed with.
+func (k *projectKeys) current() []byte {
+	if k.keyID != "" {
+		return k.data
+	}
+	return k.vault
+}
+
+// seal encrypts value into v, a version of key in env, under the project's
+// current key.
+func (k *projectKeys) seal(v *SecretVersion, env, key, value string) error {
+	ct, nonce, hash, err := encrypt(k.current(), value, versionAAD(k.project, env, key, v.Version))
+	if err != nil {
+		return err
+	}
+	v.NonceB64 = base64.StdEncoding.EncodeToString(nonce)
+	v.CipherB64 = base64.StdEncoding.EncodeToString(ct)
+	v.PlainHash = hash
+	v.KeyID = k.keyID
+	v.AAD = aadV1
+	return nil
+}
+
+// resealProject re-encrypts every version of project from one key set to
+// another. It returns how many versions were re-encrypted.
+func resealProject(project *Project, from, to *projectKeys) (int, error) {
+	count := 0
+	for envName, env := range project.Envs {
+		for name, rec := range env.Vars {
+			for i := range rec.Versions {
+				v := &rec.Versions[i]
+				if v.Deleted || v.CipherB64 == "" {
+					continue
+				}
+				plain, err := from.decrypt(envName, name, *v)
+				if err != nil {
+					return count, fmt.Errorf("%s: %w", name, err)
+				}
+				if err := to.seal(v, envName, name, plain); err != nil {
+					return count, err
+				}
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// memberPublicKey returns the registered key a member's data keys are
+// wrapped for. A legacy identity is refused: anyone holding this vault's
+// recovery phrase can derive it.
+func memberPublicKey(team *Team, vaultKey []byte, actor string) (*ecdh.PublicKey, error) {
+	encoded := team.PublicKeys[actor]
+	if encoded == "" {
+		return nil, errors.New("no public key registered; add them again with the key `envsync team key` prints on their device")
+	}
+	pub, err := parsePublicKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := legacyIdentityKey(vaultKey, actor)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Equal(legacy.PublicKey()) {
+		return nil, errors.New("public key is derived from the recovery phrase; add them again with the key `envsync team key` prints on their device")
+	}
+	return pub, nil
+}
+
+func wrapForTeam(team *Team, keys *projectKeys) (map[string]*WrappedKey, error) {
+	wrapped := map[string]*WrappedKey{}
+	for _, actor := range sortedKeys(team.Members) {
+		pub, err := memberPublicKey(team, keys.vault, actor)
+		if err != nil {
+			return nil, fmt.Errorf("member %s: %w", actor, err)
+		}
+		w, err := wrapDataKey(pub, keys.keyID, keys.data)
+		if err != nil {
+			return nil, err
+		}
+		wrapped[actor] = w
+	}
+	return wrapped, nil
+}
+
+// copyProjectKeys copies the team binding and wrapped data keys of src onto
+// dst.
+func copyProjectKeys(dst, src *Project) {
+	dst.Team = src.Team
+	dst.DataKeyID = src.DataKeyID
+	dst.KeyMAC = src.KeyMAC
+	dst.WrappedKeys = map[string]*WrappedKey{}
+	for actor, w := range src.WrappedKeys {
+		c := *w
+		dst.WrappedKeys[actor] = &c
+	}
+}
+
+// rekeyTeamProjects wraps the data key of every project in team for its
+// current members, locally and on the remote. With rotate, or for a project
+// that has no data key yet, a fresh key replaces the old one and every
+// version is re-encrypted under it, so removed members cannot read anything
+// written afterwards. State is saved once the remotes are written; remotes
+// after the first that fail are recorded in state.PendingRekey.
+func (a *App) rekeyTeamProjects(state *State, teamName string, rotate bool) (int, error) {
+	team := state.Teams[teamName]
+	if team == nil {
+		return 0, fmt.Errorf("unknown team %q", teamName)
+	}
+	if err := a.finishPendingRekey(state); err != nil {
+		return 0, err
+	}
+	id, err := a.memberIdentity(state)
+	if err != nil {
+		return 0, err
+	}
+	if err := a.registerDevice(state, team, id.vault); err != nil {
+		return 0, err
+	}
+	authKey, err := authenticateTeam(id, team)
+	if err != nil {
+		return 0, err
+	}
+	targets := map[string]*rekeyTarget{}
+	var order []string
+	versions := 0
+	for _, name := range sortedKeys(state.Projects) {
+		project := state.Projects[name]
+		if project == nil || project.Team != teamName {
+			continue
+		}
+		oldKeys, err := a.keysFor(state, project)
+		if err != nil {
+			return 0, err
+		}
+		newKeys := oldKeys
+		if rotate || project.DataKeyID == "" {
+			if newKeys, err = newProjectKeys(oldKeys.project, oldKeys.vault); err != nil {
+				return 0, err
+			}
+		}
+		wrapped, err := wrapForTeam(team, newKeys)
+		if err != nil {
+			return 0, err
+		}
+		keyMAC, err := projectKeyMAC(name, teamName, newKeys, authKey)
+		if err != nil {
+			return 0, err
+		}
+
+		scope := projectScope(name, project)
+		target := targets[scope.String()]
+		if target == nil {
+			remote, err := a.loadRemoteStoreWith(state, scope)
+			if err != nil {
+				return 0, err
+			}
+			target = &rekeyTarget{scope: scope, remote: remote, revision: remote.Revision}
+			targets[scope.String()] = target
+		}
+		if remoteProject := target.remote.Projects[name]; remoteProject != nil {
+			if remoteProject.DataKeyID != project.DataKeyID {
+				return 0, fmt.Errorf("remote project %q uses a different data key; pull and retry", name)
+			}
+			if err := rekeyRemoteProject(id, remoteProject, teamName, newKeys, wrapped, keyMAC); err != nil {
+				return 0, err
+			}
+			order = append(order, scope.String())
+		}
+		if newKeys != oldKeys {
+			n, err := resealProject(project, oldKeys, newKeys)
+			if err != nil {
+				return 0, fmt.Errorf("re-encrypt project %q: %w", name, err)
+			}
+			versions += n
+		}
+		project.DataKeyID = newKeys.keyID
+		project.WrappedKeys = wrapped
+		project.KeyMAC = keyMAC
+	}
+
+	var failed []string
+	var saveErr error
+	seen := map[string]bool{}
+	for _, key := range order {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		target := targets[key]
+		target.remote.Teams = teamsForPush(target.remote.Teams, state.Teams, a.actorID(state))
+		err := a.saveRemoteStoreWith(state, target.scope, target.remote, target.revision)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, errRemoteConflict) {
+			err = fmt.Errorf("remote %s changed during re-key; pull and retry: %w", target.scope, err)
+		}
+		if len(seen) == 1 {
+			return 0, err
+		}
+		failed = append(failed, target.scope.String())
+		saveErr = err
+	}
+	if len(failed) > 0 {
+		state.PendingRekey = &PendingRekey{Scopes: failed, Team: teamName}
+	}
+	if err := a.saveState(state); err != nil {
+		return versions, err
+	}
+	if len(failed) > 0 {
+		return versions, fmt.Errorf("remotes %s still hold the previous data keys; the next push finishes them: %w", strings.Join(failed, ", "), saveErr)
+	}
+	return versions, nil
+}
+
+// rekeyRemoteProject moves remoteProject, under whatever data key it holds,
+// to keys and wrapped, authenticated by keyMAC.
+func rekeyRemoteProject(id *memberIdentity, remoteProject *Project, teamName string, keys *projectKeys, wrapped map[string]*WrappedKey, keyMAC string) error {
+	if remoteProject.DataKeyID != keys.keyID {
+		oldKeys, err := projectKeysFrom(id, remoteProject)
+		if err != nil {
+			return err
+		}
+		if _, err := resealProject(remoteProject, oldKeys, keys); err != nil {
+			return fmt.Errorf("re-encrypt remote project %q: %w", remoteProject.Name, err)
+		}
+	}
+	remoteProject.Team = teamName
+	remoteProject.DataKeyID = keys.keyID
+	remoteProject.WrappedKeys = wrapped
+	remoteProject.KeyMAC = keyMAC
+	return nil
+}
+
+// finishTeamRekey moves the projects of teamName on the remote for scope to
+// the data keys local state already holds.
+func (a *App) finishTeamRekey(state *State, teamName string, scope remoteScope, id *memberIdentity) error {
+	remote, err := a.loadRemoteStoreFor(scope)
+	if err != nil {
+		return err
+	}
+	openRemoteProjects(remote, id)
+	for _, name := range sortedKeys(state.Projects) {
+		project := state.Projects[name]
+		remoteProject := remote.Projects[name]
+		if project == nil || project.Team != teamName || remoteProject == nil || projectScope(name, project).String() != scope.String() {
+			continue
+		}
+		keys, err := projectKeysFrom(id, project)
+		if err != nil {
+			return err
+		}
+		wrapped := map[string]*WrappedKey{}
+		for actor, w := range project.WrappedKeys {
+			c := *w
+			wrapped[actor] = &c
+		}
+		if err := rekeyRemoteProject(id, remoteProject, teamName, keys, wrapped, project.KeyMAC); err != nil {
+			return err
+		}
+	}
+	remote.Teams = teamsForPush(remote.Teams, state.Teams, id.actor)
+	return a.saveRemoteStoreWith(state, scope, remote, remote.Revision)
+}
+
+// checkRemoteKeys verifies this device can work with projName on remote.
+// Projects under a data key do not depend on the remote's recovery phrase,
+// so members with their own phrase can share a remote. local is nil on pull,
+// where a newer remote data key is adopted rather than rejected.
+func checkRemoteKeys(state *State, remote *RemoteStore, projName string, local *Project) error {
+	remoteProject := remote.Projects[projName]
+	keyed := remoteProject != nil && remoteProject.DataKeyID != ""
+	if local != nil && local.DataKeyID != "" {
+		if keyed && remoteProject.DataKeyID != local.DataKeyID {
+			return fmt.Errorf("data key for project %q changed on the remote; pull first", projName)
+		}
+		return nil
+	}
+	if keyed {
+		if local != nil {
+			return fmt.Errorf("project %q has a data key on the remote; pull first", projName)
+		}
+		return nil
+	}
+	return validateRemoteCrypto(state, remote)
+}
+
+// adoptProjectKeys takes the data key and wrapped keys of remoteProject. When
+// the key was rotated, local versions are re-encrypted under the new key. In
+// a team with an authentication key the key must verify under it first, so
+// nothing is adopted or re-encrypted under a key the remote made up.
+func (a *App) adoptProjectKeys(state *State, project, remoteProject *Project) error {
+	if pinned := state.Teams[project.Team]; pinned != nil && pinned.AuthKeyID != "" && remoteProject.Team != project.Team {
+		return fmt.Errorf("refusing project %q from the remote: it moved from team %q to %q", project.Name, project.Team, remoteProject.Team)
+	}
+	if team := state.Teams[remoteProject.Team]; team != nil && team.AuthKeyID != "" {
+		id, err := a.memberIdentity(state)
+		if err != nil {
+			return err
+		}
+		keys, err := projectKeysFrom(id, remoteProject)
+		if err != nil {
+			return err
+		}
+		if err := verifyProjectKey(id, team, remoteProject, keys); err != nil {
+			return err
+		}
+	}
+	if project.DataKeyID == remoteProject.DataKeyID {
+		copyProjectKeys(project, remoteProject)
+		return nil
+	}
+	oldKeys, err := a.keysFor(state, project)
+	if err != nil {
+		return err
+	}
+	copyProjectKeys(project, remoteProject)
+	newKeys, err := a.keysFor(state, project)
+	if err != nil {
+		return err
+	}
+	if _, err := resealProject(project, oldKeys, newKeys); err != nil {
+		return fmt.Errorf("re-encrypt project %q: %w", project.Name, err)
+	}
+	return nil
+}
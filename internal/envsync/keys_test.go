@@ -0,0 +1,340 @@
+package envsync
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTeamProject(t *testing.T) *App {
+	t.Helper()
+	app, _ := newTestApp(t)
+	if err := app.TeamCreate("core"); err != nil {
+		t.Fatalf("team create: %v", err)
+	}
+	if err := app.ProjectCreate("web"); err != nil {
+		t.Fatalf("project create: %v", err)
+	}
+	if err := app.ProjectUse("web"); err != nil {
+		t.Fatalf("project use: %v", err)
+	}
+	if err := app.Set("TOKEN", "t1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	return app
+}
+
+func TestTeamMemberWithOwnPhraseLosesAccessOnRemoval(t *testing.T) {
+	admin := newTeamProject(t)
+	member, out := newMemberApp(t, admin)
+
+	if err := member.TeamKey(); err != nil {
+		t.Fatalf("team key: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected team key output %q", out.String())
+	}
+	actor := lastField(lines[0])
+	publicKey := lastField(lines[1])
+	if err := admin.TeamAddMemberWith("core", actor, AddMemberOptions{Role: roleReader, PublicKey: publicKey}); err != nil {
+		t.Fatalf("add member: %v", err)
+	}
+
+	if err := member.TeamJoin("core"); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if err := member.ProjectUse("web"); err != nil {
+		t.Fatalf("member project use: %v", err)
+	}
+	out.Reset()
+	if err := member.Get("TOKEN"); err != nil {
+		t.Fatalf("member get: %v", err)
+	}
+	if got := strings.TrimSpace(out.String()); got != "t1" {
+		t.Fatalf("member read %q, want t1", got)
+	}
+
+	before, err := admin.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeyID := before.Projects["web"].DataKeyID
+	if err := admin.TeamRemoveMember("core", actor); err != nil {
+		t.Fatalf("remove member: %v", err)
+	}
+	if err := admin.Set("TOKEN", "t2", ""); err != nil {
+		t.Fatalf("set after removal: %v", err)
+	}
+	if err := admin.Push(false); err != nil {
+		t.Fatalf("push after removal: %v", err)
+	}
+
+	remote, err := admin.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := remote.Projects["web"]
+	if web.DataKeyID == oldKeyID {
+		t.Fatal("expected removal to rotate the data key")
+	}
+	if _, ok := web.WrappedKeys[actor]; ok {
+		t.Fatal("expected removed member's wrapped key to be dropped")
+	}
+	for _, v := range web.Envs[defaultEnv].Vars["TOKEN"].Versions {
+		if v.KeyID != web.DataKeyID {
+			t.Fatalf("v%d sealed with %q, want %q", v.Version, v.KeyID, web.DataKeyID)
+		}
+	}
+
+	// The removed member still holds the old data key, which opens nothing
+	// on the remote any more.
+	state, err := member.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeys, err := member.keysFor(state, state.Projects["web"])
+	if err != nil {
+		t.Fatalf("member keys: %v", err)
+	}
+	if _, err := oldKeys.decrypt(defaultEnv, "TOKEN", *currentVersion(web.Envs[defaultEnv].Vars["TOKEN"])); err == nil {
+		t.Fatal("expected removed member to be unable to decrypt the new value")
+	}
+	if err := member.Pull(false); err == nil || !strings.Contains(err.Error(), "no data key") {
+		t.Fatalf("expected pull to fail without a data key, got %v", err)
+	}
+}
+
+func TestPhraseRotateKeepsTeamAccess(t *testing.T) {
+	app := newTeamProject(t)
+	// Wrap the caller's data key for the legacy identity, as older releases
+	// did; rotation moves it to the device identity.
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor := app.actorID(state)
+	keys, err := app.keysFor(state, state.Projects["web"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := legacyIdentityKey(keys.vault, actor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Projects["web"].WrappedKeys[actor], err = wrapDataKey(legacy.PublicKey(), keys.keyID, keys.data); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.saveState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	confirmRotation(app)
+	if err := app.PhraseRotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	t.Setenv("ENVSYNC_RECOVERY_PHRASE", app.phraseCache)
+	if got := activeValuesFor(t, app)["TOKEN"]; got != "t1" {
+		t.Fatalf("read %q after rotation, want t1", got)
+	}
+
+	// A restored device has an identity of its own and needs an admin to
+	// add it before it can read the team project.
+	peer, out := newPeerApp(t, app)
+	if err := peer.ProjectUse("web"); err == nil {
+		t.Fatal("expected a restored device to need adding to the team")
+	}
+	out.Reset()
+	if err := peer.TeamKey(); err != nil {
+		t.Fatalf("team key: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if err := app.TeamAddMemberWith("core", lastField(lines[0]), AddMemberOptions{Role: roleReader, PublicKey: lastField(lines[1])}); err != nil {
+		t.Fatalf("add member: %v", err)
+	}
+	if err := peer.TeamJoin("core"); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if err := peer.Pull(false); err != nil {
+		t.Fatalf("peer pull: %v", err)
+	}
+	if err := peer.ProjectUse("web"); err != nil {
+		t.Fatalf("peer project use: %v", err)
+	}
+	if got := activeValuesFor(t, peer)["TOKEN"]; got != "t1" {
+		t.Fatalf("restored device read %q, want t1", got)
+	}
+}
+
+func TestTeamAddMemberRefusesPhraseDerivedKey(t *testing.T) {
+	app := newTeamProject(t)
+	if err := app.TeamAddMember("core", "bob", roleReader); err == nil || !strings.Contains(err.Error(), "public key required") {
+		t.Fatalf("expected a public key to be required, got %v", err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vaultKey, err := app.getSecretKey(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := legacyIdentityKey(vaultKey, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := base64.StdEncoding.EncodeToString(legacy.PublicKey().Bytes())
+	if err := app.TeamAddMemberWith("core", "bob", AddMemberOptions{Role: roleReader, PublicKey: derived}); err == nil || !strings.Contains(err.Error(), "derived from the recovery phrase") {
+		t.Fatalf("expected a phrase-derived key to be refused, got %v", err)
+	}
+}
+
+func TestPullRefusesTeamKeysTheRemoteMadeUp(t *testing.T) {
+	admin := newTeamProject(t)
+	member, out := newMemberApp(t, admin)
+	if err := member.TeamKey(); err != nil {
+		t.Fatalf("team key: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	actor, publicKey := lastField(lines[0]), lastField(lines[1])
+	if err := admin.TeamAddMemberWith("core", actor, AddMemberOptions{Role: roleReader, PublicKey: publicKey}); err != nil {
+		t.Fatalf("add member: %v", err)
+	}
+	if err := member.TeamJoin("core"); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if err := member.ProjectUse("web"); err != nil {
+		t.Fatalf("member project use: %v", err)
+	}
+	original, err := admin.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper := func(edit func(remote *RemoteStore)) {
+		t.Helper()
+		remote, err := admin.loadRemoteStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote.Teams = cloneTeams(original.Teams)
+		remote.Projects["web"] = original.Projects["web"]
+		edit(remote)
+		if err := admin.saveRemoteStoreFor(remoteScope{}, remote, remote.Revision); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A public key of the server's own for the admin to wrap data keys for.
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper(func(remote *RemoteStore) {
+		remote.Teams["core"].PublicKeys[actor] = base64.StdEncoding.EncodeToString(other.PublicKey().Bytes())
+	})
+	if err := admin.Pull(false); err == nil || !strings.Contains(err.Error(), "do not verify") {
+		t.Fatalf("expected a swapped public key to be refused, got %v", err)
+	}
+
+	// A data key the server knows, wrapped for the member.
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := newProjectKeys("web", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := wrapDataKey(pub, forged.keyID, forged.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper(func(remote *RemoteStore) {
+		web := *original.Projects["web"]
+		web.DataKeyID, web.WrappedKeys = forged.keyID, map[string]*WrappedKey{actor: wrapped}
+		remote.Projects["web"] = &web
+	})
+	if err := member.Pull(false); err == nil || !strings.Contains(err.Error(), "does not verify") {
+		t.Fatalf("expected a forged data key to be refused, got %v", err)
+	}
+	state, err := member.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Projects["web"].DataKeyID != original.Projects["web"].DataKeyID {
+		t.Fatal("expected the member to keep its data key")
+	}
+
+	// Dropping the authentication key does not turn the checks off.
+	tamper(func(remote *RemoteStore) {
+		core := remote.Teams["core"]
+		core.AuthKeyID, core.AuthKeys, core.KeysMAC = "", nil, ""
+	})
+	if err := member.Pull(false); err == nil || !strings.Contains(err.Error(), "authentication key was replaced") {
+		t.Fatalf("expected a stripped authentication key to be refused, got %v", err)
+	}
+
+	tamper(func(*RemoteStore) {})
+	if err := member.Pull(false); err != nil {
+		t.Fatalf("pull of the untouched remote: %v", err)
+	}
+}
+
+// devicePublicKey returns the public key of app's device identity.
+func devicePublicKey(t *testing.T, app *App) string {
+	t.Helper()
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.Identity.PublicKeyB64
+}
+
+func lastField(s string) string {
+	fields := strings.Fields(s)
+	return fields[len(fields)-1]
+}
+
+func TestMovedCiphertextFailsToDecrypt(t *testing.T) {
+	app, _ := newTestApp(t)
+	setAll(t, app, "DEV_DB_PASSWORD", "dev-secret", "PROD_DB_PASSWORD", "prod-secret")
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := state.Projects["api"].Envs["dev"].Vars
+	dev, prod := &vars["DEV_DB_PASSWORD"].Versions[0], vars["PROD_DB_PASSWORD"].Versions[0]
+	dev.CipherB64, dev.NonceB64 = prod.CipherB64, prod.NonceB64
+	if err := app.saveState(state); err != nil {
+		t.Fatal(err)
+	}
+	err = app.Get("DEV_DB_PASSWORD")
+	if err == nil || !strings.Contains(err.Error(), "moved or tampered") {
+		t.Fatalf("expected a swapped ciphertext to fail, got %v", err)
+	}
+
+	// Dropping the marker must not fall back to opening it unbound.
+	state, err = app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Projects["api"].Envs["dev"].Vars["DEV_DB_PASSWORD"].Versions[0].AAD = 0
+	if err := app.saveState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Get("DEV_DB_PASSWORD"); !errors.Is(err, errUnboundVersion) {
+		t.Fatalf("expected an unbound version to be rejected, got %v", err)
+	}
+	// A wrong key is not reported as a moved ciphertext.
+	v := state.Projects["api"].Envs["dev"].Vars["PROD_DB_PASSWORD"].Versions[0]
+	aad := versionAAD("api", "dev", "PROD_DB_PASSWORD", v.Version)
+	if _, err := decrypt(make([]byte, 32), v, aad); !errors.Is(err, errDecrypt) {
+		t.Fatalf("expected a generic error for a wrong key, got %v", err)
+	}
+}
@@ -78,7 +78,49 @@ func cloneTeams(in map[string]*Team) map[string]*Team {
 		for actor, role := range team.Members {
 			c.Members[actor] = role
 		}
+		if len(team.PublicKeys) > 0 {
+			c.PublicKeys = map[string]string{}
+			for actor, key := range team.PublicKeys {
+				c.PublicKeys[actor] = key
+			}
+		}
+		c.AuthKeyID, c.KeysMAC = team.AuthKeyID, team.KeysMAC
+		if len(team.AuthKeys) > 0 {
+			c.AuthKeys = map[string]*WrappedKey{}
+			for actor, w := range team.AuthKeys {
+				c.AuthKeys[actor] = w
+			}
+		}
 		out[k] = c
 	}
 	return out
 }
+
+// teamsForPush returns the team definitions a push writes: the local copy of
+// teams the actor administers on the remote (or created locally) and, for
+// the rest, the remote copy with only the actor's own public key refreshed.
+// Only admins may change membership, which envsync-server enforces as well.
+// In teams with an authentication key only admins may change public keys,
+// since the roster MAC covers them.
+func teamsForPush(remote, local map[string]*Team, actor string) map[string]*Team {
+	out := cloneTeams(remote)
+	for name, team := range cloneTeams(local) {
+		current := out[name]
+		if current == nil {
+			current = team
+		}
+		if current.Members[actor] == roleAdmin {
+			out[name] = team
+			continue
+		}
+		key := team.PublicKeys[actor]
+		if current.Members[actor] == "" || key == "" || current.AuthKeyID != "" {
+			continue
+		}
+		if current.PublicKeys == nil {
+			current.PublicKeys = map[string]string{}
+		}
+		current.PublicKeys[actor] = key
+	}
+	return out
+}
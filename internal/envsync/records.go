@@ -0,0 +1,177 @@
+package envsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envsync-cloud lists secretRecordsFeature in featuresHeader when it accepts
+// single SecretRecord writes under /v1/vaults/{project}/envs/{env}/secrets.
+// A push that only changes records then sends those instead of re-uploading
+// the whole vault.
+const (
+	featuresHeader       = "X-Envsync-Features"
+	secretRecordsFeature = "secret-records"
+	revisionHeader       = "X-Envsync-Revision"
+)
+
+// errRecordsUnsupported makes push fall back to a whole-store write.
+var errRecordsUnsupported = errors.New("remote does not accept record writes")
+
+func hasFeature(header, feature string) bool {
+	for _, f := range strings.Split(header, ",") {
+		if strings.TrimSpace(f) == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// recordBase is the remote env as loaded, before local changes are rebased
+// onto it. Each record write is conditioned on the version it had here.
+type recordBase struct {
+	metadata []byte
+	vars     map[string]*SecretRecord
+}
+
+// newRecordBase returns nil when a push has to write the whole store: the
+// remote does not accept record writes or the project has no vault yet.
+func (a *App) newRecordBase(remote *RemoteStore, projName, envName string) *recordBase {
+	if !remote.secretRecords || a.effectiveRemoteMode() != "cloud" || remote.Revision == 0 || remote.Projects[projName] == nil {
+		return nil
+	}
+	if remote.Projects[projName].Sealed != nil {
+		// Record URLs would carry the names sealing hides.
+		return nil
+	}
+	metadata, err := vaultMetadata(remote, projName)
+	if err != nil {
+		return nil
+	}
+	base := &recordBase{metadata: metadata, vars: map[string]*SecretRecord{}}
+	if env := remote.Projects[projName].Envs[envName]; env != nil {
+		for k, rec := range env.Vars {
+			base.vars[k] = cloneRecord(rec)
+		}
+	}
+	return base
+}
+
+// vaultMetadata encodes the parts of remote a push may change besides the
+// records of one env, including which envs inherit from which.
+func vaultMetadata(remote *RemoteStore, projName string) ([]byte, error) {
+	project := *remote.Projects[projName]
+	parents := envParents(&project)
+	project.Envs = nil
+	return json.Marshal(struct {
+		SaltB64     string
+		KeyCheckB64 string
+		KDF         *KDFParams
+		Rekey       *RekeyInfo
+		Teams       map[string]*Team
+		Project     *Project
+		Parents     map[string]string
+	}{remote.SaltB64, remote.KeyCheckB64, remote.KDF, remote.Rekey, remote.Teams, &project, parents})
+}
+
+// changed returns the records of envName that differ from the base. ok is
+// false when the push also changed vault metadata, which only a whole-store
+// write carries.
+func (b *recordBase) changed(remote *RemoteStore, projName, envName string) (records map[string]*SecretRecord, ok bool) {
+	if b == nil {
+		return nil, false
+	}
+	metadata, err := vaultMetadata(remote, projName)
+	if err != nil || !bytes.Equal(metadata, b.metadata) {
+		return nil, false
+	}
+	records = map[string]*SecretRecord{}
+	for k, rec := range remote.Projects[projName].Envs[envName].Vars {
+		if !reflect.DeepEqual(b.vars[k], rec) {
+			records[k] = rec
+		}
+	}
+	return records, true
+}
+
+// saveRemoteRecords writes records one at a time. A key that moved since
+// base fails with errRemoteConflict so push reloads and rebases. remote's
+// revision follows the one the server reports after each write. Records
+// written before a failure stay on the remote; the next push or pull finds
+// them identical to the local ones and takes them as synced.
+func (a *App) saveRemoteRecords(scope remoteScope, remote *RemoteStore, projName, envName string, base *recordBase, records map[string]*SecretRecord) error {
+	token, err := a.cloudAccessToken()
+	if err != nil {
+		return err
+	}
+	query := remoteScope{OrganizationID: scope.OrganizationID, TeamID: scope.TeamID}.query()
+	for _, k := range sortedKeys(records) {
+		expected := 0
+		if rec := base.vars[k]; rec != nil {
+			expected = rec.CurrentVersion
+		}
+		u := secretURL(a.cloudBaseURL(), projName, envName, k, query)
+		revision, err := a.putRemoteRecord(u, token, records[k], expected)
+		if err != nil {
+			return err
+		}
+		if revision > 0 {
+			remote.Revision = revision
+		}
+	}
+	return nil
+}
+
+// putRemoteRecord returns the vault revision from the response, or 0 when
+// the server did not report one.
+func (a *App) putRemoteRecord(u, token string, rec *SecretRecord, expectedVersion int) (int, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	revision := 0
+	err = a.withHTTPRetry(func() (bool, error) {
+		req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", strconv.Itoa(expectedVersion))
+		addAuthHeader(req, token)
+		resp, err := a.httpClient().Do(req)
+		if err != nil {
+			return isRetryableNetworkError(err), err
+		}
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			revision, _ = strconv.Atoi(resp.Header.Get(revisionHeader))
+			return false, nil
+		case resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusPreconditionFailed:
+			return false, fmt.Errorf("%w: %s %s", errRemoteConflict, resp.Status, strings.TrimSpace(string(respBody)))
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+			return false, fmt.Errorf("%w: %s", errRecordsUnsupported, resp.Status)
+		}
+		err = fmt.Errorf("remote record PUT failed: %s %s", resp.Status, strings.TrimSpace(string(respBody)))
+		return isRetryableStatus(resp.StatusCode), err
+	})
+	return revision, err
+}
+
+func secretURL(baseURL, project, env, key string, query url.Values) string {
+	u := strings.TrimSuffix(baseURL, "/") + "/v1/vaults/" + url.PathEscape(project) +
+		"/envs/" + url.PathEscape(env) + "/secrets/" + url.PathEscape(key)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
@@ -0,0 +1,521 @@
+package envsync
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errVaultRekeyed reports a remote that was re-keyed by `phrase rotate` on
+// another device while this device still holds the previous key.
+var errVaultRekeyed = errors.New("vault was re-keyed")
+
+// RekeyInfo records recovery phrase rotations on a remote so devices still
+// using a retired phrase get an actionable error instead of a generic
+// mismatch.
+type RekeyInfo struct {
+	PreviousKeyChecks []string `json:"previous_key_checks"`
+	RotatedAt         string   `json:"rotated_at"`
+	DeviceID          string   `json:"device_id"`
+}
+
+type rekeyTarget struct {
+	scope    remoteScope
+	remote   *RemoteStore
+	revision int
+}
+
+// PhraseRotate replaces the recovery phrase. Every secret version in local
+// state and on the remote, history included, is re-encrypted under a key
+// derived from a fresh phrase and salt. The new phrase is shown, and one of
+// its words typed back, before anything is written.
+func (a *App) PhraseRotate() error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	oldKey, err := a.getSecretKey(state)
+	if err != nil {
+		return err
+	}
+	newPhrase, err := generatePhrase(12)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.Stdout, "Recovery phrase (save this now; it is not stored):\n%s\n", cBold(newPhrase))
+	if err := a.confirmPhrase(newPhrase); err != nil {
+		return err
+	}
+	res, err := a.rekeyVault(state, oldKey, newPhrase, state.KDF)
+	if err != nil {
+		return err
+	}
+	a.phraseCache = newPhrase
+	if phrase, err := a.phraseFromKeychain(); err == nil && strings.TrimSpace(phrase) != "" {
+		if err := a.storePhraseKeychain(newPhrase); err != nil {
+			fmt.Fprintf(a.Stderr, "warning: keychain still holds the previous phrase: %v\n", err)
+		}
+	}
+	if os.Getenv("ENVSYNC_RECOVERY_PHRASE") != "" {
+		fmt.Fprintln(a.Stderr, "warning: ENVSYNC_RECOVERY_PHRASE still holds the previous phrase; update it")
+	}
+	a.logAudit("phrase_rotate", state, map[string]any{"versions": res.versions, "remotes": res.remotes})
+	fmt.Fprintf(a.Stdout, "%s %d secret versions\n", cSuccess("re-keyed"), res.versions)
+	a.promptAndSaveRecoveryPhrase(newPhrase)
+	if len(res.failed) > 0 {
+		return fmt.Errorf("remotes %s still use the previous recovery phrase; the next push finishes them: %w", strings.Join(res.failed, ", "), res.saveErr)
+	}
+	return nil
+}
+
+// confirmPhrase asks for a random word of phrase, so the vault is not
+// re-keyed under a phrase nobody has seen. It reads stdin a byte at a time
+// to leave the rest for the prompts that follow.
+func (a *App) confirmPhrase(phrase string) error {
+	words := strings.Fields(phrase)
+	var b [1]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	n := int(b[0])%len(words) + 1
+	fmt.Fprintf(a.Stderr, "Type word %d of the new phrase to confirm: ", n)
+	var line []byte
+	for {
+		if _, err := a.Stdin.Read(b[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	if strings.TrimSpace(string(line)) != words[n-1] {
+		return errors.New("recovery phrase not confirmed; nothing was changed")
+	}
+	return nil
+}
+
+// PhraseUpgradeKDF keeps the recovery phrase but derives a new vault key
+// from it with a fresh salt and the KDF cost in opts, and re-encrypts every
+// secret version like PhraseRotate.
+func (a *App) PhraseUpgradeKDF(opts KDFOptions) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	from := kdfOf(state.KDF)
+	kdf, err := opts.params(from)
+	if err != nil {
+		return err
+	}
+	if sameKDF(state.KDF, kdf) {
+		fmt.Fprintf(a.Stdout, "%s %s\n", cSuccess("already using"), kdf)
+		return nil
+	}
+	oldKey, err := a.getSecretKey(state)
+	if err != nil {
+		return err
+	}
+	if a.phraseCache == "" {
+		// The agent only hands out the key; re-deriving needs the phrase.
+		phrase, err := a.readPhrase()
+		if err != nil {
+			return err
+		}
+		a.phraseCache = phrase
+	}
+	if kdf.MemoryKiB < from.MemoryKiB || kdf.Time < from.Time {
+		fmt.Fprintln(a.Stderr, cWarn("%s is cheaper to guess against than the current %s", kdf, from))
+	}
+	res, err := a.rekeyVault(state, oldKey, a.phraseCache, kdf)
+	if err != nil {
+		return err
+	}
+	a.logAudit("phrase_upgrade_kdf", state, map[string]any{"from": from.String(), "to": kdf.String(), "versions": res.versions, "remotes": res.remotes})
+	fmt.Fprintf(a.Stdout, "%s %d secret versions with %s (was %s)\n", cSuccess("re-keyed"), res.versions, kdf, from)
+	fmt.Fprintln(a.Stdout, "Other devices must run `envsync restore` with the same recovery phrase.")
+	if len(res.failed) > 0 {
+		return fmt.Errorf("remotes %s still use the previous KDF parameters; the next push finishes them: %w", strings.Join(res.failed, ", "), res.saveErr)
+	}
+	return nil
+}
+
+// rekeyResult reports what rekeyVault re-encrypted. failed lists remotes
+// after the first that kept the previous key, with the last error in
+// saveErr; they are recorded in state.PendingRekey.
+type rekeyResult struct {
+	versions int
+	remotes  int
+	failed   []string
+	saveErr  error
+}
+
+// PendingRekey lists the remotes a re-key wrote locally but could not write
+// to, so they still hold the previous keys. The next push or re-key finishes
+// them first. After a phrase rotation the previous vault key is kept, sealed
+// under the current one, until then; after a team data key rotation the
+// previous keys are unwrapped from the remote copy instead.
+type PendingRekey struct {
+	Scopes              []string `json:"scopes"`
+	Team                string   `json:"team,omitempty"`
+	PreviousKeyCheckB64 string   `json:"previous_key_check_b64,omitempty"`
+	NonceB64            string   `json:"nonce_b64,omitempty"`
+	CipherB64           string   `json:"cipher_b64,omitempty"`
+}
+
+const pendingRekeyInfo = "envsync-pending-rekey"
+
+func sealPreviousKey(pending *PendingRekey, vaultKey, previous []byte) error {
+	key, err := hkdf.Key(sha256.New, vaultKey, nil, pendingRekeyInfo, 32)
+	if err != nil {
+		return err
+	}
+	nonce, ct, err := sealBytes(key, previous, []byte(pendingRekeyInfo))
+	if err != nil {
+		return err
+	}
+	pending.NonceB64 = base64.StdEncoding.EncodeToString(nonce)
+	pending.CipherB64 = base64.StdEncoding.EncodeToString(ct)
+	return nil
+}
+
+func (p *PendingRekey) previousKey(vaultKey []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, vaultKey, nil, pendingRekeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(p.NonceB64)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(p.CipherB64)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := openBytes(key, nonce, ct, []byte(pendingRekeyInfo))
+	if err != nil {
+		return nil, fmt.Errorf("open previous vault key: %w", err)
+	}
+	return previous, nil
+}
+
+// vaultRekey is what a phrase rotation writes to every remote.
+type vaultRekey struct {
+	from, to      *memberIdentity
+	previousCheck string
+	saltB64       string
+	checkB64      string
+	kdf           *KDFParams
+	info          RekeyInfo
+}
+
+// rekeyRemote re-encrypts remote, as loaded for scope, in memory from r.from
+// to r.to. It returns nil for a remote that holds nothing yet or is already
+// under r.to.
+func rekeyRemote(scope remoteScope, remote *RemoteStore, r *vaultRekey) (*rekeyTarget, error) {
+	if remote.SaltB64 == "" && len(remote.Projects) == 0 || remote.KeyCheckB64 == r.checkB64 {
+		return nil, nil
+	}
+	if remote.SaltB64 != "" && remote.KeyCheckB64 != r.previousCheck {
+		return nil, fmt.Errorf("remote %s is encrypted with a different recovery phrase", scope)
+	}
+	openRemoteProjects(remote, r.from)
+	if _, err := reencryptProjects(remote.Projects, r.from.vault, r.to.vault); err != nil {
+		return nil, fmt.Errorf("re-encrypt remote %s: %w", scope, err)
+	}
+	if err := rewrapIdentity(remote.Projects, remote.Teams, r.from.actor, r.from.vault, r.to.device); err != nil {
+		return nil, fmt.Errorf("re-wrap data keys on remote %s: %w", scope, err)
+	}
+	info := r.info
+	if remote.Rekey != nil {
+		info.PreviousKeyChecks = append(info.PreviousKeyChecks, remote.Rekey.PreviousKeyChecks...)
+	}
+	info.PreviousKeyChecks = append(info.PreviousKeyChecks, r.previousCheck)
+	remote.Rekey = &info
+	remote.SaltB64 = r.saltB64
+	remote.KeyCheckB64 = r.checkB64
+	remote.KDF = r.kdf
+	sealed, err := sealRemoteStore(remote, r.to)
+	if err != nil {
+		return nil, fmt.Errorf("seal remote %s: %w", scope, err)
+	}
+	return &rekeyTarget{scope: scope, remote: sealed, revision: remote.Revision}, nil
+}
+
+// rekeyVault derives a new vault key from phrase, a fresh salt and kdf,
+// re-encrypts every version sealed with oldKey in state and on the remotes,
+// and saves state. The remotes keep a record of the retired key check so
+// stale devices are told to restore.
+func (a *App) rekeyVault(state *State, oldKey []byte, phrase string, kdf *KDFParams) (*rekeyResult, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	newKey, err := deriveKey(phrase, salt, kdf)
+	if err != nil {
+		return nil, err
+	}
+	newSaltB64 := base64.StdEncoding.EncodeToString(salt)
+	newCheckB64 := base64.StdEncoding.EncodeToString(keyCheck(newKey))
+	if err := a.finishPendingRekey(state); err != nil {
+		return nil, err
+	}
+	actor := a.actorID(state)
+	device, err := a.deviceIdentity(state, oldKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &vaultRekey{
+		from:          &memberIdentity{actor: actor, vault: oldKey, device: device},
+		to:            &memberIdentity{actor: actor, vault: newKey, device: device},
+		previousCheck: state.KeyCheckB64,
+		saltB64:       newSaltB64,
+		checkB64:      newCheckB64,
+		kdf:           kdf,
+		info: RekeyInfo{
+			RotatedAt: a.Now().UTC().Format(time.RFC3339),
+			DeviceID:  state.DeviceID,
+		},
+	}
+
+	// Re-encrypt every remote copy in memory first so a bad remote aborts
+	// the rotation before anything is written.
+	targets := []*rekeyTarget{}
+	for _, scope := range a.rekeyScopes(state) {
+		remote, err := a.loadRemoteStoreFor(scope)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateRemoteCrypto(state, remote); err != nil {
+			return nil, err
+		}
+		target, err := rekeyRemote(scope, remote, r)
+		if err != nil {
+			return nil, err
+		}
+		if target != nil {
+			targets = append(targets, target)
+		}
+	}
+	versions, err := reencryptProjects(state.Projects, oldKey, newKey)
+	if err != nil {
+		return nil, fmt.Errorf("re-encrypt local state: %w", err)
+	}
+	if err := rewrapIdentity(state.Projects, state.Teams, actor, oldKey, device); err != nil {
+		return nil, fmt.Errorf("re-wrap data keys: %w", err)
+	}
+	if state.Identity, err = sealDeviceIdentity(newKey, device); err != nil {
+		return nil, err
+	}
+	state.SaltB64 = newSaltB64
+	state.KeyCheckB64 = newCheckB64
+	state.KDF = kdf
+
+	// The rotation must not overwrite versions it has not re-encrypted, so a
+	// remote that moved since it was loaded fails instead of retrying.
+	res := &rekeyResult{versions: versions}
+	for i, target := range targets {
+		err := a.saveRemoteStoreFor(target.scope, target.remote, target.revision)
+		if err == nil {
+			res.remotes++
+			continue
+		}
+		if errors.Is(err, errRemoteConflict) {
+			err = fmt.Errorf("remote %s changed during rotation; pull and retry: %w", target.scope, err)
+		}
+		if i == 0 {
+			return nil, err
+		}
+		res.failed = append(res.failed, target.scope.String())
+		res.saveErr = err
+	}
+	if len(res.failed) > 0 {
+		state.PendingRekey = &PendingRekey{Scopes: res.failed, PreviousKeyCheckB64: r.previousCheck}
+		if err := sealPreviousKey(state.PendingRekey, newKey, oldKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.saveState(state); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// finishPendingRekey writes the remotes a previous re-key could not. Those
+// still failing stay pending and are reported. The caller saves state.
+func (a *App) finishPendingRekey(state *State) error {
+	pending := state.PendingRekey
+	if pending == nil {
+		return nil
+	}
+	id, err := a.memberIdentity(state)
+	if err != nil {
+		return err
+	}
+	var finish func(remoteScope) error
+	if pending.Team != "" {
+		finish = func(scope remoteScope) error { return a.finishTeamRekey(state, pending.Team, scope, id) }
+	} else {
+		previous, err := pending.previousKey(id.vault)
+		if err != nil {
+			return err
+		}
+		if id.device, err = a.deviceIdentity(state, id.vault); err != nil {
+			return err
+		}
+		r := &vaultRekey{
+			from:          &memberIdentity{actor: id.actor, vault: previous, device: id.device},
+			to:            id,
+			previousCheck: pending.PreviousKeyCheckB64,
+			saltB64:       state.SaltB64,
+			checkB64:      state.KeyCheckB64,
+			kdf:           state.KDF,
+			info: RekeyInfo{
+				RotatedAt: a.Now().UTC().Format(time.RFC3339),
+				DeviceID:  state.DeviceID,
+			},
+		}
+		finish = func(scope remoteScope) error {
+			remote, err := a.loadRemoteStoreFor(scope)
+			if err != nil {
+				return err
+			}
+			target, err := rekeyRemote(scope, remote, r)
+			if err != nil || target == nil {
+				return err
+			}
+			return a.saveRemoteStoreFor(target.scope, target.remote, target.revision)
+		}
+	}
+	var remaining []string
+	var lastErr error
+	seen := map[string]bool{}
+	for _, scope := range a.rekeyScopes(state) {
+		if seen[scope.String()] || !slices.Contains(pending.Scopes, scope.String()) {
+			continue
+		}
+		seen[scope.String()] = true
+		if err := finish(scope); err != nil {
+			remaining = append(remaining, scope.String())
+			lastErr = err
+			continue
+		}
+		fmt.Fprintf(a.Stdout, "%s %s\n", cSuccess("finished re-keying"), scope)
+	}
+	if len(remaining) > 0 {
+		pending.Scopes = remaining
+		return fmt.Errorf("remotes %s still hold the previous keys: %w", strings.Join(remaining, ", "), lastErr)
+	}
+	state.PendingRekey = nil
+	return nil
+}
+
+// rekeyScopes lists the remotes holding this device's projects. Cloud keeps
+// one vault per project; the other modes share a single document.
+func (a *App) rekeyScopes(state *State) []remoteScope {
+	if a.effectiveRemoteMode() != "cloud" {
+		return []remoteScope{{}}
+	}
+	scopes := []remoteScope{}
+	for _, name := range sortedKeys(state.Projects) {
+		scopes = append(scopes, projectScope(name, state.Projects[name]))
+	}
+	return scopes
+}
+
+// reencryptProjects decrypts every version sealed with the vault key oldKey
+// and seals it again with newKey. Versions under a project data key are left
+// alone, and versions are bound to their location exactly when they were
+// before. It returns how many versions were re-encrypted.
+func reencryptProjects(projects map[string]*Project, oldKey, newKey []byte) (int, error) {
+	count := 0
+	for _, project := range projects {
+		for envName, env := range project.Envs {
+			for name, rec := range env.Vars {
+				for i := range rec.Versions {
+					v := &rec.Versions[i]
+					if v.Deleted || v.CipherB64 == "" || v.KeyID != "" {
+						continue
+					}
+					var aad []byte
+					if v.AAD != 0 {
+						aad = versionAAD(project.Name, envName, name, v.Version)
+					}
+					plain, err := open(oldKey, *v, aad)
+					if err != nil {
+						return count, fmt.Errorf("%s v%d: %w", name, v.Version, err)
+					}
+					ct, nonce, hash, err := encrypt(newKey, plain, aad)
+					if err != nil {
+						return count, err
+					}
+					v.CipherB64 = base64.StdEncoding.EncodeToString(ct)
+					v.NonceB64 = base64.StdEncoding.EncodeToString(nonce)
+					v.PlainHash = hash
+					count++
+				}
+			}
+		}
+	}
+	return count, nil
+}
+
+// rewrapIdentity moves the caller's data keys still wrapped for the legacy
+// identity derived from oldKey, which the new vault key can no longer
+// derive, to the device identity, and publishes the device's public key on
+// the teams the caller belongs to. Teams with an authentication key keep the
+// keys their admins added.
+func rewrapIdentity(projects map[string]*Project, teams map[string]*Team, actor string, oldKey []byte, device *ecdh.PrivateKey) error {
+	legacy, err := legacyIdentityKey(oldKey, actor)
+	if err != nil {
+		return err
+	}
+	for name, project := range projects {
+		wrapped := project.WrappedKeys[actor]
+		if wrapped == nil {
+			continue
+		}
+		if _, err := unwrapDataKey(device, wrapped); err == nil {
+			continue
+		}
+		data, err := unwrapDataKey(legacy, wrapped)
+		if err != nil {
+			return fmt.Errorf("project %q: %w", name, err)
+		}
+		if project.WrappedKeys[actor], err = wrapDataKey(device.PublicKey(), wrapped.KeyID, data); err != nil {
+			return err
+		}
+	}
+	for _, team := range teams {
+		if team == nil || team.Members[actor] == "" || team.AuthKeyID != "" {
+			continue
+		}
+		if team.PublicKeys == nil {
+			team.PublicKeys = map[string]string{}
+		}
+		team.PublicKeys[actor] = base64.StdEncoding.EncodeToString(device.PublicKey().Bytes())
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package envsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
+
+// phraseConfirmer answers the confirmation prompt of PhraseRotate with the
+// word it asks for, taken from what the app has printed by then.
+type phraseConfirmer struct {
+	app    *App
+	answer []byte
+	asked  bool
+}
+
+func (c *phraseConfirmer) Read(p []byte) (int, error) {
+	if !c.asked {
+		c.asked = true
+		words := strings.Fields(lastLine(c.app.Stdout.(*bytes.Buffer).String()))
+		prompt := c.app.Stderr.(*bytes.Buffer).String()
+		var n int
+		if _, err := fmt.Sscanf(prompt[strings.LastIndex(prompt, "Type word "):], "Type word %d", &n); err != nil {
+			return 0, err
+		}
+		c.answer = []byte(words[n-1] + "\n")
+	}
+	if len(c.answer) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.answer)
+	c.answer = c.answer[n:]
+	return n, nil
+}
+
+func confirmRotation(app *App) {
+	app.Stdin = &phraseConfirmer{app: app}
+}
+
+func TestPhraseRotateReencryptsHistoryAndRemote(t *testing.T) {
+	app, stdout := newTestApp(t)
+	for _, v := range []string{"a1", "a2"} {
+		if err := app.Set("TOKEN", v, ""); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	peer, _ := newPeerApp(t, app)
+	before, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout.Reset()
+	confirmRotation(app)
+	if err := app.PhraseRotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	newPhrase := app.phraseCache
+	if len(strings.Fields(newPhrase)) != 12 || !strings.Contains(stdout.String(), newPhrase) {
+		t.Fatalf("expected a new 12-word recovery phrase to be shown, got %q", newPhrase)
+	}
+
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.SaltB64 == before.SaltB64 || state.KeyCheckB64 == before.KeyCheckB64 {
+		t.Fatal("expected salt and key check to change")
+	}
+	app.phraseCache = ""
+	if _, err := app.getSecretKey(state); err == nil {
+		t.Fatal("expected previous phrase to be rejected")
+	}
+	t.Setenv("ENVSYNC_RECOVERY_PHRASE", newPhrase)
+	app.phraseCache = ""
+	key, err := app.getSecretKey(state)
+	if err != nil {
+		t.Fatalf("new phrase: %v", err)
+	}
+	rec := state.Projects["api"].Envs["dev"].Vars["TOKEN"]
+	for i, want := range []string{"a1", "a2"} {
+		got, err := decrypt(key, rec.Versions[i], versionAAD("api", "dev", "TOKEN", i+1))
+		if err != nil || got != want {
+			t.Fatalf("history v%d: got %q err %v", i+1, got, err)
+		}
+	}
+
+	remote, err := app.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.KeyCheckB64 != state.KeyCheckB64 || remote.Rekey == nil {
+		t.Fatalf("expected remote re-keyed with rotation metadata, got %+v", remote.Rekey)
+	}
+	remoteRec := remote.Projects["api"].Envs["dev"].Vars["TOKEN"]
+	if got, err := decrypt(key, remoteRec.Versions[0], versionAAD("api", "dev", "TOKEN", 1)); err != nil || got != "a1" {
+		t.Fatalf("remote history v1: got %q err %v", got, err)
+	}
+
+	err = peer.Pull(false)
+	if !errors.Is(err, errVaultRekeyed) || !strings.Contains(err.Error(), "envsync restore") {
+		t.Fatalf("expected re-keyed vault error on stale device, got %v", err)
+	}
+}
+
+func TestPhraseRotateAbortsWhenRemoteMoves(t *testing.T) {
+	app, _ := newTestApp(t)
+	rr := newRacingRemote(t)
+	app.RemoteURL = rr.server.URL
+	app.HTTPClient = rr.server.Client()
+	if err := app.Set("TOKEN", "a1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	before, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr.race = func(*RemoteStore) {}
+	confirmRotation(app)
+	err = app.PhraseRotate()
+	if !errors.Is(err, errRemoteConflict) || !strings.Contains(err.Error(), "changed during rotation") {
+		t.Fatalf("expected rotation to abort on concurrent change, got %v", err)
+	}
+	after, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.KeyCheckB64 != before.KeyCheckB64 {
+		t.Fatal("expected local state to keep the previous key after an aborted rotation")
+	}
+}
+
+func TestInitRecordsKDFParams(t *testing.T) {
+	tmp := t.TempDir()
+	stdout := &bytes.Buffer{}
+	app := &App{
+		ConfigDir: tmp,
+		StatePath: filepath.Join(tmp, "state.json"),
+		Stdin:     strings.NewReader(""),
+		Stdout:    stdout,
+		Stderr:    &bytes.Buffer{},
+		Now:       time.Now,
+	}
+	if err := app.InitWith(InitOptions{KDF: KDFOptions{MemoryMiB: 1}}); err == nil {
+		t.Fatal("expected --kdf-memory below the minimum to fail")
+	}
+	if err := app.InitWith(InitOptions{KDF: KDFOptions{MemoryMiB: 8, Time: 2}}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := KDFParams{Version: 1, Algorithm: "argon2id", Time: 2, MemoryKiB: 8 * 1024, Threads: 4}
+	if state.KDF == nil || *state.KDF != want {
+		t.Fatalf("kdf = %+v, want %+v", state.KDF, want)
+	}
+	t.Setenv("ENVSYNC_RECOVERY_PHRASE", lastLine(stdout.String()))
+	if _, err := app.getSecretKey(state); err != nil {
+		t.Fatalf("derive with recorded params: %v", err)
+	}
+	err = app.InitWith(InitOptions{KDF: KDFOptions{Time: 3}})
+	if err == nil || !strings.Contains(err.Error(), "upgrade-kdf") {
+		t.Fatalf("expected re-init with KDF flags to point at upgrade-kdf, got %v", err)
+	}
+}
+
+func TestPhraseUpgradeKDFKeepsPhrase(t *testing.T) {
+	app, stdout := newTestApp(t)
+	for _, v := range []string{"a1", "a2"} {
+		if err := app.Set("TOKEN", v, ""); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	peer, _ := newPeerApp(t, app)
+	before, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.KDF == nil || *before.KDF != defaultKDFParams() {
+		t.Fatalf("expected init to record the default params, got %+v", before.KDF)
+	}
+
+	if err := app.PhraseUpgradeKDF(KDFOptions{MemoryMiB: 8, Time: 2}); err != nil {
+		t.Fatalf("upgrade-kdf: %v", err)
+	}
+	if stderr := app.Stderr.(*bytes.Buffer).String(); !strings.Contains(stderr, "cheaper") {
+		t.Fatalf("expected a warning for lowering the memory cost, got %q", stderr)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.KDF == nil || state.KDF.Time != 2 || state.KDF.MemoryKiB != 8*1024 || state.SaltB64 == before.SaltB64 {
+		t.Fatalf("expected new params and salt, got %+v", state.KDF)
+	}
+	remote, err := app.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameKDF(remote.KDF, state.KDF) || remote.KeyCheckB64 != state.KeyCheckB64 {
+		t.Fatalf("remote kdf = %+v, want %+v", remote.KDF, state.KDF)
+	}
+
+	// The same phrase still unlocks, locally and on a device restored from
+	// the remote's params.
+	app.phraseCache, app.vaultKeyFor = "", ""
+	if got := activeValuesFor(t, app)["TOKEN"]; got != "a2" {
+		t.Fatalf("TOKEN = %q after upgrade", got)
+	}
+	fresh, _ := newPeerApp(t, app)
+	if got := activeValuesFor(t, fresh)["TOKEN"]; got != "a2" {
+		t.Fatalf("restored TOKEN = %q", got)
+	}
+	if err := peer.Pull(false); !errors.Is(err, errVaultRekeyed) {
+		t.Fatalf("expected re-keyed vault error on stale device, got %v", err)
+	}
+
+	stdout.Reset()
+	if err := app.PhraseUpgradeKDF(KDFOptions{MemoryMiB: 8, Time: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "already using") {
+		t.Fatalf("expected a no-op, got:\n%s", stdout.String())
+	}
+
+	// Flags left out keep the current cost rather than the defaults.
+	if err := app.PhraseUpgradeKDF(KDFOptions{Time: 3}); err != nil {
+		t.Fatal(err)
+	}
+	state, err = app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.KDF.Time != 3 || state.KDF.MemoryKiB != 8*1024 {
+		t.Fatalf("expected only the time to change, got %+v", state.KDF)
+	}
+}
+
+func TestPhraseRotateRequiresConfirmation(t *testing.T) {
+	app, _ := newTestApp(t)
+	if err := app.Set("TOKEN", "t1", ""); err != nil {
+		t.Fatal(err)
+	}
+	before, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Stdin = strings.NewReader("wrong\n")
+	if err := app.PhraseRotate(); err == nil || !strings.Contains(err.Error(), "not confirmed") {
+		t.Fatalf("expected an unconfirmed phrase to be refused, got %v", err)
+	}
+	after, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.KeyCheckB64 != before.KeyCheckB64 || after.SaltB64 != before.SaltB64 {
+		t.Fatal("expected nothing to change before the phrase is confirmed")
+	}
+}
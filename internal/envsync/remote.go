@@ -9,17 +9,86 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// errRemoteConflict reports that the remote revision moved between load and
+// save. Push reloads, rebases and retries when it sees it.
+var errRemoteConflict = errors.New("remote changed concurrently")
+
+// defaultCloudVault is the vault envsync-cloud uses when no project is given.
+// Stores pushed before per-project vaults existed live there.
+const defaultCloudVault = "default"
+
+// remoteScope selects the cloud vault a command reads or writes. File and
+// http remotes keep every project in one document and ignore it.
+type remoteScope struct {
+	Project        string
+	OrganizationID string
+	TeamID         string
+	// Unsealed is the project's name when Project is its sealed ID: the
+	// vault it used before its metadata was sealed.
+	Unsealed string
+}
+
+func projectScope(name string, project *Project) remoteScope {
+	scope := remoteScope{Project: name}
+	if project != nil {
+		scope.OrganizationID = project.CloudOrganizationID
+		scope.TeamID = project.CloudTeamID
+		if project.Sealed != nil {
+			scope.Project, scope.Unsealed = project.Sealed.ID, name
+		}
+	}
+	return scope
+}
+
+func (s remoteScope) query() url.Values {
+	values := url.Values{}
+	if s.Project != "" {
+		values.Set("project", strings.ToLower(s.Project))
+	}
+	if s.OrganizationID != "" {
+		values.Set("organization_id", s.OrganizationID)
+	}
+	if s.TeamID != "" {
+		values.Set("team_id", s.TeamID)
+	}
+	return values
+}
+
+func (s remoteScope) String() string {
+	project := s.Project
+	if project == "" {
+		project = defaultCloudVault
+	}
+	switch {
+	case s.TeamID != "":
+		return "team " + s.TeamID + "/" + project
+	case s.OrganizationID != "":
+		return "organization " + s.OrganizationID + "/" + project
+	}
+	return "personal/" + project
+}
+
 func (a *App) loadRemoteStore() (*RemoteStore, error) {
+	return a.loadRemoteStoreFor(remoteScope{})
+}
+
+func (a *App) saveRemoteStore(remote *RemoteStore, expectedRevision int) error {
+	return a.saveRemoteStoreFor(remoteScope{}, remote, expectedRevision)
+}
+
+func (a *App) loadRemoteStoreFor(scope remoteScope) (*RemoteStore, error) {
 	switch a.effectiveRemoteMode() {
 	case "cloud":
-		return a.loadRemoteCloud()
+		return a.loadRemoteCloud(scope)
 	case "http":
 		return a.loadRemoteHTTP()
 	default:
@@ -27,10 +96,10 @@ func (a *App) loadRemoteStore() (*RemoteStore, error) {
 	}
 }
 
-func (a *App) saveRemoteStore(remote *RemoteStore, expectedRevision int) error {
+func (a *App) saveRemoteStoreFor(scope remoteScope, remote *RemoteStore, expectedRevision int) error {
 	switch a.effectiveRemoteMode() {
 	case "cloud":
-		return a.saveRemoteCloud(remote, expectedRevision)
+		return a.saveRemoteCloud(scope, remote, expectedRevision)
 	case "http":
 		return a.saveRemoteHTTP(remote, expectedRevision)
 	default:
@@ -82,7 +151,7 @@ func (a *App) saveRemoteFile(remote *RemoteStore, expectedRevision int) error {
 			return err
 		}
 		if current.Revision != expectedRevision {
-			return fmt.Errorf("remote changed concurrently: expected revision %d, got %d", expectedRevision, current.Revision)
+			return fmt.Errorf("%w: expected revision %d, got %d", errRemoteConflict, expectedRevision, current.Revision)
 		}
 		remote.Revision = current.Revision + 1
 		if err := os.MkdirAll(filepath.Dir(a.RemotePath), 0o700); err != nil {
@@ -114,21 +183,47 @@ func (a *App) saveRemoteFile(remote *RemoteStore, expectedRevision int) error {
 }
 
 func (a *App) loadRemoteHTTP() (*RemoteStore, error) {
-	return a.loadRemoteHTTPFromURL(a.RemoteURL, a.authHeaderToken())
+	return a.loadRemoteHTTPFromURL(a.RemoteURL, a.authHeaderToken(), nil)
 }
 
-func (a *App) loadRemoteCloud() (*RemoteStore, error) {
+func (a *App) loadRemoteCloud(scope remoteScope) (*RemoteStore, error) {
 	token, err := a.cloudAccessToken()
 	if err != nil {
 		return nil, err
 	}
-	return a.loadRemoteHTTPFromURL(a.cloudBaseURL(), token)
+	remote, err := a.loadRemoteHTTPFromURL(a.cloudBaseURL(), token, scope.query())
+	if err != nil {
+		return nil, err
+	}
+	if remote.Revision > 0 || scope.Project == "" || strings.EqualFold(scope.Project, defaultCloudVault) {
+		return remote, nil
+	}
+	// The project has no vault of its own yet. Seed it from the owner's
+	// default vault, or from the vault it used before its metadata was
+	// sealed, so the first push carries the existing history over.
+	name := scope.Project
+	from := remoteScope{OrganizationID: scope.OrganizationID, TeamID: scope.TeamID}
+	if scope.Unsealed != "" {
+		name, from.Project = scope.Unsealed, scope.Unsealed
+	}
+	legacy, err := a.loadRemoteHTTPFromURL(a.cloudBaseURL(), token, from.query())
+	if err != nil {
+		return nil, err
+	}
+	if project := legacy.Projects[name]; project != nil {
+		remote.SaltB64 = legacy.SaltB64
+		remote.KeyCheckB64 = legacy.KeyCheckB64
+		remote.KDF = legacy.KDF
+		remote.Teams = legacy.Teams
+		remote.Projects[name] = project
+	}
+	return remote, nil
 }
 
-func (a *App) loadRemoteHTTPFromURL(baseURL, token string) (*RemoteStore, error) {
+func (a *App) loadRemoteHTTPFromURL(baseURL, token string, query url.Values) (*RemoteStore, error) {
 	var remote *RemoteStore
 	err := a.withHTTPRetry(func() (bool, error) {
-		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/v1/store", nil)
+		req, err := http.NewRequest(http.MethodGet, storeURL(baseURL, query), nil)
 		if err != nil {
 			return false, err
 		}
@@ -147,6 +242,7 @@ func (a *App) loadRemoteHTTPFromURL(baseURL, token string) (*RemoteStore, error)
 		if err != nil {
 			return false, err
 		}
+		decoded.secretRecords = hasFeature(resp.Header.Get(featuresHeader), secretRecordsFeature)
 		remote = decoded
 		return false, nil
 	})
@@ -157,25 +253,25 @@ func (a *App) loadRemoteHTTPFromURL(baseURL, token string) (*RemoteStore, error)
 }
 
 func (a *App) saveRemoteHTTP(remote *RemoteStore, expectedRevision int) error {
-	return a.saveRemoteHTTPToURL(a.RemoteURL, a.authHeaderToken(), remote, expectedRevision)
+	return a.saveRemoteHTTPToURL(a.RemoteURL, a.authHeaderToken(), nil, remote, expectedRevision)
 }
 
-func (a *App) saveRemoteCloud(remote *RemoteStore, expectedRevision int) error {
+func (a *App) saveRemoteCloud(scope remoteScope, remote *RemoteStore, expectedRevision int) error {
 	token, err := a.cloudAccessToken()
 	if err != nil {
 		return err
 	}
-	return a.saveRemoteHTTPToURL(a.cloudBaseURL(), token, remote, expectedRevision)
+	return a.saveRemoteHTTPToURL(a.cloudBaseURL(), token, scope.query(), remote, expectedRevision)
 }
 
-func (a *App) saveRemoteHTTPToURL(baseURL, token string, remote *RemoteStore, expectedRevision int) error {
+func (a *App) saveRemoteHTTPToURL(baseURL, token string, query url.Values, remote *RemoteStore, expectedRevision int) error {
 	remote.Revision = expectedRevision + 1
 	body, err := encodeRemoteStoreBody(remote)
 	if err != nil {
 		return err
 	}
 	return a.withHTTPRetry(func() (bool, error) {
-		req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(baseURL, "/")+"/v1/store", bytes.NewReader(body))
+		req, err := http.NewRequest(http.MethodPut, storeURL(baseURL, query), bytes.NewReader(body))
 		if err != nil {
 			return false, err
 		}
@@ -187,6 +283,10 @@ func (a *App) saveRemoteHTTPToURL(baseURL, token string, remote *RemoteStore, ex
 			return isRetryableNetworkError(err), err
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusPreconditionFailed {
+			respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return false, fmt.Errorf("%w: %s %s", errRemoteConflict, resp.Status, strings.TrimSpace(string(respBody)))
+		}
 		if resp.StatusCode != http.StatusOK {
 			respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
 			err := fmt.Errorf("remote PUT failed: %s %s", resp.Status, strings.TrimSpace(string(respBody)))
@@ -196,9 +296,133 @@ func (a *App) saveRemoteHTTPToURL(baseURL, token string, remote *RemoteStore, ex
 	})
 }
 
+func storeURL(baseURL string, query url.Values) string {
+	u := strings.TrimSuffix(baseURL, "/") + "/v1/store"
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+type cloudVault struct {
+	Project  string `json:"project"`
+	Revision int    `json:"revision"`
+}
+
+// listCloudVaults returns the vaults owned by scope's owner. Servers that
+// predate /v1/vaults only know the default vault.
+func (a *App) listCloudVaults(token string, scope remoteScope) ([]cloudVault, error) {
+	var vaults []cloudVault
+	err := a.withHTTPRetry(func() (bool, error) {
+		query := remoteScope{OrganizationID: scope.OrganizationID, TeamID: scope.TeamID}.query()
+		u := a.cloudBaseURL() + "/v1/vaults"
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return false, err
+		}
+		addAuthHeader(req, token)
+		resp, err := a.httpClient().Do(req)
+		if err != nil {
+			return isRetryableNetworkError(err), err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			vaults = []cloudVault{{Project: defaultCloudVault}}
+			return false, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			err := fmt.Errorf("remote vault listing failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+			return isRetryableStatus(resp.StatusCode), err
+		}
+		var payload struct {
+			Vaults []cloudVault `json:"vaults"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+			return false, err
+		}
+		vaults = payload.Vaults
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vaults, nil
+}
+
+// loadRestoreStore returns every project restore should recreate. Cloud
+// remotes keep one vault per project and owner, so the caller's personal,
+// team and organization vaults are listed and merged. A project's own vault
+// wins over its copy in the default vault.
+func (a *App) loadRestoreStore() (*RemoteStore, error) {
+	if a.effectiveRemoteMode() != "cloud" {
+		return a.loadRemoteStore()
+	}
+	token, err := a.cloudAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	owners, err := a.cloudMemberships(token)
+	if err != nil {
+		return nil, err
+	}
+	owners = append([]remoteScope{{}}, owners...)
+
+	merged := &RemoteStore{Version: 1, Teams: map[string]*Team{}, Projects: map[string]*Project{}}
+	dedicated := map[string]bool{}
+	for _, owner := range owners {
+		vaults, err := a.listCloudVaults(token, owner)
+		if err != nil {
+			return nil, err
+		}
+		for _, vault := range vaults {
+			scope := owner
+			scope.Project = vault.Project
+			store, err := a.loadRemoteHTTPFromURL(a.cloudBaseURL(), token, scope.query())
+			if err != nil {
+				return nil, err
+			}
+			if store.SaltB64 == "" && store.KeyCheckB64 == "" {
+				continue
+			}
+			if merged.SaltB64 == "" {
+				merged.SaltB64 = store.SaltB64
+				merged.KeyCheckB64 = store.KeyCheckB64
+				merged.KDF = store.KDF
+			} else if store.SaltB64 != merged.SaltB64 || store.KeyCheckB64 != merged.KeyCheckB64 || !sameKDF(store.KDF, merged.KDF) {
+				fmt.Fprintf(a.Stderr, "warning: skipping vault %s: encrypted with a different recovery phrase\n", scope)
+				continue
+			}
+			for name, project := range store.Projects {
+				if dedicated[name] {
+					continue
+				}
+				if strings.EqualFold(vault.Project, defaultCloudVault) {
+					if _, exists := merged.Projects[name]; exists {
+						continue
+					}
+				} else {
+					dedicated[name] = true
+				}
+				project.CloudOrganizationID = owner.OrganizationID
+				project.CloudTeamID = owner.TeamID
+				merged.Projects[name] = project
+			}
+			for name, team := range store.Teams {
+				merged.Teams[name] = team
+			}
+		}
+	}
+	return merged, nil
+}
+
 func attachCryptoMetadata(state *State, remote *RemoteStore) {
 	remote.SaltB64 = state.SaltB64
 	remote.KeyCheckB64 = state.KeyCheckB64
+	remote.KDF = state.KDF
 }
 
 func validateRemoteCrypto(state *State, remote *RemoteStore) error {
@@ -206,8 +430,14 @@ func validateRemoteCrypto(state *State, remote *RemoteStore) error {
 		return nil
 	}
 	if remote.SaltB64 != state.SaltB64 || remote.KeyCheckB64 != state.KeyCheckB64 {
+		if remote.Rekey != nil && slices.Contains(remote.Rekey.PreviousKeyChecks, state.KeyCheckB64) {
+			return fmt.Errorf("%w on %s by device %s; run `envsync restore` with the current recovery phrase", errVaultRekeyed, remote.Rekey.RotatedAt, remote.Rekey.DeviceID)
+		}
 		return errors.New("remote store is encrypted with a different recovery phrase")
 	}
+	if !sameKDF(remote.KDF, state.KDF) {
+		return fmt.Errorf("remote store derives its key with %s but local state uses %s; run `envsync restore`", kdfOf(remote.KDF), kdfOf(state.KDF))
+	}
 	return nil
 }
 
@@ -237,6 +467,13 @@ func (a *App) remoteRetryConfig() (int, time.Duration, time.Duration) {
 	return attempts, base, maxDelay
 }
 
+func (a *App) pushMaxAttempts() int {
+	if a.PushMaxAttempts <= 0 {
+		return 5
+	}
+	return a.PushMaxAttempts
+}
+
 func (a *App) withHTTPRetry(op func() (retryable bool, err error)) error {
 	attempts, base, maxDelay := a.remoteRetryConfig()
 	sleepFn := a.Sleep
@@ -2,13 +2,16 @@ package envsync
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -172,3 +175,141 @@ func TestLoadRemoteHTTPDoesNotRetryOnUnauthorized(t *testing.T) {
 		t.Fatalf("expected single attempt, got %d", calls.Load())
 	}
 }
+
+// racingRemote serves one RemoteStore over HTTP and lets a test slip a
+// concurrent write in just before a PUT is applied.
+type racingRemote struct {
+	mu     sync.Mutex
+	store  *RemoteStore
+	race   func(store *RemoteStore)
+	rearm  bool
+	puts   int
+	server *httptest.Server
+}
+
+func newRacingRemote(t *testing.T) *racingRemote {
+	t.Helper()
+	rr := &racingRemote{store: &RemoteStore{Version: 1, Projects: map[string]*Project{}, Teams: map[string]*Team{}}}
+	rr.server = httptest.NewServer(http.HandlerFunc(rr.serveHTTP))
+	t.Cleanup(rr.server.Close)
+	return rr
+}
+
+func (rr *racingRemote) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if r.Method == http.MethodGet {
+		_ = json.NewEncoder(w).Encode(rr.store)
+		return
+	}
+	rr.puts++
+	if rr.race != nil {
+		rr.race(rr.store)
+		rr.store.Revision++
+		if !rr.rearm {
+			rr.race = nil
+		}
+	}
+	if r.Header.Get("If-Match") != strconv.Itoa(rr.store.Revision) {
+		http.Error(w, "revision conflict", http.StatusConflict)
+		return
+	}
+	var next RemoteStore
+	if err := json.NewDecoder(r.Body).Decode(&next); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	next.Revision = rr.store.Revision + 1
+	rr.store = &next
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestPushRebasesOntoConcurrentRemoteChange(t *testing.T) {
+	app, _ := newTestApp(t)
+	rr := newRacingRemote(t)
+	app.RemoteURL = rr.server.URL
+	app.HTTPClient = rr.server.Client()
+
+	if err := app.Set("TOKEN", "a1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	rr.race = func(store *RemoteStore) {
+		store.Projects["web"] = &Project{Name: "web", Envs: map[string]*Env{}}
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if rr.puts != 2 {
+		t.Fatalf("expected push to retry once, got %d PUTs", rr.puts)
+	}
+	if rr.store.Projects["web"] == nil {
+		t.Fatal("expected concurrent project to survive the rebase")
+	}
+	if rr.store.Projects["api"].Envs["dev"].Vars["TOKEN"] == nil {
+		t.Fatal("expected TOKEN pushed on retry")
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Projects["api"].Envs["dev"].Vars["TOKEN"].LastSyncedRemoteVersion; got != 1 {
+		t.Fatalf("expected TOKEN synced at v1, got %d", got)
+	}
+}
+
+func TestPushReportsConflictWhenSameKeyMovedConcurrently(t *testing.T) {
+	app, _ := newTestApp(t)
+	rr := newRacingRemote(t)
+	app.RemoteURL = rr.server.URL
+	app.HTTPClient = rr.server.Client()
+
+	if err := app.Set("TOKEN", "a1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := app.Set("TOKEN", "a2", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	rr.race = func(store *RemoteStore) {
+		rec := store.Projects["api"].Envs["dev"].Vars["TOKEN"]
+		next := rec.Versions[len(rec.Versions)-1]
+		next.Version = 2
+		next.DeviceID = "other-device"
+		rec.Versions = append(rec.Versions, next)
+		rec.CurrentVersion = 2
+	}
+	err := app.Push(false)
+	if err == nil || !strings.Contains(err.Error(), "push conflicts for keys: TOKEN") {
+		t.Fatalf("expected TOKEN conflict, got %v", err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Projects["api"].Envs["dev"].Vars["TOKEN"].LastSyncedRemoteVersion; got != 1 {
+		t.Fatalf("expected LastSyncedRemoteVersion to stay 1, got %d", got)
+	}
+}
+
+func TestPushGivesUpAfterMaxAttempts(t *testing.T) {
+	app, _ := newTestApp(t)
+	rr := newRacingRemote(t)
+	app.RemoteURL = rr.server.URL
+	app.HTTPClient = rr.server.Client()
+	app.PushMaxAttempts = 2
+
+	if err := app.Set("TOKEN", "a1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	rr.race = func(*RemoteStore) {}
+	rr.rearm = true
+	err := app.Push(false)
+	if !errors.Is(err, errRemoteConflict) {
+		t.Fatalf("expected remote conflict error, got %v", err)
+	}
+	if rr.puts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", rr.puts)
+	}
+}
@@ -0,0 +1,229 @@
+package envsync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	strategyOurs   = "ours"
+	strategyTheirs = "theirs"
+	strategyNewest = "newest"
+	strategyPrompt = "prompt"
+)
+
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case strategyOurs, strategyTheirs, strategyNewest, strategyPrompt:
+		return nil
+	}
+	return fmt.Errorf("invalid strategy %q (use ours, theirs, newest or prompt)", strategy)
+}
+
+// conflictResolver settles keys of env that changed both locally and
+// remotely since the last sync. Choices are remembered per key so a push
+// retry does not ask twice.
+type conflictResolver struct {
+	app      *App
+	state    *State
+	env      string
+	strategy string
+	reveal   bool
+	keys     *projectKeys
+	in       *bufio.Reader
+	choices  map[string]string
+}
+
+func (a *App) newConflictResolver(state *State, project *Project, envName, strategy string, reveal bool) (*conflictResolver, error) {
+	if err := validateStrategy(strategy); err != nil {
+		return nil, err
+	}
+	keys, err := a.keysFor(state, project)
+	if err != nil {
+		return nil, err
+	}
+	return &conflictResolver{
+		app:      a,
+		state:    state,
+		env:      envName,
+		strategy: strategy,
+		reveal:   reveal,
+		keys:     keys,
+		in:       bufio.NewReader(a.Stdin),
+		choices:  map[string]string{},
+	}, nil
+}
+
+// resolveAll decides each conflicting key and returns the merged records by
+// key plus the keys the user chose to skip.
+func (r *conflictResolver) resolveAll(keys []string, localEnv, remoteEnv *Env) (map[string]*SecretRecord, []string, error) {
+	merged := map[string]*SecretRecord{}
+	var skipped []string
+	for _, k := range keys {
+		localRec, remoteRec := localEnv.Vars[k], remoteEnv.Vars[k]
+		choice, err := r.choose(k, localRec, remoteRec)
+		if err != nil {
+			return nil, nil, err
+		}
+		if choice == "" {
+			skipped = append(skipped, k)
+			continue
+		}
+		rec, err := r.merge(k, localRec, remoteRec, choice)
+		if err != nil {
+			return nil, nil, err
+		}
+		merged[k] = rec
+	}
+	return merged, skipped, nil
+}
+
+// choose returns strategyOurs or strategyTheirs, or "" when the user skips.
+func (r *conflictResolver) choose(key string, localRec, remoteRec *SecretRecord) (string, error) {
+	if choice, ok := r.choices[key]; ok {
+		return choice, nil
+	}
+	choice := r.strategy
+	switch r.strategy {
+	case strategyNewest:
+		choice = newerSide(localRec, remoteRec)
+	case strategyPrompt:
+		var err error
+		choice, err = r.prompt(key, localRec, remoteRec)
+		if err != nil {
+			return "", err
+		}
+	}
+	r.choices[key] = choice
+	return choice, nil
+}
+
+func (r *conflictResolver) prompt(key string, localRec, remoteRec *SecretRecord) (string, error) {
+	out := r.app.Stdout
+	fmt.Fprintf(out, "%s %s\n", cWarn("conflict"), cBold(key))
+	fmt.Fprintf(out, "  base   %s\n", r.describe(key, findVersion(localRec, localRec.LastSyncedRemoteVersion)))
+	fmt.Fprintf(out, "  ours   %s\n", r.describe(key, currentVersion(localRec)))
+	fmt.Fprintf(out, "  theirs %s\n", r.describe(key, currentVersion(remoteRec)))
+	for {
+		fmt.Fprint(out, "keep [o]urs, [t]heirs or [s]kip? ")
+		line, err := r.in.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "o", "ours":
+			return strategyOurs, nil
+		case "t", "theirs":
+			return strategyTheirs, nil
+		case "s", "skip":
+			return "", nil
+		}
+		if errors.Is(err, io.EOF) {
+			fmt.Fprintln(out)
+			return "", nil
+		}
+	}
+}
+
+func (r *conflictResolver) describe(key string, v *SecretVersion) string {
+	if v == nil {
+		return cDim("(none)")
+	}
+	value := cDim("******")
+	switch {
+	case v.Deleted:
+		value = cWarn("<deleted>")
+	case r.reveal:
+		plain, err := r.keys.decrypt(r.env, key, *v)
+		if err != nil {
+			value = cError("<undecryptable>")
+		} else {
+			value = fmt.Sprintf("%q", plain)
+		}
+	case isKeyedHash(v.PlainHash) && len(v.PlainHash) >= len(keyedHashPrefix)+8:
+		value += cDim(" hmac:" + strings.TrimPrefix(v.PlainHash, keyedHashPrefix)[:8])
+	case len(v.PlainHash) >= 8:
+		value += cDim(" sha256:" + v.PlainHash[:8])
+	}
+	return fmt.Sprintf("v%d %s %s", v.Version, value, cDim(fmt.Sprintf("(device %s, %s)", v.DeviceID, v.UpdatedAt)))
+}
+
+// merge returns the record both sides hold once key is settled in favour of
+// choice. Remote history is kept and a local pick is appended on top of it as
+// a new version, so version numbers never move backwards.
+func (r *conflictResolver) merge(key string, localRec, remoteRec *SecretRecord, choice string) (*SecretRecord, error) {
+	merged := cloneRecord(remoteRec)
+	merged.LastSyncedRemoteVersion = remoteRec.CurrentVersion
+	if choice == strategyTheirs {
+		return merged, nil
+	}
+	ours := currentVersion(localRec)
+	if ours == nil {
+		return nil, errors.New("local record has no versions")
+	}
+	if ours.Deleted {
+		merged.CurrentVersion++
+		merged.Versions = append(merged.Versions, SecretVersion{
+			Version:   merged.CurrentVersion,
+			Deleted:   true,
+			UpdatedAt: r.app.Now().UTC().Format(time.RFC3339),
+			DeviceID:  r.state.DeviceID,
+		})
+		return merged, nil
+	}
+	value, err := r.keys.decrypt(r.env, key, *ours)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.app.writeSecretVersion(r.state, r.keys, r.env, key, merged, value, ours.Rotated, ours.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// newerSide picks the side whose current version was written last. Ties go
+// to the remote.
+func newerSide(localRec, remoteRec *SecretRecord) string {
+	ours, theirs := currentVersion(localRec), currentVersion(remoteRec)
+	if ours == nil || theirs == nil {
+		if ours != nil {
+			return strategyOurs
+		}
+		return strategyTheirs
+	}
+	oursAt, _ := time.Parse(time.RFC3339, ours.UpdatedAt)
+	theirsAt, _ := time.Parse(time.RFC3339, theirs.UpdatedAt)
+	if oursAt.After(theirsAt) {
+		return strategyOurs
+	}
+	return strategyTheirs
+}
+
+func currentVersion(rec *SecretRecord) *SecretVersion {
+	if rec == nil {
+		return nil
+	}
+	return findVersion(rec, rec.CurrentVersion)
+}
+
+func findVersion(rec *SecretRecord, version int) *SecretVersion {
+	if rec == nil || version <= 0 {
+		return nil
+	}
+	for i := len(rec.Versions) - 1; i >= 0; i-- {
+		if rec.Versions[i].Version == version {
+			return &rec.Versions[i]
+		}
+	}
+	return nil
+}
+
+func cloneRecord(rec *SecretRecord) *SecretRecord {
+	out := *rec
+	out.Versions = append([]SecretVersion(nil), rec.Versions...)
+	return &out
+}
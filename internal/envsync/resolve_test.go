@@ -0,0 +1,208 @@
+package envsync
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPeerApp restores a second device from app's file remote, sharing the
+// recovery phrase set by newTestApp.
+func newPeerApp(t *testing.T, app *App) (*App, *bytes.Buffer) {
+	t.Helper()
+	peer, stdout := newDeviceApp(t, app)
+	if err := peer.Restore(); err != nil {
+		t.Fatalf("restore peer: %v", err)
+	}
+	stdout.Reset()
+	return peer, stdout
+}
+
+// newMemberApp initializes a second device with its own recovery phrase that
+// shares app's remote.
+func newMemberApp(t *testing.T, app *App) (*App, *bytes.Buffer) {
+	t.Helper()
+	member, stdout := newDeviceApp(t, app)
+	if err := member.Init(); err != nil {
+		t.Fatalf("init member: %v", err)
+	}
+	member.phraseCache = lastLine(stdout.String())
+	stdout.Reset()
+	return member, stdout
+}
+
+// newDeviceApp builds an App with its own config dir on app's remote.
+func newDeviceApp(t *testing.T, app *App) (*App, *bytes.Buffer) {
+	t.Helper()
+	tmp := t.TempDir()
+	stdout := &bytes.Buffer{}
+	return &App{
+		ConfigDir:  filepath.Join(tmp, "cfg"),
+		StatePath:  filepath.Join(tmp, "cfg", "state.json"),
+		RemotePath: app.RemotePath,
+		CWD:        app.CWD,
+		Stdin:      strings.NewReader(""),
+		Stdout:     stdout,
+		Stderr:     &bytes.Buffer{},
+		Now:        app.Now,
+	}, stdout
+}
+
+func activeValuesFor(t *testing.T, app *App) map[string]string {
+	t.Helper()
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, _, err := currentProject(state, app.CWD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := currentEnv(state, app.CWD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projKeys, err := app.keysFor(state, project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := app.activeValues(projKeys, project, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// divergeToken leaves TOKEN at a2 on the remote and b2 on peer, both on top
+// of a shared a1.
+func divergeToken(t *testing.T) (*App, *App, *bytes.Buffer) {
+	t.Helper()
+	app, _ := newTestApp(t)
+	if err := app.Set("TOKEN", "a1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	peer, peerOut := newPeerApp(t, app)
+	if err := app.Set("TOKEN", "a2", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := peer.Set("TOKEN", "b2", ""); err != nil {
+		t.Fatalf("peer set: %v", err)
+	}
+	if err := peer.Push(false); err == nil || !strings.Contains(err.Error(), "push conflicts for keys: TOKEN") {
+		t.Fatalf("expected push conflict, got %v", err)
+	}
+	return app, peer, peerOut
+}
+
+func TestPullStrategyTheirsAdoptsRemote(t *testing.T) {
+	_, peer, _ := divergeToken(t)
+	if err := peer.PullWith(PullOptions{Strategy: "theirs"}); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if got := activeValuesFor(t, peer)["TOKEN"]; got != "a2" {
+		t.Fatalf("expected remote value a2, got %q", got)
+	}
+	if err := peer.Push(false); err != nil {
+		t.Fatalf("expected clean push after resolving, got %v", err)
+	}
+}
+
+func TestPushStrategyOursRecordsNewVersion(t *testing.T) {
+	app, peer, _ := divergeToken(t)
+	if err := peer.PushWith(PushOptions{Strategy: "ours"}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	remote, err := peer.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := remote.Projects["api"].Envs["dev"].Vars["TOKEN"]
+	if rec.CurrentVersion != 3 || len(rec.Versions) != 3 {
+		t.Fatalf("expected resolution as v3 on top of remote history, got v%d with %d versions", rec.CurrentVersion, len(rec.Versions))
+	}
+	if err := app.Pull(false); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if got := activeValuesFor(t, app)["TOKEN"]; got != "b2" {
+		t.Fatalf("expected b2 after pulling resolution, got %q", got)
+	}
+}
+
+func TestPushStrategyNewestPicksLatestWrite(t *testing.T) {
+	app, _ := newTestApp(t)
+	if err := app.Set("TOKEN", "a1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	peer, _ := newPeerApp(t, app)
+	peer.Now = func() time.Time { return time.Unix(100, 0).UTC() }
+	if err := peer.Set("TOKEN", "b2", ""); err != nil {
+		t.Fatalf("peer set: %v", err)
+	}
+	app.Now = func() time.Time { return time.Unix(200, 0).UTC() }
+	if err := app.Set("TOKEN", "a2", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := peer.PushWith(PushOptions{Strategy: "newest"}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if got := activeValuesFor(t, peer)["TOKEN"]; got != "a2" {
+		t.Fatalf("expected newer remote value a2, got %q", got)
+	}
+}
+
+func TestResolvePromptShowsThreeWayAndPushes(t *testing.T) {
+	app, peer, peerOut := divergeToken(t)
+	peer.Stdin = strings.NewReader("o\n")
+	if err := peer.Resolve("prompt", true); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	out := peerOut.String()
+	for _, want := range []string{`base   v1 "a1"`, `ours   v2 "b2"`, `theirs v2 "a2"`, "push complete"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if err := app.Pull(false); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if got := activeValuesFor(t, app)["TOKEN"]; got != "b2" {
+		t.Fatalf("expected b2 after resolve, got %q", got)
+	}
+}
+
+func TestResolvePromptMasksValuesAndSkips(t *testing.T) {
+	_, peer, peerOut := divergeToken(t)
+	peer.Stdin = strings.NewReader("s\n")
+	err := peer.Resolve("", false)
+	if err == nil || !strings.Contains(err.Error(), "pull conflicts for keys: TOKEN") {
+		t.Fatalf("expected skipped key to stay conflicting, got %v", err)
+	}
+	out := peerOut.String()
+	if strings.Contains(out, `"b2"`) || strings.Contains(out, `"a2"`) {
+		t.Fatalf("expected masked values, got:\n%s", out)
+	}
+	if !strings.Contains(out, "hmac:") {
+		t.Fatalf("expected hash hint for masked values, got:\n%s", out)
+	}
+}
+
+func TestInvalidStrategyRejected(t *testing.T) {
+	app, _ := newTestApp(t)
+	if err := app.PushWith(PushOptions{Strategy: "mine"}); err == nil || !strings.Contains(err.Error(), "invalid strategy") {
+		t.Fatalf("expected invalid strategy error, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package envsync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+)
+
+// ExitCodeError reports that a child process started by RunWith exited
+// unsuccessfully. The CLI propagates Code as its own exit status.
+type ExitCodeError struct {
+	Code int
+}
+
+func (e *ExitCodeError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Code)
+}
+
+// RunOptions selects the environment envsync run injects. Empty Project
+// and Env use the active ones; Raw skips ${...} expansion.
+type RunOptions struct {
+	Project string
+	Env     string
+	Raw     bool
+}
+
+// resolvedValues decrypts the active values of the selected environment and
+// expands their references unless raw. It returns the resolved project and
+// environment names alongside.
+func (a *App) resolvedValues(state *State, projectName, envName string, raw bool) (map[string]string, string, string, error) {
+	project, projectName, env, envName, err := resolveProjectEnv(state, a.CWD, projectName, envName)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := a.requireProjectRole(state, project, roleAdmin, roleWriter, roleReader); err != nil {
+		return nil, "", "", err
+	}
+	projKeys, err := a.keysFor(state, project)
+	if err != nil {
+		return nil, "", "", err
+	}
+	values, err := a.activeValues(projKeys, project, env)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if !raw {
+		if values, err = a.interpolate(state, projectName, envName, values); err != nil {
+			return nil, "", "", err
+		}
+	}
+	return values, projectName, envName, nil
+}
+
+// RunWith executes command with the decrypted secrets of the selected
+// environment merged into its environment.
+func (a *App) RunWith(command []string, opts RunOptions) error {
+	if len(command) == 0 {
+		return errors.New("command required; usage: envsync run -- <cmd> [args...]")
+	}
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	values, projectName, envName, err := a.resolvedValues(state, opts.Project, opts.Env, opts.Raw)
+	if err != nil {
+		return err
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path, command[1:]...)
+	cmd.Env = mergeEnviron(os.Environ(), values)
+	cmd.Stdin = a.Stdin
+	cmd.Stdout = a.Stdout
+	cmd.Stderr = a.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	a.logAudit("run", state, map[string]any{
+		"project": projectName,
+		"env":     envName,
+		"command": filepath.Base(command[0]),
+		"keys":    len(values),
+	})
+
+	stop := forwardSignals(cmd.Process)
+	err = cmd.Wait()
+	stop()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return &ExitCodeError{Code: exitStatus(exitErr.ProcessState)}
+		}
+		return err
+	}
+	return nil
+}
+
+// mergeEnviron overlays values onto a KEY=VALUE environment list. Secrets win
+// over inherited variables with the same name.
+func mergeEnviron(base []string, values map[string]string) []string {
+	out := make([]string, 0, len(base)+len(values))
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, overridden := values[name]; overridden {
+			continue
+		}
+		out = append(out, kv)
+	}
+	for _, k := range sortedKeys(values) {
+		out = append(out, k+"="+values[k])
+	}
+	return out
+}
+
+// forwardSignals relays termination signals received by envsync to proc until
+// the returned stop function is called.
+func forwardSignals(proc *os.Process) func() {
+	ch := make(chan os.Signal, 4)
+	signal.Notify(ch, forwardedSignals...)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sig := range ch {
+			_ = proc.Signal(sig)
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(ch)
+		<-done
+	}
+}
@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package envsync
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunInjectsSecretsIntoChild(t *testing.T) {
+	app, stdout := newTestApp(t)
+	if err := app.Set("TOKEN", "abc $HOME", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Set("OLD", "gone", "1s"); err != nil {
+		t.Fatalf("set expiring: %v", err)
+	}
+	if err := app.Set("REMOVED", "x", ""); err != nil {
+		t.Fatalf("set removed: %v", err)
+	}
+	if err := app.Delete("REMOVED"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	app.Now = func() time.Time { return time.Unix(60, 0).UTC() }
+	t.Setenv("TOKEN", "inherited")
+	stdout.Reset()
+
+	script := `printf '%s|%s|%s' "$TOKEN" "${OLD-unset}" "${REMOVED-unset}"`
+	if err := app.RunWith([]string{"sh", "-c", script}, RunOptions{}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := stdout.String(); got != "abc $HOME|unset|unset" {
+		t.Fatalf("unexpected child output %q", got)
+	}
+}
+
+func TestRunPropagatesExitCode(t *testing.T) {
+	app, _ := newTestApp(t)
+	err := app.RunWith([]string{"sh", "-c", "exit 7"}, RunOptions{})
+	var exitErr *ExitCodeError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected ExitCodeError, got %v", err)
+	}
+	if exitErr.Code != 7 {
+		t.Fatalf("expected exit code 7, got %d", exitErr.Code)
+	}
+}
+
+func TestRunSelectsProjectAndEnv(t *testing.T) {
+	app, stdout := newTestApp(t)
+	if err := app.EnvCreate("prod"); err != nil {
+		t.Fatalf("env create: %v", err)
+	}
+	if err := app.EnvUse("prod"); err != nil {
+		t.Fatalf("env use: %v", err)
+	}
+	if err := app.Set("TOKEN", "prod-token", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.EnvUse("dev"); err != nil {
+		t.Fatalf("env use dev: %v", err)
+	}
+	stdout.Reset()
+
+	if err := app.RunWith([]string{"sh", "-c", `printf %s "$TOKEN"`}, RunOptions{Project: "api", Env: "prod"}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := stdout.String(); got != "prod-token" {
+		t.Fatalf("expected prod-token, got %q", got)
+	}
+	if err := app.RunWith([]string{"true"}, RunOptions{Project: "api", Env: "staging"}); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected missing env error, got %v", err)
+	}
+}
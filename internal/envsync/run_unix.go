@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package envsync
+
+import (
+	"os"
+	"syscall"
+)
+
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// exitStatus mirrors shell conventions: a child killed by a signal reports
+// 128 + the signal number.
+func exitStatus(ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ps.ExitCode()
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package envsync
+
+import "os"
+
+var forwardedSignals = []os.Signal{os.Interrupt}
+
+func exitStatus(ps *os.ProcessState) int {
+	return ps.ExitCode()
+}
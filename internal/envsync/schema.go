@@ -0,0 +1,465 @@
+package envsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	schemaString = "string"
+	schemaInt    = "int"
+	schemaBool   = "bool"
+	schemaURL    = "url"
+	schemaEmail  = "email"
+	schemaJSON   = "json"
+	schemaRegex  = "regex"
+	schemaEnum   = "enum"
+)
+
+// schemaFiles are the names a committed schema may have, in lookup order.
+var schemaFiles = []string{".envsync.schema.yaml", ".envsync.schema.yml", ".envsync.schema.json"}
+
+// Schema declares the keys a project's environments should hold. Version
+// grows with every `envsync schema set`; push and pull keep the newest.
+type Schema struct {
+	Version int                   `json:"version"`
+	Keys    map[string]*KeySchema `json:"keys"`
+}
+
+// KeySchema describes one key. Required lists the envs that must set it,
+// "*" meaning all of them. Pattern is the regex a value of type regex must
+// match in full; Values are the choices of type enum.
+type KeySchema struct {
+	Type        string   `json:"type,omitempty"`
+	Required    []string `json:"required,omitempty"`
+	MinLength   int      `json:"min_length,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Values      []string `json:"values,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// schemaViolation is a key whose value, or absence, breaks the schema.
+type schemaViolation struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+func (v schemaViolation) String() string {
+	return v.Key + ": " + v.Reason
+}
+
+// requiredIn reports whether ks requires a value in envName.
+func (ks *KeySchema) requiredIn(envName string) bool {
+	return slices.Contains(ks.Required, "*") || slices.Contains(ks.Required, envName)
+}
+
+// check returns why value breaks ks, or "" if it does not.
+func (ks *KeySchema) check(value string) string {
+	if n := utf8.RuneCountInString(value); n < ks.MinLength {
+		return fmt.Sprintf("must be at least %d characters, got %d", ks.MinLength, n)
+	}
+	switch ks.Type {
+	case schemaInt:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "must be an integer"
+		}
+	case schemaBool:
+		switch strings.ToLower(value) {
+		case "true", "false", "1", "0", "yes", "no", "on", "off":
+		default:
+			return "must be a boolean (true/false, 1/0, yes/no, on/off)"
+		}
+	case schemaURL:
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "") {
+			return "must be an absolute URL"
+		}
+	case schemaEmail:
+		if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+			return "must be an email address"
+		}
+	case schemaJSON:
+		if !json.Valid([]byte(value)) {
+			return "must be valid JSON"
+		}
+	case schemaRegex:
+		if re, err := regexp.Compile(`^(?:` + ks.Pattern + `)$`); err == nil && !re.MatchString(value) {
+			return fmt.Sprintf("must match /%s/", ks.Pattern)
+		}
+	case schemaEnum:
+		if !slices.Contains(ks.Values, value) {
+			return "must be one of " + strings.Join(ks.Values, ", ")
+		}
+	}
+	return ""
+}
+
+// violations checks the active values of envName against s: required keys
+// must be set and every declared key must hold a valid value.
+func (s *Schema) violations(envName string, values map[string]string) []schemaViolation {
+	out := []schemaViolation{}
+	for _, k := range sortedKeys(s.Keys) {
+		ks := s.Keys[k]
+		v, ok := values[k]
+		switch {
+		case !ok && ks.requiredIn(envName):
+			out = append(out, schemaViolation{k, "required in " + envName + " but not set"})
+		case ok:
+			if reason := ks.check(v); reason != "" {
+				out = append(out, schemaViolation{k, reason})
+			}
+		}
+	}
+	return out
+}
+
+// checkStored checks a value about to be stored. Values holding ${...}
+// references are only checked once expanded, by validate and push.
+func (s *Schema) checkStored(key, value string) string {
+	ks := s.Keys[key]
+	if ks == nil || hasReference(value) {
+		return ""
+	}
+	return ks.check(strings.ReplaceAll(value, "$${", "${"))
+}
+
+// newerSchema reports whether a should replace b.
+func newerSchema(a, b *Schema) bool {
+	return a != nil && (b == nil || a.Version > b.Version)
+}
+
+func hasReference(value string) bool {
+	return strings.Contains(strings.ReplaceAll(value, "$${", ""), "${")
+}
+
+// findSchemaFile walks up from cwd to the nearest committed schema that
+// belongs to project: one in the directory of the .envsync.json marker
+// naming project, or below it.
+func findSchemaFile(cwd, project string) string {
+	markerPath, owner := findMarker(cwd, nil)
+	if markerPath == "" || owner != project {
+		return ""
+	}
+	root := filepath.Dir(markerPath)
+	dir := cwd
+	for {
+		for _, name := range schemaFiles {
+			path := filepath.Join(dir, name)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path
+			}
+		}
+		parent := filepath.Dir(dir)
+		if dir == root || parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// schemaFor returns the schema that applies to project and where it came
+// from. A schema file committed with the project's checkout takes
+// precedence over the one stored with the project; both may be absent.
+func (a *App) schemaFor(project *Project) (*Schema, string, error) {
+	if path := findSchemaFile(a.CWD, project.Name); path != "" {
+		schema, err := readSchemaFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		return schema, path, nil
+	}
+	if project.Schema != nil {
+		return project.Schema, fmt.Sprintf("project %s (v%d)", project.Name, project.Schema.Version), nil
+	}
+	return nil, "", nil
+}
+
+func readSchemaFile(path string) (*Schema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := parseSchema(b, strings.EqualFold(filepath.Ext(path), ".json"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// parseSchema decodes a schema document from JSON or the block YAML subset
+// readYAMLTree accepts, rejecting unknown fields and types.
+func parseSchema(data []byte, isJSON bool) (*Schema, error) {
+	var (
+		tree any
+		err  error
+	)
+	if isJSON {
+		err = json.Unmarshal(data, &tree)
+	} else {
+		tree, err = readYAMLTree(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	root, ok := tree.(map[string]any)
+	if !ok {
+		return nil, errors.New("schema must be a mapping with a keys field")
+	}
+	schema := &Schema{Keys: map[string]*KeySchema{}}
+	for _, field := range sortedKeys(root) {
+		switch v := root[field]; field {
+		case "version":
+			if schema.Version, err = schemaInteger("version", v); err != nil {
+				return nil, err
+			}
+		case "keys":
+			keys, ok := v.(map[string]any)
+			if !ok {
+				return nil, errors.New("keys must be a mapping of key names")
+			}
+			for _, name := range sortedKeys(keys) {
+				if schema.Keys[name], err = parseKeySchema(name, keys[name]); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+	}
+	return schema, nil
+}
+
+func parseKeySchema(name string, tree any) (*KeySchema, error) {
+	ks := &KeySchema{Type: schemaString}
+	fields, ok := tree.(map[string]any)
+	if !ok && tree != nil {
+		return nil, fmt.Errorf("keys.%s must be a mapping", name)
+	}
+	var err error
+	for _, field := range sortedKeys(fields) {
+		path := "keys." + name + "." + field
+		switch v := fields[field]; field {
+		case "type":
+			ks.Type, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a string", path)
+			}
+		case "required":
+			switch v := v.(type) {
+			case bool:
+				if v {
+					ks.Required = []string{"*"}
+				}
+			case []any:
+				if ks.Required, err = schemaStrings(path, v); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("%s must be true, false or a list of environments", path)
+			}
+		case "min_length":
+			if ks.MinLength, err = schemaInteger(path, v); err != nil {
+				return nil, err
+			}
+		case "pattern":
+			if ks.Pattern, ok = v.(string); !ok {
+				return nil, fmt.Errorf("%s must be a string", path)
+			}
+		case "values":
+			list, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list", path)
+			}
+			if ks.Values, err = schemaStrings(path, list); err != nil {
+				return nil, err
+			}
+		case "description":
+			if ks.Description, ok = v.(string); !ok {
+				return nil, fmt.Errorf("%s must be a string", path)
+			}
+		default:
+			return nil, fmt.Errorf("unknown field %q", path)
+		}
+	}
+	switch ks.Type {
+	case schemaString, schemaInt, schemaBool, schemaURL, schemaEmail, schemaJSON:
+	case schemaRegex:
+		if ks.Pattern == "" {
+			return nil, fmt.Errorf("keys.%s: type regex needs a pattern", name)
+		}
+		if _, err := regexp.Compile(ks.Pattern); err != nil {
+			return nil, fmt.Errorf("keys.%s.pattern: %w", name, err)
+		}
+	case schemaEnum:
+		if len(ks.Values) == 0 {
+			return nil, fmt.Errorf("keys.%s: type enum needs values", name)
+		}
+	default:
+		return nil, fmt.Errorf("keys.%s.type: unknown type %q (want string, int, bool, url, email, json, regex or enum)", name, ks.Type)
+	}
+	if ks.Pattern != "" && ks.Type != schemaRegex {
+		return nil, fmt.Errorf("keys.%s: pattern needs type regex", name)
+	}
+	if len(ks.Values) > 0 && ks.Type != schemaEnum {
+		return nil, fmt.Errorf("keys.%s: values need type enum", name)
+	}
+	return ks, nil
+}
+
+func schemaInteger(path string, v any) (int, error) {
+	switch n := v.(type) {
+	case int:
+		if n >= 0 {
+			return n, nil
+		}
+	case float64:
+		if n >= 0 && n == float64(int(n)) {
+			return int(n), nil
+		}
+	}
+	return 0, fmt.Errorf("%s must be a non-negative integer", path)
+}
+
+// schemaStrings reads a list of scalars as strings, so enum values like
+// 8080 or true need no quotes.
+func schemaStrings(path string, list []any) ([]string, error) {
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		switch item := item.(type) {
+		case string:
+			out = append(out, item)
+		case int, float64, bool:
+			out = append(out, fmt.Sprint(item))
+		default:
+			return nil, fmt.Errorf("%s must list scalars", path)
+		}
+	}
+	return out, nil
+}
+
+// SchemaSet stores the schema in file with the active project so push
+// shares it. Its version is one past the stored one unless the file asks
+// for a higher one.
+func (a *App) SchemaSet(file string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	schema, err := readSchemaFile(file)
+	if err != nil {
+		return err
+	}
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	project, projName, err := currentProject(state, a.CWD)
+	if err != nil {
+		return err
+	}
+	if err := a.requireProjectRole(state, project, roleAdmin, roleMaintainer); err != nil {
+		return err
+	}
+	if project.Schema != nil {
+		schema.Version = max(schema.Version, project.Schema.Version+1)
+	}
+	schema.Version = max(schema.Version, 1)
+	project.Schema = schema
+	if err := a.saveState(state); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.Stdout, "%s %s %s\n", cSuccess("schema set for"), cBold(projName),
+		cDim(fmt.Sprintf("(v%d, %d keys; push to share it)", schema.Version, len(schema.Keys))))
+	a.logAudit("schema_set", state, map[string]any{"project": projName, "version": schema.Version, "keys": sortedKeys(schema.Keys)})
+	return nil
+}
+
+// SchemaShow prints the schema that applies to the active project as JSON.
+func (a *App) SchemaShow() error {
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	project, _, err := currentProject(state, a.CWD)
+	if err != nil {
+		return err
+	}
+	schema, source, err := a.schemaFor(project)
+	if err != nil {
+		return err
+	}
+	if schema == nil {
+		return errors.New("no schema; commit .envsync.schema.yaml or run `envsync schema set <file>`")
+	}
+	fmt.Fprintln(a.Stderr, cDim("schema from "+source))
+	enc := json.NewEncoder(a.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schema)
+}
+
+// Validate checks the decrypted values of envName (the active env when
+// empty) against the schema.
+func (a *App) Validate(envName string) error {
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	schema, violations, envName, err := a.schemaViolations(state, "", envName)
+	if err != nil {
+		return err
+	}
+	if schema == nil {
+		return errors.New("no schema; commit .envsync.schema.yaml or run `envsync schema set <file>`")
+	}
+	for _, v := range violations {
+		fmt.Fprintf(a.Stdout, "  %s %s: %s\n", cError("x"), cBold(v.Key), v.Reason)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%d schema violations in %s", len(violations), envName)
+	}
+	fmt.Fprintf(a.Stdout, "%s %s %s\n", cSuccess("schema ok for"), cBold(envName), cDim(fmt.Sprintf("(%d keys checked)", len(schema.Keys))))
+	return nil
+}
+
+// schemaViolations decrypts and expands the values of projName/envName
+// (empty names select the active ones) and checks them against the schema
+// that applies, if any. It returns the schema and the resolved env name.
+func (a *App) schemaViolations(state *State, projName, envName string) (*Schema, []schemaViolation, string, error) {
+	project, projName, _, envName, err := resolveProjectEnv(state, a.CWD, projName, envName)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	schema, _, err := a.schemaFor(project)
+	if err != nil || schema == nil {
+		return nil, nil, envName, err
+	}
+	values, _, _, err := a.resolvedValues(state, projName, envName, false)
+	if err != nil {
+		return nil, nil, envName, err
+	}
+	return schema, schema.violations(envName, values), envName, nil
+}
+
+// requireSchema fails with every violation of projName/envName; action
+// names what --no-validate would let through.
+func (a *App) requireSchema(state *State, projName, envName, action string) error {
+	_, violations, envName, err := a.schemaViolations(state, projName, envName)
+	if err != nil || len(violations) == 0 {
+		return err
+	}
+	lines := make([]string, len(violations))
+	for i, v := range violations {
+		lines[i] = "  " + v.String()
+	}
+	return fmt.Errorf("%s breaks the schema (rerun with --no-validate to %s anyway):\n%s", envName, action, strings.Join(lines, "\n"))
+}
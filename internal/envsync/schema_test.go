@@ -0,0 +1,217 @@
+package envsync
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSchemaYAML = `# api secrets
+version: 2
+keys:
+  DATABASE_URL:
+    type: url
+    required: [prod, staging]
+    description: >
+      Primary database,
+      read-write.
+  PORT:
+    type: int
+    required: true
+  LOG_LEVEL:
+    type: enum
+    values:
+      - debug
+      - info
+      - "warn"
+  BUILD_ID:
+    type: regex
+    pattern: '[0-9a-f]{7}'  # short sha
+  ADMIN_EMAIL:
+    type: email
+    min_length: 6
+`
+
+func TestParseSchemaYAML(t *testing.T) {
+	schema, err := parseSchema([]byte(testSchemaYAML), false)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := &Schema{Version: 2, Keys: map[string]*KeySchema{
+		"DATABASE_URL": {Type: schemaURL, Required: []string{"prod", "staging"}, Description: "Primary database, read-write.\n"},
+		"PORT":         {Type: schemaInt, Required: []string{"*"}},
+		"LOG_LEVEL":    {Type: schemaEnum, Values: []string{"debug", "info", "warn"}},
+		"BUILD_ID":     {Type: schemaRegex, Pattern: "[0-9a-f]{7}"},
+		"ADMIN_EMAIL":  {Type: schemaEmail, MinLength: 6},
+	}}
+	if !reflect.DeepEqual(schema, want) {
+		for k, ks := range schema.Keys {
+			t.Logf("%s: %+v", k, *ks)
+		}
+		t.Fatalf("unexpected schema")
+	}
+
+	fromJSON, err := parseSchema([]byte(`{"keys": {"PORT": {"type": "int", "required": true}, "MODE": {"type": "enum", "values": [1, 2]}}}`), true)
+	if err != nil {
+		t.Fatalf("parse json: %v", err)
+	}
+	if got := fromJSON.Keys["MODE"].Values; strings.Join(got, ",") != "1,2" {
+		t.Fatalf("json enum values: %v", got)
+	}
+
+	for doc, wantErr := range map[string]string{
+		"keys:\n  A:\n    type: integer\n":         `unknown type "integer"`,
+		"keys:\n  A:\n    typo: int\n":             `unknown field "keys.A.typo"`,
+		"keys:\n  A:\n    type: regex\n":           "type regex needs a pattern",
+		"keys:\n  A:\n    pattern: x\n":            "pattern needs type regex",
+		"keys:\n  A:\n    required: prod\n":        "must be true, false or a list",
+		"keys:\n  A:\n  type: int\n    extra: 1\n": "line 4: unexpected indentation",
+	} {
+		if _, err := parseSchema([]byte(doc), false); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("%q: expected error containing %q, got %v", doc, wantErr, err)
+		}
+	}
+}
+
+func TestSchemaViolations(t *testing.T) {
+	schema, err := parseSchema([]byte(testSchemaYAML), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := schema.violations("prod", map[string]string{
+		"PORT":        "abc",
+		"LOG_LEVEL":   "trace",
+		"BUILD_ID":    "1234567",
+		"ADMIN_EMAIL": "a@b",
+		"OTHER":       "anything",
+	})
+	want := []schemaViolation{
+		{"ADMIN_EMAIL", "must be at least 6 characters, got 3"},
+		{"DATABASE_URL", "required in prod but not set"},
+		{"LOG_LEVEL", "must be one of debug, info, warn"},
+		{"PORT", "must be an integer"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("violations:\n got %v\nwant %v", got, want)
+	}
+	if got := schema.violations("dev", map[string]string{"PORT": "8080"}); len(got) != 0 {
+		t.Fatalf("dev should pass, got %v", got)
+	}
+	if reason := schema.checkStored("PORT", "${BASE_PORT}"); reason != "" {
+		t.Fatalf("references should be checked once expanded, got %q", reason)
+	}
+}
+
+// commitSchema writes testSchemaYAML next to a marker naming api in app's
+// working directory.
+func commitSchema(t *testing.T, app *App) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(app.CWD, markerFile), []byte(`{"project": "api"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(app.CWD, ".envsync.schema.yaml"), []byte(testSchemaYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaBlocksInvalidSetImportAndPush(t *testing.T) {
+	app, stdout := newTestApp(t)
+	commitSchema(t, app)
+
+	err := app.Set("PORT", "abc", "")
+	if err == nil || !strings.Contains(err.Error(), "PORT: must be an integer") {
+		t.Fatalf("expected set to be refused, got %v", err)
+	}
+	if err := app.SetWith("PORT", "abc", SetOptions{NoValidate: true}); err != nil {
+		t.Fatalf("set --no-validate: %v", err)
+	}
+
+	envFile := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envFile, []byte("LOG_LEVEL=trace\nBUILD_ID=abc1234\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err = app.ImportEnv(envFile)
+	if err == nil || !strings.Contains(err.Error(), "LOG_LEVEL: must be one of debug, info, warn") {
+		t.Fatalf("expected import to be refused, got %v", err)
+	}
+
+	err = app.Push(false)
+	if err == nil || !strings.Contains(err.Error(), "PORT: must be an integer") {
+		t.Fatalf("expected push to be refused, got %v", err)
+	}
+	stdout.Reset()
+	if err := app.Validate(""); err == nil || !strings.Contains(stdout.String(), "PORT") {
+		t.Fatalf("expected validate to report PORT, got %v:\n%s", err, stdout.String())
+	}
+
+	if err := app.Set("PORT", "8080", ""); err != nil {
+		t.Fatalf("set valid port: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push valid env: %v", err)
+	}
+	if err := app.EnvCreate("prod"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Validate("prod"); err == nil || !strings.Contains(err.Error(), "2 schema violations in prod") {
+		t.Fatalf("expected prod to miss DATABASE_URL and PORT, got %v", err)
+	}
+}
+
+func TestCommittedSchemaAppliesOnlyToItsProject(t *testing.T) {
+	app, _ := newTestApp(t)
+	commitSchema(t, app)
+	if err := app.ProjectCreate("web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.ProjectUse("web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Set("PORT", "abc", ""); err != nil {
+		t.Fatalf("expected api's schema to leave web alone, got %v", err)
+	}
+	if err := app.ProjectUse("api"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Set("PORT", "abc", ""); err == nil || !strings.Contains(err.Error(), "PORT: must be an integer") {
+		t.Fatalf("expected api's schema to apply, got %v", err)
+	}
+}
+
+func TestSchemaSetSyncsThroughPushAndPull(t *testing.T) {
+	app, stdout := newTestApp(t)
+	setAll(t, app, "PORT", "8080")
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	peer, peerOut := newPeerApp(t, app)
+
+	schemaFile := filepath.Join(t.TempDir(), "schema.yaml")
+	if err := os.WriteFile(schemaFile, []byte(testSchemaYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.SchemaSet(schemaFile); err != nil {
+		t.Fatalf("schema set: %v", err)
+	}
+	if err := app.SchemaSet(schemaFile); err != nil {
+		t.Fatalf("schema set again: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "v3") {
+		t.Fatalf("expected the second set to bump to v3, got:\n%s", stdout.String())
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push schema: %v", err)
+	}
+
+	if err := peer.Pull(false); err != nil {
+		t.Fatalf("peer pull: %v", err)
+	}
+	if !strings.Contains(peerOut.String(), "pulled schema v3") {
+		t.Fatalf("expected schema pull, got:\n%s", peerOut.String())
+	}
+	if err := peer.Set("PORT", "http", ""); err == nil {
+		t.Fatal("expected the pulled schema to refuse PORT=http")
+	}
+}
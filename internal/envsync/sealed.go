@@ -0,0 +1,417 @@
+package envsync
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A project with sealed metadata keeps its names from whoever holds the
+// remote store. On the remote the project is stored under a random ID, its
+// envs and keys under HMACs of their names, and an AES-GCM manifest sealed
+// with the project's key maps the IDs back. Values were already encrypted;
+// timestamps, device IDs, version counts, team membership and the team a
+// project belongs to stay visible so the server can check revisions and
+// enforce roles. Locally the project
+// is stored as before, and the remote copy is opened on load and sealed
+// again on save.
+
+const sealedIDPrefix = "sealed-"
+
+// SealedInfo marks a project with sealed metadata. ID names the project on
+// the remote and its cloud vault; NameKeyB64 keys the HMAC that turns env
+// and key names into IDs. The remote copy carries only the ID, the name key
+// travels inside the manifest.
+type SealedInfo struct {
+	ID         string `json:"id"`
+	NameKeyB64 string `json:"name_key_b64,omitempty"`
+}
+
+// SealedManifest is the encrypted name map of a project on the remote.
+type SealedManifest struct {
+	NonceB64  string `json:"nonce_b64"`
+	CipherB64 string `json:"cipher_b64"`
+}
+
+// projectManifest is what SealedManifest decrypts to: the project fields
+// that carry names, and the names behind each env and key ID.
+type projectManifest struct {
+	Name       string                 `json:"name"`
+	Team       string                 `json:"team,omitempty"`
+	NameKeyB64 string                 `json:"name_key_b64"`
+	Schema     *Schema                `json:"schema,omitempty"`
+	Envs       map[string]manifestEnv `json:"envs"`
+}
+
+type manifestEnv struct {
+	Name   string            `json:"name"`
+	Parent string            `json:"parent,omitempty"`
+	Keys   map[string]string `json:"keys"`
+}
+
+func newSealedInfo() (*SealedInfo, error) {
+	id, err := randomHex(12)
+	if err != nil {
+		return nil, err
+	}
+	nameKey := make([]byte, 32)
+	if _, err := rand.Read(nameKey); err != nil {
+		return nil, err
+	}
+	return &SealedInfo{ID: sealedIDPrefix + id, NameKeyB64: base64.StdEncoding.EncodeToString(nameKey)}, nil
+}
+
+// opened reports whether s came with its name key, which a stub left in an
+// unsealed vault does not.
+func (s *SealedInfo) opened() bool {
+	return s != nil && s.NameKeyB64 != ""
+}
+
+// nameID returns the remote ID of a name. parts qualify it, so the same key
+// name in two envs gets unrelated IDs.
+func nameID(nameKey []byte, parts ...string) string {
+	h := hmac.New(sha256.New, nameKey)
+	h.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func manifestKey(key []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, key, nil, "envsync-manifest", 32)
+}
+
+func manifestAAD(id string) []byte {
+	return []byte("envsync-manifest:" + id)
+}
+
+// sealProject returns the remote form of project, which must have sealed
+// metadata. Records are shared with project, not copied.
+func sealProject(project *Project, keys *projectKeys) (*Project, error) {
+	nameKey, err := base64.StdEncoding.DecodeString(project.Sealed.NameKeyB64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name key: %w", err)
+	}
+	id := project.Sealed.ID
+	manifest := projectManifest{
+		Name:       project.Name,
+		Team:       project.Team,
+		NameKeyB64: project.Sealed.NameKeyB64,
+		Schema:     project.Schema,
+		Envs:       map[string]manifestEnv{},
+	}
+	out := &Project{
+		Name:                id,
+		Team:                project.Team,
+		CloudOrganizationID: project.CloudOrganizationID,
+		CloudTeamID:         project.CloudTeamID,
+		DataKeyID:           project.DataKeyID,
+		WrappedKeys:         project.WrappedKeys,
+		Sealed:              &SealedInfo{ID: id},
+		Envs:                map[string]*Env{},
+	}
+	for envName, env := range project.Envs {
+		envID := nameID(nameKey, "env", envName)
+		entry := manifestEnv{Name: envName, Parent: env.Parent, Keys: map[string]string{}}
+		sealed := &Env{Name: envID, Vars: map[string]*SecretRecord{}}
+		for key, rec := range env.Vars {
+			keyID := nameID(nameKey, "key", envName, key)
+			entry.Keys[keyID] = key
+			sealed.Vars[keyID] = rec
+		}
+		manifest.Envs[envID] = entry
+		out.Envs[envID] = sealed
+	}
+	plain, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	mk, err := manifestKey(keys.current())
+	if err != nil {
+		return nil, err
+	}
+	nonce, ct, err := sealBytes(mk, plain, manifestAAD(id))
+	if err != nil {
+		return nil, err
+	}
+	out.Manifest = &SealedManifest{
+		NonceB64:  base64.StdEncoding.EncodeToString(nonce),
+		CipherB64: base64.StdEncoding.EncodeToString(ct),
+	}
+	return out, nil
+}
+
+// openProject reverses sealProject.
+func openProject(sealed *Project, keys *projectKeys) (*Project, error) {
+	id := sealed.Sealed.ID
+	nonce, err := base64.StdEncoding.DecodeString(sealed.Manifest.NonceB64)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(sealed.Manifest.CipherB64)
+	if err != nil {
+		return nil, err
+	}
+	mk, err := manifestKey(keys.current())
+	if err != nil {
+		return nil, err
+	}
+	plain, err := openBytes(mk, nonce, ct, manifestAAD(id))
+	if err != nil {
+		return nil, errors.New("manifest does not open with this project's key")
+	}
+	var manifest projectManifest
+	if err := json.Unmarshal(plain, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	out := &Project{
+		Name:                manifest.Name,
+		Team:                manifest.Team,
+		CloudOrganizationID: sealed.CloudOrganizationID,
+		CloudTeamID:         sealed.CloudTeamID,
+		DataKeyID:           sealed.DataKeyID,
+		WrappedKeys:         sealed.WrappedKeys,
+		Schema:              manifest.Schema,
+		Sealed:              &SealedInfo{ID: id, NameKeyB64: manifest.NameKeyB64},
+		Envs:                map[string]*Env{},
+	}
+	for envID, env := range sealed.Envs {
+		entry, ok := manifest.Envs[envID]
+		if !ok {
+			return nil, fmt.Errorf("env %s is missing from the manifest", envID)
+		}
+		opened := &Env{Name: entry.Name, Parent: entry.Parent, Vars: map[string]*SecretRecord{}}
+		for keyID, rec := range env.Vars {
+			key, ok := entry.Keys[keyID]
+			if !ok {
+				return nil, fmt.Errorf("key %s in env %s is missing from the manifest", keyID, entry.Name)
+			}
+			opened.Vars[key] = rec
+		}
+		out.Envs[entry.Name] = opened
+	}
+	return out, nil
+}
+
+// hasManifests reports whether any project on remote is sealed.
+func hasManifests(projects map[string]*Project) bool {
+	for _, project := range projects {
+		if project != nil && project.Manifest != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSealedProjects reports whether any project must be sealed on save.
+func hasSealedProjects(projects map[string]*Project) bool {
+	for _, project := range projects {
+		if project != nil && project.Sealed.opened() {
+			return true
+		}
+	}
+	return false
+}
+
+// openRemoteProjects replaces every sealed project on remote with its
+// opened form. An opened project replaces an unsealed copy of the same
+// name: the one it was sealed from, or the stub left behind when its cloud
+// vault moved. Projects this device cannot open, such as those of teams it
+// is not in, are set aside and written back unchanged.
+func openRemoteProjects(remote *RemoteStore, member *memberIdentity) {
+	for _, id := range sortedKeys(remote.Projects) {
+		project := remote.Projects[id]
+		if project == nil || project.Manifest == nil || project.Sealed == nil {
+			continue
+		}
+		delete(remote.Projects, id)
+		keys, err := projectKeysFrom(member, project)
+		if err == nil {
+			var opened *Project
+			if opened, err = openProject(project, keys); err == nil {
+				remote.Projects[opened.Name] = opened
+				continue
+			}
+		}
+		if remote.opaque == nil {
+			remote.opaque = map[string]*Project{}
+		}
+		remote.opaque[id] = project
+	}
+}
+
+// sealRemoteStore returns a copy of remote in the form it is stored in, with
+// every project that has sealed metadata sealed and the projects set aside
+// by openRemoteProjects restored.
+func sealRemoteStore(remote *RemoteStore, member *memberIdentity) (*RemoteStore, error) {
+	out := *remote
+	out.Projects = make(map[string]*Project, len(remote.Projects)+len(remote.opaque))
+	for id, project := range remote.opaque {
+		out.Projects[id] = project
+	}
+	for _, name := range sortedKeys(remote.Projects) {
+		project := remote.Projects[name]
+		if project == nil || !project.Sealed.opened() {
+			out.Projects[name] = project
+			continue
+		}
+		keys, err := projectKeysFrom(member, project)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := sealProject(project, keys)
+		if err != nil {
+			return nil, fmt.Errorf("seal project %q: %w", name, err)
+		}
+		if _, taken := out.Projects[sealed.Name]; taken {
+			return nil, fmt.Errorf("remote holds sealed project %s, which this device cannot open", sealed.Name)
+		}
+		out.Projects[sealed.Name] = sealed
+	}
+	return &out, nil
+}
+
+// loadRemoteStoreWith loads the remote for scope and opens its sealed
+// projects with the keys of state.
+func (a *App) loadRemoteStoreWith(state *State, scope remoteScope) (*RemoteStore, error) {
+	remote, err := a.loadRemoteStoreFor(scope)
+	if err != nil {
+		return nil, err
+	}
+	if !hasManifests(remote.Projects) {
+		return remote, nil
+	}
+	id, err := a.memberIdentity(state)
+	if err != nil {
+		return nil, err
+	}
+	openRemoteProjects(remote, id)
+	return remote, nil
+}
+
+// saveRemoteStoreWith seals the projects of remote that have sealed
+// metadata and saves it for scope. remote itself stays open.
+func (a *App) saveRemoteStoreWith(state *State, scope remoteScope, remote *RemoteStore, expectedRevision int) error {
+	if !hasSealedProjects(remote.Projects) && len(remote.opaque) == 0 {
+		return a.saveRemoteStoreFor(scope, remote, expectedRevision)
+	}
+	id := &memberIdentity{actor: a.actorID(state)}
+	if hasSealedProjects(remote.Projects) {
+		var err error
+		if id, err = a.memberIdentity(state); err != nil {
+			return err
+		}
+	}
+	sealed, err := sealRemoteStore(remote, id)
+	if err != nil {
+		return err
+	}
+	err = a.saveRemoteStoreFor(scope, sealed, expectedRevision)
+	remote.Revision = sealed.Revision
+	return err
+}
+
+// loadProjectRemote loads the remote of projName. When another device has
+// sealed the project's metadata and its cloud vault moved, the stub left in
+// the old vault is followed to the new one.
+func (a *App) loadProjectRemote(state *State, projName string, project *Project) (*RemoteStore, error) {
+	remote, err := a.loadRemoteStoreWith(state, projectScope(projName, project))
+	if err != nil {
+		return nil, err
+	}
+	stub := remote.Projects[projName]
+	if stub == nil || stub.Sealed == nil || stub.Sealed.opened() || project.Sealed != nil {
+		return remote, nil
+	}
+	moved := *project
+	moved.Sealed = &SealedInfo{ID: stub.Sealed.ID}
+	return a.loadRemoteStoreWith(state, projectScope(projName, &moved))
+}
+
+// checkRemoteSealed stops a device that has not seen a project's metadata
+// sealed from writing its names back in the clear.
+func checkRemoteSealed(remote *RemoteStore, projName string, local *Project) error {
+	remoteProject := remote.Projects[projName]
+	if remoteProject == nil || remoteProject.Sealed == nil {
+		return nil
+	}
+	if local.Sealed == nil || local.Sealed.ID != remoteProject.Sealed.ID {
+		return fmt.Errorf("project %q has sealed metadata on the remote; pull first", projName)
+	}
+	return nil
+}
+
+// adoptSealedInfo takes the sealed metadata settings of remoteProject.
+func adoptSealedInfo(project, remoteProject *Project) bool {
+	if !remoteProject.Sealed.opened() || (project.Sealed != nil && *project.Sealed == *remoteProject.Sealed) {
+		return false
+	}
+	sealed := *remoteProject.Sealed
+	project.Sealed = &sealed
+	return true
+}
+
+// retireUnsealedVault empties the cloud vault a sealed project was seeded
+// from, leaving a stub that points devices which have not pulled since at
+// the project's new vault.
+func (a *App) retireUnsealedVault(scope remoteScope) error {
+	from := remoteScope{Project: scope.Unsealed, OrganizationID: scope.OrganizationID, TeamID: scope.TeamID}
+	remote, err := a.loadRemoteStoreFor(from)
+	if err != nil {
+		return fmt.Errorf("empty vault %s: %w", from, err)
+	}
+	project := remote.Projects[scope.Unsealed]
+	if remote.Revision == 0 || project == nil || project.Sealed != nil {
+		return nil
+	}
+	remote.Projects[scope.Unsealed] = &Project{
+		Name:   scope.Unsealed,
+		Sealed: &SealedInfo{ID: scope.Project},
+		Envs:   map[string]*Env{},
+	}
+	if err := a.saveRemoteStoreFor(from, remote, remote.Revision); err != nil {
+		return fmt.Errorf("empty vault %s: %w", from, err)
+	}
+	return nil
+}
+
+// ProjectSeal turns on sealed metadata for a project. From the next push
+// its remote copy is stored under IDs, with the names only in the
+// encrypted manifest.
+func (a *App) ProjectSeal(name string) error {
+	unlock, err := a.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	project, ok := state.Projects[name]
+	if !ok {
+		return fmt.Errorf("unknown project %q", name)
+	}
+	if err := a.requireProjectRole(state, project, roleAdmin); err != nil {
+		return err
+	}
+	if project.Sealed != nil {
+		fmt.Fprintf(a.Stdout, "%s %s\n", cDim("metadata already sealed for project"), cBold(name))
+		return nil
+	}
+	if project.Sealed, err = newSealedInfo(); err != nil {
+		return err
+	}
+	if err := a.saveState(state); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.Stdout, "%s %s as %s\n", cSuccess("sealed metadata of project"), cBold(name), project.Sealed.ID)
+	fmt.Fprintln(a.Stdout, "The next `envsync push` replaces the remote copy.")
+	a.logAudit("project_seal", state, map[string]any{"project": name, "id": project.Sealed.ID})
+	return nil
+}
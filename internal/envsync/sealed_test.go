@@ -0,0 +1,134 @@
+package envsync
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSealedProjectHidesNamesOnRemote(t *testing.T) {
+	app, stdout := newTestApp(t)
+	if err := app.Set("ACQUISITION_TARGET_API_KEY", "s3cret", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	stale, _ := newPeerApp(t, app)
+
+	if err := app.ProjectSeal("api"); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("sealed push: %v", err)
+	}
+	raw, err := os.ReadFile(app.RemotePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ACQUISITION_TARGET_API_KEY", `"api"`, `"dev"`} {
+		if strings.Contains(string(raw), name) {
+			t.Fatalf("remote store still names %s:\n%s", name, raw)
+		}
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := state.Projects["api"].Sealed.ID
+	remote, err := app.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sortedKeys(remote.Projects); len(got) != 1 || got[0] != id || remote.Projects[id].Manifest == nil {
+		t.Fatalf("expected only the sealed project %s on the remote, got %v", id, got)
+	}
+
+	stdout.Reset()
+	if err := app.Diff(); err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "in sync") {
+		t.Fatalf("expected diff to open the manifest, got %q", stdout.String())
+	}
+
+	peer, _ := newPeerApp(t, app)
+	if got := activeValuesFor(t, peer)["ACQUISITION_TARGET_API_KEY"]; got != "s3cret" {
+		t.Fatalf("restored %q from the sealed project", got)
+	}
+
+	if err := stale.Set("ACQUISITION_TARGET_API_KEY", "leak", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := stale.Push(false); err == nil || !strings.Contains(err.Error(), "pull first") {
+		t.Fatalf("expected a device that has not seen the seal to be told to pull, got %v", err)
+	}
+	if err := stale.PullWith(PullOptions{Strategy: "theirs"}); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	staleState, err := stale.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := staleState.Projects["api"].Sealed; got == nil || got.ID != id {
+		t.Fatalf("expected pull to adopt sealed metadata %s, got %+v", id, got)
+	}
+	if err := stale.Set("ACQUISITION_TARGET_API_KEY", "rotated", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := stale.Push(false); err != nil {
+		t.Fatalf("push after adopting the seal: %v", err)
+	}
+	if err := app.Pull(false); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if got := activeValuesFor(t, app)["ACQUISITION_TARGET_API_KEY"]; got != "rotated" {
+		t.Fatalf("pulled %q", got)
+	}
+}
+
+func TestSealedTeamProjectKeepsTeamOnRemote(t *testing.T) {
+	app := newTeamProject(t)
+	if err := app.ProjectSeal("web"); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	raw, err := app.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := sortedKeys(raw.Projects)[0]
+	if project := raw.Projects[id]; project.Manifest == nil || project.Team != "core" {
+		t.Fatalf("expected sealed project %s to keep team core on the remote, got %q", id, project.Team)
+	}
+}
+
+func TestSealedProjectSurvivesPhraseRotate(t *testing.T) {
+	app, _ := newTestApp(t)
+	if err := app.Set("TOKEN", "a1", ""); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := app.ProjectSeal("api"); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	confirmRotation(app)
+	if err := app.PhraseRotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	t.Setenv("ENVSYNC_RECOVERY_PHRASE", app.phraseCache)
+	if err := os.Remove(app.StatePath); err != nil {
+		t.Fatal(err)
+	}
+	app.phraseCache = ""
+	if err := app.Restore(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := activeValuesFor(t, app)["TOKEN"]; got != "a1" {
+		t.Fatalf("restored %q after rotating the phrase", got)
+	}
+}
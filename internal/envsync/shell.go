@@ -0,0 +1,359 @@
+package envsync
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	shellBash = "bash"
+	shellZsh  = "zsh"
+	shellFish = "fish"
+	shellPwsh = "pwsh"
+	shellNu   = "nu"
+
+	// hookStateVar records what the prompt hook loaded into the shell so the
+	// next prompt can skip unchanged directories and unset stale keys.
+	hookStateVar = "ENVSYNC_LOADED"
+)
+
+var shellNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// LoadOptions controls how Load prints the active environment.
+type LoadOptions struct {
+	// Shell is bash (the default), zsh, fish, pwsh or nu.
+	Shell string
+	// Raw skips ${...} reference expansion.
+	Raw bool
+}
+
+// LoadWith prints the active environment as statements for opts.Shell to
+// evaluate. nu gets a JSON record to pipe into `from json | load-env`.
+func (a *App) LoadWith(opts LoadOptions) error {
+	shell := shellBash
+	if strings.TrimSpace(opts.Shell) != "" {
+		var err error
+		if shell, err = parseShell(opts.Shell); err != nil {
+			return err
+		}
+	}
+	state, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	values, _, _, err := a.resolvedValues(state, "", "", opts.Raw)
+	if err != nil {
+		return err
+	}
+	if shell == shellNu {
+		return json.NewEncoder(a.Stdout).Encode(values)
+	}
+	return a.writeShellEnv(shell, values, nil)
+}
+
+func parseShell(shell string) (string, error) {
+	switch s := strings.ToLower(strings.TrimSpace(shell)); s {
+	case shellBash, shellZsh, shellFish, shellPwsh, shellNu:
+		return s, nil
+	case "powershell":
+		return shellPwsh, nil
+	case "nushell":
+		return shellNu, nil
+	}
+	return "", fmt.Errorf("unknown shell %q (want bash, zsh, fish, pwsh or nu)", shell)
+}
+
+// writeShellEnv prints statements that unset the keys in unset and set
+// values. Keys the shell cannot name are skipped with a warning.
+func (a *App) writeShellEnv(shell string, values map[string]string, unset []string) error {
+	var b strings.Builder
+	for _, k := range unset {
+		if a.shellName(shell, k) {
+			b.WriteString(shellUnset(shell, k))
+			b.WriteByte('\n')
+		}
+	}
+	for _, k := range sortedKeys(values) {
+		if a.shellName(shell, k) {
+			b.WriteString(shellSet(shell, k, values[k]))
+			b.WriteByte('\n')
+		}
+	}
+	_, err := io.WriteString(a.Stdout, b.String())
+	return err
+}
+
+func (a *App) shellName(shell, key string) bool {
+	if shell == shellPwsh || shellNamePattern.MatchString(key) {
+		return true
+	}
+	fmt.Fprintf(a.Stderr, "envsync: skipped %s: not a valid %s variable name\n", key, shell)
+	return false
+}
+
+func shellSet(shell, key, value string) string {
+	switch shell {
+	case shellFish:
+		return "set -gx " + key + " " + fishQuote(value)
+	case shellPwsh:
+		if shellNamePattern.MatchString(key) {
+			return "$env:" + key + " = " + pwshQuote(value)
+		}
+		return "Set-Item -LiteralPath " + pwshQuote("Env:"+key) + " -Value " + pwshQuote(value)
+	default:
+		return "export " + key + "=" + shellQuote(value)
+	}
+}
+
+func shellUnset(shell, key string) string {
+	switch shell {
+	case shellFish:
+		return "set -e " + key
+	case shellPwsh:
+		return "Remove-Item -LiteralPath " + pwshQuote("Env:"+key) + " -ErrorAction SilentlyContinue"
+	default:
+		return "unset " + key
+	}
+}
+
+// fishQuote single-quotes v; fish only treats \ and ' as special inside.
+func fishQuote(v string) string {
+	return "'" + escapeWith(v, `\'`, nil) + "'"
+}
+
+// pwshQuote single-quotes v. PowerShell also ends single-quoted strings at
+// the typographic single quotes, so those are doubled too.
+func pwshQuote(v string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range v {
+		switch r {
+		case '\'', '‘', '’', '‚', '‛':
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// Hook prints the prompt hook for shell. Installed in the shell's startup
+// file, it runs `envsync hook <shell> --eval` before every prompt.
+func (a *App) Hook(shell string) error {
+	shell, err := parseShell(shell)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "envsync"
+	}
+	var script string
+	switch shell {
+	case shellBash:
+		script = strings.ReplaceAll(bashHook, "{{envsync}}", shellQuote(exe))
+	case shellZsh:
+		script = strings.ReplaceAll(zshHook, "{{envsync}}", shellQuote(exe))
+	case shellFish:
+		script = strings.ReplaceAll(fishHook, "{{envsync}}", fishQuote(exe))
+	case shellPwsh:
+		script = strings.ReplaceAll(pwshHook, "{{envsync}}", pwshQuote(exe))
+	case shellNu:
+		script = strings.ReplaceAll(nuHook, "{{envsync}}", `"`+escapeWith(exe, `"\`, nil)+`"`)
+	}
+	_, err = io.WriteString(a.Stdout, script)
+	return err
+}
+
+const bashHook = `_envsync_hook() {
+  local previous_exit_status=$?
+  eval "$({{envsync}} hook bash --eval)"
+  return $previous_exit_status
+}
+if [[ ";${PROMPT_COMMAND:-};" != *";_envsync_hook;"* ]]; then
+  PROMPT_COMMAND="_envsync_hook${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+fi
+`
+
+const zshHook = `_envsync_hook() {
+  eval "$({{envsync}} hook zsh --eval)"
+}
+typeset -ag precmd_functions chpwd_functions
+if (( ! ${precmd_functions[(I)_envsync_hook]} )); then
+  precmd_functions=(_envsync_hook $precmd_functions)
+fi
+if (( ! ${chpwd_functions[(I)_envsync_hook]} )); then
+  chpwd_functions=(_envsync_hook $chpwd_functions)
+fi
+`
+
+const fishHook = `function __envsync_hook --on-event fish_prompt --on-variable PWD
+    {{envsync}} hook fish --eval | source
+end
+`
+
+const pwshHook = `if (-not (Test-Path function:global:__envsync_prompt)) {
+    Set-Item -Path function:global:__envsync_prompt -Value $function:prompt
+    function global:prompt {
+        $exitCode = $global:LASTEXITCODE
+        $script = (& {{envsync}} hook pwsh --eval) -join "` + "`" + `n"
+        if ($script) { Invoke-Expression $script }
+        $global:LASTEXITCODE = $exitCode
+        __envsync_prompt
+    }
+}
+`
+
+const nuHook = `$env.config = ($env.config | upsert hooks.pre_prompt (
+    ($env.config.hooks.pre_prompt? | default []) | append {||
+        let change = (^{{envsync}} hook nu --eval | from json)
+        hide-env --ignore-errors ...$change.unset
+        load-env $change.set
+    }
+))
+`
+
+// hookState is what ENVSYNC_LOADED holds between prompts: the marker the
+// shell is inside, a stamp of the files its values came from, the keys the
+// hook set and the values those keys had before it set them. Keys missing
+// from Saved were unset.
+type hookState struct {
+	Marker string            `json:"marker,omitempty"`
+	Stamp  string            `json:"stamp,omitempty"`
+	Keys   []string          `json:"keys,omitempty"`
+	Saved  map[string]string `json:"saved,omitempty"`
+}
+
+// saved reports the value key had before the hook first set it.
+func (s hookState) saved(key string) (string, bool) {
+	if slices.Contains(s.Keys, key) {
+		v, ok := s.Saved[key]
+		return v, ok
+	}
+	return os.LookupEnv(key)
+}
+
+func parseHookState(raw string) hookState {
+	var s hookState
+	if b, err := base64.RawURLEncoding.DecodeString(raw); err == nil {
+		_ = json.Unmarshal(b, &s)
+	}
+	return s
+}
+
+func (s hookState) encode() string {
+	b, _ := json.Marshal(s)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// HookEval prints what the prompt hook should evaluate for the current
+// directory. While the nearest .envsync.json marker and the state file are
+// unchanged it prints nothing and decrypts nothing, so the prompt stays
+// fast. Entering a marked directory loads its project's active environment,
+// leaving it restores the values the shell had before, or unsets keys it
+// did not have. Failures are reported once and not
+// retried until a file changes.
+func (a *App) HookEval(shell string) error {
+	shell, err := parseShell(shell)
+	if err != nil {
+		return err
+	}
+	prev := parseHookState(os.Getenv(hookStateVar))
+	next := hookState{}
+	next.Marker, _ = findMarker(a.CWD, nil)
+	if next.Marker != "" {
+		next.Stamp = hookStamp(next.Marker, a.StatePath)
+	}
+	if next.Marker == prev.Marker && next.Stamp == prev.Stamp {
+		if shell == shellNu {
+			return json.NewEncoder(a.Stdout).Encode(map[string]any{"set": map[string]string{}, "unset": []string{}})
+		}
+		return nil
+	}
+	values := map[string]string{}
+	switch {
+	case next.Marker != "":
+		loaded, label, err := a.hookValues()
+		if err != nil {
+			fmt.Fprintf(a.Stderr, "envsync: %v\n", err)
+			break
+		}
+		values = loaded
+		fmt.Fprintf(a.Stderr, "envsync: loaded %s (%d keys)\n", label, len(values))
+	case len(prev.Keys) > 0:
+		fmt.Fprintf(a.Stderr, "envsync: unloaded %d keys\n", len(prev.Keys))
+	}
+	next.Keys = sortedKeys(values)
+	for _, k := range next.Keys {
+		if v, ok := prev.saved(k); ok {
+			if next.Saved == nil {
+				next.Saved = map[string]string{}
+			}
+			next.Saved[k] = v
+		}
+	}
+	unset := []string{}
+	for _, k := range prev.Keys {
+		if _, ok := values[k]; ok {
+			continue
+		}
+		if v, ok := prev.Saved[k]; ok {
+			values[k] = v
+		} else {
+			unset = append(unset, k)
+		}
+	}
+	if next.Marker == "" {
+		unset = append(unset, hookStateVar)
+	} else {
+		values[hookStateVar] = next.encode()
+	}
+	if shell == shellNu {
+		return json.NewEncoder(a.Stdout).Encode(map[string]any{"set": values, "unset": unset})
+	}
+	return a.writeShellEnv(shell, values, unset)
+}
+
+// hookValues decrypts the environment the marker in the working directory
+// selects, without prompting for the recovery phrase.
+func (a *App) hookValues() (map[string]string, string, error) {
+	state, err := a.loadState()
+	if err != nil {
+		return nil, "", err
+	}
+	_, project := findMarker(a.CWD, state)
+	if project == "" {
+		return nil, "", fmt.Errorf("%s names a project that does not exist", markerFile)
+	}
+	if a.phraseCache == "" && a.agentKey(state) == nil {
+		if a.phraseCache = a.storedPhrase(); a.phraseCache == "" {
+			return nil, "", errors.New("recovery phrase not available; run `envsync phrase save` or start `envsync agent` so the hook can load without prompting")
+		}
+	}
+	values, projectName, envName, err := a.resolvedValues(state, project, "", false)
+	if err != nil {
+		return nil, "", err
+	}
+	return values, projectName + "/" + envName, nil
+}
+
+// hookStamp identifies the versions of the files the hook's values depend
+// on. A missing file stamps as zero.
+func hookStamp(paths ...string) string {
+	parts := make([]string, len(paths))
+	for i, p := range paths {
+		var mod int64
+		if info, err := os.Stat(p); err == nil {
+			mod = info.ModTime().UnixNano()
+		}
+		parts[i] = fmt.Sprint(mod)
+	}
+	return strings.Join(parts, ":")
+}
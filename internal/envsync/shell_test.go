@@ -0,0 +1,157 @@
+package envsync
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellSetQuoting(t *testing.T) {
+	value := "it's $HOME `id` ‘ü’ \\n"
+	cases := []struct {
+		shell string
+		want  string
+	}{
+		{shellBash, `export K='it'\''s $HOME ` + "`id`" + ` ‘ü’ \n'`},
+		{shellZsh, `export K='it'\''s $HOME ` + "`id`" + ` ‘ü’ \n'`},
+		{shellFish, `set -gx K 'it\'s $HOME ` + "`id`" + ` ‘ü’ \\n'`},
+		{shellPwsh, `$env:K = 'it''s $HOME ` + "`id`" + ` ‘‘ü’’ \n'`},
+	}
+	for _, tc := range cases {
+		if got := shellSet(tc.shell, "K", value); got != tc.want {
+			t.Fatalf("%s: got %s, want %s", tc.shell, got, tc.want)
+		}
+	}
+	if got := shellSet(shellPwsh, "A.B", "v"); got != `Set-Item -LiteralPath 'Env:A.B' -Value 'v'` {
+		t.Fatalf("pwsh non-identifier key: %s", got)
+	}
+}
+
+func TestLoadWithShell(t *testing.T) {
+	app, stdout := newTestApp(t)
+	setAll(t, app, "MULTI", "line1\nline2", "QUOTE", `say "hi" it's`)
+
+	stdout.Reset()
+	if err := app.LoadWith(LoadOptions{Shell: "fish"}); err != nil {
+		t.Fatalf("load fish: %v", err)
+	}
+	want := "set -gx MULTI 'line1\nline2'\nset -gx QUOTE 'say \"hi\" it\\'s'\n"
+	if stdout.String() != want {
+		t.Fatalf("fish output:\n%s\nwant:\n%s", stdout.String(), want)
+	}
+
+	stdout.Reset()
+	if err := app.LoadWith(LoadOptions{Shell: "nu"}); err != nil {
+		t.Fatalf("load nu: %v", err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("nu output is not JSON: %v\n%s", err, stdout.String())
+	}
+	if got["MULTI"] != "line1\nline2" || got["QUOTE"] != `say "hi" it's` {
+		t.Fatalf("nu values: %v", got)
+	}
+
+	if err := app.LoadWith(LoadOptions{Shell: "tcsh"}); err == nil || !strings.Contains(err.Error(), "unknown shell") {
+		t.Fatalf("expected unknown shell error, got %v", err)
+	}
+}
+
+func TestHookEvalLoadsCachesAndUnloads(t *testing.T) {
+	app, stdout := newTestApp(t)
+	setAll(t, app, "API_KEY", "k 1")
+	if err := os.WriteFile(filepath.Join(app.CWD, markerFile), []byte(`{"project":"api"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Dir(app.CWD)
+	app.CWD = filepath.Join(app.CWD, "src")
+	if err := os.MkdirAll(app.CWD, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(hookStateVar, "")
+
+	stdout.Reset()
+	if err := app.HookEval("bash"); err != nil {
+		t.Fatalf("hook eval: %v", err)
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "export API_KEY='k 1'\n") {
+		t.Fatalf("expected API_KEY export, got:\n%s", out)
+	}
+	_, rest, ok := strings.Cut(out, "export "+hookStateVar+"='")
+	if !ok {
+		t.Fatalf("expected %s export, got:\n%s", hookStateVar, out)
+	}
+	loaded, _, _ := strings.Cut(rest, "'")
+	if keys := parseHookState(loaded).Keys; strings.Join(keys, ",") != "API_KEY" {
+		t.Fatalf("hook state keys: %v", keys)
+	}
+	t.Setenv(hookStateVar, loaded)
+
+	stdout.Reset()
+	app.phraseCache = ""
+	t.Setenv("ENVSYNC_RECOVERY_PHRASE", "")
+	if err := app.HookEval("bash"); err != nil {
+		t.Fatalf("cached hook eval: %v", err)
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("expected no output for unchanged directory, got:\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	app.CWD = outside
+	if err := app.HookEval("nu"); err != nil {
+		t.Fatalf("hook eval outside: %v", err)
+	}
+	var change struct {
+		Set   map[string]string `json:"set"`
+		Unset []string          `json:"unset"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &change); err != nil {
+		t.Fatalf("nu hook output is not JSON: %v\n%s", err, stdout.String())
+	}
+	if len(change.Set) != 0 || strings.Join(change.Unset, ",") != "API_KEY,"+hookStateVar {
+		t.Fatalf("unexpected change leaving marker: %+v", change)
+	}
+}
+
+func TestHookEvalRestoresShellValues(t *testing.T) {
+	app, stdout := newTestApp(t)
+	setAll(t, app, "API_KEY", "k1")
+	if err := os.WriteFile(filepath.Join(app.CWD, markerFile), []byte(`{"project":"api"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Dir(app.CWD)
+	t.Setenv(hookStateVar, "")
+	t.Setenv("API_KEY", "from-shell")
+
+	var change struct {
+		Set   map[string]string `json:"set"`
+		Unset []string          `json:"unset"`
+	}
+	eval := func() {
+		t.Helper()
+		stdout.Reset()
+		if err := app.HookEval("nu"); err != nil {
+			t.Fatalf("hook eval: %v", err)
+		}
+		change.Set, change.Unset = nil, nil
+		if err := json.Unmarshal(stdout.Bytes(), &change); err != nil {
+			t.Fatalf("nu hook output is not JSON: %v\n%s", err, stdout.String())
+		}
+	}
+	eval()
+	if change.Set["API_KEY"] != "k1" {
+		t.Fatalf("expected API_KEY to load, got %+v", change)
+	}
+	t.Setenv(hookStateVar, change.Set[hookStateVar])
+	t.Setenv("API_KEY", "k1")
+
+	app.CWD = outside
+	eval()
+	if change.Set["API_KEY"] != "from-shell" || strings.Join(change.Unset, ",") != hookStateVar {
+		t.Fatalf("expected leaving to restore the shell's API_KEY, got %+v", change)
+	}
+}
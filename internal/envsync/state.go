@@ -1,14 +1,24 @@
 package envsync
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 )
 
-const currentStateSchemaVersion = 2
+// currentStateSchemaVersion is the state layout this build writes. v3 seals
+// every secret version with its location as associated data; moving a v2
+// state there re-encrypts, so it needs the vault key and is done by
+// bindStateVersions instead of migrateStateSchema.
+const currentStateSchemaVersion = 3
+
+// markerFile pins a directory and its children to a project.
+const markerFile = ".envsync.json"
 
 func (a *App) loadState() (*State, error) {
 	b, err := os.ReadFile(a.StatePath)
@@ -22,6 +32,7 @@ func (a *App) loadState() (*State, error) {
 	if err := json.Unmarshal(b, &state); err != nil {
 		return nil, err
 	}
+	state.loaded = b
 	_, _, _ = migrateStateSchema(&state)
 	return &state, nil
 }
@@ -43,19 +54,156 @@ func (a *App) stateVersionOnDisk() (int, error) {
 	return raw.Version, nil
 }
 
+// lockState takes the exclusive lock on the state file for a command that
+// loads, changes and saves it, so concurrent invocations queue up instead of
+// overwriting each other's changes. Nested calls share the outer lock; the
+// returned func releases one level.
+func (a *App) lockState() (func(), error) {
+	if a.stateLocks == 0 {
+		lockPath := a.StatePath + ".lock"
+		if err := os.MkdirAll(filepath.Dir(lockPath), 0o700); err != nil {
+			return nil, err
+		}
+		release, err := acquireFileLock(lockPath)
+		if err != nil {
+			return nil, fmt.Errorf("lock state: %w", err)
+		}
+		a.releaseState = release
+	}
+	a.stateLocks++
+	return func() {
+		a.stateLocks--
+		if a.stateLocks == 0 {
+			a.releaseState()
+			a.releaseState = nil
+		}
+	}, nil
+}
+
+// saveState writes state under the state lock. If the file changed since
+// state was loaded (a writer that does not take the lock, or a sync tool),
+// the changes made to state are merged onto the file's current content, and
+// saving fails only when both touched the same value.
 func (a *App) saveState(state *State) error {
-	if err := os.MkdirAll(filepath.Dir(a.StatePath), 0o700); err != nil {
+	unlock, err := a.lockState()
+	if err != nil {
 		return err
 	}
+	defer unlock()
 	b, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		return err
 	}
-	tmp := a.StatePath + ".tmp"
-	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+	current, err := os.ReadFile(a.StatePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if state.loaded != nil {
+			return errors.New("state file was removed while envsync was using it")
+		}
+	case err != nil:
+		return err
+	case state.loaded == nil:
+		return errors.New("state file was created by another envsync process; rerun the command")
+	case !bytes.Equal(current, state.loaded):
+		merged, err := mergeStateJSON(state.loaded, b, current)
+		if err != nil {
+			return err
+		}
+		var fresh State
+		if err := json.Unmarshal(merged, &fresh); err != nil {
+			return err
+		}
+		*state = fresh
+		if b, err = json.MarshalIndent(state, "", "  "); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.StatePath), filepath.Base(a.StatePath)+".tmp.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), a.StatePath); err != nil {
 		return err
 	}
-	return os.Rename(tmp, a.StatePath)
+	state.loaded = b
+	return nil
+}
+
+// mergeStateJSON applies the difference between base and ours to theirs,
+// three-way, and fails on a value both sides changed differently.
+func mergeStateJSON(base, ours, theirs []byte) ([]byte, error) {
+	var b, o, t any
+	for _, doc := range []struct {
+		data []byte
+		into *any
+	}{{base, &b}, {ours, &o}, {theirs, &t}} {
+		if err := json.Unmarshal(doc.data, doc.into); err != nil {
+			return nil, err
+		}
+	}
+	merged, conflict := mergeJSONValue(b, o, t, "")
+	if conflict != "" {
+		return nil, fmt.Errorf("state file changed on disk while envsync was running and both changed %s; rerun the command", conflict)
+	}
+	return json.MarshalIndent(merged, "", "  ")
+}
+
+// absentValue stands in for a key missing from one side of a merge.
+type absentValue struct{}
+
+// mergeJSONValue merges one value of decoded JSON and returns the path of
+// the first conflict, if any.
+func mergeJSONValue(base, ours, theirs any, path string) (any, string) {
+	switch {
+	case reflect.DeepEqual(ours, base):
+		return theirs, ""
+	case reflect.DeepEqual(theirs, base), reflect.DeepEqual(ours, theirs):
+		return ours, ""
+	}
+	om, ok1 := ours.(map[string]any)
+	tm, ok2 := theirs.(map[string]any)
+	if !ok1 || !ok2 {
+		if path == "" {
+			path = "the whole file"
+		}
+		return nil, path
+	}
+	bm, _ := base.(map[string]any)
+	merged := map[string]any{}
+	keys := map[string]bool{}
+	for _, m := range []map[string]any{bm, om, tm} {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	for _, k := range sortedKeys(keys) {
+		get := func(m map[string]any) any {
+			if v, ok := m[k]; ok {
+				return v
+			}
+			return absentValue{}
+		}
+		v, conflict := mergeJSONValue(get(bm), get(om), get(tm), strings.TrimPrefix(path+"."+k, "."))
+		if conflict != "" {
+			return nil, conflict
+		}
+		if _, gone := v.(absentValue); !gone {
+			merged[k] = v
+		}
+	}
+	return merged, ""
 }
 
 func currentProject(state *State, cwd string) (*Project, string, error) {
@@ -99,21 +247,66 @@ func currentEnv(state *State, cwd string) (*Env, error) {
 	return env, nil
 }
 
+// resolveProjectEnv returns the project and environment a command should act
+// on. Empty names fall back to the active project and environment.
+func resolveProjectEnv(state *State, cwd, projectName, envName string) (*Project, string, *Env, string, error) {
+	var (
+		project *Project
+		err     error
+	)
+	if projectName == "" {
+		project, projectName, err = currentProject(state, cwd)
+		if err != nil {
+			return nil, "", nil, "", err
+		}
+	} else {
+		project = state.Projects[projectName]
+		if project == nil {
+			return nil, "", nil, "", fmt.Errorf("unknown project %q", projectName)
+		}
+	}
+	if envName == "" {
+		envName = state.CurrentEnv
+	}
+	if envName == "" {
+		envName = defaultEnv
+	}
+	env := project.Envs[envName]
+	if env == nil {
+		return nil, "", nil, "", fmt.Errorf("environment %q does not exist", envName)
+	}
+	if env.Vars == nil {
+		env.Vars = map[string]*SecretRecord{}
+	}
+	return project, projectName, env, envName, nil
+}
+
 // detectProjectFromMarker reads a .envsync.json marker file in the given
 // directory (or any parent) and returns the project name it references, if
 // that project exists in the current state.
 func detectProjectFromMarker(cwd string, state *State) string {
+	_, project := findMarker(cwd, state)
+	return project
+}
+
+// findMarker walks up from cwd to the nearest .envsync.json naming a
+// project and returns its path and project. Markers for projects missing
+// from state are skipped; a nil state accepts any project.
+func findMarker(cwd string, state *State) (string, string) {
 	dir := cwd
 	for {
-		markerPath := filepath.Join(dir, ".envsync.json")
+		markerPath := filepath.Join(dir, markerFile)
 		b, err := os.ReadFile(markerPath)
 		if err == nil {
 			var marker struct {
 				Project string `json:"project"`
 			}
 			if json.Unmarshal(b, &marker) == nil && marker.Project != "" {
+				if state == nil {
+					return markerPath, marker.Project
+				}
 				if _, ok := state.Projects[marker.Project]; ok {
-					return marker.Project
+					return markerPath, marker.Project
 				}
 			}
 		}
@@ -123,7 +316,7 @@ func detectProjectFromMarker(cwd string, state *State) string {
 		}
 		dir = parent
 	}
-	return ""
+	return "", ""
 }
 
 func markSyncedVersions(projects map[string]*Project) {
@@ -210,15 +403,185 @@ func migrateStateSchema(state *State) (changed bool, fromVersion int, toVersion
 		}
 	}
 
-	if state.Version > currentStateSchemaVersion {
-		toVersion = state.Version
-		return changed, fromVersion, toVersion
-	}
-	if state.Version < currentStateSchemaVersion {
-		state.Version = currentStateSchemaVersion
+	if state.Version == 2 && !hasUnboundVersions(state.Projects) {
+		state.Version = 3
 		changed = true
 	}
 
 	toVersion = state.Version
 	return changed, fromVersion, toVersion
 }
+
+// anyVersion reports whether a sealed version in projects satisfies match.
+func anyVersion(projects map[string]*Project, match func(SecretVersion) bool) bool {
+	for _, project := range projects {
+		if project == nil {
+			continue
+		}
+		for _, env := range project.Envs {
+			if env == nil {
+				continue
+			}
+			for _, rec := range env.Vars {
+				if rec == nil {
+					continue
+				}
+				for _, v := range rec.Versions {
+					if !v.Deleted && v.CipherB64 != "" && match(v) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// hasUnboundVersions reports whether any version in projects was sealed
+// without associated data.
+func hasUnboundVersions(projects map[string]*Project) bool {
+	return anyVersion(projects, func(v SecretVersion) bool { return v.AAD == 0 })
+}
+
+// hasUnboundRecord reports whether any live version of rec was sealed
+// without associated data.
+func hasUnboundRecord(rec *SecretRecord) bool {
+	for _, v := range rec.Versions {
+		if !v.Deleted && v.CipherB64 != "" && v.AAD == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLegacyHashes reports whether any version in projects still carries an
+// unkeyed PlainHash.
+func hasLegacyHashes(projects map[string]*Project) bool {
+	return anyVersion(projects, func(v SecretVersion) bool { return !isKeyedHash(v.PlainHash) })
+}
+
+// bindStateVersions moves a v2 state to v3 by sealing every version written
+// without associated data again, bound to its project, env, key and version.
+// Versions this device cannot decrypt, such as those of team projects it
+// holds no data key for, are left as they are, and the state stays on v2 so
+// they are bound once the key is at hand. It returns how many versions were
+// re-sealed.
+func (a *App) bindStateVersions(state *State) (int, error) {
+	if state.Version >= currentStateSchemaVersion {
+		return 0, nil
+	}
+	count, err := a.eachOpenProject(state, func(p *Project) bool {
+		return hasUnboundVersions(map[string]*Project{p.Name: p})
+	}, bindVersions)
+	if err != nil {
+		return count, err
+	}
+	if !hasUnboundVersions(state.Projects) {
+		state.Version = currentStateSchemaVersion
+	}
+	return count, nil
+}
+
+// rehashStateVersions replaces the unkeyed SHA-256 PlainHash older builds
+// stored with the keyed HMAC, for every version this device can decrypt.
+// Others, such as those of team projects it holds no data key for, keep
+// theirs. It returns how many hashes were rewritten.
+func (a *App) rehashStateVersions(state *State) (int, error) {
+	if !hasLegacyHashes(state.Projects) {
+		return 0, nil
+	}
+	return a.eachOpenProject(state, func(p *Project) bool {
+		return hasLegacyHashes(map[string]*Project{p.Name: p})
+	}, rehashVersions)
+}
+
+// eachOpenProject calls fn with every project in state that need selects
+// and this device holds keys for, and sums the counts fn returns.
+func (a *App) eachOpenProject(state *State, need func(*Project) bool, fn func(*Project, *projectKeys) (int, error)) (int, error) {
+	if _, err := a.getSecretKey(state); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, projName := range sortedKeys(state.Projects) {
+		project := state.Projects[projName]
+		if !need(project) {
+			continue
+		}
+		keys, err := a.unwrapProjectKeys(state, project)
+		if err != nil {
+			continue
+		}
+		n, err := fn(project, keys)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// eachSealedVersion calls fn with every live version of project that keys
+// hold the sealing key for, until fn returns an error.
+func eachSealedVersion(project *Project, keys *projectKeys, fn func(envName, name string, v *SecretVersion, sealKey []byte) error) error {
+	for envName, env := range project.Envs {
+		for name, rec := range env.Vars {
+			for i := range rec.Versions {
+				v := &rec.Versions[i]
+				if v.Deleted || v.CipherB64 == "" {
+					continue
+				}
+				sealKey, err := keys.sealedWith(*v)
+				if err != nil {
+					continue
+				}
+				if err := fn(envName, name, v, sealKey); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// bindVersions seals every version of project written without associated
+// data again under keys, bound to its location. Versions keys cannot open
+// are left as they are.
+func bindVersions(project *Project, keys *projectKeys) (int, error) {
+	count := 0
+	err := eachSealedVersion(project, keys, func(envName, name string, v *SecretVersion, sealKey []byte) error {
+		if v.AAD != 0 {
+			return nil
+		}
+		plain, err := decryptUnbound(sealKey, *v)
+		if err != nil {
+			return fmt.Errorf("%s v%d in %s/%s: %w", name, v.Version, project.Name, envName, err)
+		}
+		if err := keys.seal(v, envName, name, plain); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// rehashVersions replaces the unkeyed PlainHash of every version of project
+// keys can open. The rewritten hashes reach the remote with the next push.
+func rehashVersions(project *Project, keys *projectKeys) (int, error) {
+	count := 0
+	err := eachSealedVersion(project, keys, func(envName, name string, v *SecretVersion, sealKey []byte) error {
+		if isKeyedHash(v.PlainHash) {
+			return nil
+		}
+		// A version that does not open keeps its hash; reading it fails
+		// loudly later.
+		plain, err := keys.decrypt(envName, name, *v)
+		if err != nil {
+			return nil
+		}
+		v.PlainHash = plainHash(sealKey, plain)
+		count++
+		return nil
+	})
+	return count, err
+}
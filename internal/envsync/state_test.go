@@ -0,0 +1,414 @@
+package envsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cloneApp returns an App on the same state file, as a second envsync
+// process would be.
+func cloneApp(app *App) *App {
+	c := *app
+	c.Stdout, c.Stderr = io.Discard, io.Discard
+	c.stateLocks, c.releaseState = 0, nil
+	return &c
+}
+
+func TestConcurrentSetsKeepEveryWrite(t *testing.T) {
+	app, _ := newTestApp(t)
+	setAll(t, app, "SHARED", "seed")
+
+	const writers = 8
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, 2*writers)
+	for i := range writers {
+		wg.Add(1)
+		w := cloneApp(app)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs <- w.Set(fmt.Sprintf("KEY_%d", i), fmt.Sprint(i), "")
+			errs <- w.Set("SHARED", fmt.Sprint(i), "")
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	values := activeValuesFor(t, app)
+	for i := range writers {
+		if got := values[fmt.Sprintf("KEY_%d", i)]; got != fmt.Sprint(i) {
+			t.Fatalf("KEY_%d = %q; a concurrent write was lost", i, got)
+		}
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := state.Projects["api"].Envs["dev"].Vars["SHARED"]; rec.CurrentVersion != writers+1 || len(rec.Versions) != writers+1 {
+		t.Fatalf("expected %d versions of SHARED, got %d", writers+1, len(rec.Versions))
+	}
+}
+
+func TestSetWaitsForStateLock(t *testing.T) {
+	app, _ := newTestApp(t)
+	setAll(t, app, "A", "1")
+	unlock, err := app.lockState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := cloneApp(app)
+	done := make(chan error)
+	go func() { done <- other.Set("A", "2", "") }()
+	select {
+	case err := <-done:
+		unlock()
+		t.Fatalf("set finished while the state was locked: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("set after unlock: %v", err)
+	}
+	if got := activeValuesFor(t, app)["A"]; got != "2" {
+		t.Fatalf("A = %q after the lock was released", got)
+	}
+}
+
+func TestSaveStateMergesExternalChanges(t *testing.T) {
+	app, _ := newTestApp(t)
+	setAll(t, app, "A", "1")
+	stale, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer that bypasses the lock changes another part of the file.
+	if err := cloneApp(app).Set("B", "2", ""); err != nil {
+		t.Fatal(err)
+	}
+	stale.ProjectBindings["/srv/api"] = "api"
+	if err := app.saveState(stale); err != nil {
+		t.Fatalf("save over an external change: %v", err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.ProjectBindings["/srv/api"] != "api" || activeValuesFor(t, app)["B"] != "2" {
+		t.Fatal("expected both the external and the local change to survive")
+	}
+
+	// Both sides writing the same key cannot be merged.
+	stale, err = app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cloneApp(app).Set("A", "external", ""); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := app.keysFor(stale, stale.Projects["api"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.writeSecretVersion(stale, keys, "dev", "A", stale.Projects["api"].Envs["dev"].Vars["A"], "local", false, ""); err != nil {
+		t.Fatal(err)
+	}
+	err = app.saveState(stale)
+	if err == nil || !strings.Contains(err.Error(), "projects.api.envs.dev.vars.A") {
+		t.Fatalf("expected a conflict on A, got %v", err)
+	}
+	if got := activeValuesFor(t, app)["A"]; got != "external" {
+		t.Fatalf("conflicting save clobbered A: %q", got)
+	}
+}
+
+// unbindProjects seals every version in projects again without associated
+// data, as envsync wrote them before state schema v3.
+func unbindProjects(t *testing.T, key []byte, projects map[string]*Project) {
+	t.Helper()
+	for projName, project := range projects {
+		for envName, env := range project.Envs {
+			for name, rec := range env.Vars {
+				for i := range rec.Versions {
+					v := &rec.Versions[i]
+					plain, err := decrypt(key, *v, versionAAD(projName, envName, name, v.Version))
+					if err != nil {
+						t.Fatal(err)
+					}
+					ct, nonce, _, err := encrypt(key, plain, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					v.CipherB64, v.NonceB64, v.AAD = encode(ct), encode(nonce), 0
+				}
+			}
+		}
+	}
+}
+
+func TestStateV3MigrationBindsLegacyVersions(t *testing.T) {
+	app, stdout := newTestApp(t)
+	setAll(t, app, "A", "1", "B", "2")
+	if err := app.Set("A", "1b", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatal(err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := app.getSecretKey(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbindProjects(t, key, state.Projects)
+	state.Version = 2
+	if err := app.saveState(state); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := app.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbindProjects(t, key, remote.Projects)
+	if err := app.saveRemoteStoreFor(remoteScope{}, remote, remote.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"A": "1b", "B": "2"}
+	if got := activeValuesFor(t, app); !reflect.DeepEqual(got, want) {
+		t.Fatalf("values on a v2 state = %q, want %q", got, want)
+	}
+	stdout.Reset()
+	if err := app.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if out := stdout.String(); !strings.Contains(out, "v2 -> v3") || !strings.Contains(out, "re-encrypted 3 secret versions") {
+		t.Fatalf("unexpected upgrade output:\n%s", out)
+	}
+	state, err = app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != 3 || hasUnboundVersions(state.Projects) {
+		t.Fatalf("expected every version bound on v3, got v%d", state.Version)
+	}
+
+	// Restoring from a remote an older envsync pushed does not bind what it
+	// finds there; the values open once the upgraded device pushes them.
+	peer, _ := newPeerApp(t, app)
+	if warn := peer.Stderr.(*bytes.Buffer).String(); !strings.Contains(warn, "sealed without their location") {
+		t.Fatalf("expected restore to warn about unbound versions, got %q", warn)
+	}
+	if err := peer.Get("A"); !errors.Is(err, errUnboundVersion) {
+		t.Fatalf("expected a restored unbound version to be rejected, got %v", err)
+	}
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := peer.Pull(false); err != nil {
+		t.Fatalf("peer pull: %v", err)
+	}
+	if got := activeValuesFor(t, peer); !reflect.DeepEqual(got, want) {
+		t.Fatalf("values after pull = %q, want %q", got, want)
+	}
+}
+
+func TestStateStaysV2UntilEveryProjectIsBound(t *testing.T) {
+	app, _ := newTestApp(t)
+	setAll(t, app, "A", "1")
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := app.getSecretKey(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbindProjects(t, key, state.Projects)
+	// A team project whose data key this device does not hold yet.
+	other := cloneRecord(state.Projects["api"].Envs["dev"].Vars["A"])
+	state.Projects["other"] = &Project{Name: "other", Team: "core", DataKeyID: "k2", Envs: map[string]*Env{
+		"dev": {Name: "dev", Vars: map[string]*SecretRecord{"A": other}},
+	}}
+	state.Version = 2
+	if err := app.saveState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	bound, err := app.bindStateVersions(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound != 1 || state.Version != 2 {
+		t.Fatalf("bound %d versions on v%d, want 1 on v2", bound, state.Version)
+	}
+	if hasUnboundRecord(state.Projects["api"].Envs["dev"].Vars["A"]) {
+		t.Fatal("expected the open project to be bound")
+	}
+}
+
+func TestPullRejectsUnboundRemoteVersions(t *testing.T) {
+	app, _ := newTestApp(t)
+	setAll(t, app, "A", "1", "B", "2")
+	if err := app.Push(false); err != nil {
+		t.Fatal(err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := app.getSecretKey(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbindProjects(t, key, state.Projects)
+	state.Version = 2
+	if err := app.saveState(state); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := app.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbindProjects(t, key, remote.Projects)
+	if err := app.saveRemoteStoreFor(remoteScope{}, remote, remote.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set moves the state to v3, binding A and B locally. Pull keeps those
+	// over the unbound remote copies and does not take B back once it is
+	// gone locally.
+	if err := app.Set("C", "3", ""); err != nil {
+		t.Fatal(err)
+	}
+	state, err = app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(state.Projects["api"].Envs["dev"].Vars, "B")
+	if err := app.saveState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Pull(false); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if warn := app.Stderr.(*bytes.Buffer).String(); !strings.Contains(warn, "skipped A, B") {
+		t.Fatalf("expected pull to skip the unbound remote copies, got %q", warn)
+	}
+	state, err = app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := state.Projects["api"].Envs["dev"].Vars
+	if vars["B"] != nil || state.Version != 3 || hasUnboundVersions(state.Projects) {
+		t.Fatalf("expected pull to take nothing unbound from the remote, got v%d", state.Version)
+	}
+	if got := activeValuesFor(t, app)["A"]; got != "1" {
+		t.Fatalf("A = %q after pull, want 1", got)
+	}
+
+	// Pushing from the upgraded device replaces the unbound remote copy.
+	if err := app.Push(false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	remote, err = app.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasUnboundRecord(remote.Projects["api"].Envs["dev"].Vars["A"]) {
+		t.Fatal("expected push to replace the unbound remote copy of A")
+	}
+}
+
+func TestRehashReplacesUnkeyedHashes(t *testing.T) {
+	app, stdout := newTestApp(t)
+	setAll(t, app, "PIN", "1234", "TOKEN", "t1")
+	if err := app.Push(false); err != nil {
+		t.Fatal(err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := state.Projects["api"].Envs["dev"].Vars
+	if h := vars["PIN"].Versions[0].PlainHash; !isKeyedHash(h) || strings.Contains(h, legacyPlainHash("1234")) {
+		t.Fatalf("expected a keyed hash, got %q", h)
+	}
+
+	// A state written by an older build carries unkeyed hashes while the
+	// remote already has keyed ones.
+	vars["PIN"].Versions[0].PlainHash = legacyPlainHash("1234")
+	vars["TOKEN"].Versions[0].PlainHash = legacyPlainHash("t1")
+	if err := app.saveState(state); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	if err := app.Diff(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "in sync") {
+		t.Fatalf("expected mixed hashes of one version to compare equal, got:\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	if err := app.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "replaced 2 value hashes") {
+		t.Fatalf("unexpected init output:\n%s", stdout.String())
+	}
+	state, err = app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasLegacyHashes(state.Projects) {
+		t.Fatal("expected every hash to be keyed")
+	}
+}
+
+func TestPullRehashesUnkeyedRemoteHashes(t *testing.T) {
+	app, _ := newTestApp(t)
+	setAll(t, app, "A", "1")
+	if err := app.Push(false); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := app.loadRemoteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Projects["api"].Envs["dev"].Vars["A"].Versions[0].PlainHash = legacyPlainHash("1")
+	if err := app.saveRemoteStoreFor(remoteScope{}, remote, remote.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Set("B", "2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Pull(false); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	state, err := app.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasLegacyHashes(state.Projects) {
+		t.Fatal("expected pull to rehash what it took from the remote")
+	}
+}
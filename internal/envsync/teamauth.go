@@ -0,0 +1,201 @@
+package envsync
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// A team also holds a random authentication key, wrapped for every member
+// like a data key, so the server never sees it. Its roster (members, roles
+// and public keys) and the data key of each of its projects carry an HMAC
+// under that key. A device takes a team's authentication key the first time
+// it can open one and from then on refuses a roster or data key from the
+// remote that does not verify under it, so the remote cannot slip in a
+// public key of its own for admins to wrap data keys for, or a data key it
+// knows for members to adopt. Teams from before authentication keys are
+// taken as they are until an admin re-keys them.
+
+const (
+	teamRosterInfo = "envsync-team-roster"
+	projectKeyInfo = "envsync-project-key"
+)
+
+// teamAuthKey opens id's copy of team's authentication key.
+func teamAuthKey(id *memberIdentity, team *Team) ([]byte, error) {
+	w := team.AuthKeys[id.actor]
+	if w == nil || w.KeyID != team.AuthKeyID {
+		return nil, fmt.Errorf("no authentication key for %s on team %q; ask a team admin to add this device's public key", id.actor, team.Name)
+	}
+	key, err := id.unwrap(w)
+	if err != nil {
+		return nil, fmt.Errorf("open authentication key of team %q: %w", team.Name, err)
+	}
+	return key, nil
+}
+
+// authMAC returns the HMAC of fields under a subkey of authKey for info.
+func authMAC(authKey []byte, info string, fields any, secret []byte) (string, error) {
+	msg, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	sub, err := hkdf.Key(sha256.New, authKey, nil, info, 32)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, sub)
+	h.Write(msg)
+	h.Write(secret)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// rosterMAC covers team's name, authentication key ID, members and public
+// keys. encoding/json sorts map keys, so the encoding is stable.
+func rosterMAC(team *Team, authKey []byte) (string, error) {
+	return authMAC(authKey, teamRosterInfo, struct {
+		Team       string            `json:"team"`
+		AuthKeyID  string            `json:"auth_key_id"`
+		Members    map[string]string `json:"members"`
+		PublicKeys map[string]string `json:"public_keys"`
+	}{team.Name, team.AuthKeyID, team.Members, team.PublicKeys}, nil)
+}
+
+// projectKeyMAC covers a project's name, team and data key.
+func projectKeyMAC(projName, teamName string, keys *projectKeys, authKey []byte) (string, error) {
+	return authMAC(authKey, projectKeyInfo, struct {
+		Project string `json:"project"`
+		Team    string `json:"team"`
+		KeyID   string `json:"key_id"`
+	}{projName, teamName, keys.keyID}, keys.data)
+}
+
+// authenticateTeam wraps team's authentication key for its current members
+// and renews the roster MAC, creating the key for a team that has none yet.
+// It returns the key, for the caller to MAC data keys with.
+func authenticateTeam(id *memberIdentity, team *Team) ([]byte, error) {
+	var authKey []byte
+	if team.AuthKeyID == "" {
+		keyID, err := randomHex(4)
+		if err != nil {
+			return nil, err
+		}
+		authKey = make([]byte, 32)
+		if _, err := rand.Read(authKey); err != nil {
+			return nil, err
+		}
+		team.AuthKeyID = keyID
+	} else {
+		var err error
+		if authKey, err = teamAuthKey(id, team); err != nil {
+			return nil, err
+		}
+	}
+	wrapped, err := wrapForTeam(team, &projectKeys{keyID: team.AuthKeyID, data: authKey, vault: id.vault})
+	if err != nil {
+		return nil, err
+	}
+	team.AuthKeys = wrapped
+	mac, err := rosterMAC(team, authKey)
+	if err != nil {
+		return nil, err
+	}
+	team.KeysMAC = mac
+	return authKey, nil
+}
+
+// sealProjectKey records the MAC of keys on project under authKey.
+func sealProjectKey(project *Project, teamName string, keys *projectKeys, authKey []byte) error {
+	mac, err := projectKeyMAC(project.Name, teamName, keys, authKey)
+	if err != nil {
+		return err
+	}
+	project.KeyMAC = mac
+	return nil
+}
+
+// verifiedTeam checks remote, a team's definition on the remote, and returns
+// it for local state. The authentication key is local's when this device
+// holds it; otherwise remote's own is taken, if it is wrapped for this
+// device. A remote team without one is only accepted while local has none
+// either.
+func verifiedTeam(id *memberIdentity, local, remote *Team) (*Team, error) {
+	var authKey []byte
+	if local != nil && local.AuthKeyID != "" {
+		if key, err := teamAuthKey(id, local); err == nil {
+			if remote.AuthKeyID != local.AuthKeyID {
+				return nil, fmt.Errorf("refusing team %q from the remote: its authentication key was replaced", remote.Name)
+			}
+			authKey = key
+		}
+	}
+	if authKey == nil && remote.AuthKeyID != "" {
+		key, err := teamAuthKey(id, remote)
+		if err != nil {
+			if remote.Members[id.actor] != "" {
+				return nil, err
+			}
+			// Teams this device is not in are only listed; nothing is wrapped
+			// for their members here.
+			return remote, nil
+		}
+		authKey = key
+	}
+	if authKey == nil {
+		if local != nil && local.AuthKeyID != "" {
+			return nil, fmt.Errorf("refusing team %q from the remote: this device cannot open its authentication key; ask a team admin to add it again", remote.Name)
+		}
+		return remote, nil
+	}
+	want, err := rosterMAC(remote, authKey)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(want), []byte(remote.KeysMAC)) {
+		return nil, fmt.Errorf("refusing team %q from the remote: its members and public keys do not verify under the team's authentication key", remote.Name)
+	}
+	return remote, nil
+}
+
+// verifiedTeams returns the teams of remote checked against local. Local
+// teams with an authentication key that remote leaves out are kept, so their
+// key stays pinned.
+func verifiedTeams(id *memberIdentity, local, remote map[string]*Team) (map[string]*Team, error) {
+	out := cloneTeams(remote)
+	for name, team := range out {
+		if _, err := verifiedTeam(id, local[name], team); err != nil {
+			return nil, err
+		}
+	}
+	for name, team := range cloneTeams(local) {
+		if out[name] == nil && team.AuthKeyID != "" {
+			out[name] = team
+		}
+	}
+	return out, nil
+}
+
+// verifyProjectKey checks keys, opened from project, against the MAC an
+// admin of team recorded. Projects of teams without an authentication key
+// are not checked.
+func verifyProjectKey(id *memberIdentity, team *Team, project *Project, keys *projectKeys) error {
+	if team == nil || team.AuthKeyID == "" || keys.data == nil {
+		return nil
+	}
+	authKey, err := teamAuthKey(id, team)
+	if err != nil {
+		return err
+	}
+	want, err := projectKeyMAC(project.Name, team.Name, keys, authKey)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(want), []byte(project.KeyMAC)) {
+		return fmt.Errorf("refusing the data key of project %q: it does not verify under the authentication key of team %q", project.Name, team.Name)
+	}
+	return nil
+}
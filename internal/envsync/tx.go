@@ -0,0 +1,156 @@
+package envsync
+
+import "fmt"
+
+// secretTx batches changes to the secrets of one environment. It holds the
+// state lock from begin to close, the state is loaded and the caller's role
+// checked once, the project keys are unwrapped (running the recovery phrase
+// KDF) on the first write only, and commit writes the state file once and
+// logs a single audit event naming every changed key. Bulk commands build
+// on it so their cost does not grow with a full load, derive and save per
+// key.
+type secretTx struct {
+	app      *App
+	state    *State
+	project  *Project
+	projName string
+	env      *Env
+	envName  string
+	projKeys *projectKeys
+	versions map[string]int
+	unlock   func()
+}
+
+// beginSecretTx opens a transaction on envName of projectName; empty names
+// mean the active project and environment. Only admins and writers may
+// open one. Callers defer close.
+func (a *App) beginSecretTx(projectName, envName string) (*secretTx, error) {
+	unlock, err := a.lockState()
+	if err != nil {
+		return nil, err
+	}
+	state, err := a.loadState()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	project, projName, env, envName, err := resolveProjectEnv(state, a.CWD, projectName, envName)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	if err := a.requireProjectRole(state, project, roleAdmin, roleWriter); err != nil {
+		unlock()
+		return nil, err
+	}
+	return &secretTx{
+		app:      a,
+		state:    state,
+		project:  project,
+		projName: projName,
+		env:      env,
+		envName:  envName,
+		versions: map[string]int{},
+		unlock:   unlock,
+	}, nil
+}
+
+// close releases the state lock; changes not committed are dropped.
+func (tx *secretTx) close() {
+	if tx.unlock != nil {
+		tx.unlock()
+		tx.unlock = nil
+	}
+}
+
+// keys returns the project keys, unwrapping them on first use.
+func (tx *secretTx) keys() (*projectKeys, error) {
+	if tx.projKeys == nil {
+		keys, err := tx.app.keysFor(tx.state, tx.project)
+		if err != nil {
+			return nil, err
+		}
+		tx.projKeys = keys
+	}
+	return tx.projKeys, nil
+}
+
+// record returns the record of key, creating an empty one if needed.
+func (tx *secretTx) record(key string) *SecretRecord {
+	rec := tx.env.Vars[key]
+	if rec == nil {
+		rec = &SecretRecord{}
+		tx.env.Vars[key] = rec
+	}
+	return rec
+}
+
+// set seals value as a new version of key.
+func (tx *secretTx) set(key, value string, rotated bool, expiresAt string) (int, error) {
+	keys, err := tx.keys()
+	if err != nil {
+		return 0, err
+	}
+	next, err := tx.app.writeSecretVersion(tx.state, keys, tx.envName, key, tx.record(key), value, rotated, expiresAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	tx.versions[key] = next
+	return next, nil
+}
+
+// delete records a deleted version of key.
+func (tx *secretTx) delete(key string) (int, error) {
+	rec := tx.env.Vars[key]
+	if rec == nil {
+		return 0, fmt.Errorf("key %q not found", key)
+	}
+	next := tx.app.deleteSecretVersion(tx.state, rec)
+	tx.versions[key] = next
+	return next, nil
+}
+
+// restore appends the value of target, an earlier version of key, as its
+// new current version. The value is sealed again because the version number
+// is part of what the ciphertext is bound to.
+func (tx *secretTx) restore(key string, target SecretVersion) (int, error) {
+	if target.Deleted {
+		return tx.delete(key)
+	}
+	keys, err := tx.keys()
+	if err != nil {
+		return 0, err
+	}
+	value, err := keys.decrypt(tx.envName, key, target)
+	if err != nil {
+		return 0, err
+	}
+	return tx.set(key, value, false, "")
+}
+
+// changed returns the keys written so far, sorted.
+func (tx *secretTx) changed() []string {
+	return sortedKeys(tx.versions)
+}
+
+// commit saves the state and logs action with fields plus the project,
+// environment and changed keys. A transaction without changes writes
+// nothing.
+func (tx *secretTx) commit(action string, fields map[string]any) error {
+	if len(tx.versions) == 0 {
+		return nil
+	}
+	if err := tx.app.saveState(tx.state); err != nil {
+		return err
+	}
+	event := map[string]any{
+		"project": tx.projName,
+		"env":     tx.envName,
+		"keys":    tx.changed(),
+	}
+	for k, v := range fields {
+		event[k] = v
+	}
+	tx.app.logAudit(action, tx.state, event)
+	return nil
+}
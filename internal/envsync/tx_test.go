@@ -0,0 +1,104 @@
+package envsync
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecretTxWritesOnceAndLogsOneEvent(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.AuditPath = filepath.Join(t.TempDir(), "audit.log")
+	setAll(t, app, "OLD", "x")
+	before, err := os.ReadFile(app.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := app.beginSecretTx("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.close()
+	for i, k := range []string{"C", "A", "B"} {
+		if _, err := tx.set(k, strings.Repeat("v", i+1), false, ""); err != nil {
+			t.Fatalf("set %s: %v", k, err)
+		}
+	}
+	if _, err := tx.delete("OLD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.delete("MISSING"); err == nil {
+		t.Fatal("expected deleting an unknown key to fail")
+	}
+	if after, _ := os.ReadFile(app.StatePath); string(after) != string(before) {
+		t.Fatal("state written before commit")
+	}
+	if err := tx.commit("bulk", map[string]any{"source": "test"}); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	got := activeValuesFor(t, app)
+	if want := map[string]string{"A": "vv", "B": "vvv", "C": "v"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("values = %q, want %q", got, want)
+	}
+	raw, err := os.ReadFile(app.AuditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	var event map[string]any
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["action"] != "bulk" || event["source"] != "test" || event["env"] != "dev" {
+		t.Fatalf("unexpected event: %v", event)
+	}
+	if keys := auditKeys(event); !reflect.DeepEqual(keys, []string{"A", "B", "C", "OLD"}) {
+		t.Fatalf("event keys = %v", keys)
+	}
+	if n := strings.Count(string(raw), `"action":"bulk"`); n != 1 {
+		t.Fatalf("expected one audit event, got %d", n)
+	}
+}
+
+func TestRollbackAllRestoresPointInTime(t *testing.T) {
+	app, stdout := newTestApp(t)
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	app.Now = func() time.Time { return now }
+	setAll(t, app, "A", "a1", "B", "b1", "GONE", "g1")
+
+	now = now.Add(time.Hour)
+	setAll(t, app, "A", "a2", "NEW", "n1")
+	if err := app.Delete("GONE"); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Hour)
+	stdout.Reset()
+	if err := app.RollbackAll("90m"); err != nil {
+		t.Fatalf("rollback --all: %v", err)
+	}
+	got := activeValuesFor(t, app)
+	if want := map[string]string{"A": "a1", "B": "b1", "GONE": "g1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("values = %q, want %q", got, want)
+	}
+	if !strings.Contains(stdout.String(), "(2 restored, 1 deleted)") {
+		t.Fatalf("unexpected output:\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	if err := app.RollbackAll("2026-10-01T12:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "nothing changed") {
+		t.Fatalf("expected no changes, got:\n%s", stdout.String())
+	}
+	if err := app.RollbackAll("yesterday"); err == nil {
+		t.Fatal("expected an invalid --to to fail")
+	}
+}